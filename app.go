@@ -0,0 +1,417 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"sync"
+	"tiktok/config"
+	"tiktok/dao"
+	"tiktok/middleware/cache"
+	"tiktok/middleware/jwt"
+	"tiktok/middleware/mail"
+	"tiktok/middleware/oss"
+	"tiktok/middleware/rabbitmq"
+	"tiktok/service/account"
+	"tiktok/service/outbox"
+	"tiktok/service/reconcile"
+	uSrvImp "tiktok/service/user/impl"
+	vSrvImp "tiktok/service/video/impl"
+	"time"
+
+	amqp "github.com/rabbitmq/amqp091-go"
+	"github.com/redis/go-redis/v9"
+	"gorm.io/gorm"
+)
+
+// component is a unit of the application lifecycle,
+// stop is optional and only called if start succeeded
+type component struct {
+	name  string
+	start func() error
+	stop  func(ctx context.Context) error
+}
+
+// App owns the backing services of the server,
+// components are started in registration order and stopped in reverse
+type App struct {
+	cfg        *config.Config
+	components []component
+	started    int
+	failed     chan error
+
+	db         *gorm.DB
+	repos      dao.Repos
+	rdb        *redis.Client
+	broker     cache.Broker
+	caches     cache.Caches
+	storage    oss.Storage
+	mailer     mail.Mailer
+	relSrv     *uSrvImp.RelServiceImpl
+	userSrv    *uSrvImp.UserServiceImpl
+	likeSrv    *vSrvImp.LikeServiceImpl
+	commSrv    *vSrvImp.CommServiceImpl
+	videoSrv   *vSrvImp.VideoServiceImpl
+	accountSrv *account.Service
+	relay      *outbox.Relay
+}
+
+func NewApp(cfg *config.Config) *App {
+	return &App{
+		cfg:    cfg,
+		failed: make(chan error, 1),
+	}
+}
+
+func (a *App) register(c component) *App {
+	a.components = append(a.components, c)
+	return a
+}
+
+// fail reports a component that stopped working after it started
+func (a *App) fail(err error) {
+	select {
+	case a.failed <- err:
+	default:
+	}
+}
+
+func (a *App) WithDB() *App {
+	return a.register(component{
+		name: "mysql",
+		start: func() (err error) {
+			if a.db, err = dao.NewDB(a.cfg.MySQL); err != nil {
+				return err
+			}
+			a.repos = dao.NewRepos(a.db)
+			return nil
+		},
+		stop: func(context.Context) error { return dao.Close(a.db) },
+	})
+}
+
+// WithMQ connects RabbitMQ if it is the selected mq.driver,
+// it must be registered before WithCache which hands the events to it
+func (a *App) WithMQ() *App {
+	if a.cfg.MQ.Driver != "rabbitmq" {
+		return a
+	}
+
+	var conn *amqp.Connection
+	return a.register(component{
+		name: "rabbitmq",
+		start: func() (err error) {
+			if conn, err = rabbitmq.NewRmqConnection(a.cfg.RabbitMQ); err != nil {
+				return err
+			}
+			a.broker = rabbitmq.NewBroker(conn, a.cfg.RabbitMQ)
+			go func() {
+				if err := <-conn.NotifyClose(make(chan *amqp.Error, 1)); err != nil {
+					a.fail(fmt.Errorf("rabbitmq connection is lost - %w", err))
+				}
+			}()
+			return nil
+		},
+		stop: func(context.Context) error { return conn.Close() },
+	})
+}
+
+func (a *App) WithCache() *App {
+	return a.register(component{
+		name: "redis",
+		start: func() error {
+			rdb, err := cache.NewClient(a.cfg.Redis)
+			if err != nil {
+				return err
+			}
+			a.rdb = rdb
+			a.caches = cache.NewCaches(rdb, a.broker)
+			return nil
+		},
+		stop: func(context.Context) error { return a.rdb.Close() },
+	})
+}
+
+func (a *App) WithStorage() *App {
+	return a.register(component{
+		name: "storage",
+		start: func() (err error) {
+			a.storage, err = oss.NewStorage(a.cfg.Storage)
+			return err
+		},
+	})
+}
+
+// WithAuth depends on the cache keeping the revocation list
+func (a *App) WithAuth() *App {
+	return a.register(component{
+		name: "jwt",
+		start: func() error {
+			return jwt.Init(a.cfg.JWT, a.caches.Tokens)
+		},
+	})
+}
+
+func (a *App) WithMail() *App {
+	return a.register(component{
+		name: "mail",
+		start: func() (err error) {
+			a.mailer, err = mail.NewMailer(a.cfg.Mail)
+			return err
+		},
+	})
+}
+
+// WithServices wires the services up with the repos and storage
+func (a *App) WithServices() *App {
+	return a.register(component{
+		name: "services",
+		start: func() error {
+			a.relSrv = uSrvImp.NewRelService(a.repos.Follows, a.repos.Users, a.repos.Events,
+				a.caches.Relations, a.caches.Users)
+			a.userSrv = uSrvImp.NewUserService(a.relSrv, a.repos.Users, a.repos.Uploads, a.storage,
+				a.caches.Users, a.caches.Tokens, a.caches.Logins, a.mailer, a.cfg.Lockout, a.cfg.Reset)
+			a.likeSrv = vSrvImp.NewLikeService(a.repos.Likes, a.repos.Videos, a.repos.Events,
+				a.caches.Likes, a.caches.Videos, a.caches.Users)
+			a.commSrv = vSrvImp.NewCommService(a.repos.Comments, a.repos.Events, a.caches.Comments)
+			a.videoSrv = vSrvImp.NewVideoService(a.userSrv, a.likeSrv, a.commSrv,
+				a.storage, a.repos.Videos, a.repos.Likes, a.repos.Outbox, a.repos.Uploads,
+				a.caches.Videos, a.caches.Likes, a.caches.Users)
+			a.accountSrv = account.NewService(a.userSrv, a.repos, a.caches, a.storage, a.mailer, a.cfg.Export)
+			a.relay = outbox.NewRelay(a.repos.Outbox)
+			a.relay.Handle(dao.TopicVideoPublished, a.videoSrv.HandleVideoPublished)
+			a.relay.Handle(dao.TopicExportRequested, a.accountSrv.HandleExportRequested)
+			a.relay.Handle(dao.TopicExportExpired, a.accountSrv.HandleExportExpired)
+			return nil
+		},
+	})
+}
+
+// WithConsumers warms the feed up and runs the outbox relay and the MQ consumers,
+// it depends on the services
+func (a *App) WithConsumers() *App {
+	a.register(component{
+		name: "feed-warmup",
+		start: func() error {
+			// the feed is shared, one replica warming it up is enough
+			lease := cache.NewLease(a.rdb, "feed-warmup", time.Minute)
+			err := lease.Hold(context.Background(), func(context.Context) error {
+				return vSrvImp.LoadVideosToCache(a.caches.Videos, a.repos.Videos)
+			})
+			if errors.Is(err, cache.ErrLeaseHeld) {
+				log.Println("feed is being warmed up by another instance, skipped")
+				return nil
+			}
+			return err
+		},
+	})
+
+	a.schedule("outbox-relay", outbox.PollInterval, func(ctx context.Context) error {
+		_, err := a.relay.Drain(ctx)
+		return err
+	})
+
+	var cancel context.CancelFunc
+	var wg sync.WaitGroup
+	return a.register(component{
+		name: "mq-consumers",
+		start: func() error {
+			var ctx context.Context
+			ctx, cancel = context.WithCancel(context.Background())
+			consumers := []func(context.Context){
+				a.likeSrv.LikeMqConsumer,
+				a.commSrv.CommentMqConsumer,
+				a.relSrv.FollowMqConsumer,
+			}
+			for _, consume := range consumers {
+				wg.Add(1)
+				go func() {
+					defer wg.Done()
+					consume(ctx)
+				}()
+			}
+			return nil
+		},
+		stop: func(ctx context.Context) error {
+			cancel()
+			return waitGroupWithContext(ctx, &wg)
+		},
+	})
+}
+
+// WithJobs schedules the background jobs enabled in the config
+func (a *App) WithJobs() *App {
+	if interval := a.cfg.Jobs.ReconcileInterval; interval > 0 {
+		a.schedule("reconcile", interval, func(ctx context.Context) error {
+			job := reconcile.NewJob(a.repos, a.caches.Videos, a.caches.Users, a.caches.Relations)
+			report, err := job.Run(ctx, false)
+			log.Printf("reconciled %d videos, %d users and %d follow sets, %d discrepancies repaired\n",
+				report.VideosChecked, report.UsersChecked, report.FollowSetsChecked, len(report.Discrepancies))
+			return err
+		})
+	}
+	if interval := a.cfg.Jobs.UploadGCInterval; interval > 0 {
+		a.schedule("upload-gc", interval, func(ctx context.Context) error {
+			n, err := a.videoSrv.CollectOrphanedUploads(ctx, time.Now().Add(-uploadGracePeriod))
+			if n > 0 {
+				log.Printf("deleted %d orphaned uploads\n", n)
+			}
+			return err
+		})
+	}
+	if interval := a.cfg.Jobs.EventGCInterval; interval > 0 {
+		a.schedule("event-gc", interval, func(ctx context.Context) error {
+			n, err := collectProcessedEvents(ctx, a.repos.Events, time.Now().Add(-a.cfg.Jobs.EventRetention))
+			if n > 0 {
+				log.Printf("deleted %d processed event ids\n", n)
+			}
+			return err
+		})
+	}
+	return a
+}
+
+// uploadGracePeriod is how long a publish may take before its uploads count as orphaned
+const uploadGracePeriod = 24 * time.Hour
+
+// eventGCBatch bounds the ids deleted by one statement of the event GC
+const eventGCBatch = 1000
+
+// collectProcessedEvents deletes the ids of the events processed before the given time
+func collectProcessedEvents(ctx context.Context, events dao.EventRepo, before time.Time) (int, error) {
+	deleted := 0
+	for ctx.Err() == nil {
+		n, err := events.DeleteProcessedEvents(before, eventGCBatch)
+		deleted += n
+		if err != nil {
+			return deleted, fmt.Errorf("failed to delete processed events - %w", err)
+		}
+		if n < eventGCBatch {
+			return deleted, nil
+		}
+	}
+	return deleted, ctx.Err()
+}
+
+// schedule runs job every interval, every replica ticks
+// but a lease lets a single one run the job at a time
+func (a *App) schedule(name string, interval time.Duration, job func(ctx context.Context) error) *App {
+	var cancel context.CancelFunc
+	var wg sync.WaitGroup
+	return a.register(component{
+		name: name,
+		start: func() error {
+			var ctx context.Context
+			ctx, cancel = context.WithCancel(context.Background())
+			lease := cache.NewLease(a.rdb, name, time.Minute)
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				ticker := time.NewTicker(interval)
+				defer ticker.Stop()
+				for {
+					select {
+					case <-ctx.Done():
+						return
+					case <-ticker.C:
+					}
+					err := lease.Hold(ctx, job)
+					if err != nil && !errors.Is(err, cache.ErrLeaseHeld) && ctx.Err() == nil {
+						log.Printf("WARN: %s failed, detail: %v\n", name, err)
+					}
+				}
+			}()
+			return nil
+		},
+		stop: func(ctx context.Context) error {
+			cancel()
+			return waitGroupWithContext(ctx, &wg)
+		},
+	})
+}
+
+// WithAll registers every backing component required by the API server
+func (a *App) WithAll() *App {
+	return a.WithDB().WithMQ().WithCache().WithStorage().WithMail().WithAuth().WithServices().WithConsumers().WithJobs()
+}
+
+// WithHTTPServer serves the handler built by newHandler on the configured address,
+// newHandler runs once the former components started so it can rely on them.
+// It should be registered last so that in-flight requests are drained before the rest stops
+func (a *App) WithHTTPServer(newHandler func() http.Handler) *App {
+	srv := &http.Server{
+		Addr: a.cfg.Server.Addr,
+	}
+	return a.register(component{
+		name: "http-server",
+		start: func() error {
+			srv.Handler = newHandler()
+			ln, err := net.Listen("tcp", srv.Addr)
+			if err != nil {
+				return err
+			}
+			go func() {
+				if err := srv.Serve(ln); err != nil && !errors.Is(err, http.ErrServerClosed) {
+					a.fail(fmt.Errorf("http server stopped unexpectedly - %w", err))
+				}
+			}()
+			return nil
+		},
+		stop: srv.Shutdown,
+	})
+}
+
+func (a *App) Start() error {
+	for _, c := range a.components {
+		if err := c.start(); err != nil {
+			a.Stop(context.Background())
+			return fmt.Errorf("failed to start %s - %w", c.name, err)
+		}
+		a.started++
+		log.Printf("%s started\n", c.name)
+	}
+	return nil
+}
+
+// Wait blocks until ctx is done or a started component fails
+func (a *App) Wait(ctx context.Context) error {
+	select {
+	case <-ctx.Done():
+		return nil
+	case err := <-a.failed:
+		return err
+	}
+}
+
+// Stop stops the started components in reverse order, ctx bounds the whole
+// shutdown and every component is still stopped once it expires
+func (a *App) Stop(ctx context.Context) {
+	for ; a.started > 0; a.started-- {
+		c := a.components[a.started-1]
+		if c.stop == nil {
+			continue
+		}
+		if err := c.stop(ctx); err != nil {
+			log.Printf("WARN: failed to stop %s, detail: %v\n", c.name, err)
+			continue
+		}
+		log.Printf("%s stopped\n", c.name)
+	}
+}
+
+func waitGroupWithContext(ctx context.Context, wg *sync.WaitGroup) error {
+	done := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
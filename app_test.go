@@ -0,0 +1,77 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"testing"
+	"tiktok/config"
+	"tiktok/dao"
+	"tiktok/dao/memory"
+	"time"
+)
+
+func TestAppStartsInOrderAndStopsInReverse(t *testing.T) {
+	var events []string
+	track := func(name string, failStart bool) component {
+		return component{
+			name: name,
+			start: func() error {
+				events = append(events, "start "+name)
+				if failStart {
+					return errors.New("boom")
+				}
+				return nil
+			},
+			stop: func(context.Context) error {
+				events = append(events, "stop "+name)
+				return nil
+			},
+		}
+	}
+
+	cfg := config.Default()
+	app := NewApp(&cfg).register(track("a", false)).register(track("b", false))
+	if err := app.Start(); err != nil {
+		t.Fatal(err)
+	}
+	app.Stop(context.Background())
+	want := []string{"start a", "start b", "stop b", "stop a"}
+	if !reflect.DeepEqual(events, want) {
+		t.Fatalf("got %v, want %v", events, want)
+	}
+
+	events = nil
+	app = NewApp(&cfg).register(track("a", false)).register(track("b", true)).register(track("c", false))
+	if err := app.Start(); err == nil {
+		t.Fatal("expected start failure")
+	}
+	want = []string{"start a", "start b", "stop a"}
+	if !reflect.DeepEqual(events, want) {
+		t.Fatalf("got %v, want %v", events, want)
+	}
+}
+
+func TestCollectProcessedEvents(t *testing.T) {
+	repos := memory.NewRepos()
+	runs := 0
+	apply := func(dao.Repos) error {
+		runs++
+		return nil
+	}
+	for _, id := range []string{"e1", "e2", "e3"} {
+		if err := repos.Events.Once(id, apply); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if n, err := collectProcessedEvents(context.Background(), repos.Events, time.Now().Add(-time.Hour)); err != nil || n != 0 {
+		t.Fatalf("expected recent events to be kept, got %d, %v", n, err)
+	}
+	if err := repos.Events.Once("e1", apply); err != nil || runs != 3 {
+		t.Fatalf("expected a redelivery to be dropped, got %d runs, %v", runs, err)
+	}
+	if n, err := collectProcessedEvents(context.Background(), repos.Events, time.Now().Add(time.Second)); err != nil || n != 3 {
+		t.Fatalf("expected 3 events to be deleted, got %d, %v", n, err)
+	}
+}
@@ -1,7 +1,466 @@
 package config
 
-const (
-	AmqpUri       = "amqp://localhost:5672"
-	JwtSecret     = "Linkvvu"
-	EncryptSecret = "pw.secret"
+import (
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"time"
+
+	"gopkg.in/yaml.v3"
 )
+
+type Config struct {
+	Server       Server       `yaml:"server"`
+	MySQL        MySQL        `yaml:"mysql"`
+	Redis        Redis        `yaml:"redis"`
+	Storage      Storage      `yaml:"storage"`
+	MQ           MQ           `yaml:"mq"`
+	RabbitMQ     RabbitMQ     `yaml:"rabbitmq"`
+	JWT          JWT          `yaml:"jwt"`
+	Lockout      Lockout      `yaml:"lockout"`
+	Registration Registration `yaml:"registration"`
+	Mail         Mail         `yaml:"mail"`
+	Reset        Reset        `yaml:"password_reset"`
+	Export       Export       `yaml:"data_export"`
+	Jobs         Jobs         `yaml:"jobs"`
+}
+
+type Server struct {
+	Addr string `yaml:"addr" env:"TIKTOK_SERVER_ADDR"`
+	// ShutdownTimeout bounds draining in-flight requests and consumers
+	ShutdownTimeout time.Duration `yaml:"shutdown_timeout" env:"TIKTOK_SERVER_SHUTDOWN_TIMEOUT"`
+	// TrustedProxies are the IPs or CIDRs whose X-Forwarded-For is believed,
+	// the client IP throttles the logins so it must not be spoofable
+	TrustedProxies []string `yaml:"trusted_proxies" env:"TIKTOK_SERVER_TRUSTED_PROXIES"`
+}
+
+type MySQL struct {
+	DSN string `yaml:"dsn" env:"TIKTOK_MYSQL_DSN"`
+}
+
+type Redis struct {
+	Addr     string `yaml:"addr" env:"TIKTOK_REDIS_ADDR"`
+	Password string `yaml:"password" env:"TIKTOK_REDIS_PASSWORD"`
+	DB       int    `yaml:"db" env:"TIKTOK_REDIS_DB"`
+}
+
+type Storage struct {
+	// Driver is either "aliyun" or "local"
+	Driver string       `yaml:"driver" env:"TIKTOK_STORAGE_DRIVER"`
+	OSS    OSS          `yaml:"oss"`
+	Local  LocalStorage `yaml:"local"`
+}
+
+// OSS credentials fall back to the OSS_ACCESS_KEY_ID/OSS_ACCESS_KEY_SECRET
+// variables read by the Aliyun SDK when left empty
+type OSS struct {
+	Endpoint        string `yaml:"endpoint" env:"TIKTOK_OSS_ENDPOINT"`
+	Bucket          string `yaml:"bucket" env:"TIKTOK_OSS_BUCKET"`
+	AccessKeyId     string `yaml:"access_key_id" env:"TIKTOK_OSS_ACCESS_KEY_ID"`
+	AccessKeySecret string `yaml:"access_key_secret" env:"TIKTOK_OSS_ACCESS_KEY_SECRET"`
+}
+
+// LocalStorage keeps objects under Dir and serves them below BaseURL,
+// signed URLs are generated with Secret or a random per-process key if empty
+type LocalStorage struct {
+	Dir     string `yaml:"dir" env:"TIKTOK_STORAGE_LOCAL_DIR"`
+	BaseURL string `yaml:"base_url" env:"TIKTOK_STORAGE_LOCAL_BASE_URL"`
+	Secret  string `yaml:"secret" env:"TIKTOK_STORAGE_LOCAL_SECRET"`
+}
+
+// MQ selects the queues carrying the write-behind events to MySQL
+type MQ struct {
+	// Driver is either "redis" for Redis streams or "rabbitmq"
+	Driver string `yaml:"driver" env:"TIKTOK_MQ_DRIVER"`
+}
+
+type RabbitMQ struct {
+	URI string `yaml:"uri" env:"TIKTOK_AMQP_URI"`
+	// Prefetch bounds the unacked deliveries per consumer
+	Prefetch int `yaml:"prefetch" env:"TIKTOK_AMQP_PREFETCH"`
+	// MaxRetries failed deliveries are retried after RetryBackoff doubling
+	// each time, then the message goes to the dead-letter exchange
+	MaxRetries   int           `yaml:"max_retries" env:"TIKTOK_AMQP_MAX_RETRIES"`
+	RetryBackoff time.Duration `yaml:"retry_backoff" env:"TIKTOK_AMQP_RETRY_BACKOFF"`
+}
+
+type JWT struct {
+	// Secret is the HS256 key with id "default", it also verifies
+	// the tokens issued before key ids were introduced
+	Secret string `yaml:"secret" env:"TIKTOK_JWT_SECRET"`
+	// Keys are the other keys, a token is accepted if any of them verifies it
+	Keys []JWTKey `yaml:"keys"`
+	// SigningKey is the id of the key signing new tokens, the first
+	// of Keys or the default one if empty
+	SigningKey string `yaml:"signing_key" env:"TIKTOK_JWT_SIGNING_KEY"`
+	// Expiry is the lifetime of an access token, keep it short since
+	// a revoked token is only rejected while the revocation is cached
+	Expiry time.Duration `yaml:"expiry" env:"TIKTOK_JWT_EXPIRY"`
+	// RefreshExpiry is the lifetime of a refresh token, a session ends
+	// unless it is refreshed within that time
+	RefreshExpiry time.Duration `yaml:"refresh_expiry" env:"TIKTOK_JWT_REFRESH_EXPIRY"`
+}
+
+// DefaultJWTKey is the id of the key made of JWT.Secret
+const DefaultJWTKey = "default"
+
+// JWTKey is a key of the keyset, it is published by the JWKS endpoint
+// unless it is an HMAC secret
+type JWTKey struct {
+	Id string `yaml:"id"`
+	// Algorithm is HS256, RS256 or EdDSA
+	Algorithm string `yaml:"algorithm"`
+	// Secret is the secret of HS256
+	Secret string `yaml:"secret"`
+	// PrivateKeyFile is the PEM encoded private key of RS256 and EdDSA
+	PrivateKeyFile string `yaml:"private_key_file"`
+	// PublicKeyFile is the PEM encoded public key of a retired key,
+	// it only verifies the tokens signed before
+	PublicKeyFile string `yaml:"public_key_file"`
+}
+
+// SigningKeyId resolves the id of the key signing new tokens
+func (c JWT) SigningKeyId() string {
+	switch {
+	case c.SigningKey != "":
+		return c.SigningKey
+	case len(c.Keys) > 0:
+		return c.Keys[0].Id
+	default:
+		return DefaultJWTKey
+	}
+}
+
+func (c JWT) validateKeys() []error {
+	var errs []error
+	if c.Secret == "" && len(c.Keys) == 0 {
+		errs = append(errs, errors.New("jwt.secret or jwt.keys is required"))
+	}
+	ids := map[string]bool{}
+	if c.Secret != "" {
+		ids[DefaultJWTKey] = true
+	}
+	for i, k := range c.Keys {
+		if k.Id == "" {
+			errs = append(errs, fmt.Errorf("jwt.keys[%d].id is required", i))
+			continue
+		}
+		if ids[k.Id] {
+			errs = append(errs, fmt.Errorf("duplicated jwt key %q", k.Id))
+		}
+		ids[k.Id] = true
+		switch k.Algorithm {
+		case "HS256":
+			if k.Secret == "" {
+				errs = append(errs, fmt.Errorf("jwt key %q: secret is required", k.Id))
+			}
+		case "RS256", "EdDSA":
+			if k.PrivateKeyFile == "" && k.PublicKeyFile == "" {
+				errs = append(errs, fmt.Errorf("jwt key %q: private_key_file or public_key_file is required", k.Id))
+			}
+		default:
+			errs = append(errs, fmt.Errorf("jwt key %q: unknown algorithm %q", k.Id, k.Algorithm))
+		}
+	}
+	signing := c.SigningKeyId()
+	if c.Secret != "" || len(c.Keys) > 0 {
+		if !ids[signing] {
+			errs = append(errs, fmt.Errorf("unknown jwt.signing_key %q", signing))
+		}
+		for _, k := range c.Keys {
+			if k.Id == signing && k.Algorithm != "HS256" && k.PrivateKeyFile == "" {
+				errs = append(errs, fmt.Errorf("jwt signing key %q has no private_key_file", k.Id))
+			}
+		}
+	}
+	return errs
+}
+
+// Lockout throttles the failed logins of a username and of a client IP
+type Lockout struct {
+	// MaxFailures of a username before it is locked, 0 disables the lockout
+	MaxFailures int `yaml:"max_failures" env:"TIKTOK_LOCKOUT_MAX_FAILURES"`
+	// IPMaxFailures of an IP before it is locked, higher since an IP may be shared
+	IPMaxFailures int `yaml:"ip_max_failures" env:"TIKTOK_LOCKOUT_IP_MAX_FAILURES"`
+	// Backoff is the first lockout, doubled by every failure after it
+	Backoff    time.Duration `yaml:"backoff" env:"TIKTOK_LOCKOUT_BACKOFF"`
+	MaxBackoff time.Duration `yaml:"max_backoff" env:"TIKTOK_LOCKOUT_MAX_BACKOFF"`
+	// Window is how long the failures are counted after the last one
+	Window time.Duration `yaml:"window" env:"TIKTOK_LOCKOUT_WINDOW"`
+}
+
+// Registration restricts the usernames of new accounts
+type Registration struct {
+	// BlockedUsernames can't be registered on top of the built-in reserved
+	// ones, they are compared case-insensitively
+	BlockedUsernames []string `yaml:"blocked_usernames" env:"TIKTOK_REGISTRATION_BLOCKED_USERNAMES"`
+}
+
+// Mail sends the mails through SMTP, or writes them under Dir
+// with the "file" driver for local development
+type Mail struct {
+	// Driver is either "smtp" or "file"
+	Driver string `yaml:"driver" env:"TIKTOK_MAIL_DRIVER"`
+	From   string `yaml:"from" env:"TIKTOK_MAIL_FROM"`
+	SMTP   SMTP   `yaml:"smtp"`
+	Dir    string `yaml:"dir" env:"TIKTOK_MAIL_DIR"`
+}
+
+type SMTP struct {
+	Addr     string `yaml:"addr" env:"TIKTOK_SMTP_ADDR"`
+	Username string `yaml:"username" env:"TIKTOK_SMTP_USERNAME"`
+	Password string `yaml:"password" env:"TIKTOK_SMTP_PASSWORD"`
+}
+
+// Reset configures the password reset links sent by mail
+type Reset struct {
+	// URL is the page resetting the password, the link appends the token query
+	URL string `yaml:"url" env:"TIKTOK_PASSWORD_RESET_URL"`
+	// Expiry is how long a reset link can be used
+	Expiry time.Duration `yaml:"expiry" env:"TIKTOK_PASSWORD_RESET_EXPIRY"`
+	// Cooldown is how long a user or client IP waits between two reset mails, 0 disables it
+	Cooldown time.Duration `yaml:"cooldown" env:"TIKTOK_PASSWORD_RESET_COOLDOWN"`
+}
+
+// Export configures the personal data archives, they are deleted
+// by the outbox relay once their link expired
+type Export struct {
+	// Expiry is how long the mailed download link can be used, at most a day
+	Expiry time.Duration `yaml:"expiry" env:"TIKTOK_DATA_EXPORT_EXPIRY"`
+	// Cooldown is how long a user waits between two exports, 0 disables it
+	Cooldown time.Duration `yaml:"cooldown" env:"TIKTOK_DATA_EXPORT_COOLDOWN"`
+}
+
+// Jobs schedules the background jobs, a zero interval disables the job
+type Jobs struct {
+	// ReconcileInterval is how often the counters are recomputed from the records
+	ReconcileInterval time.Duration `yaml:"reconcile_interval" env:"TIKTOK_JOBS_RECONCILE_INTERVAL"`
+	// UploadGCInterval is how often the objects of failed publishes are deleted
+	UploadGCInterval time.Duration `yaml:"upload_gc_interval" env:"TIKTOK_JOBS_UPLOAD_GC_INTERVAL"`
+	// EventGCInterval is how often the ids of the processed MQ events older
+	// than EventRetention are deleted, a redelivery after that is applied again
+	EventGCInterval time.Duration `yaml:"event_gc_interval" env:"TIKTOK_JOBS_EVENT_GC_INTERVAL"`
+	EventRetention  time.Duration `yaml:"event_retention" env:"TIKTOK_JOBS_EVENT_RETENTION"`
+}
+
+// redeliveryWindow is how long after its first delivery an event may still
+// be redelivered, the retries of RabbitMQ or the reclaims of Redis streams
+func (c *Config) redeliveryWindow() time.Duration {
+	if c.MQ.Driver == "rabbitmq" {
+		return c.RabbitMQ.RetryBackoff * time.Duration(1<<c.RabbitMQ.MaxRetries)
+	}
+	// a stream message is dead-lettered after 5 deliveries a minute apart
+	return time.Hour
+}
+
+// Default returns the configuration used for local development,
+// every field can be overridden by the config file or environment
+func Default() Config {
+	return Config{
+		Server: Server{
+			Addr:            ":8080",
+			ShutdownTimeout: time.Second * 15,
+		},
+		MySQL: MySQL{
+			DSN: "root:@tcp(127.0.0.1:3306)/tiktok?charset=utf8mb4&parseTime=True",
+		},
+		Redis: Redis{
+			Addr: "localhost:6379",
+		},
+		Storage: Storage{
+			Driver: "aliyun",
+			OSS: OSS{
+				Endpoint: "oss-cn-huhehaote.aliyuncs.com",
+				Bucket:   "proj-tiktok",
+			},
+			Local: LocalStorage{
+				Dir:     "data/storage",
+				BaseURL: "http://localhost:8080/static",
+			},
+		},
+		MQ: MQ{
+			Driver: "redis",
+		},
+		RabbitMQ: RabbitMQ{
+			URI:          "amqp://localhost:5672",
+			Prefetch:     16,
+			MaxRetries:   5,
+			RetryBackoff: time.Second,
+		},
+		JWT: JWT{
+			Expiry:        time.Minute * 15,
+			RefreshExpiry: time.Hour * 24 * 30,
+		},
+		Lockout: Lockout{
+			MaxFailures:   5,
+			IPMaxFailures: 50,
+			Backoff:       time.Minute,
+			MaxBackoff:    time.Hour,
+			Window:        time.Hour,
+		},
+		Mail: Mail{
+			Driver: "file",
+			From:   "tiktok@localhost",
+			Dir:    "data/mail",
+		},
+		Reset: Reset{
+			URL:      "http://localhost:8080/reset-password",
+			Expiry:   time.Minute * 30,
+			Cooldown: time.Minute,
+		},
+		Export: Export{
+			Expiry:   time.Hour * 24,
+			Cooldown: time.Hour,
+		},
+		Jobs: Jobs{
+			ReconcileInterval: time.Hour,
+			UploadGCInterval:  time.Hour,
+			EventGCInterval:   time.Hour,
+			EventRetention:    time.Hour * 24 * 7,
+		},
+	}
+}
+
+// Load reads the YAML file at path on top of the defaults, then applies
+// the environment overrides and validates the result.
+// An empty path skips the file.
+func Load(path string) (*Config, error) {
+	cfg := Default()
+	if path != "" {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read config file %s - %w", path, err)
+		}
+		if err := yaml.Unmarshal(data, &cfg); err != nil {
+			return nil, fmt.Errorf("failed to parse config file %s - %w", path, err)
+		}
+	}
+
+	if err := applyEnv(&cfg); err != nil {
+		return nil, err
+	}
+	if err := cfg.Validate(); err != nil {
+		return nil, err
+	}
+	return &cfg, nil
+}
+
+func (c *Config) Validate() error {
+	var errs []error
+	if c.Server.Addr == "" {
+		errs = append(errs, errors.New("server.addr is required"))
+	}
+	if c.Server.ShutdownTimeout <= 0 {
+		errs = append(errs, errors.New("server.shutdown_timeout must be positive"))
+	}
+	for _, proxy := range c.Server.TrustedProxies {
+		if _, _, err := net.ParseCIDR(proxy); err != nil && net.ParseIP(proxy) == nil {
+			errs = append(errs, fmt.Errorf("invalid server.trusted_proxies %q", proxy))
+		}
+	}
+	if c.MySQL.DSN == "" {
+		errs = append(errs, errors.New("mysql.dsn is required"))
+	}
+	if c.Redis.Addr == "" {
+		errs = append(errs, errors.New("redis.addr is required"))
+	}
+	if c.Redis.DB < 0 {
+		errs = append(errs, errors.New("redis.db must not be negative"))
+	}
+	switch c.Storage.Driver {
+	case "aliyun":
+		if c.Storage.OSS.Endpoint == "" || c.Storage.OSS.Bucket == "" {
+			errs = append(errs, errors.New("storage.oss.endpoint and storage.oss.bucket are required"))
+		}
+	case "local":
+		if c.Storage.Local.Dir == "" || c.Storage.Local.BaseURL == "" {
+			errs = append(errs, errors.New("storage.local.dir and storage.local.base_url are required"))
+		}
+	default:
+		errs = append(errs, fmt.Errorf("unknown storage.driver %q", c.Storage.Driver))
+	}
+	switch c.MQ.Driver {
+	case "redis":
+	case "rabbitmq":
+		if c.RabbitMQ.URI == "" {
+			errs = append(errs, errors.New("rabbitmq.uri is required"))
+		}
+		if c.RabbitMQ.Prefetch <= 0 {
+			errs = append(errs, errors.New("rabbitmq.prefetch must be positive"))
+		}
+		if c.RabbitMQ.MaxRetries < 0 {
+			errs = append(errs, errors.New("rabbitmq.max_retries must not be negative"))
+		}
+		if c.RabbitMQ.RetryBackoff <= 0 {
+			errs = append(errs, errors.New("rabbitmq.retry_backoff must be positive"))
+		}
+	default:
+		errs = append(errs, fmt.Errorf("unknown mq.driver %q", c.MQ.Driver))
+	}
+	errs = append(errs, c.JWT.validateKeys()...)
+	if c.JWT.Expiry <= 0 {
+		errs = append(errs, errors.New("jwt.expiry must be positive"))
+	}
+	if c.JWT.RefreshExpiry < c.JWT.Expiry {
+		errs = append(errs, errors.New("jwt.refresh_expiry must not be shorter than jwt.expiry"))
+	}
+	if c.Lockout.MaxFailures < 0 || c.Lockout.IPMaxFailures < 0 {
+		errs = append(errs, errors.New("lockout.max_failures and lockout.ip_max_failures must not be negative"))
+	}
+	if c.Lockout.MaxFailures > 0 || c.Lockout.IPMaxFailures > 0 {
+		if c.Lockout.Backoff <= 0 || c.Lockout.MaxBackoff < c.Lockout.Backoff {
+			errs = append(errs, errors.New("lockout.backoff must be positive and not longer than lockout.max_backoff"))
+		}
+		if c.Lockout.Window <= 0 {
+			errs = append(errs, errors.New("lockout.window must be positive"))
+		}
+	}
+	switch c.Mail.Driver {
+	case "smtp":
+		if c.Mail.SMTP.Addr == "" {
+			errs = append(errs, errors.New("mail.smtp.addr is required"))
+		}
+	case "file":
+		if c.Mail.Dir == "" {
+			errs = append(errs, errors.New("mail.dir is required"))
+		}
+	default:
+		errs = append(errs, fmt.Errorf("unknown mail.driver %q", c.Mail.Driver))
+	}
+	if c.Mail.From == "" {
+		errs = append(errs, errors.New("mail.from is required"))
+	}
+	if c.Reset.URL == "" {
+		errs = append(errs, errors.New("password_reset.url is required"))
+	}
+	if c.Reset.Expiry <= 0 {
+		errs = append(errs, errors.New("password_reset.expiry must be positive"))
+	}
+	if c.Reset.Cooldown < 0 {
+		errs = append(errs, errors.New("password_reset.cooldown must not be negative"))
+	}
+	if c.Export.Expiry <= 0 || c.Export.Expiry > time.Hour*24 {
+		errs = append(errs, errors.New("data_export.expiry must be positive and at most 24h"))
+	}
+	if c.Export.Cooldown < 0 {
+		errs = append(errs, errors.New("data_export.cooldown must not be negative"))
+	}
+	if c.Jobs.ReconcileInterval < 0 {
+		errs = append(errs, errors.New("jobs.reconcile_interval must not be negative"))
+	}
+	if c.Jobs.UploadGCInterval < 0 {
+		errs = append(errs, errors.New("jobs.upload_gc_interval must not be negative"))
+	}
+	if c.Jobs.EventGCInterval < 0 {
+		errs = append(errs, errors.New("jobs.event_gc_interval must not be negative"))
+	}
+	if window := c.redeliveryWindow(); c.Jobs.EventGCInterval > 0 && c.Jobs.EventRetention < window {
+		errs = append(errs, fmt.Errorf("jobs.event_retention must be at least %v, the longest redelivery window", window))
+	}
+
+	if len(errs) > 0 {
+		return fmt.Errorf("invalid config - %w", errors.Join(errs...))
+	}
+	return nil
+}
@@ -0,0 +1,104 @@
+package config
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestLoadFileAndEnv(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "config.yaml")
+	data := []byte("redis:\n  addr: redis:6379\n  db: 2\njwt:\n  secret: from-file\n  expiry: 2h\n")
+	if err := os.WriteFile(path, data, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("TIKTOK_JWT_SECRET", "from-env")
+	t.Setenv("TIKTOK_REDIS_DB", "3")
+
+	cfg, err := Load(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cfg.Redis.Addr != "redis:6379" || cfg.Redis.DB != 3 {
+		t.Fatalf("unexpected redis config: %+v", cfg.Redis)
+	}
+	if cfg.JWT.Secret != "from-env" || cfg.JWT.Expiry != 2*time.Hour {
+		t.Fatalf("unexpected jwt config: %+v", cfg.JWT)
+	}
+	if cfg.Server.Addr != ":8080" {
+		t.Fatalf("default server addr lost: %q", cfg.Server.Addr)
+	}
+}
+
+func TestLoadRejectsInvalid(t *testing.T) {
+	t.Setenv("TIKTOK_JWT_SECRET", "")
+	if _, err := Load(""); err == nil {
+		t.Fatal("expected missing jwt secret to be rejected")
+	}
+
+	t.Setenv("TIKTOK_JWT_SECRET", "secret")
+	t.Setenv("TIKTOK_JWT_EXPIRY", "soon")
+	if _, err := Load(""); err == nil {
+		t.Fatal("expected malformed duration to be rejected")
+	}
+}
+
+func TestValidateMQDriver(t *testing.T) {
+	cfg := Default()
+	cfg.JWT.Secret = "secret"
+	cfg.MQ.Driver = "kafka"
+	if err := cfg.Validate(); err == nil {
+		t.Fatal("expected unknown mq driver to be rejected")
+	}
+
+	cfg.MQ.Driver = "rabbitmq"
+	cfg.RabbitMQ.RetryBackoff = 0
+	if err := cfg.Validate(); err == nil {
+		t.Fatal("expected zero retry backoff to be rejected")
+	}
+}
+
+func TestValidateEventRetention(t *testing.T) {
+	cfg := Default()
+	cfg.JWT.Secret = "secret"
+	cfg.MQ.Driver = "rabbitmq"
+	cfg.RabbitMQ.MaxRetries, cfg.RabbitMQ.RetryBackoff = 10, time.Hour
+	if err := cfg.Validate(); err == nil {
+		t.Fatal("expected a retention shorter than the retries to be rejected")
+	}
+	cfg.Jobs.EventGCInterval = 0
+	if err := cfg.Validate(); err != nil {
+		t.Fatalf("expected the retention to be ignored with the job disabled, got %v", err)
+	}
+}
+
+func TestValidateJWTKeys(t *testing.T) {
+	cfg := Default()
+	cfg.JWT.Keys = []JWTKey{{Id: "k1", Algorithm: "EdDSA", PrivateKeyFile: "k1.pem"}}
+	if err := cfg.Validate(); err != nil {
+		t.Fatal(err)
+	}
+	if id := cfg.JWT.SigningKeyId(); id != "k1" {
+		t.Fatalf("expected the first key to sign, got %q", id)
+	}
+
+	for name, keys := range map[string][]JWTKey{
+		"duplicated id":     {{Id: "k1", Algorithm: "HS256", Secret: "a"}, {Id: "k1", Algorithm: "HS256", Secret: "b"}},
+		"unknown algorithm": {{Id: "k1", Algorithm: "none"}},
+		"missing secret":    {{Id: "k1", Algorithm: "HS256"}},
+		"verify only":       {{Id: "k1", Algorithm: "RS256", PublicKeyFile: "k1.pub"}},
+	} {
+		cfg.JWT.Keys = keys
+		if err := cfg.Validate(); err == nil {
+			t.Fatalf("expected %s to be rejected", name)
+		}
+	}
+
+	cfg.JWT.Secret = "secret"
+	cfg.JWT.Keys = nil
+	cfg.JWT.SigningKey = "k2"
+	if err := cfg.Validate(); err == nil {
+		t.Fatal("expected an unknown signing key to be rejected")
+	}
+}
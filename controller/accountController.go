@@ -0,0 +1,50 @@
+package controller
+
+import (
+	"net/http"
+	"tiktok/pkg"
+	"tiktok/service/account"
+
+	"github.com/gin-gonic/gin"
+)
+
+type AccountController struct {
+	accountSrv *account.Service
+}
+
+func NewAccountController(accountSrv *account.Service) *AccountController {
+	return &AccountController{
+		accountSrv: accountSrv,
+	}
+}
+
+// DeleteAccountReq confirms the deletion with the password
+type DeleteAccountReq struct {
+	Password string `json:"password" binding:"required"`
+}
+
+func (ctl *AccountController) DeleteAccount(ctx *gin.Context) {
+	var req DeleteAccountReq
+	if err := ctx.ShouldBindJSON(&req); err != nil {
+		appE := bindingError(err)
+		ctx.AbortWithError(appE.HttpStatus, appE)
+		return
+	}
+
+	if err := ctl.accountSrv.DeleteAccount(ctx.GetUint64("user_id"), req.Password, ctx.ClientIP()); err != nil {
+		ctx.Error(err)
+		ctx.Abort()
+		return
+	}
+	ctx.JSON(http.StatusOK, pkg.NewOkResp())
+}
+
+// RequestExport starts building the data archive of the user, the link is mailed once it is ready
+func (ctl *AccountController) RequestExport(ctx *gin.Context) {
+	if err := ctl.accountSrv.RequestExport(ctx.GetUint64("user_id")); err != nil {
+		ctx.Error(err)
+		ctx.Abort()
+		return
+	}
+	ctx.JSON(http.StatusOK, pkg.NewOkResp())
+}
@@ -2,6 +2,8 @@ package controller
 
 import (
 	"errors"
+	"math"
+	"strconv"
 	"tiktok/pkg"
 
 	"github.com/gin-gonic/gin"
@@ -18,6 +20,9 @@ func ErrHandler(ctx *gin.Context) {
 		var appE *pkg.AppError
 		if errors.As(err, &appE) {
 			// service error
+			if appE.RetryAfter > 0 {
+				ctx.Header("Retry-After", strconv.Itoa(int(math.Ceil(appE.RetryAfter.Seconds()))))
+			}
 			ctx.JSON(appE.HttpStatus, pkg.NewErrResp(appE))
 		} else {
 			// native error
@@ -1,8 +1,12 @@
 package controller
 
 import (
+	"errors"
+	"fmt"
+	"io"
 	"net/http"
 	"strconv"
+	"strings"
 	"tiktok/pkg"
 	uSrv "tiktok/service/user"
 
@@ -11,8 +15,9 @@ import (
 
 type AuthResp struct {
 	pkg.Response
-	UserId uint64 `json:"user_id,omitempty"`
-	Token  string `json:"token,omitempty"`
+	UserId       uint64 `json:"user_id,omitempty"`
+	Token        string `json:"token,omitempty"`
+	RefreshToken string `json:"refresh_token,omitempty"`
 }
 
 type UserInfoResp struct {
@@ -37,76 +42,238 @@ func NewUserController(user_srv uSrv.UserService) *UserController {
 
 func (ctl *UserController) Destroy() {}
 
+// AuthReq registers an account, see RegisterValidators for the custom rules
 type AuthReq struct {
-	Username string `json:"username"`
-	Password string `json:"password"`
+	Username string `json:"username" binding:"required,min=3,max=32,username,notreserved"`
+	Password string `json:"password" binding:"required,min=8,password,nefield=Username"`
+	// Email receives the password reset links
+	Email string `json:"email,omitempty" binding:"omitempty,max=255,email"`
+}
+
+// LoginReq isn't validated beyond presence, the accounts registered
+// before the rules must still be able to log in
+type LoginReq struct {
+	Username string `json:"username" binding:"required"`
+	Password string `json:"password" binding:"required"`
 }
 
 func (ctl *UserController) Register(ctx *gin.Context) {
 	var registerReq AuthReq
 	err := ctx.ShouldBindJSON(&registerReq)
 	if err != nil {
-		appE := pkg.NewError(pkg.ErrValidation, err)
+		appE := bindingError(err)
 		ctx.AbortWithError(appE.HttpStatus, appE)
 		return
 	}
 
-	// TODO:
-	//	use validator lib to validate
-	if registerReq.Username == "" || registerReq.Password == "" {
+	info, err := ctl.userSrv.Register(registerReq.Username, registerReq.Password, registerReq.Email)
+	if err != nil {
+		ctx.Error(err)
+		ctx.Abort()
+		return
+	}
+	ctx.JSON(http.StatusOK, newAuthResp(info))
+}
+
+func (ctl *UserController) Login(ctx *gin.Context) {
+	var loginReq LoginReq
+	err := ctx.ShouldBindJSON(&loginReq)
+	if err != nil {
+		appE := bindingError(err)
+		ctx.AbortWithError(appE.HttpStatus, appE)
+		return
+	}
+
+	info, err := ctl.userSrv.Login(loginReq.Username, loginReq.Password, ctx.ClientIP())
+	if err != nil {
+		ctx.Error(err)
+		ctx.Abort()
+		return
+	}
+
+	ctx.JSON(http.StatusOK, newAuthResp(info))
+}
+
+type RefreshReq struct {
+	RefreshToken string `json:"refresh_token" binding:"required"`
+}
+
+func (ctl *UserController) Refresh(ctx *gin.Context) {
+	var req RefreshReq
+	if err := ctx.ShouldBindJSON(&req); err != nil {
 		appE := pkg.NewError(pkg.ErrValidation, err)
 		ctx.AbortWithError(appE.HttpStatus, appE)
 		return
 	}
 
-	info, err := ctl.userSrv.Register(registerReq.Username, registerReq.Password)
+	info, err := ctl.userSrv.Refresh(req.RefreshToken)
 	if err != nil {
 		ctx.Error(err)
 		ctx.Abort()
 		return
 	}
-	ctx.JSON(http.StatusOK, AuthResp{
+	ctx.JSON(http.StatusOK, newAuthResp(info))
+}
+
+func (ctl *UserController) Logout(ctx *gin.Context) {
+	if err := ctl.userSrv.Logout(ctx.GetString("session_id")); err != nil {
+		ctx.Error(err)
+		ctx.Abort()
+		return
+	}
+	ctx.JSON(http.StatusOK, pkg.NewOkResp())
+}
+
+type UpdateProfileReq struct {
+	Nickname *string `json:"nickname" binding:"omitempty,max=32"`
+	Bio      *string `json:"bio" binding:"omitempty,max=255"`
+}
+
+func (ctl *UserController) UpdateProfile(ctx *gin.Context) {
+	var req UpdateProfileReq
+	if err := ctx.ShouldBindJSON(&req); err != nil {
+		appE := bindingError(err)
+		ctx.AbortWithError(appE.HttpStatus, appE)
+		return
+	}
+	if req.Nickname == nil && req.Bio == nil {
+		appE := pkg.NewError(pkg.ErrValidation, errors.New("nothing to update"))
+		ctx.AbortWithError(appE.HttpStatus, appE)
+		return
+	}
+
+	info, err := ctl.userSrv.UpdateProfile(ctx.GetUint64("user_id"), req.Nickname, req.Bio)
+	if err != nil {
+		ctx.Error(err)
+		ctx.Abort()
+		return
+	}
+	ctx.JSON(http.StatusOK, UserInfoResp{
 		Response: pkg.NewOkResp(),
-		UserId:   info.Id,
-		Token:    info.Token,
+		User:     *info,
 	})
 }
 
-func (ctl *UserController) Login(ctx *gin.Context) {
-	var loginReq AuthReq
-	err := ctx.ShouldBindJSON(&loginReq)
+// maxImageSize bounds the avatar and background images
+const maxImageSize = 5 << 20
+
+func (ctl *UserController) UploadAvatar(ctx *gin.Context) {
+	ctl.uploadImage(ctx, ctl.userSrv.UploadAvatar)
+}
+
+func (ctl *UserController) UploadBackground(ctx *gin.Context) {
+	ctl.uploadImage(ctx, ctl.userSrv.UploadBackground)
+}
+
+// uploadImage stores the image form file by upload
+func (ctl *UserController) uploadImage(ctx *gin.Context, upload func(uint64, io.Reader) (*uSrv.UserInfo, error)) {
+	imageFH, err := ctx.FormFile("image")
 	if err != nil {
-		appE := pkg.NewError(pkg.ErrValidation, err)
-		ctx.AbortWithError(appE.HttpStatus, appE)
+		ctx.AbortWithError(http.StatusBadRequest, pkg.NewError(pkg.ErrValidation, err))
+		return
+	}
+	if imageFH.Size > maxImageSize {
+		err := fmt.Errorf("image is larger than %d bytes", maxImageSize)
+		ctx.AbortWithError(http.StatusBadRequest, pkg.NewError(pkg.ErrValidation, err))
+		return
+	}
+	image, err := imageFH.Open()
+	if err != nil {
+		ctx.AbortWithError(http.StatusBadRequest, pkg.NewError(pkg.ErrValidation, err))
 		return
 	}
+	defer image.Close()
 
-	info, err := ctl.userSrv.Login(loginReq.Username, loginReq.Password)
+	info, err := upload(ctx.GetUint64("user_id"), image)
 	if err != nil {
 		ctx.Error(err)
 		ctx.Abort()
 		return
 	}
-
-	ctx.JSON(http.StatusOK, AuthResp{
+	ctx.JSON(http.StatusOK, UserInfoResp{
 		Response: pkg.NewOkResp(),
-		UserId:   info.Id,
-		Token:    info.Token,
+		User:     *info,
 	})
 }
 
+type ChangePasswordReq struct {
+	OldPassword string `json:"old_password" binding:"required"`
+	NewPassword string `json:"new_password" binding:"required,min=8,password"`
+}
+
+// ChangePassword logs every session out and returns the tokens of a new one
+func (ctl *UserController) ChangePassword(ctx *gin.Context) {
+	var req ChangePasswordReq
+	if err := ctx.ShouldBindJSON(&req); err != nil {
+		appE := bindingError(err)
+		ctx.AbortWithError(appE.HttpStatus, appE)
+		return
+	}
+
+	info, err := ctl.userSrv.ChangePassword(ctx.GetUint64("user_id"), req.OldPassword, req.NewPassword,
+		ctx.ClientIP())
+	if err != nil {
+		ctx.Error(err)
+		ctx.Abort()
+		return
+	}
+	ctx.JSON(http.StatusOK, newAuthResp(info))
+}
+
+type ForgotPasswordReq struct {
+	Username string `json:"username" binding:"required"`
+}
+
+// ForgotPassword answers ok whether or not a mail is sent,
+// so it can't tell which usernames exist
+func (ctl *UserController) ForgotPassword(ctx *gin.Context) {
+	var req ForgotPasswordReq
+	if err := ctx.ShouldBindJSON(&req); err != nil {
+		appE := bindingError(err)
+		ctx.AbortWithError(appE.HttpStatus, appE)
+		return
+	}
+
+	if err := ctl.userSrv.RequestPasswordReset(req.Username, ctx.ClientIP()); err != nil {
+		ctx.Error(err)
+		ctx.Abort()
+		return
+	}
+	ctx.JSON(http.StatusOK, pkg.NewOkResp())
+}
+
+type ResetPasswordReq struct {
+	Token    string `json:"token" binding:"required"`
+	Password string `json:"password" binding:"required,min=8,password"`
+}
+
+func (ctl *UserController) ResetPassword(ctx *gin.Context) {
+	var req ResetPasswordReq
+	if err := ctx.ShouldBindJSON(&req); err != nil {
+		appE := bindingError(err)
+		ctx.AbortWithError(appE.HttpStatus, appE)
+		return
+	}
+
+	if err := ctl.userSrv.ResetPassword(req.Token, req.Password); err != nil {
+		ctx.Error(err)
+		ctx.Abort()
+		return
+	}
+	ctx.JSON(http.StatusOK, pkg.NewOkResp())
+}
+
+func newAuthResp(info *uSrv.AuthInfo) AuthResp {
+	return AuthResp{
+		Response:     pkg.NewOkResp(),
+		UserId:       info.Id,
+		Token:        info.Token,
+		RefreshToken: info.RefreshToken,
+	}
+}
+
 func (ctl *UserController) GetUserInfo(ctx *gin.Context) {
-	var userId uint64
-	var err error
-	userId = ctx.GetUint64("user_id")
-	// targetIdStr := ctx.Query("user_id")
-	// if targetIdStr == "" {
-	// 	targetId = userId
-	// } else {
-	// 	targetId, err = strconv.ParseUint(targetIdStr, 10, 64)
-	// }
-
-	// info, err := ctl.userSrv.GetInfo(targetId, userId)
+	userId := ctx.GetUint64("user_id")
 	info, err := ctl.userSrv.GetUserInfo(userId, userId)
 	if err != nil {
 		ctx.Error(err)
@@ -120,6 +287,59 @@ func (ctl *UserController) GetUserInfo(ctx *gin.Context) {
 	})
 }
 
+// GetUser returns any user, is_followed is relative to the viewer if logged in
+func (ctl *UserController) GetUser(ctx *gin.Context) {
+	targetId, err := strconv.ParseUint(ctx.Param("user_id"), 10, 64)
+	if err != nil {
+		ctx.AbortWithError(http.StatusBadRequest, pkg.NewError(pkg.ErrValidation, err))
+		return
+	}
+	info, err := ctl.userSrv.GetUserInfo(targetId, ctx.GetUint64("user_id"))
+	if err != nil {
+		ctx.Error(err)
+		ctx.Abort()
+		return
+	}
+
+	ctx.JSON(http.StatusOK, UserInfoResp{
+		Response: pkg.NewOkResp(),
+		User:     *info,
+	})
+}
+
+// ListUsers returns the users of the comma separated ids query,
+// the missing ones are left out
+func (ctl *UserController) ListUsers(ctx *gin.Context) {
+	var ids []uint64
+	for _, idStr := range strings.Split(ctx.Query("ids"), ",") {
+		if idStr = strings.TrimSpace(idStr); idStr == "" {
+			continue
+		}
+		id, err := strconv.ParseUint(idStr, 10, 64)
+		if err != nil {
+			ctx.AbortWithError(http.StatusBadRequest, pkg.NewError(pkg.ErrValidation, err))
+			return
+		}
+		ids = append(ids, id)
+	}
+	if len(ids) == 0 {
+		err := errors.New("ids is required")
+		ctx.AbortWithError(http.StatusBadRequest, pkg.NewError(pkg.ErrValidation, err))
+		return
+	}
+
+	infos, err := ctl.userSrv.GetUserInfos(ids, ctx.GetUint64("user_id"))
+	if err != nil {
+		ctx.Error(err)
+		ctx.Abort()
+		return
+	}
+	ctx.JSON(http.StatusOK, UserInfoListResp{
+		Response: pkg.NewOkResp(),
+		Users:    infos,
+	})
+}
+
 func (ctl *UserController) DoFollow(ctx *gin.Context) {
 	userId := ctx.GetUint64("user_id")
 	targetId, err := strconv.ParseInt(ctx.Param("user_id"), 10, 64)
@@ -0,0 +1,114 @@
+package controller
+
+import (
+	"errors"
+	"fmt"
+	"reflect"
+	"regexp"
+	"strings"
+	"tiktok/pkg"
+	"unicode"
+
+	"github.com/gin-gonic/gin/binding"
+	"github.com/go-playground/validator/v10"
+)
+
+// reservedUsernames could be mistaken for the service itself or a route
+var reservedUsernames = []string{
+	"admin", "administrator", "root", "system", "tiktok", "support", "official",
+	"moderator", "me", "null", "undefined", "anonymous", "guest",
+}
+
+var blockedUsernames = map[string]bool{}
+
+var usernamePattern = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9_.-]*$`)
+
+// bcrypt ignores the bytes after the 72nd
+const maxPasswordBytes = 72
+
+// RegisterValidators adds the validations of the requests to the binding,
+// blocked are the usernames refused on top of the reserved ones
+func RegisterValidators(blocked []string) error {
+	v, ok := binding.Validator.Engine().(*validator.Validate)
+	if !ok {
+		return errors.New("unexpected validator engine")
+	}
+	blockedUsernames = map[string]bool{}
+	for _, name := range append(reservedUsernames, blocked...) {
+		blockedUsernames[strings.ToLower(name)] = true
+	}
+
+	// reports the fields by their JSON names
+	v.RegisterTagNameFunc(func(f reflect.StructField) string {
+		name, _, _ := strings.Cut(f.Tag.Get("json"), ",")
+		if name == "-" {
+			return ""
+		}
+		return name
+	})
+	if err := v.RegisterValidation("username", validUsername); err != nil {
+		return err
+	}
+	if err := v.RegisterValidation("notreserved", notReserved); err != nil {
+		return err
+	}
+	return v.RegisterValidation("password", strongPassword)
+}
+
+func validUsername(fl validator.FieldLevel) bool {
+	return usernamePattern.MatchString(fl.Field().String())
+}
+
+func notReserved(fl validator.FieldLevel) bool {
+	return !blockedUsernames[strings.ToLower(fl.Field().String())]
+}
+
+func strongPassword(fl validator.FieldLevel) bool {
+	password := fl.Field().String()
+	if len(password) > maxPasswordBytes {
+		return false
+	}
+	var letter, digit bool
+	for _, r := range password {
+		letter = letter || unicode.IsLetter(r)
+		digit = digit || unicode.IsDigit(r)
+	}
+	return letter && digit
+}
+
+// bindingError reports the invalid fields of a request which failed to bind
+func bindingError(err error) *pkg.AppError {
+	appE := pkg.NewError(pkg.ErrValidation, err)
+	var errs validator.ValidationErrors
+	if !errors.As(err, &errs) {
+		return appE
+	}
+	fields := make([]pkg.FieldError, 0, len(errs))
+	for _, e := range errs {
+		fields = append(fields, pkg.FieldError{Field: e.Field(), Reason: fieldReason(e)})
+	}
+	return appE.WithFields(fields)
+}
+
+func fieldReason(e validator.FieldError) string {
+	switch e.Tag() {
+	case "required":
+		return "is required"
+	case "min":
+		return fmt.Sprintf("must be at least %s characters", e.Param())
+	case "max":
+		return fmt.Sprintf("must be at most %s characters", e.Param())
+	case "username":
+		return "may only contain letters, digits, '_', '.' and '-', and must start with a letter or digit"
+	case "notreserved":
+		return "is reserved"
+	case "password":
+		return fmt.Sprintf("must contain a letter and a digit and be at most %d bytes", maxPasswordBytes)
+	case "email":
+		return "must be an email address"
+	case "nefield":
+		return "must differ from the username"
+	default:
+		return fmt.Sprintf("failed on %s", e.Tag())
+	}
+}
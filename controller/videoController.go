@@ -4,7 +4,6 @@ import (
 	"mime/multipart"
 	"net/http"
 	"strconv"
-	"tiktok/middleware/jwt"
 	"tiktok/pkg"
 	vSrv "tiktok/service/video"
 	"time"
@@ -105,19 +104,7 @@ func (ctl *VideoController) ListUserLikedVideos(ctx *gin.Context) {
 
 func (ctl *VideoController) Feed(ctx *gin.Context) {
 	// user_id is zero when not logged in state
-	var user_id uint64
-	token := ctx.Query("token")
-	if token != "" {
-		claim, err := jwt.ParsingToken(token)
-		if err != nil {
-			ctx.AbortWithError(http.StatusUnauthorized, pkg.NewError(pkg.ErrAuthException, err))
-			return
-		}
-
-		id, _ := strconv.ParseUint(claim.UserId, 10, 64)
-		user_id = id
-	}
-	// else the user is tourist
+	user_id := ctx.GetUint64("user_id")
 
 	time_str := ctx.Query("latest_time")
 	var latest_time *time.Time
@@ -210,19 +197,8 @@ func (ctl *VideoController) DeleteComment(ctx *gin.Context) {
 }
 
 func (ctl *VideoController) ListVideoComments(ctx *gin.Context) {
-	var userId int64
-	token := ctx.Query("token")
-	if token != "" {
-		claim, err := jwt.ParsingToken(token)
-		if err != nil {
-			ctx.AbortWithError(http.StatusUnauthorized, pkg.NewError(pkg.ErrAuthException, err))
-			return
-		}
-
-		id, _ := strconv.ParseInt(claim.UserId, 10, 64)
-		userId = id
-	}
-
+	// userId is zero when not logged in state
+	userId := int64(ctx.GetUint64("user_id"))
 	video_id, _ := strconv.ParseUint(ctx.Param("video_id"), 10, 64)
 	commInfos, err := ctl.videoSrv.ListVideoComments(int64(video_id), userId)
 	if err != nil {
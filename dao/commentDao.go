@@ -1,5 +1,7 @@
 package dao
 
+import "gorm.io/gorm"
+
 type Comment struct {
 	Id          int64  `redis:"id"`
 	UserId      int64  `redis:"user_id"`
@@ -8,3 +10,46 @@ type Comment struct {
 	CommentText string `redis:"content"`
 	CreateAt    int64  `redis:"create_at"`
 }
+
+type commentRepo struct {
+	db *gorm.DB
+}
+
+func (r *commentRepo) GetCommentById(commentId int64) (Comment, error) {
+	c := Comment{}
+	err := r.db.First(&c, "id = ?", commentId).Error
+	return c, err
+}
+
+func (r *commentRepo) GetCommentsByVideo(videoId int64) ([]Comment, error) {
+	models := []Comment{}
+	err := r.db.Where("video_id = ?", videoId).Find(&models).Error
+	return models, err
+}
+
+func (r *commentRepo) GetCommentsByUser(userId int64) ([]Comment, error) {
+	models := []Comment{}
+	err := r.db.Where("user_id = ?", userId).Order("id").Find(&models).Error
+	return models, err
+}
+
+func (r *commentRepo) PersistComment(comment *Comment) error {
+	return r.db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Create(comment).Error; err != nil {
+			return err
+		}
+		return tx.Model(&Video{}).Where("id = ?", comment.VideoId).
+			Update("comment_count", gorm.Expr("comment_count + ?", 1)).Error
+	})
+}
+
+func (r *commentRepo) DeleteComment(videoId, commentId int64) error {
+	return r.db.Transaction(func(tx *gorm.DB) error {
+		res := tx.Delete(&Comment{Id: commentId})
+		if res.Error != nil || res.RowsAffected == 0 {
+			return res.Error
+		}
+		return tx.Model(&Video{}).Where("id = ?", videoId).
+			Update("comment_count", gorm.Expr("comment_count + ?", -1)).Error
+	})
+}
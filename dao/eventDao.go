@@ -0,0 +1,44 @@
+package dao
+
+import (
+	"errors"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+type ProcessedEvent struct {
+	EventId     string `gorm:"primaryKey"`
+	ProcessedAt time.Time
+}
+
+type eventRepo struct {
+	db *gorm.DB
+}
+
+func (r *eventRepo) Once(eventId string, fn func(repos Repos) error) error {
+	return r.db.Transaction(func(tx *gorm.DB) error {
+		if eventId != "" {
+			// a concurrent delivery of the same event blocks on the key until this tx ends
+			err := tx.Create(&ProcessedEvent{EventId: eventId, ProcessedAt: time.Now()}).Error
+			if errors.Is(err, ErrDuplicatedKey) {
+				return nil
+			}
+			if err != nil {
+				return err
+			}
+		}
+		return fn(NewRepos(tx))
+	})
+}
+
+func (r *eventRepo) DeleteProcessedEvents(before time.Time, limit int) (int, error) {
+	ids := []string{}
+	err := r.db.Model(&ProcessedEvent{}).Where("processed_at < ?", before).
+		Order("processed_at").Limit(limit).Pluck("event_id", &ids).Error
+	if err != nil || len(ids) == 0 {
+		return 0, err
+	}
+	res := r.db.Where("event_id IN ?", ids).Delete(&ProcessedEvent{})
+	return int(res.RowsAffected), res.Error
+}
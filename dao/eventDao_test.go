@@ -0,0 +1,107 @@
+package dao
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"strings"
+	"sync"
+	"testing"
+
+	mysqlDriver "github.com/go-sql-driver/mysql"
+	"gorm.io/driver/mysql"
+)
+
+// fakeConn answers the statements of gorm the way MySQL would,
+// insertErr is returned by every INSERT
+type fakeConn struct {
+	mu        sync.Mutex
+	insertErr error
+	stmts     []string
+}
+
+func (c *fakeConn) Connect(context.Context) (driver.Conn, error) { return c, nil }
+func (c *fakeConn) Driver() driver.Driver                        { return nil }
+func (c *fakeConn) Prepare(query string) (driver.Stmt, error) {
+	return nil, errors.New("prepared statements aren't supported")
+}
+func (c *fakeConn) Close() error              { return nil }
+func (c *fakeConn) Begin() (driver.Tx, error) { return c, nil }
+func (c *fakeConn) Commit() error             { return c.record("COMMIT") }
+func (c *fakeConn) Rollback() error           { return c.record("ROLLBACK") }
+
+func (c *fakeConn) record(stmt string) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.stmts = append(c.stmts, stmt)
+	return nil
+}
+
+func (c *fakeConn) ExecContext(ctx context.Context, query string, args []driver.NamedValue) (driver.Result, error) {
+	c.record(query)
+	if strings.HasPrefix(query, "INSERT") && c.insertErr != nil {
+		return nil, c.insertErr
+	}
+	return fakeResult{}, nil
+}
+
+type fakeResult struct{}
+
+func (fakeResult) LastInsertId() (int64, error) { return 1, nil }
+func (fakeResult) RowsAffected() (int64, error) { return 1, nil }
+
+func newFakeDB(t *testing.T, insertErr error) (*fakeConn, Repos) {
+	t.Helper()
+	conn := &fakeConn{insertErr: insertErr}
+	db, err := open(mysql.New(mysql.Config{Conn: sql.OpenDB(conn), SkipInitializeWithVersion: true}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return conn, NewRepos(db)
+}
+
+func TestOnceDropsRecordedEvents(t *testing.T) {
+	duplicated := &mysqlDriver.MySQLError{Number: 1062, Message: "Duplicate entry 'e1' for key 'PRIMARY'"}
+	conn, repos := newFakeDB(t, duplicated)
+	err := repos.Events.Once("e1", func(Repos) error {
+		t.Fatal("expected a recorded event to be skipped")
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("expected the duplicated key to be translated, got %v", err)
+	}
+	if last := conn.stmts[len(conn.stmts)-1]; last != "COMMIT" {
+		t.Fatalf("expected the transaction to end, got %v", conn.stmts)
+	}
+}
+
+func TestOnceFailsOnOtherErrors(t *testing.T) {
+	lost := &mysqlDriver.MySQLError{Number: 1205, Message: "Lock wait timeout exceeded"}
+	conn, repos := newFakeDB(t, lost)
+	err := repos.Events.Once("e1", func(Repos) error {
+		t.Fatal("expected fn to be skipped")
+		return nil
+	})
+	if !errors.As(err, new(*mysqlDriver.MySQLError)) {
+		t.Fatalf("expected the error to be returned, got %v", err)
+	}
+	if last := conn.stmts[len(conn.stmts)-1]; last != "ROLLBACK" {
+		t.Fatalf("expected the transaction to be rolled back, got %v", conn.stmts)
+	}
+}
+
+func TestOnceRunsFnInTransaction(t *testing.T) {
+	conn, repos := newFakeDB(t, nil)
+	err := repos.Events.Once("e1", func(repos Repos) error {
+		_, err := repos.Outbox.Enqueue(TopicVideoPublished, "1")
+		return err
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(conn.stmts) != 3 || !strings.Contains(conn.stmts[0], "processed_events") ||
+		!strings.Contains(conn.stmts[1], "outbox") || conn.stmts[2] != "COMMIT" {
+		t.Fatalf("expected the event and the change to commit together, got %v", conn.stmts)
+	}
+}
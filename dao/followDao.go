@@ -1,26 +1,69 @@
 package dao
 
+import (
+	"errors"
+
+	"gorm.io/gorm"
+)
+
 type Follow struct {
 	UserId     int64
 	FollowedId int64
 }
 
-func GetFollowedSet(uid int64) ([]Follow, error) {
+// FollowVersion is the sequence number of the last action applied to a pair
+type FollowVersion struct {
+	UserId     int64 `gorm:"primaryKey;autoIncrement:false"`
+	FollowedId int64 `gorm:"primaryKey;autoIncrement:false"`
+	Seq        uint64
+}
+
+type followRepo struct {
+	db *gorm.DB
+}
+
+func (r *followRepo) GetFollowedSet(uid int64) ([]Follow, error) {
 	models := []Follow{}
-	err := Db.Where("user_id = ?", uid).Find(&models).Error
+	err := r.db.Where("user_id = ?", uid).Find(&models).Error
 	return models, err
 }
 
-func GetFollowerSet(uid int64) ([]Follow, error) {
+func (r *followRepo) GetFollowerSet(uid int64) ([]Follow, error) {
 	models := []Follow{}
-	err := Db.Where("followed_id = ?", uid).Find(&models).Error
+	err := r.db.Where("followed_id = ?", uid).Find(&models).Error
 	return models, err
 }
 
-func PersistFollow(followedId, userId int64) error {
-	return Db.Create(&Follow{UserId: userId, FollowedId: followedId}).Error
+func (r *followRepo) PersistFollow(followedId, userId int64, seq uint64) error {
+	return r.applyFollow(followedId, userId, seq, func(tx *gorm.DB) error {
+		err := tx.Create(&Follow{UserId: userId, FollowedId: followedId}).Error
+		if errors.Is(err, ErrDuplicatedKey) {
+			return nil
+		}
+		return err
+	})
+}
+
+func (r *followRepo) DeleteFollowRecord(followedId, userId int64, seq uint64) error {
+	return r.applyFollow(followedId, userId, seq, func(tx *gorm.DB) error {
+		return tx.Delete(&Follow{}, &Follow{UserId: userId, FollowedId: followedId}).Error
+	})
 }
 
-func DeleteFollowRecord(followedId, userId int64) error {
-	return Db.Delete(&Follow{}, &Follow{UserId: userId, FollowedId: followedId}).Error
+// applyFollow runs apply within a transaction unless either user is deleted,
+// as the action was queued before the deletion, or a later action of the pair
+// is already applied
+func (r *followRepo) applyFollow(followedId, userId int64, seq uint64, apply func(tx *gorm.DB) error) error {
+	return r.db.Transaction(func(tx *gorm.DB) error {
+		if live, err := lockLiveUsers(tx, uint64(userId), uint64(followedId)); err != nil || !live {
+			return err
+		}
+		if seq > 0 {
+			pair := map[string]any{"user_id": userId, "followed_id": followedId}
+			if stale, err := bumpVersion(tx, &FollowVersion{}, pair, seq); err != nil || stale {
+				return err
+			}
+		}
+		return apply(tx)
+	})
 }
@@ -1,19 +1,27 @@
 package dao
 
 import (
-	"log"
+	"tiktok/config"
 
 	"gorm.io/driver/mysql"
 	"gorm.io/gorm"
 )
 
-var Db *gorm.DB
+func NewDB(cfg config.MySQL) (*gorm.DB, error) {
+	return open(mysql.Open(cfg.DSN))
+}
+
+func open(dialector gorm.Dialector) (*gorm.DB, error) {
+	return gorm.Open(dialector, &gorm.Config{
+		// reports unique index violations as ErrDuplicatedKey
+		TranslateError: true,
+	})
+}
 
-func init() {
-	dsn := "root:@tcp(127.0.0.1:3306)/tiktok?charset=utf8mb4&parseTime=True"
-	var err error
-	Db, err = gorm.Open(mysql.Open(dsn), &gorm.Config{})
+func Close(db *gorm.DB) error {
+	sqlDb, err := db.DB()
 	if err != nil {
-		log.Panicln("failed to connect target database from MySQL, detail:", err)
+		return err
 	}
+	return sqlDb.Close()
 }
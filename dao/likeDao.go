@@ -1,35 +1,112 @@
 package dao
 
+import (
+	"errors"
+
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
 type Like struct {
 	UserId  uint64
 	VideoId uint64
 }
 
-func GetLikedVideoIds(userId uint64) ([]uint64, error) {
-	videoIds := []uint64{}
-	err := Db.Model(Like{}).Where("user_id = ?", userId).Pluck("video_id", &videoIds).Error
-	return videoIds, err
+// LikeVersion is the sequence number of the last action applied to a pair
+type LikeVersion struct {
+	UserId  uint64 `gorm:"primaryKey;autoIncrement:false"`
+	VideoId uint64 `gorm:"primaryKey;autoIncrement:false"`
+	Seq     uint64
 }
 
-func GetLikeRecordByVid(video_id uint64) ([]Like, error) {
-	like_records := make([]Like, 0)
-	err := Db.Model(&Like{}).Where("video_id = ?", video_id).Find(&like_records).Error
-	return like_records, err
+type likeRepo struct {
+	db *gorm.DB
 }
 
-func GetLikeCntByVideoId(video_id uint64) (uint64, error) {
-	vid := Video{}
-	err := Db.Model(&Video{}).Where("id = ?", video_id).Find(&vid).Error
-	if err != nil {
-		return 0, err
-	}
-	return vid.LikeCount, err
+func (r *likeRepo) GetLikedVideoIds(userId uint64) ([]uint64, error) {
+	videoIds := []uint64{}
+	err := r.db.Model(Like{}).Where("user_id = ?", userId).Pluck("video_id", &videoIds).Error
+	return videoIds, err
 }
 
-func InsertLikeRecord(user_id, video_id uint64) error {
-	return Db.Create(&Like{UserId: user_id, VideoId: video_id}).Error
+func (r *likeRepo) ApplyLike(user_id, video_id uint64, liked bool, seq uint64) error {
+	return r.db.Transaction(func(tx *gorm.DB) error {
+		// an action queued before the user or the author is deleted is dropped
+		authors := []uint64{}
+		if err := tx.Model(&Video{}).Where("id = ?", video_id).Pluck("author_id", &authors).Error; err != nil {
+			return err
+		}
+		if len(authors) == 0 {
+			return nil
+		}
+		if live, err := lockLiveUsers(tx, user_id, authors[0]); err != nil || !live {
+			return err
+		}
+		// the video may be deleted by the deletion of its author waited for
+		err := tx.Clauses(clause.Locking{Strength: "SHARE"}).Select("id").Take(&Video{}, "id = ?", video_id).Error
+		if errors.Is(err, ErrRecordNotFound) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		if seq > 0 {
+			pair := map[string]any{"user_id": user_id, "video_id": video_id}
+			if stale, err := bumpVersion(tx, &LikeVersion{}, pair, seq); err != nil || stale {
+				return err
+			}
+		}
+		incr := 1
+		if liked {
+			err := tx.Create(&Like{UserId: user_id, VideoId: video_id}).Error
+			if errors.Is(err, ErrDuplicatedKey) {
+				// already liked, the count was taken then
+				return nil
+			}
+			if err != nil {
+				return err
+			}
+		} else {
+			res := tx.Delete(&Like{}, &Like{UserId: user_id, VideoId: video_id})
+			if res.Error != nil || res.RowsAffected == 0 {
+				return res.Error
+			}
+			incr = -1
+		}
+		err = tx.Model(&Video{}).Where("id = ?", video_id).
+			Update("like_count", gorm.Expr("like_count + ?", incr)).Error
+		if err != nil {
+			return err
+		}
+		if err := adjustCounter(tx, "id = ?", user_id, "liked_video_count", incr); err != nil {
+			return err
+		}
+		author := tx.Model(&Video{}).Select("author_id").Where("id = ?", video_id)
+		return adjustCounter(tx, "id = (?)", author, "total_liked", incr)
+	})
 }
 
-func DeleteLikeRecord(user_id, video_id uint64) error {
-	return Db.Delete(&Like{}, &Like{UserId: user_id, VideoId: video_id}).Error
+// bumpVersion records seq as the last action applied to the pair of the
+// version table of model, stale is true if a later one is already applied.
+// The version row stays locked until tx ends so that the actions of a pair
+// are applied one by one
+func bumpVersion(tx *gorm.DB, model any, pair map[string]any, seq uint64) (stale bool, err error) {
+	seqs := []uint64{}
+	err = tx.Model(model).Clauses(clause.Locking{Strength: "UPDATE"}).Where(pair).Pluck("seq", &seqs).Error
+	if err != nil {
+		return false, err
+	}
+	if len(seqs) == 0 {
+		// a concurrent first action fails on the key and is redelivered
+		row := map[string]any{"seq": seq}
+		for column, id := range pair {
+			row[column] = id
+		}
+		return false, tx.Model(model).Create(row).Error
+	}
+	if seqs[0] >= seq {
+		return true, nil
+	}
+	return false, tx.Model(model).Where(pair).Update("seq", seq).Error
 }
@@ -0,0 +1,794 @@
+// Package memory implements the dao repositories in memory,
+// it is meant for tests and local runs without MySQL
+package memory
+
+import (
+	"sort"
+	"strconv"
+	"sync"
+	"tiktok/dao"
+	"time"
+)
+
+type likeKey struct {
+	userId, videoId uint64
+}
+
+type followKey struct {
+	userId, followedId int64
+}
+
+// store holds every table, the repos share it so that
+// cross-table writes stay consistent like a DB transaction
+type store struct {
+	mu sync.Mutex
+
+	users    map[uint64]dao.User
+	videos   map[uint64]dao.Video
+	likes    map[likeKey]struct{}
+	versions map[likeKey]uint64
+	follows  map[followKey]struct{}
+	// followVersions mirrors follow_versions like versions does like_versions
+	followVersions map[followKey]uint64
+	comments       map[int64]dao.Comment
+	events         map[string]time.Time
+	outbox         map[uint64]dao.OutboxMessage
+	uploads        map[string]time.Time
+	// deleted keeps the soft-deleted users out of the lookups
+	deleted map[uint64]dao.User
+
+	lastUserId    uint64
+	lastVideoId   uint64
+	lastCommentId int64
+	lastMessageId uint64
+}
+
+func NewRepos() dao.Repos {
+	s := &store{
+		users:    map[uint64]dao.User{},
+		deleted:  map[uint64]dao.User{},
+		videos:   map[uint64]dao.Video{},
+		likes:    map[likeKey]struct{}{},
+		versions: map[likeKey]uint64{},
+		follows:  map[followKey]struct{}{},
+		comments: map[int64]dao.Comment{},
+
+		followVersions: map[followKey]uint64{},
+		events:         map[string]time.Time{},
+		outbox:         map[uint64]dao.OutboxMessage{},
+		uploads:        map[string]time.Time{},
+	}
+	repos := dao.Repos{
+		Users:    &userRepo{s},
+		Videos:   &videoRepo{s},
+		Likes:    &likeRepo{s},
+		Follows:  &followRepo{s},
+		Comments: &commentRepo{s},
+		Outbox:   &outboxRepo{s},
+		Uploads:  &uploadRepo{s},
+	}
+	events := &eventRepo{store: s, repos: repos}
+	repos.Events = events
+	events.repos.Events = events
+	return repos
+}
+
+type userRepo struct{ *store }
+
+func (r *userRepo) GetUserById(id uint64) (dao.User, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	u, ok := r.users[id]
+	if !ok {
+		return dao.User{}, dao.ErrRecordNotFound
+	}
+	return u, nil
+}
+
+func (r *userRepo) GetUserByUsername(username string) (dao.User, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for _, u := range r.users {
+		if u.Username == username {
+			return u, nil
+		}
+	}
+	return dao.User{}, dao.ErrRecordNotFound
+}
+
+func (r *userRepo) PersistUser(user *dao.User) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.usernameTaken(user.Username) {
+		return dao.ErrDuplicatedKey
+	}
+	r.lastUserId++
+	user.Id = r.lastUserId
+	r.users[user.Id] = *user
+	return nil
+}
+
+// usernameTaken reports whether a user has the username, deleted ones
+// included since the unique key covers them
+func (s *store) usernameTaken(username string) bool {
+	for _, u := range s.users {
+		if u.Username == username {
+			return true
+		}
+	}
+	for _, u := range s.deleted {
+		if u.Username == username {
+			return true
+		}
+	}
+	return false
+}
+
+func (r *userRepo) UpdatePassword(id uint64, password string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	u, ok := r.users[id]
+	if !ok {
+		return dao.ErrRecordNotFound
+	}
+	u.Password = password
+	r.users[id] = u
+	return nil
+}
+
+func (r *userRepo) UpdateProfile(id uint64, profile dao.UserProfile, uploadKeys []string) (dao.UserProfile, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	u, ok := r.users[id]
+	if !ok {
+		return dao.UserProfile{}, dao.ErrRecordNotFound
+	}
+	old, previous := u, dao.UserProfile{}
+	if profile.Nickname != nil {
+		previous.Nickname, u.Nickname = &old.Nickname, *profile.Nickname
+	}
+	if profile.Bio != nil {
+		previous.Bio, u.Bio = &old.Bio, *profile.Bio
+	}
+	if profile.AvatarUrl != nil {
+		previous.AvatarUrl, u.AvatarUrl = &old.AvatarUrl, *profile.AvatarUrl
+	}
+	if profile.BackgroundImgUrl != nil {
+		previous.BackgroundImgUrl, u.BackgroundImgUrl = &old.BackgroundImgUrl, *profile.BackgroundImgUrl
+	}
+	r.users[id] = u
+	for _, key := range uploadKeys {
+		delete(r.uploads, key)
+	}
+	return previous, nil
+}
+
+func (r *userRepo) ListUserCounts(afterId uint64, limit int) ([]dao.UserCounts, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	ids := make([]uint64, 0, len(r.users))
+	for id := range r.users {
+		if id > afterId {
+			ids = append(ids, id)
+		}
+	}
+	sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+	if len(ids) > limit {
+		ids = ids[:limit]
+	}
+
+	counts := make([]dao.UserCounts, 0, len(ids))
+	for _, id := range ids {
+		counts = append(counts, r.userCounts(id))
+	}
+	return counts, nil
+}
+
+// userCounts returns the stored counters of the user next to the counted ones
+func (s *store) userCounts(id uint64) dao.UserCounts {
+	u := s.users[id]
+	c := dao.UserCounts{
+		UserId:          id,
+		VideoCount:      u.VideoCount,
+		TotalLiked:      u.TotalLiked,
+		LikedVideoCount: u.LikedVideoCount,
+	}
+	for _, v := range s.videos {
+		if v.AuthorId == id {
+			c.Videos++
+		}
+	}
+	for k := range s.likes {
+		if k.userId == id {
+			c.LikesGiven++
+		}
+		if v, ok := s.videos[k.videoId]; ok && v.AuthorId == id {
+			c.LikesReceived++
+		}
+	}
+	return c
+}
+
+func (r *userRepo) RecountUser(id uint64) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if u, ok := r.users[id]; ok {
+		c := r.userCounts(id)
+		u.VideoCount, u.TotalLiked, u.LikedVideoCount = c.Videos, c.LikesReceived, c.LikesGiven
+		r.users[id] = u
+	}
+	return nil
+}
+
+// adjustCounter adds incr to the counter of the user picked by field,
+// a decrement stops at zero
+func (s *store) adjustCounter(uid uint64, field func(*dao.User) *uint64, incr int) {
+	u, ok := s.users[uid]
+	if !ok {
+		return
+	}
+	if c := field(&u); incr >= 0 {
+		*c += uint64(incr)
+	} else {
+		*c -= min(*c, uint64(-incr))
+	}
+	s.users[uid] = u
+}
+
+func (r *userRepo) DeleteUser(id uint64, orphanKeys []string) (dao.DeletedUser, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if _, ok := r.users[id]; !ok {
+		return dao.DeletedUser{}, dao.ErrRecordNotFound
+	}
+	// the renaming fails on the unique key and rolls everything back
+	if r.usernameTaken(dao.DeletedUsername(id)) {
+		return dao.DeletedUser{}, dao.ErrDuplicatedKey
+	}
+	deleted := dao.DeletedUser{}
+	videoIds, userIds := map[uint64]bool{}, map[uint64]bool{}
+	for _, v := range r.sortedVideos() {
+		if v.AuthorId == id {
+			deleted.Videos = append(deleted.Videos, v)
+			delete(r.videos, v.Id)
+		}
+	}
+
+	for k := range r.likes {
+		if v, ok := r.videos[k.videoId]; !ok {
+			// on a deleted video
+			if k.userId != id {
+				userIds[k.userId] = true
+				r.adjustCounter(k.userId, func(u *dao.User) *uint64 { return &u.LikedVideoCount }, -1)
+			}
+		} else if k.userId == id {
+			videoIds[v.Id] = true
+			userIds[v.AuthorId] = true
+			v.LikeCount -= min(v.LikeCount, 1)
+			r.videos[v.Id] = v
+			r.adjustCounter(v.AuthorId, func(u *dao.User) *uint64 { return &u.TotalLiked }, -1)
+		} else {
+			continue
+		}
+		delete(r.likes, k)
+	}
+	for k := range r.versions {
+		if _, ok := r.videos[k.videoId]; !ok || k.userId == id {
+			delete(r.versions, k)
+		}
+	}
+
+	for cid, c := range r.comments {
+		v, ok := r.videos[uint64(c.VideoId)]
+		if ok && uint64(c.UserId) != id {
+			continue
+		}
+		if ok {
+			videoIds[v.Id] = true
+			v.CommentCount -= min(v.CommentCount, 1)
+			r.videos[v.Id] = v
+		}
+		deleted.CommentIds = append(deleted.CommentIds, cid)
+		delete(r.comments, cid)
+	}
+
+	for k := range r.follows {
+		if k.userId == int64(id) || k.followedId == int64(id) {
+			userIds[uint64(k.userId)] = true
+			userIds[uint64(k.followedId)] = true
+			delete(r.follows, k)
+		}
+	}
+	for k := range r.followVersions {
+		if k.userId == int64(id) || k.followedId == int64(id) {
+			delete(r.followVersions, k)
+		}
+	}
+
+	now := time.Now()
+	for _, key := range orphanKeys {
+		if _, ok := r.uploads[key]; !ok {
+			r.uploads[key] = now
+		}
+	}
+
+	delete(userIds, id)
+	for uid := range userIds {
+		deleted.UserIds = append(deleted.UserIds, uid)
+	}
+	for vid := range videoIds {
+		deleted.VideoIds = append(deleted.VideoIds, vid)
+	}
+	sort.Slice(deleted.CommentIds, func(i, j int) bool { return deleted.CommentIds[i] < deleted.CommentIds[j] })
+	sort.Slice(deleted.UserIds, func(i, j int) bool { return deleted.UserIds[i] < deleted.UserIds[j] })
+	sort.Slice(deleted.VideoIds, func(i, j int) bool { return deleted.VideoIds[i] < deleted.VideoIds[j] })
+
+	// the personal data is erased and the username freed
+	delete(r.users, id)
+	r.deleted[id] = dao.User{Id: id, Username: dao.DeletedUsername(id)}
+	return deleted, nil
+}
+
+type videoRepo struct{ *store }
+
+func (r *videoRepo) PersistVideo(video *dao.Video) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.lastVideoId++
+	video.Id = r.lastVideoId
+	r.videos[video.Id] = *video
+	return nil
+}
+
+func (r *videoRepo) GetVideoById(videoId uint64) (dao.Video, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	v, ok := r.videos[videoId]
+	if !ok {
+		return dao.Video{}, dao.ErrRecordNotFound
+	}
+	return v, nil
+}
+
+func (r *videoRepo) GetVideosByAuthor(authorId uint64) ([]dao.Video, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	videos := []dao.Video{}
+	for _, v := range r.sortedVideos() {
+		if v.AuthorId == authorId {
+			videos = append(videos, v)
+		}
+	}
+	return videos, nil
+}
+
+func (r *videoRepo) GetAllVideos() ([]dao.Video, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.sortedVideos(), nil
+}
+
+func (r *videoRepo) ListVideoCounts(afterId uint64, limit int) ([]dao.VideoCounts, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	counts := []dao.VideoCounts{}
+	for _, v := range r.sortedVideos() {
+		if v.Id <= afterId {
+			continue
+		}
+		if len(counts) == limit {
+			break
+		}
+		counts = append(counts, r.videoCounts(v))
+	}
+	return counts, nil
+}
+
+// videoCounts returns the stored counters of v next to the counted ones
+func (s *store) videoCounts(v dao.Video) dao.VideoCounts {
+	c := dao.VideoCounts{VideoId: v.Id, LikeCount: v.LikeCount, CommentCount: v.CommentCount}
+	for k := range s.likes {
+		if k.videoId == v.Id {
+			c.Likes++
+		}
+	}
+	for _, comment := range s.comments {
+		if uint64(comment.VideoId) == v.Id {
+			c.Comments++
+		}
+	}
+	return c
+}
+
+func (r *videoRepo) RecountVideo(videoId uint64) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if v, ok := r.videos[videoId]; ok {
+		c := r.videoCounts(v)
+		v.LikeCount, v.CommentCount = c.Likes, c.Comments
+		r.videos[videoId] = v
+	}
+	return nil
+}
+
+func (s *store) sortedVideos() []dao.Video {
+	videos := make([]dao.Video, 0, len(s.videos))
+	for _, v := range s.videos {
+		videos = append(videos, v)
+	}
+	sort.Slice(videos, func(i, j int) bool { return videos[i].Id < videos[j].Id })
+	return videos
+}
+
+type likeRepo struct{ *store }
+
+func (r *likeRepo) GetLikedVideoIds(userId uint64) ([]uint64, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	ids := []uint64{}
+	for k := range r.likes {
+		if k.userId == userId {
+			ids = append(ids, k.videoId)
+		}
+	}
+	sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+	return ids, nil
+}
+
+func (r *likeRepo) ApplyLike(userId, videoId uint64, liked bool, seq uint64) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	v, ok := r.videos[videoId]
+	if _, live := r.users[userId]; !ok || !live {
+		return nil
+	}
+	if _, live := r.users[v.AuthorId]; !live {
+		return nil
+	}
+	key := likeKey{userId, videoId}
+	if seq > 0 {
+		if r.versions[key] >= seq {
+			return nil
+		}
+		r.versions[key] = seq
+	}
+	if liked {
+		if _, ok := r.likes[key]; ok {
+			return nil
+		}
+		r.likes[key] = struct{}{}
+	} else {
+		if _, ok := r.likes[key]; !ok {
+			return nil
+		}
+		delete(r.likes, key)
+	}
+
+	incr := 1
+	if !liked {
+		incr = -1
+	}
+	v.LikeCount += uint64(incr)
+	r.videos[videoId] = v
+	r.adjustCounter(v.AuthorId, func(u *dao.User) *uint64 { return &u.TotalLiked }, incr)
+	r.adjustCounter(userId, func(u *dao.User) *uint64 { return &u.LikedVideoCount }, incr)
+	return nil
+}
+
+type followRepo struct{ *store }
+
+func (r *followRepo) GetFollowedSet(uid int64) ([]dao.Follow, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	models := []dao.Follow{}
+	for k := range r.follows {
+		if k.userId == uid {
+			models = append(models, dao.Follow{UserId: k.userId, FollowedId: k.followedId})
+		}
+	}
+	return models, nil
+}
+
+func (r *followRepo) GetFollowerSet(uid int64) ([]dao.Follow, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	models := []dao.Follow{}
+	for k := range r.follows {
+		if k.followedId == uid {
+			models = append(models, dao.Follow{UserId: k.userId, FollowedId: k.followedId})
+		}
+	}
+	return models, nil
+}
+
+func (r *followRepo) PersistFollow(followedId, userId int64, seq uint64) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	key := followKey{userId, followedId}
+	if r.applicable(key, seq) {
+		r.follows[key] = struct{}{}
+	}
+	return nil
+}
+
+func (r *followRepo) DeleteFollowRecord(followedId, userId int64, seq uint64) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	key := followKey{userId, followedId}
+	if r.applicable(key, seq) {
+		delete(r.follows, key)
+	}
+	return nil
+}
+
+// applicable reports whether both users of key are live and no later action
+// of the pair is applied, recording seq as the last one
+func (r *followRepo) applicable(key followKey, seq uint64) bool {
+	for _, id := range []int64{key.userId, key.followedId} {
+		if _, live := r.users[uint64(id)]; !live {
+			return false
+		}
+	}
+	if seq > 0 {
+		if r.followVersions[key] >= seq {
+			return false
+		}
+		r.followVersions[key] = seq
+	}
+	return true
+}
+
+type commentRepo struct{ *store }
+
+func (r *commentRepo) GetCommentById(commentId int64) (dao.Comment, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	c, ok := r.comments[commentId]
+	if !ok {
+		return dao.Comment{}, dao.ErrRecordNotFound
+	}
+	return c, nil
+}
+
+func (r *commentRepo) GetCommentsByVideo(videoId int64) ([]dao.Comment, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	models := []dao.Comment{}
+	for _, c := range r.comments {
+		if c.VideoId == videoId {
+			models = append(models, c)
+		}
+	}
+	sort.Slice(models, func(i, j int) bool { return models[i].Id < models[j].Id })
+	return models, nil
+}
+
+func (r *commentRepo) GetCommentsByUser(userId int64) ([]dao.Comment, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	models := []dao.Comment{}
+	for _, c := range r.comments {
+		if c.UserId == userId {
+			models = append(models, c)
+		}
+	}
+	sort.Slice(models, func(i, j int) bool { return models[i].Id < models[j].Id })
+	return models, nil
+}
+
+func (r *commentRepo) PersistComment(comment *dao.Comment) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.lastCommentId++
+	comment.Id = r.lastCommentId
+	r.comments[comment.Id] = *comment
+	if v, ok := r.videos[uint64(comment.VideoId)]; ok {
+		v.CommentCount++
+		r.videos[v.Id] = v
+	}
+	return nil
+}
+
+func (r *commentRepo) DeleteComment(videoId, commentId int64) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if _, ok := r.comments[commentId]; !ok {
+		return nil
+	}
+	delete(r.comments, commentId)
+	if v, ok := r.videos[uint64(videoId)]; ok {
+		v.CommentCount--
+		r.videos[v.Id] = v
+	}
+	return nil
+}
+
+type outboxRepo struct{ *store }
+
+func (r *outboxRepo) PublishVideo(video *dao.Video, uploadKeys []string) (uint64, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.lastVideoId++
+	video.Id = r.lastVideoId
+	r.videos[video.Id] = *video
+	r.adjustCounter(video.AuthorId, func(u *dao.User) *uint64 { return &u.VideoCount }, 1)
+
+	r.lastMessageId++
+	now := time.Now()
+	r.outbox[r.lastMessageId] = dao.OutboxMessage{
+		Id:            r.lastMessageId,
+		Topic:         dao.TopicVideoPublished,
+		Payload:       strconv.FormatUint(video.Id, 10),
+		NextAttemptAt: now,
+		CreatedAt:     now,
+	}
+	for _, key := range uploadKeys {
+		delete(r.uploads, key)
+	}
+	return r.lastMessageId, nil
+}
+
+func (r *outboxRepo) Enqueue(topic, payload string) (uint64, error) {
+	return r.EnqueueAt(topic, payload, time.Now())
+}
+
+func (r *outboxRepo) EnqueueAt(topic, payload string, at time.Time) (uint64, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.lastMessageId++
+	r.outbox[r.lastMessageId] = dao.OutboxMessage{
+		Id:            r.lastMessageId,
+		Topic:         topic,
+		Payload:       payload,
+		NextAttemptAt: at,
+		CreatedAt:     time.Now(),
+	}
+	return r.lastMessageId, nil
+}
+
+func (r *outboxRepo) PendingMessages(now time.Time, limit int) ([]dao.OutboxMessage, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	msgs := []dao.OutboxMessage{}
+	for _, m := range r.outbox {
+		if !m.NextAttemptAt.After(now) {
+			msgs = append(msgs, m)
+		}
+	}
+	sort.Slice(msgs, func(i, j int) bool { return msgs[i].Id < msgs[j].Id })
+	if len(msgs) > limit {
+		msgs = msgs[:limit]
+	}
+	return msgs, nil
+}
+
+func (r *outboxRepo) DeleteMessage(id uint64) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	delete(r.outbox, id)
+	return nil
+}
+
+func (r *outboxRepo) RetryMessage(id uint64, next time.Time) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if m, ok := r.outbox[id]; ok {
+		m.Attempts++
+		m.NextAttemptAt = next
+		r.outbox[id] = m
+	}
+	return nil
+}
+
+type uploadRepo struct{ *store }
+
+func (r *uploadRepo) AddPendingUploads(keys []string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	now := time.Now()
+	for _, key := range keys {
+		if _, ok := r.uploads[key]; ok {
+			return dao.ErrDuplicatedKey
+		}
+		r.uploads[key] = now
+	}
+	return nil
+}
+
+func (r *uploadRepo) ExpiredUploads(before time.Time, limit int) ([]string, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	keys := []string{}
+	for key, createdAt := range r.uploads {
+		if createdAt.Before(before) {
+			keys = append(keys, key)
+		}
+	}
+	sort.Slice(keys, func(i, j int) bool { return r.uploads[keys[i]].Before(r.uploads[keys[j]]) })
+	if len(keys) > limit {
+		keys = keys[:limit]
+	}
+	return keys, nil
+}
+
+func (r *uploadRepo) DeletePendingUploads(keys []string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for _, key := range keys {
+		delete(r.uploads, key)
+	}
+	return nil
+}
+
+// eventRepo runs the events one at a time, a failed fn isn't rolled back
+// which is fine as long as fn makes a single repo call
+type eventRepo struct {
+	*store
+	eventMu sync.Mutex
+	repos   dao.Repos
+}
+
+func (r *eventRepo) Once(eventId string, fn func(repos dao.Repos) error) error {
+	r.eventMu.Lock()
+	defer r.eventMu.Unlock()
+
+	r.mu.Lock()
+	_, done := r.events[eventId]
+	r.mu.Unlock()
+	if done {
+		return nil
+	}
+
+	if err := fn(r.repos); err != nil {
+		return err
+	}
+	if eventId != "" {
+		r.mu.Lock()
+		r.events[eventId] = time.Now()
+		r.mu.Unlock()
+	}
+	return nil
+}
+
+func (r *eventRepo) DeleteProcessedEvents(before time.Time, limit int) (int, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	ids := []string{}
+	for id, at := range r.events {
+		if at.Before(before) {
+			ids = append(ids, id)
+		}
+	}
+	sort.Slice(ids, func(i, j int) bool { return r.events[ids[i]].Before(r.events[ids[j]]) })
+	if len(ids) > limit {
+		ids = ids[:limit]
+	}
+	for _, id := range ids {
+		delete(r.events, id)
+	}
+	return len(ids), nil
+}
+
+// SetVideoCounts overwrites the counters of a video in repos built by NewRepos,
+// tests use it to make them drift from the records
+func SetVideoCounts(repos dao.Repos, videoId, likeCount, commentCount uint64) {
+	r := repos.Videos.(*videoRepo)
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if v, ok := r.videos[videoId]; ok {
+		v.LikeCount, v.CommentCount = likeCount, commentCount
+		r.videos[videoId] = v
+	}
+}
+
+// SetUserCounts overwrites the counters of a user in repos built by NewRepos,
+// tests use it to make them drift from the records
+func SetUserCounts(repos dao.Repos, id, videoCount, totalLiked, likedVideoCount uint64) {
+	r := repos.Users.(*userRepo)
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if u, ok := r.users[id]; ok {
+		u.VideoCount, u.TotalLiked, u.LikedVideoCount = videoCount, totalLiked, likedVideoCount
+		r.users[id] = u
+	}
+}
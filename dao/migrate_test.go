@@ -0,0 +1,48 @@
+package dao
+
+import (
+	"testing"
+	"testing/fstest"
+)
+
+func TestEmbeddedMigrations(t *testing.T) {
+	migrations, err := Migrations()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(migrations) == 0 {
+		t.Fatal("no migration embedded")
+	}
+	for i, m := range migrations {
+		if i > 0 && m.Version <= migrations[i-1].Version {
+			t.Fatalf("migration %d is out of order", m.Version)
+		}
+		if len(splitStatements(m.Up)) == 0 || len(splitStatements(m.Down)) == 0 {
+			t.Fatalf("migration %d_%s has an empty script", m.Version, m.Name)
+		}
+	}
+}
+
+func TestLoadMigrationsRequiresPairs(t *testing.T) {
+	fsys := fstest.MapFS{
+		"0001_a.up.sql":   {Data: []byte("CREATE TABLE a (id INT);")},
+		"0001_a.down.sql": {Data: []byte("DROP TABLE a;")},
+		"0002_b.up.sql":   {Data: []byte("CREATE TABLE b (id INT);")},
+	}
+	if _, err := LoadMigrations(fsys); err == nil {
+		t.Fatal("expected a migration without down file to be rejected")
+	}
+}
+
+func TestSplitStatements(t *testing.T) {
+	stmts := splitStatements(`
+-- comment
+CREATE TABLE a (
+    id INT
+);
+CREATE INDEX idx ON a (id);
+`)
+	if len(stmts) != 2 {
+		t.Fatalf("expected 2 statements, got %d: %q", len(stmts), stmts)
+	}
+}
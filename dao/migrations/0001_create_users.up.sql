@@ -0,0 +1,10 @@
+CREATE TABLE users (
+    id                 BIGINT UNSIGNED NOT NULL AUTO_INCREMENT,
+    username           VARCHAR(64)     NOT NULL,
+    password           VARCHAR(255)    NOT NULL,
+    nickname           VARCHAR(64)     NOT NULL DEFAULT '',
+    avatar_url         VARCHAR(512)    NOT NULL DEFAULT '',
+    background_img_url VARCHAR(512)    NOT NULL DEFAULT '',
+    PRIMARY KEY (id),
+    UNIQUE KEY uk_username (username)
+) ENGINE = InnoDB DEFAULT CHARSET = utf8mb4;
@@ -0,0 +1,15 @@
+CREATE TABLE videos (
+    id            BIGINT UNSIGNED NOT NULL AUTO_INCREMENT,
+    author_id     BIGINT UNSIGNED NOT NULL,
+    title         VARCHAR(255)    NOT NULL DEFAULT '',
+    play_url      VARCHAR(512)    NOT NULL,
+    cover_url     VARCHAR(512)    NOT NULL,
+    publish_at    DATETIME(3)     NOT NULL,
+    like_count    BIGINT UNSIGNED NOT NULL DEFAULT 0,
+    comment_count BIGINT UNSIGNED NOT NULL DEFAULT 0,
+    PRIMARY KEY (id),
+    -- feed pagination scans by publish time
+    KEY idx_publish_at (publish_at),
+    -- published videos of an author
+    KEY idx_author_publish_at (author_id, publish_at)
+) ENGINE = InnoDB DEFAULT CHARSET = utf8mb4;
@@ -0,0 +1,8 @@
+CREATE TABLE likes (
+    id       BIGINT UNSIGNED NOT NULL AUTO_INCREMENT,
+    user_id  BIGINT UNSIGNED NOT NULL,
+    video_id BIGINT UNSIGNED NOT NULL,
+    PRIMARY KEY (id),
+    UNIQUE KEY uk_user_video (user_id, video_id),
+    KEY idx_video_id (video_id)
+) ENGINE = InnoDB DEFAULT CHARSET = utf8mb4;
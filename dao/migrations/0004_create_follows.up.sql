@@ -0,0 +1,9 @@
+CREATE TABLE follows (
+    id          BIGINT UNSIGNED NOT NULL AUTO_INCREMENT,
+    user_id     BIGINT          NOT NULL,
+    followed_id BIGINT          NOT NULL,
+    PRIMARY KEY (id),
+    UNIQUE KEY uk_user_followed (user_id, followed_id),
+    -- followers of a user
+    KEY idx_followed_id (followed_id)
+) ENGINE = InnoDB DEFAULT CHARSET = utf8mb4;
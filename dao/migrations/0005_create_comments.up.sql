@@ -0,0 +1,13 @@
+CREATE TABLE comments (
+    id           BIGINT        NOT NULL AUTO_INCREMENT,
+    user_id      BIGINT        NOT NULL,
+    video_id     BIGINT        NOT NULL,
+    parent_id    BIGINT        NOT NULL DEFAULT 0,
+    comment_text VARCHAR(1024) NOT NULL,
+    -- unix seconds
+    create_at    BIGINT        NOT NULL,
+    PRIMARY KEY (id),
+    -- comment list of a video ordered by time
+    KEY idx_video_create_at (video_id, create_at),
+    KEY idx_user_id (user_id)
+) ENGINE = InnoDB DEFAULT CHARSET = utf8mb4;
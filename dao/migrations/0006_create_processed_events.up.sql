@@ -0,0 +1,7 @@
+-- ids of the MQ events already applied, makes redelivered events a no-op
+CREATE TABLE processed_events (
+    event_id     VARCHAR(64) NOT NULL,
+    processed_at DATETIME    NOT NULL,
+    PRIMARY KEY (event_id),
+    KEY idx_processed_at (processed_at)
+) ENGINE = InnoDB DEFAULT CHARSET = utf8mb4;
@@ -0,0 +1,12 @@
+-- messages written in the same transaction as the change they announce,
+-- a relay delivers them and deletes them once handled
+CREATE TABLE outbox (
+    id              BIGINT UNSIGNED NOT NULL AUTO_INCREMENT,
+    topic           VARCHAR(64)     NOT NULL,
+    payload         TEXT            NOT NULL,
+    attempts        INT             NOT NULL DEFAULT 0,
+    next_attempt_at DATETIME(3)     NOT NULL,
+    created_at      DATETIME(3)     NOT NULL,
+    PRIMARY KEY (id),
+    KEY idx_next_attempt_at (next_attempt_at)
+) ENGINE = InnoDB DEFAULT CHARSET = utf8mb4;
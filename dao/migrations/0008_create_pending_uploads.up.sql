@@ -0,0 +1,8 @@
+-- storage objects uploaded by a publish that hasn't committed yet,
+-- the ones left behind by a failed publish are garbage-collected
+CREATE TABLE pending_uploads (
+    object_key VARCHAR(255) NOT NULL,
+    created_at DATETIME     NOT NULL,
+    PRIMARY KEY (object_key),
+    KEY idx_created_at (created_at)
+) ENGINE = InnoDB DEFAULT CHARSET = utf8mb4;
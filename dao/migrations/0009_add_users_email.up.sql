@@ -0,0 +1,2 @@
+-- where the password reset links are sent, empty if the user gave none
+ALTER TABLE users ADD COLUMN email VARCHAR(255) NOT NULL DEFAULT '' AFTER password;
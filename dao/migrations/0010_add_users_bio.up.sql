@@ -0,0 +1 @@
+ALTER TABLE users ADD COLUMN bio VARCHAR(255) NOT NULL DEFAULT '' AFTER nickname;
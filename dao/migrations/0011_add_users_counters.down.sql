@@ -0,0 +1,4 @@
+ALTER TABLE users
+    DROP COLUMN liked_video_count,
+    DROP COLUMN total_liked,
+    DROP COLUMN video_count;
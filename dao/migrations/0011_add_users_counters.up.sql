@@ -0,0 +1,12 @@
+-- creator statistics kept up to date by publishing and liking,
+-- the reconciliation job repairs them from the records
+ALTER TABLE users
+    ADD COLUMN video_count       BIGINT UNSIGNED NOT NULL DEFAULT 0 AFTER background_img_url,
+    ADD COLUMN total_liked       BIGINT UNSIGNED NOT NULL DEFAULT 0 AFTER video_count,
+    ADD COLUMN liked_video_count BIGINT UNSIGNED NOT NULL DEFAULT 0 AFTER total_liked;
+
+UPDATE users SET
+    video_count       = (SELECT COUNT(*) FROM videos WHERE videos.author_id = users.id),
+    total_liked       = (SELECT COUNT(*) FROM likes JOIN videos ON videos.id = likes.video_id
+                         WHERE videos.author_id = users.id),
+    liked_video_count = (SELECT COUNT(*) FROM likes WHERE likes.user_id = users.id);
@@ -0,0 +1,2 @@
+-- a deleted account is kept anonymized so that its id isn't reused
+ALTER TABLE users ADD COLUMN deleted_at DATETIME(3) NULL DEFAULT NULL AFTER liked_video_count;
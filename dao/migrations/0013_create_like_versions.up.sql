@@ -0,0 +1,9 @@
+-- sequence number of the last like or unlike applied to a pair,
+-- an action delivered after a later one of the same pair is dropped
+CREATE TABLE like_versions (
+    user_id  BIGINT UNSIGNED NOT NULL,
+    video_id BIGINT UNSIGNED NOT NULL,
+    seq      BIGINT UNSIGNED NOT NULL,
+    PRIMARY KEY (user_id, video_id),
+    KEY idx_video_id (video_id)
+) ENGINE = InnoDB DEFAULT CHARSET = utf8mb4;
@@ -0,0 +1,9 @@
+-- sequence number of the last follow or unfollow applied to a pair,
+-- an action delivered after a later one of the same pair is dropped
+CREATE TABLE follow_versions (
+    user_id     BIGINT          NOT NULL,
+    followed_id BIGINT          NOT NULL,
+    seq         BIGINT UNSIGNED NOT NULL,
+    PRIMARY KEY (user_id, followed_id),
+    KEY idx_followed_id (followed_id)
+) ENGINE = InnoDB DEFAULT CHARSET = utf8mb4;
@@ -0,0 +1,116 @@
+package dao
+
+import (
+	"strconv"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// TopicVideoPublished carries the id of a just published video
+const TopicVideoPublished = "video.published"
+
+// TopicExportRequested carries "<user id>:<archive name>" of a requested data export
+const TopicExportRequested = "account.export_requested"
+
+// TopicExportExpired carries the storage key of an archive whose download link expired
+const TopicExportExpired = "account.export_expired"
+
+type OutboxMessage struct {
+	Id            uint64
+	Topic         string
+	Payload       string
+	Attempts      int
+	NextAttemptAt time.Time
+	CreatedAt     time.Time
+}
+
+func (OutboxMessage) TableName() string {
+	return "outbox"
+}
+
+type PendingUpload struct {
+	ObjectKey string `gorm:"primaryKey"`
+	CreatedAt time.Time
+}
+
+type outboxRepo struct {
+	db *gorm.DB
+}
+
+func (r *outboxRepo) PublishVideo(video *Video, uploadKeys []string) (uint64, error) {
+	msg := OutboxMessage{Topic: TopicVideoPublished}
+	err := r.db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Create(video).Error; err != nil {
+			return err
+		}
+		if err := adjustCounter(tx, "id = ?", video.AuthorId, "video_count", 1); err != nil {
+			return err
+		}
+		msg.Payload = strconv.FormatUint(video.Id, 10)
+		msg.CreatedAt = time.Now()
+		msg.NextAttemptAt = msg.CreatedAt
+		if err := tx.Create(&msg).Error; err != nil {
+			return err
+		}
+		if len(uploadKeys) == 0 {
+			return nil
+		}
+		return tx.Where("object_key IN ?", uploadKeys).Delete(&PendingUpload{}).Error
+	})
+	return msg.Id, err
+}
+
+func (r *outboxRepo) Enqueue(topic, payload string) (uint64, error) {
+	return r.EnqueueAt(topic, payload, time.Now())
+}
+
+func (r *outboxRepo) EnqueueAt(topic, payload string, at time.Time) (uint64, error) {
+	msg := OutboxMessage{Topic: topic, Payload: payload, NextAttemptAt: at, CreatedAt: time.Now()}
+	err := r.db.Create(&msg).Error
+	return msg.Id, err
+}
+
+func (r *outboxRepo) PendingMessages(now time.Time, limit int) ([]OutboxMessage, error) {
+	msgs := []OutboxMessage{}
+	err := r.db.Where("next_attempt_at <= ?", now).Order("id").Limit(limit).Find(&msgs).Error
+	return msgs, err
+}
+
+func (r *outboxRepo) DeleteMessage(id uint64) error {
+	return r.db.Delete(&OutboxMessage{Id: id}).Error
+}
+
+func (r *outboxRepo) RetryMessage(id uint64, next time.Time) error {
+	return r.db.Model(&OutboxMessage{Id: id}).Updates(map[string]any{
+		"attempts":        gorm.Expr("attempts + 1"),
+		"next_attempt_at": next,
+	}).Error
+}
+
+type uploadRepo struct {
+	db *gorm.DB
+}
+
+func (r *uploadRepo) AddPendingUploads(keys []string) error {
+	uploads := make([]PendingUpload, 0, len(keys))
+	now := time.Now()
+	for _, key := range keys {
+		uploads = append(uploads, PendingUpload{ObjectKey: key, CreatedAt: now})
+	}
+	return r.db.Create(&uploads).Error
+}
+
+func (r *uploadRepo) ExpiredUploads(before time.Time, limit int) ([]string, error) {
+	keys := []string{}
+	err := r.db.Model(&PendingUpload{}).Where("created_at < ?", before).
+		Order("created_at").Limit(limit).Pluck("object_key", &keys).Error
+	return keys, err
+}
+
+func (r *uploadRepo) DeletePendingUploads(keys []string) error {
+	if len(keys) == 0 {
+		return nil
+	}
+	return r.db.Where("object_key IN ?", keys).Delete(&PendingUpload{}).Error
+}
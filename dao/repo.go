@@ -0,0 +1,143 @@
+package dao
+
+import (
+	"time"
+
+	"gorm.io/gorm"
+)
+
+var (
+	ErrRecordNotFound = gorm.ErrRecordNotFound
+	ErrDuplicatedKey  = gorm.ErrDuplicatedKey
+)
+
+type UserRepo interface {
+	GetUserById(id uint64) (User, error)
+	GetUserByUsername(username string) (User, error)
+	PersistUser(user *User) error
+	// UpdatePassword replaces the password hash of the user
+	UpdatePassword(id uint64, password string) error
+	// UpdateProfile sets the non-nil fields of the profile and
+	// clears the pending uploads it refers to in the same transaction,
+	// it returns the values those fields had before the update
+	UpdateProfile(id uint64, profile UserProfile, uploadKeys []string) (UserProfile, error)
+	// ListUserCounts returns the counters of at most limit users
+	// with an id greater than afterId, ordered by id
+	ListUserCounts(afterId uint64, limit int) ([]UserCounts, error)
+	// RecountUser sets the counters of the user to the counts of the records,
+	// in one statement so that a concurrent change isn't lost
+	RecountUser(id uint64) error
+	// DeleteUser anonymizes and soft-deletes the user within one transaction,
+	// deleting the videos along with their likes and comments, the likes, comments
+	// and follows of the user and adjusting the counters they were part of.
+	// orphanKeys are tracked as pending uploads so that the objects are collected
+	// even if deleting them fails
+	DeleteUser(id uint64, orphanKeys []string) (DeletedUser, error)
+}
+
+type VideoRepo interface {
+	PersistVideo(video *Video) error
+	GetVideoById(videoId uint64) (Video, error)
+	// get published videos by the specified author
+	GetVideosByAuthor(authorId uint64) ([]Video, error)
+	GetAllVideos() ([]Video, error)
+	// ListVideoCounts returns the counters of at most limit videos
+	// with an id greater than afterId, ordered by id
+	ListVideoCounts(afterId uint64, limit int) ([]VideoCounts, error)
+	// RecountVideo sets the counters of the video to the counts of the records,
+	// in one statement so that a concurrent change isn't lost
+	RecountVideo(videoId uint64) error
+}
+
+type LikeRepo interface {
+	GetLikedVideoIds(userId uint64) ([]uint64, error)
+	// ApplyLike inserts or deletes the like record and adjusts like_count of the video,
+	// liked_video_count of the user and total_liked of the author within one transaction,
+	// the count is left alone if the record already is in the requested state.
+	// The action is dropped if one of the pair with a greater seq is already applied,
+	// a zero seq skips the check. It is dropped as well if the user, the video or
+	// its author is deleted
+	ApplyLike(userId, videoId uint64, liked bool, seq uint64) error
+}
+
+type FollowRepo interface {
+	GetFollowedSet(uid int64) ([]Follow, error)
+	GetFollowerSet(uid int64) ([]Follow, error)
+	// PersistFollow is a no-op if the follow record exists or either user is deleted.
+	// Both actions are dropped if one of the pair with a greater seq is already
+	// applied, a zero seq skips the check
+	PersistFollow(followedId, userId int64, seq uint64) error
+	DeleteFollowRecord(followedId, userId int64, seq uint64) error
+}
+
+type CommentRepo interface {
+	GetCommentById(commentId int64) (Comment, error)
+	GetCommentsByVideo(videoId int64) ([]Comment, error)
+	// GetCommentsByUser returns the comments posted by the user, the oldest first
+	GetCommentsByUser(userId int64) ([]Comment, error)
+	// PersistComment also increments comment_count of the video
+	PersistComment(comment *Comment) error
+	// DeleteComment also decrements comment_count of the video,
+	// unless the comment is already gone
+	DeleteComment(videoId, commentId int64) error
+}
+
+// EventRepo records the ids of the processed MQ events
+type EventRepo interface {
+	// Once runs fn with repos bound to one transaction that also records eventId,
+	// fn is skipped if eventId is already recorded. An empty eventId isn't recorded
+	Once(eventId string, fn func(repos Repos) error) error
+	// DeleteProcessedEvents forgets at most limit ids recorded before the given time,
+	// the oldest first, and returns how many were deleted
+	DeleteProcessedEvents(before time.Time, limit int) (int, error)
+}
+
+// OutboxRepo keeps the messages announcing committed changes,
+// they are delivered by a relay until handled
+type OutboxRepo interface {
+	// PublishVideo persists the video together with a TopicVideoPublished message,
+	// counts it on the author and clears the pending uploads of its objects
+	// within one transaction
+	PublishVideo(video *Video, uploadKeys []string) (msgId uint64, err error)
+	// Enqueue adds a message which isn't tied to any other change
+	Enqueue(topic, payload string) (msgId uint64, err error)
+	// EnqueueAt adds a message which isn't delivered before at
+	EnqueueAt(topic, payload string, at time.Time) (msgId uint64, err error)
+	// PendingMessages returns at most limit messages due at now, the oldest first
+	PendingMessages(now time.Time, limit int) ([]OutboxMessage, error)
+	DeleteMessage(id uint64) error
+	// RetryMessage counts a failed attempt and defers the message to next
+	RetryMessage(id uint64, next time.Time) error
+}
+
+// UploadRepo tracks the storage objects whose video isn't persisted yet
+type UploadRepo interface {
+	AddPendingUploads(keys []string) error
+	// ExpiredUploads returns at most limit keys added before the given time
+	ExpiredUploads(before time.Time, limit int) ([]string, error)
+	DeletePendingUploads(keys []string) error
+}
+
+type Repos struct {
+	Users    UserRepo
+	Videos   VideoRepo
+	Likes    LikeRepo
+	Follows  FollowRepo
+	Comments CommentRepo
+	Events   EventRepo
+	Outbox   OutboxRepo
+	Uploads  UploadRepo
+}
+
+func NewRepos(db *gorm.DB) Repos {
+	return Repos{
+		Users:    &userRepo{db},
+		Videos:   &videoRepo{db},
+		Likes:    &likeRepo{db},
+		Follows:  &followRepo{db},
+		Comments: &commentRepo{db},
+		Events:   &eventRepo{db},
+		Outbox:   &outboxRepo{db},
+		Uploads:  &uploadRepo{db},
+	}
+}
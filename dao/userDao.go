@@ -2,37 +2,356 @@ package dao
 
 import (
 	"fmt"
+	"slices"
+	"time"
+
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
 )
 
 type User struct {
 	Id               uint64 `redis:"id"`
 	Username         string `redis:"username"`
 	Password         string `redis:"password"`
+	Email            string `redis:"email"`
 	Nickname         string `redis:"nickname"`
+	Bio              string `redis:"bio"`
 	AvatarUrl        string `redis:"avatar_url"`
 	BackgroundImgUrl string `redis:"background_url"`
+	VideoCount       uint64 `redis:"video_count"`
+	TotalLiked       uint64 `redis:"total_liked"`
+	LikedVideoCount  uint64 `redis:"liked_video_count"`
+	// DeletedAt hides a deleted account from every query
+	DeletedAt gorm.DeletedAt `redis:"-"`
 }
 
-func GetUserList() (users []User, err error) {
-	err = Db.Find(&users).Error
-	if err != nil {
-		fmt.Println("failed to get users, detail:", err.Error())
+// UserCounts holds the counters stored on a user
+// next to the ones counted from the videos and likes tables
+type UserCounts struct {
+	UserId          uint64
+	VideoCount      uint64
+	TotalLiked      uint64
+	LikedVideoCount uint64
+	Videos          uint64
+	LikesReceived   uint64
+	LikesGiven      uint64
+}
+
+// UserProfile is the editable part of a user, nil fields are left alone
+type UserProfile struct {
+	Nickname         *string
+	Bio              *string
+	AvatarUrl        *string
+	BackgroundImgUrl *string
+}
+
+func (p UserProfile) columns() map[string]any {
+	columns := map[string]any{}
+	if p.Nickname != nil {
+		columns["nickname"] = *p.Nickname
+	}
+	if p.Bio != nil {
+		columns["bio"] = *p.Bio
+	}
+	if p.AvatarUrl != nil {
+		columns["avatar_url"] = *p.AvatarUrl
+	}
+	if p.BackgroundImgUrl != nil {
+		columns["background_img_url"] = *p.BackgroundImgUrl
+	}
+	return columns
+}
+
+// previous returns the values of user that the non-nil fields of the profile replace
+func (p UserProfile) previous(user User) UserProfile {
+	previous := UserProfile{}
+	if p.Nickname != nil {
+		previous.Nickname = &user.Nickname
 	}
-	return
+	if p.Bio != nil {
+		previous.Bio = &user.Bio
+	}
+	if p.AvatarUrl != nil {
+		previous.AvatarUrl = &user.AvatarUrl
+	}
+	if p.BackgroundImgUrl != nil {
+		previous.BackgroundImgUrl = &user.BackgroundImgUrl
+	}
+	return previous
 }
 
-func GetUserById(id uint64) (User, error) {
-	u := User{Id: id}
-	err := Db.First(&u).Error
+type userRepo struct {
+	db *gorm.DB
+}
+
+func (r *userRepo) GetUserById(id uint64) (User, error) {
+	u := User{}
+	err := r.db.First(&u, "id = ?", id).Error
 	return u, err
 }
 
-func GetUserByUsername(username string) (User, error) {
+func (r *userRepo) GetUserByUsername(username string) (User, error) {
 	u := User{}
-	err := Db.First(&u, "username = ?", username).Error
+	err := r.db.First(&u, "username = ?", username).Error
 	return u, err
 }
 
-func PersistUser(user *User) error {
-	return Db.Create(user).Error
+func (r *userRepo) PersistUser(user *User) error {
+	return r.db.Create(user).Error
+}
+
+func (r *userRepo) UpdatePassword(id uint64, password string) error {
+	res := r.db.Model(&User{}).Where("id = ?", id).Update("password", password)
+	if res.Error != nil {
+		return res.Error
+	}
+	if res.RowsAffected == 0 {
+		return ErrRecordNotFound
+	}
+	return nil
+}
+
+func (r *userRepo) UpdateProfile(id uint64, profile UserProfile, uploadKeys []string) (UserProfile, error) {
+	columns := profile.columns()
+	previous := UserProfile{}
+	err := r.db.Transaction(func(tx *gorm.DB) error {
+		// the row is locked so concurrent updates can't both return the same previous value,
+		// RowsAffected is zero when nothing changes, so the existence is checked here too
+		user := User{}
+		if err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).First(&user, "id = ?", id).Error; err != nil {
+			return err
+		}
+		previous = profile.previous(user)
+		if len(columns) > 0 {
+			if err := tx.Model(&User{}).Where("id = ?", id).Updates(columns).Error; err != nil {
+				return err
+			}
+		}
+		if len(uploadKeys) == 0 {
+			return nil
+		}
+		return tx.Where("object_key IN ?", uploadKeys).Delete(&PendingUpload{}).Error
+	})
+	return previous, err
+}
+
+func (r *userRepo) ListUserCounts(afterId uint64, limit int) ([]UserCounts, error) {
+	counts := []UserCounts{}
+	err := r.db.Model(&User{}).
+		Select("id AS user_id, video_count, total_liked, liked_video_count, "+
+			"(SELECT COUNT(*) FROM videos WHERE videos.author_id = users.id) AS videos, "+
+			"(SELECT COUNT(*) FROM likes JOIN videos ON videos.id = likes.video_id "+
+			"WHERE videos.author_id = users.id) AS likes_received, "+
+			"(SELECT COUNT(*) FROM likes WHERE likes.user_id = users.id) AS likes_given").
+		Where("id > ?", afterId).
+		Order("id").
+		Limit(limit).
+		Scan(&counts).Error
+	return counts, err
+}
+
+func (r *userRepo) RecountUser(id uint64) error {
+	return r.db.Model(&User{}).Where("id = ?", id).Updates(map[string]any{
+		"video_count": gorm.Expr("(SELECT COUNT(*) FROM videos WHERE videos.author_id = users.id)"),
+		"total_liked": gorm.Expr("(SELECT COUNT(*) FROM likes JOIN videos ON videos.id = likes.video_id " +
+			"WHERE videos.author_id = users.id)"),
+		"liked_video_count": gorm.Expr("(SELECT COUNT(*) FROM likes WHERE likes.user_id = users.id)"),
+	}).Error
+}
+
+// adjustCounter adds incr to a counter of the user, a decrement stops
+// at zero since the counters are unsigned
+func adjustCounter(tx *gorm.DB, where string, arg any, column string, incr int) error {
+	expr := gorm.Expr(column+" + ?", incr)
+	if incr < 0 {
+		expr = gorm.Expr("GREATEST("+column+", ?) - ?", -incr, -incr)
+	}
+	return tx.Model(&User{}).Where(where, arg).Update(column, expr).Error
+}
+
+// lockLiveUsers takes shared locks on the rows of the users, in the order of
+// the ids so that concurrent callers don't deadlock, and reports whether none
+// of them is deleted. It waits for a deletion in progress of any of them
+func lockLiveUsers(tx *gorm.DB, ids ...uint64) (bool, error) {
+	found := []uint64{}
+	err := tx.Model(&User{}).Clauses(clause.Locking{Strength: "SHARE"}).
+		Where("id IN ?", ids).Order("id").Pluck("id", &found).Error
+	if err != nil {
+		return false, err
+	}
+	for _, id := range ids {
+		if !slices.Contains(found, id) {
+			return false, nil
+		}
+	}
+	return true, nil
+}
+
+// DeletedUsername replaces the username of a deleted account, the '#'
+// is refused at registration so that nobody can take it in advance
+func DeletedUsername(id uint64) string {
+	return fmt.Sprintf("#deleted-%d", id)
+}
+
+// DeletedUser lists what the deletion of an account removed or changed
+// so that the caches can follow
+type DeletedUser struct {
+	// Videos are the deleted videos of the user
+	Videos []Video
+	// CommentIds are the deleted comments, by the user or on the videos
+	CommentIds []int64
+	// VideoIds are the other videos whose likes or comments changed
+	VideoIds []uint64
+	// UserIds are the other users whose counters, liked or follow sets changed
+	UserIds []uint64
+}
+
+func (r *userRepo) DeleteUser(id uint64, orphanKeys []string) (DeletedUser, error) {
+	deleted := DeletedUser{}
+	err := r.db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).Select("id").First(&User{}, "id = ?", id).Error; err != nil {
+			return err
+		}
+		videoIds, commentIds := []uint64{}, []int64{}
+		touchedVideos, userIds := map[uint64]bool{}, map[uint64]bool{}
+
+		// the videos of the user go along with the likes and comments on them
+		if err := tx.Where("author_id = ?", id).Find(&deleted.Videos).Error; err != nil {
+			return err
+		}
+		for _, v := range deleted.Videos {
+			videoIds = append(videoIds, v.Id)
+		}
+		if len(videoIds) > 0 {
+			var likers []struct {
+				UserId uint64
+				Likes  int
+			}
+			err := tx.Model(&Like{}).Select("user_id, COUNT(*) AS likes").
+				Where("video_id IN ? AND user_id <> ?", videoIds, id).Group("user_id").Scan(&likers).Error
+			if err != nil {
+				return err
+			}
+			for _, l := range likers {
+				userIds[l.UserId] = true
+				if err := adjustCounter(tx, "id = ?", l.UserId, "liked_video_count", -l.Likes); err != nil {
+					return err
+				}
+			}
+			if err := tx.Where("video_id IN ?", videoIds).Delete(&Like{}).Error; err != nil {
+				return err
+			}
+			if err := tx.Where("video_id IN ?", videoIds).Delete(&LikeVersion{}).Error; err != nil {
+				return err
+			}
+			if err := tx.Model(&Comment{}).Where("video_id IN ?", videoIds).Pluck("id", &commentIds).Error; err != nil {
+				return err
+			}
+			if err := tx.Where("video_id IN ?", videoIds).Delete(&Comment{}).Error; err != nil {
+				return err
+			}
+			if err := tx.Where("id IN ?", videoIds).Delete(&Video{}).Error; err != nil {
+				return err
+			}
+		}
+
+		// the likes of the user on other videos
+		var liked []Video
+		err := tx.Model(&Video{}).Select("videos.id, videos.author_id").
+			Joins("JOIN likes ON likes.video_id = videos.id").Where("likes.user_id = ?", id).Scan(&liked).Error
+		if err != nil {
+			return err
+		}
+		for _, v := range liked {
+			touchedVideos[v.Id] = true
+			userIds[v.AuthorId] = true
+			err := tx.Model(&Video{}).Where("id = ? AND like_count > 0", v.Id).
+				Update("like_count", gorm.Expr("like_count - 1")).Error
+			if err != nil {
+				return err
+			}
+			if err := adjustCounter(tx, "id = ?", v.AuthorId, "total_liked", -1); err != nil {
+				return err
+			}
+		}
+		if err := tx.Where("user_id = ?", id).Delete(&Like{}).Error; err != nil {
+			return err
+		}
+		if err := tx.Where("user_id = ?", id).Delete(&LikeVersion{}).Error; err != nil {
+			return err
+		}
+
+		// the comments of the user on other videos
+		var comments []Comment
+		if err := tx.Select("id, video_id").Where("user_id = ?", id).Find(&comments).Error; err != nil {
+			return err
+		}
+		commented := map[int64]int{}
+		for _, c := range comments {
+			commentIds = append(commentIds, c.Id)
+			commented[c.VideoId]++
+		}
+		for vid, n := range commented {
+			touchedVideos[uint64(vid)] = true
+			err := tx.Model(&Video{}).Where("id = ?", vid).
+				Update("comment_count", gorm.Expr("GREATEST(comment_count, ?) - ?", n, n)).Error
+			if err != nil {
+				return err
+			}
+		}
+		if err := tx.Where("user_id = ?", id).Delete(&Comment{}).Error; err != nil {
+			return err
+		}
+
+		// the follow edges in both directions
+		var follows []Follow
+		if err := tx.Where("user_id = ? OR followed_id = ?", id, id).Find(&follows).Error; err != nil {
+			return err
+		}
+		for _, f := range follows {
+			userIds[uint64(f.UserId)] = true
+			userIds[uint64(f.FollowedId)] = true
+		}
+		if err := tx.Where("user_id = ? OR followed_id = ?", id, id).Delete(&Follow{}).Error; err != nil {
+			return err
+		}
+		if err := tx.Where("user_id = ? OR followed_id = ?", id, id).Delete(&FollowVersion{}).Error; err != nil {
+			return err
+		}
+
+		if len(orphanKeys) > 0 {
+			uploads := make([]PendingUpload, 0, len(orphanKeys))
+			now := time.Now()
+			for _, key := range orphanKeys {
+				uploads = append(uploads, PendingUpload{ObjectKey: key, CreatedAt: now})
+			}
+			if err := tx.Clauses(clause.OnConflict{DoNothing: true}).Create(&uploads).Error; err != nil {
+				return err
+			}
+		}
+
+		delete(userIds, id)
+		for uid := range userIds {
+			deleted.UserIds = append(deleted.UserIds, uid)
+		}
+		for vid := range touchedVideos {
+			deleted.VideoIds = append(deleted.VideoIds, vid)
+		}
+		deleted.CommentIds = commentIds
+		// the personal data is erased and the username freed
+		return tx.Model(&User{}).Where("id = ?", id).Updates(map[string]any{
+			"username":           DeletedUsername(id),
+			"password":           "",
+			"email":              "",
+			"nickname":           "",
+			"bio":                "",
+			"avatar_url":         "",
+			"background_img_url": "",
+			"video_count":        0,
+			"total_liked":        0,
+			"liked_video_count":  0,
+			"deleted_at":         time.Now(),
+		}).Error
+	})
+	return deleted, err
 }
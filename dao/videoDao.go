@@ -1,6 +1,10 @@
 package dao
 
-import "time"
+import (
+	"time"
+
+	"gorm.io/gorm"
+)
 
 type Video struct {
 	Id           uint64
@@ -13,22 +17,35 @@ type Video struct {
 	CommentCount uint64
 }
 
-func PersistVideo(video *Video) error {
-	return Db.Create(video).Error
+// VideoCounts holds the counters stored on a video
+// next to the ones counted from the likes and comments tables
+type VideoCounts struct {
+	VideoId      uint64
+	LikeCount    uint64
+	CommentCount uint64
+	Likes        uint64
+	Comments     uint64
+}
+
+type videoRepo struct {
+	db *gorm.DB
+}
+
+func (r *videoRepo) PersistVideo(video *Video) error {
+	return r.db.Create(video).Error
 }
 
-func GetVideoById(video_id uint64) (v Video, err error) {
-	err = Db.First(&v, map[string]any{
+func (r *videoRepo) GetVideoById(video_id uint64) (v Video, err error) {
+	err = r.db.First(&v, map[string]any{
 		"id": video_id,
 	}).Error
 	return
 }
 
-// get published videos by the specified author
-func GetVideosByAuthor(author_id uint64) ([]Video, error) {
+func (r *videoRepo) GetVideosByAuthor(author_id uint64) ([]Video, error) {
 	var videos []Video
 
-	err := Db.Find(
+	err := r.db.Find(
 		&videos,
 		map[string]any{
 			"author_id": author_id,
@@ -38,15 +55,28 @@ func GetVideosByAuthor(author_id uint64) ([]Video, error) {
 	return videos, err
 }
 
-func UpdateLikeCount(video_id, count uint64) error {
-	return Db.Model(&Video{}).Where("id = ?", video_id).Update("like_count", count).Error
+func (r *videoRepo) GetAllVideos() ([]Video, error) {
+	var videos []Video
+	err := r.db.Find(&videos).Error
+	return videos, err
+}
+
+func (r *videoRepo) ListVideoCounts(afterId uint64, limit int) ([]VideoCounts, error) {
+	counts := []VideoCounts{}
+	err := r.db.Model(&Video{}).
+		Select("id AS video_id, like_count, comment_count, "+
+			"(SELECT COUNT(*) FROM likes WHERE likes.video_id = videos.id) AS likes, "+
+			"(SELECT COUNT(*) FROM comments WHERE comments.video_id = videos.id) AS comments").
+		Where("id > ?", afterId).
+		Order("id").
+		Limit(limit).
+		Scan(&counts).Error
+	return counts, err
 }
 
-func GetVideosByIds(ids []uint64) []Video {
-	videos := make([]Video, 0, len(ids))
-	for _, vid := range ids {
-		video, _ := GetVideoById(vid)
-		videos = append(videos, video)
-	}
-	return videos
+func (r *videoRepo) RecountVideo(videoId uint64) error {
+	return r.db.Model(&Video{}).Where("id = ?", videoId).Updates(map[string]any{
+		"like_count":    gorm.Expr("(SELECT COUNT(*) FROM likes WHERE likes.video_id = videos.id)"),
+		"comment_count": gorm.Expr("(SELECT COUNT(*) FROM comments WHERE comments.video_id = videos.id)"),
+	}).Error
 }
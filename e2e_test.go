@@ -0,0 +1,742 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"tiktok/config"
+	"tiktok/controller"
+	"tiktok/dao/memory"
+	"tiktok/middleware/cache"
+	"tiktok/middleware/mail"
+	"tiktok/middleware/oss"
+	"tiktok/pkg"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/gin-gonic/gin"
+	"github.com/redis/go-redis/v9"
+)
+
+// testServer serves the routes of setRoutes backed by in-memory repos,
+// an in-process redis and the local storage in a temp dir
+type testServer struct {
+	t   *testing.T
+	eng *gin.Engine
+	// mailDir keeps the mails written by the file mailer
+	mailDir string
+}
+
+// withTestDeps replaces WithDB, WithCache, WithStorage and WithMail
+func (a *App) withTestDeps(t *testing.T) *App {
+	return a.register(component{
+		name: "test-deps",
+		start: func() (err error) {
+			mr := miniredis.RunT(t)
+			a.repos = memory.NewRepos()
+			a.rdb = redis.NewClient(&redis.Options{Addr: mr.Addr()})
+			a.caches = cache.NewCaches(a.rdb, nil)
+			if a.storage, err = oss.NewStorage(a.cfg.Storage); err != nil {
+				return err
+			}
+			a.mailer, err = mail.NewMailer(a.cfg.Mail)
+			return err
+		},
+		stop: func(context.Context) error { return a.rdb.Close() },
+	})
+}
+
+func newTestServer(t *testing.T) *testServer {
+	t.Helper()
+	cfg := config.Default()
+	cfg.JWT.Secret = "test"
+	cfg.Storage.Driver = "local"
+	cfg.Storage.Local.Dir = t.TempDir()
+	cfg.Mail.Dir = t.TempDir()
+
+	app := NewApp(&cfg).withTestDeps(t).WithAuth().WithServices().WithConsumers()
+	if err := app.Start(); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second*5)
+		defer cancel()
+		app.Stop(ctx)
+	})
+
+	gin.SetMode(gin.TestMode)
+	if err := initControllers(app); err != nil {
+		t.Fatal(err)
+	}
+	eng := gin.New()
+	setRoutes(eng, app)
+	return &testServer{t: t, eng: eng, mailDir: cfg.Mail.Dir}
+}
+
+// do sends the request and decodes the JSON response into out if not nil
+func (s *testServer) do(method, target, contentType string, body io.Reader, out any) *httptest.ResponseRecorder {
+	s.t.Helper()
+	req := httptest.NewRequest(method, target, body)
+	if contentType != "" {
+		req.Header.Set("Content-Type", contentType)
+	}
+	return s.send(req, out)
+}
+
+// doBearer sends a bodyless request authorized by the Authorization header
+func (s *testServer) doBearer(method, target, token string, out any) *httptest.ResponseRecorder {
+	s.t.Helper()
+	req := httptest.NewRequest(method, target, nil)
+	req.Header.Set("Authorization", "Bearer "+token)
+	return s.send(req, out)
+}
+
+func (s *testServer) send(req *http.Request, out any) *httptest.ResponseRecorder {
+	s.t.Helper()
+	method, target := req.Method, req.URL.String()
+	rec := httptest.NewRecorder()
+	s.eng.ServeHTTP(rec, req)
+	if out != nil {
+		if err := json.Unmarshal(rec.Body.Bytes(), out); err != nil {
+			s.t.Fatalf("%s %s: invalid response %q - %v", method, target, rec.Body.String(), err)
+		}
+	}
+	return rec
+}
+
+func (s *testServer) doJSON(method, target string, body, out any) *httptest.ResponseRecorder {
+	s.t.Helper()
+	data, err := json.Marshal(body)
+	if err != nil {
+		s.t.Fatal(err)
+	}
+	return s.do(method, target, "application/json", bytes.NewReader(data), out)
+}
+
+// expectCode sends a bodyless request and asserts the response code
+func (s *testServer) expectCode(method, target string, want int) {
+	s.t.Helper()
+	var resp pkg.Response
+	s.do(method, target, "", nil, &resp)
+	if resp.Code != want {
+		s.t.Fatalf("%s %s: expected code %d, got %+v", method, target, want, resp)
+	}
+}
+
+func assertOk(t *testing.T, resp pkg.Response) {
+	t.Helper()
+	if resp.Code != 200 {
+		t.Fatalf("expected ok, got %+v", resp)
+	}
+}
+
+func (s *testServer) register(username string) controller.AuthResp {
+	s.t.Helper()
+	var resp controller.AuthResp
+	s.doJSON(http.MethodPost, "/tiktok/users/register",
+		controller.AuthReq{Username: username, Password: "p@ssw0rd"}, &resp)
+	assertOk(s.t, resp.Response)
+	return resp
+}
+
+func (s *testServer) publish(token, title string) {
+	s.t.Helper()
+	body := &bytes.Buffer{}
+	w := multipart.NewWriter(body)
+	w.WriteField("token", token)
+	w.WriteField("title", title)
+	video, _ := w.CreateFormFile("video", "video.mp4")
+	video.Write([]byte("video of " + title))
+	thumbnail, _ := w.CreateFormFile("thumbnail", "cover.jpg")
+	thumbnail.Write([]byte("cover of " + title))
+	w.Close()
+
+	var resp pkg.Response
+	s.do(http.MethodPost, "/tiktok/videos", w.FormDataContentType(), body, &resp)
+	assertOk(s.t, resp)
+}
+
+func withToken(path, token string) string {
+	return path + "?token=" + url.QueryEscape(token)
+}
+
+func TestE2ERegisterAndLogin(t *testing.T) {
+	s := newTestServer(t)
+	registered := s.register("alice")
+	if registered.UserId == 0 || registered.Token == "" {
+		t.Fatalf("unexpected auth response: %+v", registered)
+	}
+
+	var resp controller.AuthResp
+	s.doJSON(http.MethodPost, "/tiktok/users/register",
+		controller.AuthReq{Username: "alice", Password: "an0ther-pass"}, &resp)
+	if resp.Code != int(pkg.ErrAccountExisted) {
+		t.Fatalf("expected account existed, got %+v", resp.Response)
+	}
+	s.doJSON(http.MethodPost, "/tiktok/users/register", controller.AuthReq{Username: "bob"}, &resp)
+	if resp.Code != int(pkg.ErrValidation) {
+		t.Fatalf("expected validation error, got %+v", resp.Response)
+	}
+
+	s.doJSON(http.MethodPost, "/tiktok/users/login",
+		controller.LoginReq{Username: "alice", Password: "wrong"}, &resp)
+	if resp.Code != int(pkg.ErrUnmatchedPwd) {
+		t.Fatalf("expected unmatched password, got %+v", resp.Response)
+	}
+	resp = controller.AuthResp{}
+	s.doJSON(http.MethodPost, "/tiktok/users/login",
+		controller.LoginReq{Username: "alice", Password: "p@ssw0rd"}, &resp)
+	assertOk(t, resp.Response)
+	if resp.UserId != registered.UserId || resp.Token == "" {
+		t.Fatalf("unexpected auth response: %+v", resp)
+	}
+
+	var me controller.UserInfoResp
+	s.do(http.MethodGet, withToken("/tiktok/users/me", resp.Token), "", nil, &me)
+	assertOk(t, me.Response)
+	if me.User.Id != registered.UserId || me.User.Username != "alice" {
+		t.Fatalf("unexpected user info: %+v", me.User)
+	}
+
+	s.expectCode(http.MethodGet, "/tiktok/users/me", int(pkg.ErrValidation))
+	s.expectCode(http.MethodGet, withToken("/tiktok/users/me", "invalid"), int(pkg.ErrUnmatchedPwd))
+}
+
+func TestE2ERegisterValidation(t *testing.T) {
+	s := newTestServer(t)
+	for _, c := range []struct {
+		req    controller.AuthReq
+		fields []string
+	}{
+		{controller.AuthReq{Username: "   ", Password: "p@ssw0rd"}, []string{"username"}},
+		{controller.AuthReq{Username: "al", Password: "p@ssw0rd"}, []string{"username"}},
+		{controller.AuthReq{Username: "Admin", Password: "p@ssw0rd"}, []string{"username"}},
+		{controller.AuthReq{Username: "alice", Password: "password"}, []string{"password"}},
+		{controller.AuthReq{Username: "alice123", Password: "alice123"}, []string{"password"}},
+		{controller.AuthReq{Username: "-alice", Password: "short1"}, []string{"username", "password"}},
+	} {
+		var resp pkg.Response
+		s.doJSON(http.MethodPost, "/tiktok/users/register", c.req, &resp)
+		if resp.Code != int(pkg.ErrValidation) || len(resp.Fields) != len(c.fields) {
+			t.Fatalf("%+v: expected invalid fields %v, got %+v", c.req, c.fields, resp)
+		}
+		for i, field := range c.fields {
+			if resp.Fields[i].Field != field || resp.Fields[i].Reason == "" {
+				t.Fatalf("%+v: expected invalid fields %v, got %+v", c.req, c.fields, resp.Fields)
+			}
+		}
+	}
+	s.register("alice.b-2")
+}
+
+func TestE2EPasswordReset(t *testing.T) {
+	s := newTestServer(t)
+	var registered controller.AuthResp
+	s.doJSON(http.MethodPost, "/tiktok/users/register",
+		controller.AuthReq{Username: "alice", Password: "p@ssw0rd", Email: "alice@example.com"}, &registered)
+	assertOk(t, registered.Response)
+
+	var resp pkg.Response
+	s.doJSON(http.MethodPost, "/tiktok/users/password/forgot", controller.ForgotPasswordReq{Username: "alice"}, &resp)
+	assertOk(t, resp)
+	mails, _ := filepath.Glob(filepath.Join(s.mailDir, "*.eml"))
+	if len(mails) != 1 {
+		t.Fatalf("expected a mail, got %v", mails)
+	}
+	data, err := os.ReadFile(mails[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, link, _ := strings.Cut(string(data), "?token=")
+	token, _, _ := strings.Cut(link, "\n")
+
+	time.Sleep(time.Second)
+	s.doJSON(http.MethodPost, "/tiktok/users/password/reset",
+		controller.ResetPasswordReq{Token: token, Password: "n3w-p@ss"}, &resp)
+	assertOk(t, resp)
+	s.expectCode(http.MethodGet, withToken("/tiktok/users/me", registered.Token), int(pkg.ErrAuthException))
+
+	var logged controller.AuthResp
+	s.doJSON(http.MethodPost, "/tiktok/users/login",
+		controller.LoginReq{Username: "alice", Password: "n3w-p@ss"}, &logged)
+	assertOk(t, logged.Response)
+
+	// the current session is replaced by a new one
+	time.Sleep(time.Second)
+	var changed controller.AuthResp
+	s.doJSON(http.MethodPut, withToken("/tiktok/users/me/password", logged.Token),
+		controller.ChangePasswordReq{OldPassword: "n3w-p@ss", NewPassword: "password"}, &changed)
+	if changed.Code != int(pkg.ErrValidation) || len(changed.Fields) != 1 || changed.Fields[0].Field != "new_password" {
+		t.Fatalf("expected a weak password rejected, got %+v", changed.Response)
+	}
+	s.doJSON(http.MethodPut, withToken("/tiktok/users/me/password", logged.Token),
+		controller.ChangePasswordReq{OldPassword: "n3w-p@ss", NewPassword: "an0ther-pass"}, &changed)
+	assertOk(t, changed.Response)
+	s.expectCode(http.MethodGet, withToken("/tiktok/users/me", logged.Token), int(pkg.ErrAuthException))
+	s.expectCode(http.MethodGet, withToken("/tiktok/users/me", changed.Token), 200)
+}
+
+func TestE2EProfile(t *testing.T) {
+	s := newTestServer(t)
+	alice := s.register("alice")
+
+	var me controller.UserInfoResp
+	nickname := "Alice"
+	s.doJSON(http.MethodPatch, withToken("/tiktok/users/me", alice.Token),
+		controller.UpdateProfileReq{Nickname: &nickname}, &me)
+	assertOk(t, me.Response)
+	if me.User.Nickname != "Alice" {
+		t.Fatalf("unexpected user info: %+v", me.User)
+	}
+
+	body := &bytes.Buffer{}
+	w := multipart.NewWriter(body)
+	image, _ := w.CreateFormFile("image", "avatar.jpg")
+	image.Write([]byte("\xFF\xD8\xFF\xE0avatar"))
+	w.Close()
+	s.do(http.MethodPut, withToken("/tiktok/users/me/avatar", alice.Token), w.FormDataContentType(), body, &me)
+	assertOk(t, me.Response)
+	if me.User.AvatarUrl == "" || me.User.Nickname != "Alice" {
+		t.Fatalf("unexpected user info: %+v", me.User)
+	}
+
+	s.do(http.MethodGet, withToken("/tiktok/users/me", alice.Token), "", nil, &me)
+	assertOk(t, me.Response)
+	if me.User.AvatarUrl == "" || me.User.Nickname != "Alice" {
+		t.Fatalf("profile isn't persisted: %+v", me.User)
+	}
+	s.expectCode(http.MethodPatch, withToken("/tiktok/users/me", alice.Token), int(pkg.ErrValidation))
+}
+
+func TestE2ERefreshAndLogout(t *testing.T) {
+	s := newTestServer(t)
+	registered := s.register("alice")
+	if registered.RefreshToken == "" {
+		t.Fatalf("expected a refresh token, got %+v", registered)
+	}
+
+	var refreshed controller.AuthResp
+	s.doJSON(http.MethodPost, "/tiktok/users/token/refresh",
+		controller.RefreshReq{RefreshToken: registered.RefreshToken}, &refreshed)
+	assertOk(t, refreshed.Response)
+	if refreshed.UserId != registered.UserId || refreshed.Token == "" || refreshed.RefreshToken == registered.RefreshToken {
+		t.Fatalf("unexpected refresh response: %+v", refreshed)
+	}
+	s.expectCode(http.MethodGet, withToken("/tiktok/users/me", refreshed.Token), 200)
+
+	var resp pkg.Response
+	s.do(http.MethodPost, withToken("/tiktok/users/logout", refreshed.Token), "", nil, &resp)
+	assertOk(t, resp)
+
+	// every token of the session is revoked
+	s.expectCode(http.MethodGet, withToken("/tiktok/users/me", refreshed.Token), int(pkg.ErrAuthException))
+	s.expectCode(http.MethodGet, withToken("/tiktok/users/me", registered.Token), int(pkg.ErrAuthException))
+	s.doJSON(http.MethodPost, "/tiktok/users/token/refresh",
+		controller.RefreshReq{RefreshToken: refreshed.RefreshToken}, &resp)
+	if resp.Code != int(pkg.ErrAuthException) {
+		t.Fatalf("expected refresh after logout to fail, got %+v", resp)
+	}
+}
+
+func TestE2EPublishAndFeed(t *testing.T) {
+	s := newTestServer(t)
+	alice := s.register("alice")
+	s.expectCode(http.MethodPost, "/tiktok/videos", int(pkg.ErrValidation))
+
+	const total = 7
+	for i := 0; i < total; i++ {
+		s.publish(alice.Token, fmt.Sprintf("video-%d", i))
+		// keeps publish times apart as the feed pages by millisecond
+		time.Sleep(time.Millisecond * 2)
+	}
+
+	var pub controller.VideosResp
+	s.do(http.MethodGet, fmt.Sprintf("/tiktok/users/%d/videos", alice.UserId), "", nil, &pub)
+	assertOk(t, pub.Response)
+	if len(pub.Videos) != total || pub.Videos[0].Title != fmt.Sprintf("video-%d", total-1) {
+		t.Fatalf("unexpected published videos: %+v", pub.Videos)
+	}
+
+	// the objects are served by the local storage
+	playURL, err := url.Parse(pub.Videos[0].PlayUrl)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rec := s.do(http.MethodGet, playURL.Path, "", nil, nil)
+	if rec.Code != http.StatusOK || rec.Body.String() != fmt.Sprintf("video of video-%d", total-1) {
+		t.Fatalf("unexpected object: %d %q", rec.Code, rec.Body.String())
+	}
+
+	// pages through the feed, each page starts after the last one
+	var titles []string
+	latest := ""
+	for page := 0; page < 3; page++ {
+		target := withToken("/tiktok/videos/feed", alice.Token)
+		if latest != "" {
+			target += "&latest_time=" + latest
+		}
+		var feed controller.VideosResp
+		s.do(http.MethodGet, target, "", nil, &feed)
+		assertOk(t, feed.Response)
+		if len(feed.Videos) > 5 {
+			t.Fatalf("page is too large: %d", len(feed.Videos))
+		}
+		if len(feed.Videos) == 0 {
+			break
+		}
+		for _, v := range feed.Videos {
+			if v.Author.Id != alice.UserId {
+				t.Fatalf("unexpected author: %+v", v.Author)
+			}
+			titles = append(titles, v.Title)
+		}
+		latest = feed.Videos[len(feed.Videos)-1].PublishAt
+	}
+	if len(titles) != total {
+		t.Fatalf("expected %d videos in feed, got %v", total, titles)
+	}
+	for i, title := range titles {
+		if title != fmt.Sprintf("video-%d", i) {
+			t.Fatalf("unexpected feed order: %v", titles)
+		}
+	}
+
+	s.expectCode(http.MethodGet, "/tiktok/videos/feed?latest_time=abc", int(pkg.ErrValidation))
+	s.expectCode(http.MethodGet, "/tiktok/videos/feed?token=invalid", int(pkg.ErrAuthException))
+}
+
+func TestE2ELike(t *testing.T) {
+	s := newTestServer(t)
+	alice := s.register("alice")
+	bob := s.register("bob")
+	s.publish(alice.Token, "hello")
+
+	var pub controller.VideosResp
+	s.do(http.MethodGet, fmt.Sprintf("/tiktok/users/%d/videos", alice.UserId), "", nil, &pub)
+	assertOk(t, pub.Response)
+	videoId := pub.Videos[0].Id
+	likePath := fmt.Sprintf("/tiktok/videos/%d/like", videoId)
+	// the counters of cached users are updated along with the like
+	counts := func(uid uint64) [3]uint64 {
+		t.Helper()
+		var resp controller.UserInfoResp
+		s.do(http.MethodGet, fmt.Sprintf("/tiktok/users/%d", uid), "", nil, &resp)
+		assertOk(t, resp.Response)
+		return [3]uint64{resp.User.VideoCnt, resp.User.TotalLiked, resp.User.LikedVideoCnt}
+	}
+	if c := counts(alice.UserId); c != [3]uint64{1, 0, 0} {
+		t.Fatalf("unexpected counters of alice: %v", c)
+	}
+	if c := counts(bob.UserId); c != [3]uint64{0, 0, 0} {
+		t.Fatalf("unexpected counters of bob: %v", c)
+	}
+
+	s.expectCode(http.MethodPost, likePath, int(pkg.ErrValidation))
+	s.expectCode(http.MethodPost, withToken(likePath, bob.Token), 200)
+	// liking twice is rejected
+	s.expectCode(http.MethodPost, withToken(likePath, bob.Token), int(pkg.ErrValidation))
+	if c := counts(alice.UserId); c != [3]uint64{1, 1, 0} {
+		t.Fatalf("unexpected counters of alice: %v", c)
+	}
+	if c := counts(bob.UserId); c != [3]uint64{0, 0, 1} {
+		t.Fatalf("unexpected counters of bob: %v", c)
+	}
+
+	var liked controller.VideosResp
+	s.do(http.MethodGet, fmt.Sprintf("/tiktok/users/%d/likes", bob.UserId), "", nil, &liked)
+	assertOk(t, liked.Response)
+	if len(liked.Videos) != 1 || liked.Videos[0].Id != videoId || liked.Videos[0].LikeCnt != 1 {
+		t.Fatalf("unexpected liked videos: %+v", liked.Videos)
+	}
+
+	var feed controller.VideosResp
+	s.do(http.MethodGet, withToken("/tiktok/videos/feed", bob.Token), "", nil, &feed)
+	assertOk(t, feed.Response)
+	if len(feed.Videos) != 1 || !feed.Videos[0].IsLike {
+		t.Fatalf("expected the video to be liked in feed: %+v", feed.Videos)
+	}
+
+	s.expectCode(http.MethodDelete, withToken(likePath, bob.Token), 200)
+	s.expectCode(http.MethodDelete, withToken(likePath, bob.Token), int(pkg.ErrValidation))
+	s.do(http.MethodGet, fmt.Sprintf("/tiktok/users/%d/likes", bob.UserId), "", nil, &liked)
+	assertOk(t, liked.Response)
+	if len(liked.Videos) != 0 {
+		t.Fatalf("expected no liked videos: %+v", liked.Videos)
+	}
+	if c := counts(alice.UserId); c != [3]uint64{1, 0, 0} {
+		t.Fatalf("unexpected counters of alice: %v", c)
+	}
+}
+
+func TestE2EOptionalAuth(t *testing.T) {
+	s := newTestServer(t)
+	alice := s.register("alice")
+	bob := s.register("bob")
+	s.publish(alice.Token, "hello")
+	var pub controller.VideosResp
+	s.do(http.MethodGet, fmt.Sprintf("/tiktok/users/%d/videos", alice.UserId), "", nil, &pub)
+	assertOk(t, pub.Response)
+	videoId := pub.Videos[0].Id
+
+	var resp pkg.Response
+	s.doBearer(http.MethodPost, fmt.Sprintf("/tiktok/videos/%d/like", videoId), bob.Token, &resp)
+	assertOk(t, resp)
+
+	// the public lists know the viewer from the Authorization header
+	for _, target := range []string{
+		"/tiktok/videos/feed",
+		fmt.Sprintf("/tiktok/users/%d/videos", alice.UserId),
+		fmt.Sprintf("/tiktok/users/%d/likes", bob.UserId),
+	} {
+		var videos controller.VideosResp
+		s.doBearer(http.MethodGet, target, bob.Token, &videos)
+		assertOk(t, videos.Response)
+		if len(videos.Videos) != 1 || !videos.Videos[0].IsLike {
+			t.Fatalf("%s: expected the video to be liked: %+v", target, videos.Videos)
+		}
+
+		s.do(http.MethodGet, target, "", nil, &videos)
+		assertOk(t, videos.Response)
+		if len(videos.Videos) != 1 || videos.Videos[0].IsLike {
+			t.Fatalf("%s: expected a tourist not to like the video: %+v", target, videos.Videos)
+		}
+
+		s.doBearer(http.MethodGet, target, "invalid", &resp)
+		if resp.Code != int(pkg.ErrAuthException) {
+			t.Fatalf("%s: expected an invalid token rejected, got %+v", target, resp)
+		}
+	}
+}
+
+func TestE2EComment(t *testing.T) {
+	s := newTestServer(t)
+	alice := s.register("alice")
+	bob := s.register("bob")
+	s.publish(alice.Token, "hello")
+
+	var pub controller.VideosResp
+	s.do(http.MethodGet, fmt.Sprintf("/tiktok/users/%d/videos", alice.UserId), "", nil, &pub)
+	assertOk(t, pub.Response)
+	videoId := pub.Videos[0].Id
+	commentsPath := fmt.Sprintf("/tiktok/videos/%d/comments", videoId)
+
+	var made controller.MakeCOmmentResp
+	s.doJSON(http.MethodPost, withToken(fmt.Sprintf("/tiktok/videos/%d/comment/0", videoId), bob.Token),
+		controller.MakeCommentReq{Content: "nice"}, &made)
+	assertOk(t, made.Response)
+	if made.Comment.Content != "nice" || made.Comment.Commenter.Id != bob.UserId {
+		t.Fatalf("unexpected comment: %+v", made.Comment)
+	}
+	var reply controller.MakeCOmmentResp
+	s.doJSON(http.MethodPost,
+		withToken(fmt.Sprintf("/tiktok/videos/%d/comment/%d", videoId, made.Comment.Id), alice.Token),
+		controller.MakeCommentReq{Content: "thanks"}, &reply)
+	assertOk(t, reply.Response)
+	if reply.Comment.ParentId != made.Comment.Id {
+		t.Fatalf("unexpected reply: %+v", reply.Comment)
+	}
+	s.expectCode(http.MethodPost, fmt.Sprintf("/tiktok/videos/%d/comment/0", videoId), int(pkg.ErrValidation))
+
+	var comments controller.CommentResp
+	s.do(http.MethodGet, commentsPath, "", nil, &comments)
+	assertOk(t, comments.Response)
+	if len(comments.Comments) != 2 {
+		t.Fatalf("expected 2 comments, got %+v", comments.Comments)
+	}
+
+	var videos controller.VideosResp
+	s.do(http.MethodGet, fmt.Sprintf("/tiktok/users/%d/videos", alice.UserId), "", nil, &videos)
+	assertOk(t, videos.Response)
+	if videos.Videos[0].CommentCnt != 2 {
+		t.Fatalf("expected 2 comments counted, got %d", videos.Videos[0].CommentCnt)
+	}
+
+	deletePath := fmt.Sprintf("/tiktok/videos/%d/comment/%d", videoId, reply.Comment.Id)
+	s.expectCode(http.MethodDelete, deletePath, int(pkg.ErrValidation))
+	s.expectCode(http.MethodDelete, withToken(deletePath, alice.Token), 200)
+
+	s.do(http.MethodGet, withToken(commentsPath, bob.Token), "", nil, &comments)
+	assertOk(t, comments.Response)
+	if len(comments.Comments) != 1 || comments.Comments[0].Id != made.Comment.Id {
+		t.Fatalf("unexpected comments after deletion: %+v", comments.Comments)
+	}
+	s.expectCode(http.MethodGet, commentsPath+"?token=invalid", int(pkg.ErrAuthException))
+}
+
+func TestE2EFollow(t *testing.T) {
+	s := newTestServer(t)
+	alice := s.register("alice")
+	bob := s.register("bob")
+	carol := s.register("carol")
+
+	listIds := func(target string, token string) []uint64 {
+		t.Helper()
+		var resp controller.UserInfoListResp
+		s.do(http.MethodGet, withToken(target, token), "", nil, &resp)
+		assertOk(t, resp.Response)
+		ids := make([]uint64, 0, len(resp.Users))
+		for _, u := range resp.Users {
+			ids = append(ids, u.Id)
+		}
+		return ids
+	}
+
+	// the follows are persisted asynchronously, listing first caches the sets
+	// so that the follows below are read back from the cache
+	if ids := listIds(fmt.Sprintf("/tiktok/users/%d/follower", alice.UserId), bob.Token); len(ids) != 0 {
+		t.Fatalf("expected no followers, got %v", ids)
+	}
+	if ids := listIds(fmt.Sprintf("/tiktok/users/%d/followed", carol.UserId), carol.Token); len(ids) != 0 {
+		t.Fatalf("expected no followed, got %v", ids)
+	}
+
+	followPath := func(uid uint64) string { return "/tiktok/users/" + strconv.FormatUint(uid, 10) + "/follow" }
+	s.expectCode(http.MethodPost, followPath(alice.UserId), int(pkg.ErrValidation))
+	s.expectCode(http.MethodPost, withToken(followPath(alice.UserId), bob.Token), 200)
+	s.expectCode(http.MethodPost, withToken(followPath(alice.UserId), carol.Token), 200)
+	s.expectCode(http.MethodPost, withToken(followPath(bob.UserId), carol.Token), 200)
+	s.expectCode(http.MethodPost, withToken("/tiktok/users/abc/follow", bob.Token), int(pkg.ErrValidation))
+	s.expectCode(http.MethodPost, withToken(followPath(404404), bob.Token), int(pkg.ErrUserNotFound))
+
+	followers := listIds(fmt.Sprintf("/tiktok/users/%d/follower", alice.UserId), bob.Token)
+	if len(followers) != 2 {
+		t.Fatalf("expected 2 followers of alice, got %v", followers)
+	}
+	followed := listIds(fmt.Sprintf("/tiktok/users/%d/followed", carol.UserId), carol.Token)
+	if len(followed) != 2 {
+		t.Fatalf("expected carol to follow 2 users, got %v", followed)
+	}
+
+	var me controller.UserInfoResp
+	s.do(http.MethodGet, withToken("/tiktok/users/me", alice.Token), "", nil, &me)
+	assertOk(t, me.Response)
+	if me.User.FollowerCnt != 2 || me.User.FollowedCnt != 0 {
+		t.Fatalf("unexpected counts of alice: %+v", me.User)
+	}
+
+	s.expectCode(http.MethodDelete, withToken(followPath(alice.UserId), carol.Token), 200)
+	followed = listIds(fmt.Sprintf("/tiktok/users/%d/followed", carol.UserId), carol.Token)
+	if len(followed) != 1 || followed[0] != bob.UserId {
+		t.Fatalf("expected carol to follow bob only, got %v", followed)
+	}
+	followers = listIds(fmt.Sprintf("/tiktok/users/%d/follower", alice.UserId), carol.Token)
+	if len(followers) != 1 || followers[0] != bob.UserId {
+		t.Fatalf("expected bob to be the only follower of alice, got %v", followers)
+	}
+}
+
+func TestE2ELookupUsers(t *testing.T) {
+	s := newTestServer(t)
+	alice := s.register("alice")
+	bob := s.register("bob")
+	s.expectCode(http.MethodPost, withToken(fmt.Sprintf("/tiktok/users/%d/follow", alice.UserId), bob.Token), 200)
+
+	var user controller.UserInfoResp
+	s.do(http.MethodGet, fmt.Sprintf("/tiktok/users/%d", alice.UserId), "", nil, &user)
+	assertOk(t, user.Response)
+	if user.User.Id != alice.UserId || user.User.Username != "alice" || user.User.IsFollowed {
+		t.Fatalf("unexpected user info for a tourist: %+v", user.User)
+	}
+	s.doBearer(http.MethodGet, fmt.Sprintf("/tiktok/users/%d", alice.UserId), bob.Token, &user)
+	assertOk(t, user.Response)
+	if !user.User.IsFollowed || user.User.FollowerCnt != 1 {
+		t.Fatalf("expected alice to be followed by bob: %+v", user.User)
+	}
+	s.expectCode(http.MethodGet, "/tiktok/users/404404", int(pkg.ErrUserNotFound))
+	s.expectCode(http.MethodGet, "/tiktok/users/abc", int(pkg.ErrValidation))
+
+	var users controller.UserInfoListResp
+	target := fmt.Sprintf("/tiktok/users?ids=%d,404404,%d,%d", bob.UserId, alice.UserId, bob.UserId)
+	s.doBearer(http.MethodGet, target, bob.Token, &users)
+	assertOk(t, users.Response)
+	if len(users.Users) != 2 || users.Users[0].Id != bob.UserId || users.Users[1].Id != alice.UserId ||
+		!users.Users[1].IsFollowed {
+		t.Fatalf("unexpected users: %+v", users.Users)
+	}
+	s.expectCode(http.MethodGet, "/tiktok/users", int(pkg.ErrValidation))
+	s.expectCode(http.MethodGet, "/tiktok/users?ids=1,x", int(pkg.ErrValidation))
+}
+
+func TestE2EDeleteAccount(t *testing.T) {
+	s := newTestServer(t)
+	alice := s.register("alice")
+	bob := s.register("bob")
+	s.publish(alice.Token, "hello")
+	s.expectCode(http.MethodPost, withToken(fmt.Sprintf("/tiktok/users/%d/follow", alice.UserId), bob.Token), 200)
+	// the revocation is precise to the second
+	time.Sleep(time.Second)
+
+	var resp pkg.Response
+	s.doJSON(http.MethodDelete, withToken("/tiktok/users/me", alice.Token),
+		controller.DeleteAccountReq{Password: "wrong"}, &resp)
+	if resp.Code != int(pkg.ErrUnmatchedPwd) {
+		t.Fatalf("expected the wrong password to be rejected, got %+v", resp)
+	}
+	s.doJSON(http.MethodDelete, withToken("/tiktok/users/me", alice.Token),
+		controller.DeleteAccountReq{Password: "p@ssw0rd"}, &resp)
+	assertOk(t, resp)
+
+	s.expectCode(http.MethodGet, withToken("/tiktok/users/me", alice.Token), int(pkg.ErrAuthException))
+	s.expectCode(http.MethodGet, fmt.Sprintf("/tiktok/users/%d", alice.UserId), int(pkg.ErrUserNotFound))
+	var feed controller.VideosResp
+	s.do(http.MethodGet, "/tiktok/videos/feed", "", nil, &feed)
+	assertOk(t, feed.Response)
+	if len(feed.Videos) != 0 {
+		t.Fatalf("expected the videos of alice to be gone: %+v", feed.Videos)
+	}
+	var followed controller.UserInfoListResp
+	s.do(http.MethodGet, withToken(fmt.Sprintf("/tiktok/users/%d/followed", bob.UserId), bob.Token), "", nil, &followed)
+	assertOk(t, followed.Response)
+	if len(followed.Users) != 0 {
+		t.Fatalf("expected bob to follow nobody: %+v", followed.Users)
+	}
+	s.expectCode(http.MethodPost, withToken(fmt.Sprintf("/tiktok/users/%d/follow", alice.UserId), bob.Token),
+		int(pkg.ErrUserNotFound))
+
+	// the username is free again
+	if again := s.register("alice"); again.UserId == alice.UserId {
+		t.Fatalf("expected a new account, got %+v", again)
+	}
+}
+
+func TestE2ERequestExport(t *testing.T) {
+	s := newTestServer(t)
+	var alice controller.AuthResp
+	s.doJSON(http.MethodPost, "/tiktok/users/register",
+		controller.AuthReq{Username: "alice", Password: "p@ssw0rd", Email: "alice@example.com"}, &alice)
+	assertOk(t, alice.Response)
+	bob := s.register("bob")
+
+	s.expectCode(http.MethodPost, withToken("/tiktok/users/me/export", alice.Token), 200)
+	// the link can't be mailed to bob
+	s.expectCode(http.MethodPost, withToken("/tiktok/users/me/export", bob.Token), int(pkg.ErrValidation))
+}
+
+func TestE2EDeleteAccountNotBlockedByUsername(t *testing.T) {
+	s := newTestServer(t)
+	alice := s.register("alice")
+	// takes what looked like the name of alice once deleted
+	s.register(fmt.Sprintf("deleted-%d", alice.UserId))
+
+	var resp pkg.Response
+	s.doJSON(http.MethodDelete, withToken("/tiktok/users/me", alice.Token),
+		controller.DeleteAccountReq{Password: "p@ssw0rd"}, &resp)
+	assertOk(t, resp)
+
+	s.doJSON(http.MethodPost, "/tiktok/users/register",
+		controller.AuthReq{Username: fmt.Sprintf("#deleted-%d", alice.UserId), Password: "p@ssw0rd"}, &resp)
+	if resp.Code != int(pkg.ErrValidation) {
+		t.Fatalf("expected the placeholder to be refused, got %+v", resp)
+	}
+}
@@ -1,17 +1,73 @@
 package main
 
 import (
+	"context"
+	"flag"
 	"log"
+	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
+	"tiktok/config"
 
 	"github.com/gin-gonic/gin"
 )
 
 func main() {
 	log.SetFlags(log.Lshortfile | log.LstdFlags)
-	initControllers()
+	cfgPath := flag.String("config", os.Getenv("TIKTOK_CONFIG"), "path to the YAML config file")
+	flag.Parse()
 
-	gin.SetMode(gin.ReleaseMode)
-	eng := gin.Default()
-	setRoutes(eng)
-	eng.Run(":8080")
+	cfg, err := config.Load(*cfgPath)
+	if err != nil {
+		log.Fatalln("failed to load config, detail:", err)
+	}
+
+	switch cmd := flag.Arg(0); cmd {
+	case "", "serve":
+		serve(cfg)
+	case "migrate":
+		if err := runMigrate(NewApp(cfg), flag.Args()[1:]); err != nil {
+			log.Fatalln(err)
+		}
+	case "reconcile":
+		if err := runReconcile(NewApp(cfg), flag.Args()[1:]); err != nil {
+			log.Fatalln(err)
+		}
+	case "unlock":
+		if err := runUnlock(NewApp(cfg), flag.Args()[1:]); err != nil {
+			log.Fatalln(err)
+		}
+	default:
+		log.Fatalf("unknown command %q, expected serve, migrate, reconcile or unlock\n", cmd)
+	}
+}
+
+func serve(cfg *config.Config) {
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	app := NewApp(cfg).WithAll()
+	app.WithHTTPServer(func() http.Handler {
+		if err := initControllers(app); err != nil {
+			log.Fatalln("failed to init controllers, detail:", err)
+		}
+		gin.SetMode(gin.ReleaseMode)
+		eng := gin.Default()
+		// validated by config
+		_ = eng.SetTrustedProxies(cfg.Server.TrustedProxies)
+		setRoutes(eng, app)
+		return eng
+	})
+	if err := app.Start(); err != nil {
+		log.Fatalln(err)
+	}
+
+	if err := app.Wait(ctx); err != nil {
+		log.Println(err)
+	}
+	log.Println("shutting down")
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), cfg.Server.ShutdownTimeout)
+	defer cancel()
+	app.Stop(shutdownCtx)
 }
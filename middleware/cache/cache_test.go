@@ -0,0 +1,188 @@
+package cache
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"tiktok/dao"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/redis/go-redis/v9"
+)
+
+func newTestCaches(t *testing.T) (Caches, *miniredis.Miniredis) {
+	t.Helper()
+	mr := miniredis.RunT(t)
+	rdb := redis.NewClient(&redis.Options{Addr: mr.Addr()})
+	t.Cleanup(func() { rdb.Close() })
+	return NewCaches(rdb, nil), mr
+}
+
+func TestUserModel(t *testing.T) {
+	caches, mr := newTestCaches(t)
+	if _, err := caches.Users.GetUserModel(1); !errors.Is(err, ErrMiss) {
+		t.Fatalf("expected miss, got %v", err)
+	}
+
+	if err := caches.Users.SetUserModel(dao.User{Id: 1, Username: "alice"}); err != nil {
+		t.Fatal(err)
+	}
+	u, err := caches.Users.GetUserModel(1)
+	if err != nil || u.Username != "alice" {
+		t.Fatalf("unexpected user: %+v, %v", u, err)
+	}
+
+	if err := caches.Users.SetUserNull(2); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := caches.Users.GetUserModel(2); !errors.Is(err, ErrNullValue) {
+		t.Fatalf("expected null value, got %v", err)
+	}
+	mr.FastForward(NullValTimeout + time.Second)
+	if _, err := caches.Users.GetUserModel(2); !errors.Is(err, ErrMiss) {
+		t.Fatalf("expected null value to expire, got %v", err)
+	}
+}
+
+func TestApplyLike(t *testing.T) {
+	caches, _ := newTestCaches(t)
+
+	if _, err := caches.Likes.ApplyLike(1, 2, true); !errors.Is(err, ErrMiss) {
+		t.Fatalf("expected miss, got %v", err)
+	}
+	if err := caches.Likes.LoadUserLikedVideos(1, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	changed, err := caches.Likes.ApplyLike(1, 2, true)
+	if err != nil || !changed {
+		t.Fatalf("expected like to be applied, got %t, %v", changed, err)
+	}
+	changed, err = caches.Likes.ApplyLike(1, 2, true)
+	if err != nil || changed {
+		t.Fatalf("expected duplicated like to be ignored, got %t, %v", changed, err)
+	}
+
+	// consumed after being queued, the stream keeps it meanwhile
+	actions := make(chan LikeAction, 1)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go caches.Likes.ConsumeLikeActions(ctx, func(a LikeAction) error {
+		actions <- a
+		return nil
+	})
+	select {
+	case a := <-actions:
+		if a.EventId == "" || a.UserId != 1 || a.VideoId != 2 || !a.Liked {
+			t.Fatalf("unexpected action: %+v", a)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("like action isn't delivered")
+	}
+
+	ids, err := caches.Likes.GetUserLikedVideoIds(1)
+	if err != nil || len(ids) != 1 || ids[0] != 2 {
+		t.Fatalf("unexpected liked videos: %v, %v", ids, err)
+	}
+}
+
+func TestLikeSeq(t *testing.T) {
+	caches, mr := newTestCaches(t)
+	if err := caches.Likes.LoadUserLikedVideos(1, nil); err != nil {
+		t.Fatal(err)
+	}
+	var seqs []uint64
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	actions := make(chan LikeAction, 3)
+	go caches.Likes.ConsumeLikeActions(ctx, func(a LikeAction) error {
+		actions <- a
+		return nil
+	})
+
+	start := uint64(time.Now().UnixMicro())
+	for i, liked := range []bool{true, false, true} {
+		if i == 2 {
+			// a lost counter doesn't go back before the current time
+			mr.Del(getLikeSeqKey())
+		}
+		if _, err := caches.Likes.ApplyLike(1, 2, liked); err != nil {
+			t.Fatal(err)
+		}
+		select {
+		case a := <-actions:
+			seqs = append(seqs, a.Seq)
+		case <-time.After(time.Second):
+			t.Fatal("like action isn't delivered")
+		}
+	}
+	if seqs[0] < start || seqs[1] <= seqs[0] || seqs[2] <= seqs[1] {
+		t.Fatalf("expected increasing sequence numbers from %d, got %v", start, seqs)
+	}
+}
+
+func TestFollow(t *testing.T) {
+	caches, _ := newTestCaches(t)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	actions := make(chan FollowAction)
+	go caches.Relations.ConsumeFollowActions(ctx, func(a FollowAction) error {
+		actions <- a
+		return nil
+	})
+
+	if err := caches.Relations.LoadFollowedSet(1, nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := caches.Relations.Follow(2, 1); err != nil {
+		t.Fatal(err)
+	}
+	followAction := <-actions
+	if a := followAction; a.EventId == "" || a.TargetId != 2 || a.UserId != 1 || !a.Followed || a.Seq == 0 {
+		t.Fatalf("unexpected action: %+v", a)
+	}
+
+	cnt, err := caches.Relations.FollowedCount(1)
+	if err != nil || cnt != 1 {
+		t.Fatalf("expected 1 followed, got %d, %v", cnt, err)
+	}
+	// follower set of 2 isn't loaded, it must not be created partially
+	if _, err := caches.Relations.FollowerCount(2); !errors.Is(err, ErrMiss) {
+		t.Fatalf("expected miss, got %v", err)
+	}
+
+	if err := caches.Relations.Unfollow(2, 1); err != nil {
+		t.Fatal(err)
+	}
+	if a := <-actions; a.Followed || a.Seq <= followAction.Seq {
+		t.Fatalf("unexpected action: %+v", a)
+	}
+	followed, err := caches.Relations.IsFollowed(2, 1)
+	if err != nil || followed {
+		t.Fatalf("expected unfollowed, got %t, %v", followed, err)
+	}
+}
+
+func TestFeedAfter(t *testing.T) {
+	caches, _ := newTestCaches(t)
+	base := time.UnixMilli(1000)
+	for i := uint64(1); i <= 3; i++ {
+		v := dao.Video{Id: i, PublishAt: base.Add(time.Duration(i) * time.Second)}
+		if err := caches.Videos.SetVideoModel(v); err != nil {
+			t.Fatal(err)
+		}
+		if err := caches.Videos.AddToFeed(v); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	ids, err := caches.Videos.FeedAfter(base.Add(time.Second).UnixMilli(), 5)
+	if err != nil || len(ids) != 2 || ids[0] != 2 || ids[1] != 3 {
+		t.Fatalf("unexpected feed: %v, %v", ids, err)
+	}
+	v, err := caches.Videos.GetVideoModel(3)
+	if err != nil || v.Id != 3 || !v.PublishAt.Equal(base.Add(3*time.Second)) {
+		t.Fatalf("unexpected video: %+v, %v", v, err)
+	}
+}
@@ -0,0 +1,181 @@
+package cache
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"tiktok/dao"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// CommentCache keeps the comment models and the comment id sets of videos
+type CommentCache struct {
+	rdb    *redis.Client
+	events eventQueue
+}
+
+func NewCommentCache(rdb *redis.Client, broker Broker) *CommentCache {
+	return &CommentCache{
+		rdb:    rdb,
+		events: eventQueue{rdb: rdb, name: getCommentMqKey(), broker: broker},
+	}
+}
+
+// CommentDeletion is the message published on every comment deletion
+type CommentDeletion struct {
+	EventId   string
+	VideoId   int64
+	CommentId int64
+}
+
+func (c *CommentCache) GetCommentModel(cid int64) (dao.Comment, error) {
+	result := dao.Comment{}
+	cmd := c.rdb.HGetAll(Ctx, fmtVideoCommentModelKey(cid))
+	values, err := cmd.Result()
+	if err != nil {
+		return result, err
+	}
+	if len(values) == 0 {
+		return result, ErrMiss
+	}
+	if _, ok := values["null_value"]; ok {
+		return result, ErrNullValue
+	}
+	err = cmd.Scan(&result)
+	return result, err
+}
+
+func (c *CommentCache) SetCommentModel(model dao.Comment) error {
+	key := fmtVideoCommentModelKey(model.Id)
+	pipe := c.rdb.TxPipeline()
+	pipe.HSet(Ctx, key, model)
+	pipe.Expire(Ctx, key, expireJitter(time.Minute*5))
+	_, err := pipe.Exec(Ctx)
+	return err
+}
+
+// SetCommentNull caches the comment as nonexistent to protect the DB from penetration
+func (c *CommentCache) SetCommentNull(cid int64) error {
+	key := fmtVideoCommentModelKey(cid)
+	pipe := c.rdb.Pipeline()
+	pipe.HSet(Ctx, key, "null_value", "placeholder")
+	pipe.Expire(Ctx, key, NullValTimeout)
+	_, err := pipe.Exec(Ctx)
+	return err
+}
+
+func (c *CommentCache) LockVideoComments(vid int64) (func(), error) {
+	return tryLock(c.rdb, fmtVideoCommentSetKey(vid), 10*time.Minute)
+}
+
+func (c *CommentCache) LoadVideoComments(vid int64, comments []dao.Comment) error {
+	key := fmtVideoCommentSetKey(vid)
+	pipe := c.rdb.TxPipeline()
+	for _, comment := range comments {
+		pipe.ZAdd(Ctx, key, redis.Z{
+			Score:  float64(comment.CreateAt),
+			Member: comment.Id,
+		})
+	}
+	// placeholder
+	pipe.ZAdd(Ctx, key, redis.Z{})
+	pipe.Expire(Ctx, key, 10*time.Minute)
+	_, err := pipe.Exec(Ctx)
+	return err
+}
+
+// GetVideoCommentIds returns the ids of comments on the video, the latest first
+func (c *CommentCache) GetVideoCommentIds(vid int64) ([]int64, error) {
+	key := fmtVideoCommentSetKey(vid)
+	if n, err := c.rdb.Exists(Ctx, key).Result(); err != nil {
+		return nil, err
+	} else if n == 0 {
+		return nil, ErrMiss
+	}
+	idStr, err := c.rdb.ZRevRange(Ctx, key, 0, -1).Result()
+	if err != nil {
+		return nil, err
+	}
+	return parseIds[int64](idStr), nil
+}
+
+var addCommentScript = redis.NewScript(`
+	local comment_set_key = KEYS[1]
+	local video_model_key = KEYS[2]
+
+	local comment_id = ARGV[1]
+	local timestamp = ARGV[2]
+
+	if redis.call("EXISTS", comment_set_key) == 0 then
+		return redis.error_reply("not exist")
+	end
+	redis.call("ZADD", comment_set_key, timestamp, comment_id)
+	redis.call("HINCRBY", video_model_key, 'comment_count', 1)
+	return 0
+`)
+
+// AddComment caches a just persisted comment and increments the comment count,
+// ErrMiss is returned if the comment set of the video isn't cached
+func (c *CommentCache) AddComment(model dao.Comment) error {
+	err := addCommentScript.Run(Ctx, c.rdb,
+		[]string{fmtVideoCommentSetKey(model.VideoId), fmtVideoModelKey(uint64(model.VideoId))},
+		model.Id, model.CreateAt,
+	).Err()
+	if err != nil && strings.Contains(err.Error(), "not exist") {
+		return ErrMiss
+	}
+	return err
+}
+
+// DeleteComment evicts the comment and publishes the deletion
+func (c *CommentCache) DeleteComment(videoId, commentId int64) error {
+	msg := withEventId(fmt.Sprintf("%d:%d", videoId, commentId))
+	setKey := fmtVideoCommentSetKey(videoId)
+	pipe := c.rdb.TxPipeline()
+	pipe.ZRem(Ctx, setKey, commentId)
+	pipe.Del(Ctx, fmtVideoCommentModelKey(commentId))
+	if c.events.viaStream() {
+		pipe.XAdd(Ctx, xaddArgs(getCommentMqKey(), msg))
+	}
+	if _, err := pipe.Exec(Ctx); err != nil {
+		return fmt.Errorf("failed to exec pipeline to delete comment, detail: %w", err)
+	}
+	if err := c.events.publishAfter(msg, setKey); err != nil {
+		return fmt.Errorf("failed to publish msg to the delete comment MQ, detail: %w", err)
+	}
+
+	// fixme: use lua-script to ensure atomic
+	videoModelKey := fmtVideoModelKey(uint64(videoId))
+	if c.rdb.Exists(Ctx, videoModelKey).Val() == 1 {
+		c.rdb.HIncrBy(Ctx, videoModelKey, "comment_count", -1)
+	}
+	return nil
+}
+
+// ConsumeCommentDeletions hands the deletions to handle until ctx is done,
+// a deletion is redelivered until handle succeeds
+func (c *CommentCache) ConsumeCommentDeletions(ctx context.Context, handle func(CommentDeletion) error) {
+	c.events.consume(ctx, func(msg string) error {
+		var d CommentDeletion
+		d.EventId, msg = splitEventId(msg)
+		fmt.Sscanf(msg, "%d:%d", &d.VideoId, &d.CommentId)
+		return handle(d)
+	})
+}
+
+// EvictComments drops the comment sets of the videos and the models of the comments
+func (c *CommentCache) EvictComments(videoIds []int64, commentIds []int64) error {
+	keys := make([]string, 0, len(videoIds)+len(commentIds))
+	for _, vid := range videoIds {
+		keys = append(keys, fmtVideoCommentSetKey(vid))
+	}
+	for _, cid := range commentIds {
+		keys = append(keys, fmtVideoCommentModelKey(cid))
+	}
+	if len(keys) == 0 {
+		return nil
+	}
+	return c.rdb.Del(Ctx, keys...).Err()
+}
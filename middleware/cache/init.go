@@ -2,26 +2,79 @@ package cache
 
 import (
 	"context"
-	"log"
+	"errors"
+	"math/rand/v2"
+	"tiktok/config"
 	"time"
 
 	"github.com/redis/go-redis/v9"
 )
 
-var Rdb *redis.Client
 var Ctx context.Context = context.TODO()
 
 const NullValTimeout = time.Second * 30
 
-func init() {
-	Rdb = redis.NewClient(&redis.Options{
-		Addr:     "localhost:6379",
-		Password: "",
-		DB:       0,
+var (
+	// ErrMiss means the key isn't cached yet and should be loaded from DB
+	ErrMiss = errors.New("cache miss")
+	// ErrNullValue means the record is cached as nonexistent
+	ErrNullValue = errors.New("cached null value")
+	// ErrLocked means another loader is filling the key
+	ErrLocked = errors.New("cache is being loaded")
+)
+
+func NewClient(cfg config.Redis) (*redis.Client, error) {
+	rdb := redis.NewClient(&redis.Options{
+		Addr:     cfg.Addr,
+		Password: cfg.Password,
+		DB:       cfg.DB,
 	})
 
-	err := Rdb.Ping(Ctx).Err()
+	if err := rdb.Ping(Ctx).Err(); err != nil {
+		rdb.Close()
+		return nil, err
+	}
+	return rdb, nil
+}
+
+// Caches groups the typed caches sharing one client
+type Caches struct {
+	Users     *UserCache
+	Relations *RelationCache
+	Videos    *VideoCache
+	Likes     *LikeCache
+	Comments  *CommentCache
+	Tokens    *TokenCache
+	Logins    *LoginCache
+}
+
+// NewCaches queues the events through the Redis streams if broker is nil
+func NewCaches(rdb *redis.Client, broker Broker) Caches {
+	return Caches{
+		Users:     NewUserCache(rdb),
+		Relations: NewRelationCache(rdb, broker),
+		Videos:    NewVideoCache(rdb),
+		Likes:     NewLikeCache(rdb, broker),
+		Comments:  NewCommentCache(rdb, broker),
+		Tokens:    NewTokenCache(rdb),
+		Logins:    NewLoginCache(rdb),
+	}
+}
+
+// tryLock acquires the loader lock of key, the returned func releases it
+func tryLock(rdb *redis.Client, key string, ttl time.Duration) (func(), error) {
+	lockKey := fmtLockKey(key)
+	locked, err := rdb.SetNX(Ctx, lockKey, 1, ttl).Result()
 	if err != nil {
-		log.Panicln("failed to connect target database from Redis, detail:", err)
+		return nil, err
 	}
+	if !locked {
+		return nil, ErrLocked
+	}
+	return func() { rdb.Del(Ctx, lockKey) }, nil
+}
+
+// expireJitter spreads the expiration of hot keys
+func expireJitter(base time.Duration) time.Duration {
+	return base + time.Duration(rand.Int32N(5))*time.Second
 }
@@ -0,0 +1,117 @@
+package cache
+
+import "fmt"
+
+func fmtUserModelKey(uid int64) string {
+	return fmt.Sprintf("user_model:%d", uid)
+}
+
+func fmtUserFollowedSetKey(uid int64) string {
+	return fmt.Sprintf("user_followed:%d", uid)
+}
+
+func fmtUserFollowerSetKey(uid int64) string {
+	return fmt.Sprintf("user_followers:%d", uid)
+}
+
+// userFollowSetPatterns match the followed and follower sets for SCAN
+const (
+	userFollowedSetPattern = "user_followed:*"
+	userFollowerSetPattern = "user_followers:*"
+)
+
+func fmtVideoModelKey(vid uint64) string {
+	return fmt.Sprintf("video_model:%d", vid)
+}
+
+func getVideoStreamKey() string {
+	return "feed:new"
+}
+
+func fmtUserPubVideosKey(uid uint64) string {
+	return fmt.Sprintf("user_videos:%d", uid)
+}
+
+func fmtUserLikedVideosKey(uid uint64) string {
+	return fmt.Sprintf("user_likes:%d", uid)
+}
+
+func fmtVideoCommentSetKey(vid int64) string {
+	return fmt.Sprintf("video_comments:%d", vid)
+}
+
+func fmtVideoCommentModelKey(cid int64) string {
+	return fmt.Sprintf("comment_model:%d", cid)
+}
+
+func fmtLockKey(key string) string {
+	return fmt.Sprintf("lock:%s", key)
+}
+
+func getLikeMqKey() string {
+	return "mq:like"
+}
+
+// getLikeSeqKey is the counter ordering the like actions
+func getLikeSeqKey() string {
+	return "seq:like"
+}
+
+func getFollowMqKey() string {
+	return "mq:follow"
+}
+
+// getFollowSeqKey is the counter ordering the follow actions
+func getFollowSeqKey() string {
+	return "seq:follow"
+}
+
+func getCommentMqKey() string {
+	return "mq:delete_comment"
+}
+
+// fmtDeadLetterKey is the stream receiving the poison messages of stream
+func fmtDeadLetterKey(stream string) string {
+	return fmt.Sprintf("%s:dead", stream)
+}
+
+func fmtLeaseKey(name string) string {
+	return fmt.Sprintf("lease:%s", name)
+}
+
+// fmtRefreshTokenKey is keyed by the hash of the token, the token itself isn't stored
+func fmtRefreshTokenKey(hash string) string {
+	return fmt.Sprintf("refresh_token:%s", hash)
+}
+
+func fmtRevokedTokenKey(id string) string {
+	return fmt.Sprintf("revoked_token:%s", id)
+}
+
+// fmtRevokedUserKey holds when every earlier token of the user was revoked
+func fmtRevokedUserKey(uid string) string {
+	return fmt.Sprintf("revoked_user:%s", uid)
+}
+
+func fmtResetTokenKey(hash string) string {
+	return fmt.Sprintf("password_reset:%s", hash)
+}
+
+// fmtResetCooldownKey is set while subject, a user or an IP, can't request another reset mail
+func fmtResetCooldownKey(subject string) string {
+	return fmt.Sprintf("password_reset_cooldown:%s", subject)
+}
+
+// fmtExportCooldownKey is set while the user can't request another data export
+func fmtExportCooldownKey(uid uint64) string {
+	return fmt.Sprintf("data_export_cooldown:%d", uid)
+}
+
+// fmtLoginFailuresKey counts the failed logins of subject, a username or an IP
+func fmtLoginFailuresKey(subject string) string {
+	return fmt.Sprintf("login_failures:%s", subject)
+}
+
+func fmtLoginLockKey(subject string) string {
+	return fmt.Sprintf("login_lock:%s", subject)
+}
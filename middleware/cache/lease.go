@@ -0,0 +1,98 @@
+package cache
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"log"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// ErrLeaseHeld means another replica holds the lease
+var ErrLeaseHeld = errors.New("lease is held by another replica")
+
+// Lease elects a single replica for a job, it is held by one holder at a time
+// and expires after ttl unless the holder keeps renewing it
+type Lease struct {
+	rdb   *redis.Client
+	key   string
+	token string
+	ttl   time.Duration
+}
+
+func NewLease(rdb *redis.Client, name string, ttl time.Duration) *Lease {
+	token := make([]byte, 16)
+	rand.Read(token)
+	return &Lease{
+		rdb:   rdb,
+		key:   fmtLeaseKey(name),
+		token: hex.EncodeToString(token),
+		ttl:   ttl,
+	}
+}
+
+var renewLeaseScript = redis.NewScript(`
+	if redis.call("GET", KEYS[1]) == ARGV[1] then
+		return redis.call("PEXPIRE", KEYS[1], ARGV[2])
+	end
+	return 0
+`)
+
+var releaseLeaseScript = redis.NewScript(`
+	if redis.call("GET", KEYS[1]) == ARGV[1] then
+		return redis.call("DEL", KEYS[1])
+	end
+	return 0
+`)
+
+func (l *Lease) Acquire() (bool, error) {
+	return l.rdb.SetNX(Ctx, l.key, l.token, l.ttl).Result()
+}
+
+// Renew extends the lease, false is returned if it is lost
+func (l *Lease) Renew() (bool, error) {
+	n, err := renewLeaseScript.Run(Ctx, l.rdb, []string{l.key}, l.token, l.ttl.Milliseconds()).Int()
+	return n == 1, err
+}
+
+// Release gives the lease up if it is still held
+func (l *Lease) Release() error {
+	return releaseLeaseScript.Run(Ctx, l.rdb, []string{l.key}, l.token).Err()
+}
+
+// Hold runs fn while holding the lease, which is renewed every third of ttl.
+// The ctx of fn is cancelled if the lease is lost, so that fn stops before
+// another replica takes over. ErrLeaseHeld is returned if the lease is taken
+func (l *Lease) Hold(ctx context.Context, fn func(ctx context.Context) error) error {
+	ok, err := l.Acquire()
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return ErrLeaseHeld
+	}
+	defer l.Release()
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	go func() {
+		ticker := time.NewTicker(l.ttl / 3)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+			}
+			if ok, err := l.Renew(); err != nil || !ok {
+				log.Printf("WARN: lease %s is lost, detail: %v\n", l.key, err)
+				cancel()
+				return
+			}
+		}
+	}()
+	return fn(ctx)
+}
@@ -0,0 +1,79 @@
+package cache
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/redis/go-redis/v9"
+)
+
+func TestLease(t *testing.T) {
+	mr := miniredis.RunT(t)
+	rdb := redis.NewClient(&redis.Options{Addr: mr.Addr()})
+	defer rdb.Close()
+
+	a := NewLease(rdb, "job", time.Second)
+	b := NewLease(rdb, "job", time.Second)
+	if ok, err := a.Acquire(); err != nil || !ok {
+		t.Fatalf("expected a to acquire, got %t, %v", ok, err)
+	}
+	if ok, err := b.Acquire(); err != nil || ok {
+		t.Fatalf("expected b to be rejected, got %t, %v", ok, err)
+	}
+	// only the holder may renew or release it
+	if ok, _ := b.Renew(); ok {
+		t.Fatal("expected b not to renew the lease of a")
+	}
+	b.Release()
+	if !mr.Exists(fmtLeaseKey("job")) {
+		t.Fatal("lease of a is released by b")
+	}
+
+	mr.FastForward(time.Second * 2)
+	if ok, _ := a.Renew(); ok {
+		t.Fatal("expected the expired lease not to be renewed")
+	}
+	if ok, err := b.Acquire(); err != nil || !ok {
+		t.Fatalf("expected b to take over, got %t, %v", ok, err)
+	}
+}
+
+func TestLeaseHold(t *testing.T) {
+	mr := miniredis.RunT(t)
+	rdb := redis.NewClient(&redis.Options{Addr: mr.Addr()})
+	defer rdb.Close()
+
+	a := NewLease(rdb, "job", time.Millisecond*300)
+	b := NewLease(rdb, "job", time.Millisecond*300)
+	err := a.Hold(context.Background(), func(ctx context.Context) error {
+		if err := b.Hold(ctx, func(context.Context) error { return nil }); !errors.Is(err, ErrLeaseHeld) {
+			t.Errorf("expected the lease to be held, got %v", err)
+		}
+		// outlives the ttl, the lease is kept by the renewal
+		time.Sleep(time.Millisecond * 500)
+		return ctx.Err()
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if mr.Exists(fmtLeaseKey("job")) {
+		t.Fatal("expected the lease to be released")
+	}
+
+	// a lost lease cancels the job
+	err = a.Hold(context.Background(), func(ctx context.Context) error {
+		mr.Del(fmtLeaseKey("job"))
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-time.After(time.Second):
+			return errors.New("job isn't cancelled")
+		}
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+}
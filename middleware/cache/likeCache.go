@@ -0,0 +1,170 @@
+package cache
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// LikeCache keeps the liked video sets of users,
+// every set holds an empty placeholder member so that an empty set still exists
+type LikeCache struct {
+	rdb    *redis.Client
+	events eventQueue
+}
+
+func NewLikeCache(rdb *redis.Client, broker Broker) *LikeCache {
+	return &LikeCache{
+		rdb:    rdb,
+		events: eventQueue{rdb: rdb, name: getLikeMqKey(), broker: broker},
+	}
+}
+
+// LikeAction is the message published on every like or unlike
+type LikeAction struct {
+	EventId string
+	UserId  uint64
+	VideoId uint64
+	Liked   bool
+	// Seq orders the actions, a later action has a greater one.
+	// It is 0 for the actions queued before it was introduced
+	Seq uint64
+}
+
+func encodeLikeMqMsg(user_id, video_id uint64, action int8) string {
+	return withEventId(fmt.Sprintf("%d:%d:%d", user_id, video_id, action))
+}
+
+func decodeLikeMqMsg(cmd string) (event_id string, user_id, video_id uint64, action int8, seq uint64) {
+	event_id, cmd = splitEventId(cmd)
+	fmt.Sscanf(cmd, "%d:%d:%d:%d", &user_id, &video_id, &action, &seq)
+	return
+}
+
+// 确保点赞数缓存存在
+// 使用lua脚本原子的执行 Exists -> Set(当key不存在) -> Incr -> Expire 命令，
+// 防止出现判断exist为true，但Incr时key正好过期，导致INCR隐式初始化为1。
+// 消息附带的序号不小于当前微秒时间戳，Redis数据丢失后序号仍然递增
+var likeScript = redis.NewScript(`
+	local liked_videos_key = KEYS[1]
+	local video_info_key = KEYS[2]
+	local like_mq_key = KEYS[3]
+	local like_seq_key = KEYS[4]
+
+	local action = tonumber(ARGV[1])
+	local vid = ARGV[2]
+	local uid = ARGV[3]
+	local mq_cmd = ARGV[4]
+	local to_stream = ARGV[5]
+	local now = tonumber(ARGV[6])
+
+	local exist = redis.call("EXISTS", liked_videos_key)
+
+	if exist == 1 then
+		if redis.call("SISMEMBER", liked_videos_key, vid) == action then
+			return {2, ""}
+		else
+			redis.call( (action == 1) and "SADD" or "SREM", liked_videos_key, vid)
+			redis.call("HINCRBY", video_info_key, "like_count", (action == 0) and -1 or 1)
+			` + nextSeqCall("like_seq_key", "now") + `
+			mq_cmd = mq_cmd .. ":" .. seq
+			` + xaddCall("like_mq_key", "mq_cmd", "to_stream") + `
+			return {0, seq}
+		end
+	else
+		return {1, ""}
+	end
+`)
+
+// ApplyLike updates the liked set and like count then publishes the action,
+// changed is false if the user already is in the requested state.
+// ErrMiss is returned if the liked set of the user isn't cached
+func (c *LikeCache) ApplyLike(userId, videoId uint64, liked bool) (changed bool, err error) {
+	var action int8
+	if liked {
+		action = 1
+	}
+	msg := encodeLikeMqMsg(userId, videoId, action)
+	likedKey, videoKey := fmtUserLikedVideosKey(userId), fmtVideoModelKey(videoId)
+	res, err := likeScript.Run(
+		Ctx, c.rdb,
+		[]string{likedKey, videoKey, getLikeMqKey(), getLikeSeqKey()},
+		action, videoId, userId, msg, c.events.streamFlag(), time.Now().UnixMicro(),
+	).Slice()
+	if err != nil {
+		return false, fmt.Errorf("failed to run lua-script within redis - %w", err)
+	}
+
+	switch res[0].(int64) {
+	case 1:
+		return false, ErrMiss
+	case 2:
+		return false, nil
+	default:
+		return true, c.events.publishAfter(msg+":"+res[1].(string), likedKey, videoKey)
+	}
+}
+
+// ConsumeLikeActions hands the actions to handle until ctx is done,
+// an action is redelivered until handle succeeds
+func (c *LikeCache) ConsumeLikeActions(ctx context.Context, handle func(LikeAction) error) {
+	c.events.consume(ctx, func(msg string) error {
+		eid, uid, vid, act, seq := decodeLikeMqMsg(msg)
+		return handle(LikeAction{EventId: eid, UserId: uid, VideoId: vid, Liked: act == 1, Seq: seq})
+	})
+}
+
+func (c *LikeCache) LockUserLikedVideos(uid uint64) (func(), error) {
+	return tryLock(c.rdb, fmtUserLikedVideosKey(uid), 10*time.Second)
+}
+
+func (c *LikeCache) LoadUserLikedVideos(uid uint64, videoIds []uint64) error {
+	key := fmtUserLikedVideosKey(uid)
+	pipe := c.rdb.TxPipeline()
+	for _, v := range videoIds {
+		pipe.SAdd(Ctx, key, v)
+	}
+	// placeholder
+	pipe.SAdd(Ctx, key, "")
+	pipe.Expire(Ctx, key, 10*time.Minute)
+	_, err := pipe.Exec(Ctx)
+	return err
+}
+
+func (c *LikeCache) GetUserLikedVideoIds(uid uint64) ([]uint64, error) {
+	key := fmtUserLikedVideosKey(uid)
+	if n, err := c.rdb.Exists(Ctx, key).Result(); err != nil {
+		return nil, err
+	} else if n == 0 {
+		return nil, ErrMiss
+	}
+	vids, err := c.rdb.SMembers(Ctx, key).Result()
+	if err != nil {
+		return nil, err
+	}
+	return parseIds[uint64](vids), nil
+}
+
+func (c *LikeCache) HasLiked(userId, videoId uint64) (bool, error) {
+	key := fmtUserLikedVideosKey(userId)
+	if n, err := c.rdb.Exists(Ctx, key).Result(); err != nil {
+		return false, err
+	} else if n == 0 {
+		return false, ErrMiss
+	}
+	return c.rdb.SIsMember(Ctx, key, videoId).Result()
+}
+
+// EvictUserLikedVideos drops the liked sets of the users, they are loaded again on the next read
+func (c *LikeCache) EvictUserLikedVideos(uids ...uint64) error {
+	if len(uids) == 0 {
+		return nil
+	}
+	keys := make([]string, 0, len(uids))
+	for _, uid := range uids {
+		keys = append(keys, fmtUserLikedVideosKey(uid))
+	}
+	return c.rdb.Del(Ctx, keys...).Err()
+}
@@ -0,0 +1,105 @@
+package cache
+
+import (
+	"strings"
+	"tiktok/config"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// LoginCache counts the failed logins of usernames and client IPs
+// and locks them out with exponential backoff
+type LoginCache struct {
+	rdb *redis.Client
+}
+
+func NewLoginCache(rdb *redis.Client) *LoginCache {
+	return &LoginCache{rdb: rdb}
+}
+
+func userSubject(username string) string {
+	// MySQL compares usernames case-insensitively
+	return "user:" + strings.ToLower(username)
+}
+
+func ipSubject(ip string) string {
+	return "ip:" + ip
+}
+
+// LockedFor returns how long the username or IP is still locked, 0 if neither is
+func (c *LoginCache) LockedFor(username, ip string) (time.Duration, error) {
+	pipe := c.rdb.Pipeline()
+	userTTL := pipe.PTTL(Ctx, fmtLoginLockKey(userSubject(username)))
+	ipTTL := pipe.PTTL(Ctx, fmtLoginLockKey(ipSubject(ip)))
+	if _, err := pipe.Exec(Ctx); err != nil {
+		return 0, err
+	}
+	// a missing key has a negative ttl
+	return max(userTTL.Val(), ipTTL.Val(), 0), nil
+}
+
+// every failure after the threshold locks the subject twice as long
+var failLoginScript = redis.NewScript(`
+	local backoff = tonumber(ARGV[3])
+	local max_backoff = tonumber(ARGV[4])
+	local window = tonumber(ARGV[5])
+
+	local locked = 0
+	for i = 1, 2 do
+		local threshold = tonumber(ARGV[i])
+		if threshold > 0 then
+			local failures = redis.call("INCR", KEYS[2 * i - 1])
+			redis.call("PEXPIRE", KEYS[2 * i - 1], window)
+			if failures >= threshold then
+				local ttl = math.min(backoff * 2 ^ (failures - threshold), max_backoff)
+				ttl = math.floor(ttl)
+				redis.call("SET", KEYS[2 * i], 1, "PX", ttl)
+				-- the count outlives the lockout so the next failure backs off longer
+				redis.call("PEXPIRE", KEYS[2 * i - 1], window + ttl)
+				locked = math.max(locked, ttl)
+			end
+		end
+	end
+	return locked
+`)
+
+// RecordFailure counts a failed login of the username from the IP
+// and returns how long it locked either of them, 0 if neither
+func (c *LoginCache) RecordFailure(username, ip string, policy config.Lockout) (time.Duration, error) {
+	user, addr := userSubject(username), ipSubject(ip)
+	keys := []string{
+		fmtLoginFailuresKey(user), fmtLoginLockKey(user),
+		fmtLoginFailuresKey(addr), fmtLoginLockKey(addr),
+	}
+	ms, err := failLoginScript.Run(Ctx, c.rdb, keys,
+		policy.MaxFailures, policy.IPMaxFailures,
+		policy.Backoff.Milliseconds(), policy.MaxBackoff.Milliseconds(), policy.Window.Milliseconds(),
+	).Int64()
+	if err != nil {
+		return 0, err
+	}
+	return time.Duration(ms) * time.Millisecond, nil
+}
+
+// ResetFailures forgets the failures of the username after a successful login,
+// the IP keeps its count so that one valid account can't reset it
+func (c *LoginCache) ResetFailures(username string) error {
+	return c.rdb.Del(Ctx, fmtLoginFailuresKey(userSubject(username))).Err()
+}
+
+// Unlock lifts the lockout and forgets the failures of the username
+// and the IP, an empty one is skipped
+func (c *LoginCache) Unlock(username, ip string) error {
+	var keys []string
+	if username != "" {
+		keys = append(keys, fmtLoginFailuresKey(userSubject(username)), fmtLoginLockKey(userSubject(username)))
+	}
+	if ip != "" {
+		keys = append(keys, fmtLoginFailuresKey(ipSubject(ip)), fmtLoginLockKey(ipSubject(ip)))
+	}
+	if len(keys) == 0 {
+		return nil
+	}
+	return c.rdb.Del(Ctx, keys...).Err()
+}
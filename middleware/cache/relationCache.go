@@ -0,0 +1,242 @@
+package cache
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// RelationCache keeps the followed and follower id sets of users,
+// every set holds an empty placeholder member so that an empty set still exists
+type RelationCache struct {
+	rdb    *redis.Client
+	events eventQueue
+}
+
+func NewRelationCache(rdb *redis.Client, broker Broker) *RelationCache {
+	return &RelationCache{
+		rdb:    rdb,
+		events: eventQueue{rdb: rdb, name: getFollowMqKey(), broker: broker},
+	}
+}
+
+// FollowAction is the message published on every follow or unfollow
+type FollowAction struct {
+	EventId  string
+	TargetId int64
+	UserId   int64
+	Followed bool
+	// Seq orders the actions, a later action has a greater one.
+	// It is 0 for the actions queued before it was introduced
+	Seq uint64
+}
+
+func encodeFollowMqMsg(targetId, userId int64, action int8) string {
+	return withEventId(fmt.Sprintf("%d:%d:%d", targetId, userId, action))
+}
+
+func decodeFollowMqMsg(msg string) (eventId string, targetId, userId int64, action int8, seq uint64) {
+	eventId, msg = splitEventId(msg)
+	fmt.Sscanf(msg, "%d:%d:%d:%d", &targetId, &userId, &action, &seq)
+	return
+}
+
+// followScript adds to the cached sets if present on a follow and removes
+// from them on an unfollow, the message is appended the sequence number
+var followScript = redis.NewScript(`
+	local followedKey = KEYS[1]
+	local followerKey = KEYS[2]
+	local followMqKey = KEYS[3]
+	local followSeqKey = KEYS[4]
+	local followedId = ARGV[1]
+	local followerId = ARGV[2]
+	local msg = ARGV[3]
+	local toStream = ARGV[4]
+	local action = tonumber(ARGV[5])
+	local now = tonumber(ARGV[6])
+
+	if action == 1 then
+		if redis.call("EXISTS", followedKey) == 1 then
+			redis.call("SADD", followedKey, followedId)
+		end
+		if redis.call("EXISTS", followerKey) == 1 then
+			redis.call("SADD", followerKey, followerId)
+		end
+	else
+		redis.call("SREM", followedKey, followedId)
+		redis.call("SREM", followerKey, followerId)
+	end
+	` + nextSeqCall("followSeqKey", "now") + `
+	msg = msg .. ":" .. seq
+	` + xaddCall("followMqKey", "msg", "toStream") + `
+	return seq
+`)
+
+// Follow updates the cached sets if present and publishes the action
+func (c *RelationCache) Follow(targetId, userId int64) error {
+	return c.applyFollow(targetId, userId, 1)
+}
+
+// Unfollow updates the cached sets and publishes the action
+func (c *RelationCache) Unfollow(targetId, userId int64) error {
+	return c.applyFollow(targetId, userId, 0)
+}
+
+func (c *RelationCache) applyFollow(targetId, userId int64, action int8) error {
+	msg := encodeFollowMqMsg(targetId, userId, action)
+	followedKey, followerKey := fmtUserFollowedSetKey(userId), fmtUserFollowerSetKey(targetId)
+	seq, err := followScript.Run(Ctx, c.rdb,
+		[]string{followedKey, followerKey, getFollowMqKey(), getFollowSeqKey()},
+		targetId, userId, msg, c.events.streamFlag(), action, time.Now().UnixMicro(),
+	).Text()
+	if err != nil {
+		return err
+	}
+	return c.events.publishAfter(msg+":"+seq, followedKey, followerKey)
+}
+
+// ConsumeFollowActions hands the actions to handle until ctx is done,
+// an action is redelivered until handle succeeds
+func (c *RelationCache) ConsumeFollowActions(ctx context.Context, handle func(FollowAction) error) {
+	c.events.consume(ctx, func(msg string) error {
+		eventId, targetId, userId, action, seq := decodeFollowMqMsg(msg)
+		return handle(FollowAction{EventId: eventId, TargetId: targetId, UserId: userId, Followed: action == 1, Seq: seq})
+	})
+}
+
+func (c *RelationCache) loadSet(key string, ids []int64) error {
+	pipe := c.rdb.TxPipeline()
+	for _, id := range ids {
+		pipe.SAdd(Ctx, key, id)
+	}
+	// placeholder
+	pipe.SAdd(Ctx, key, "")
+	pipe.Expire(Ctx, key, 10*time.Minute)
+	_, err := pipe.Exec(Ctx)
+	return err
+}
+
+func (c *RelationCache) LoadFollowedSet(uid int64, followedIds []int64) error {
+	return c.loadSet(fmtUserFollowedSetKey(uid), followedIds)
+}
+
+func (c *RelationCache) LoadFollowerSet(uid int64, followerIds []int64) error {
+	return c.loadSet(fmtUserFollowerSetKey(uid), followerIds)
+}
+
+func (c *RelationCache) exists(key string) (bool, error) {
+	n, err := c.rdb.Exists(Ctx, key).Result()
+	return n == 1, err
+}
+
+func (c *RelationCache) members(key string) ([]int64, error) {
+	if ok, err := c.exists(key); err != nil {
+		return nil, err
+	} else if !ok {
+		return nil, ErrMiss
+	}
+	strs, err := c.rdb.SMembers(Ctx, key).Result()
+	if err != nil {
+		return nil, err
+	}
+	return parseIds[int64](strs), nil
+}
+
+func (c *RelationCache) count(key string) (uint64, error) {
+	if ok, err := c.exists(key); err != nil {
+		return 0, err
+	} else if !ok {
+		return 0, ErrMiss
+	}
+	cnt, err := c.rdb.SCard(Ctx, key).Uint64()
+	if err != nil {
+		return 0, err
+	}
+	// excludes the placeholder
+	if cnt > 0 {
+		cnt--
+	}
+	return cnt, nil
+}
+
+func (c *RelationCache) GetFollowedIds(uid int64) ([]int64, error) {
+	return c.members(fmtUserFollowedSetKey(uid))
+}
+
+func (c *RelationCache) GetFollowerIds(uid int64) ([]int64, error) {
+	return c.members(fmtUserFollowerSetKey(uid))
+}
+
+func (c *RelationCache) FollowedCount(uid int64) (uint64, error) {
+	return c.count(fmtUserFollowedSetKey(uid))
+}
+
+func (c *RelationCache) FollowerCount(uid int64) (uint64, error) {
+	return c.count(fmtUserFollowerSetKey(uid))
+}
+
+// ScanFollowSets calls fn with the owner of every cached followed set,
+// then of every cached follower set with followers set
+func (c *RelationCache) ScanFollowSets(ctx context.Context, fn func(uid int64, followers bool) error) error {
+	for _, followers := range []bool{false, true} {
+		pattern := userFollowedSetPattern
+		if followers {
+			pattern = userFollowerSetPattern
+		}
+		iter := c.rdb.Scan(ctx, 0, pattern, 100).Iterator()
+		for iter.Next(ctx) {
+			key := iter.Val()
+			uid, err := strconv.ParseInt(key[strings.LastIndexByte(key, ':')+1:], 10, 64)
+			if err != nil {
+				continue
+			}
+			if err := fn(uid, followers); err != nil {
+				return err
+			}
+		}
+		if err := iter.Err(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// EvictFollowSet drops a cached set, it is loaded from DB again on the next read
+func (c *RelationCache) EvictFollowSet(uid int64, followers bool) error {
+	key := fmtUserFollowedSetKey(uid)
+	if followers {
+		key = fmtUserFollowerSetKey(uid)
+	}
+	return c.rdb.Del(Ctx, key).Err()
+}
+
+// IsFollowed reports whether userId follows targetId
+func (c *RelationCache) IsFollowed(targetId, userId int64) (bool, error) {
+	key := fmtUserFollowedSetKey(userId)
+	if ok, err := c.exists(key); err != nil {
+		return false, err
+	} else if !ok {
+		return false, ErrMiss
+	}
+	return c.rdb.SIsMember(Ctx, key, targetId).Result()
+}
+
+// parseIds converts the members of a set or sorted set, skipping the placeholder
+func parseIds[T int64 | uint64](strs []string) []T {
+	ids := make([]T, 0, len(strs))
+	for _, str := range strs {
+		if str == "" {
+			continue
+		}
+		id, err := strconv.ParseInt(str, 10, 64)
+		if err != nil {
+			continue
+		}
+		ids = append(ids, T(id))
+	}
+	return ids
+}
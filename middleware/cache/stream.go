@@ -0,0 +1,327 @@
+package cache
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/redis/go-redis/v9"
+)
+
+const (
+	// streamGroup is the consumer group shared by every replica
+	streamGroup = "tiktok"
+	// streamMaxLen caps the streams approximately, acked entries are only kept for inspection
+	streamMaxLen = 100000
+	// streamBlock bounds a blocking read so consumers notice shutdown soon
+	streamBlock = time.Second * 2
+	// streamMinIdle is how long a delivered message may stay unacked
+	// before it is considered failed and reclaimed
+	streamMinIdle = time.Minute
+	// streamMaxDeliveries moves a message to the dead-letter stream
+	// after that many failed deliveries
+	streamMaxDeliveries = 5
+)
+
+// consumerName identifies this process within the consumer group,
+// the random suffix tells apart containers sharing hostname and pid
+var consumerName = func() string {
+	host, _ := os.Hostname()
+	suffix := make([]byte, 4)
+	rand.Read(suffix)
+	return fmt.Sprintf("%s-%d-%s", host, os.Getpid(), hex.EncodeToString(suffix))
+}()
+
+// xaddCall is the Lua statement appending the msg variable to the stream
+// named by the key variable if the flag variable is "1", scripts use it
+// so that a message is queued atomically with the cache update
+func xaddCall(key, msg, flag string) string {
+	return fmt.Sprintf(`if %s == "1" then redis.call("XADD", %s, "MAXLEN", "~", %d, "*", "msg", %s) end`,
+		flag, key, streamMaxLen, msg)
+}
+
+// nextSeqCall is the Lua statements setting the seq variable to the next value
+// of the counter named by the key variable, as a string. It doesn't go below the
+// now variable, a microsecond timestamp, so that it still increases once Redis
+// lost the counter
+func nextSeqCall(key, now string) string {
+	return fmt.Sprintf(`local seq = redis.call("INCR", %[1]s)
+	if seq < %[2]s then
+		seq = %[2]s
+		redis.call("SET", %[1]s, string.format("%%.0f", seq))
+	end
+	seq = string.format("%%.0f", seq)`, key, now)
+}
+
+func xaddArgs(stream, msg string) *redis.XAddArgs {
+	return &redis.XAddArgs{
+		Stream: stream,
+		MaxLen: streamMaxLen,
+		Approx: true,
+		Values: map[string]interface{}{"msg": msg},
+	}
+}
+
+// withEventId prefixes the payload of an event with a new unique id,
+// consumers keep the ids they processed to drop redeliveries
+func withEventId(payload string) string {
+	return uuid.NewString() + ":" + payload
+}
+
+// splitEventId undoes withEventId, messages queued before the ids
+// were introduced start with a number and get an empty id
+func splitEventId(msg string) (eventId, payload string) {
+	id, rest, ok := strings.Cut(msg, ":")
+	if !ok {
+		return "", msg
+	}
+	if _, err := strconv.ParseInt(id, 10, 64); err == nil {
+		return "", msg
+	}
+	return id, rest
+}
+
+// Broker carries the events in place of the Redis streams, e.g. RabbitMQ
+type Broker interface {
+	// Publish returns once the broker persisted msg
+	Publish(ctx context.Context, queue, msg string) error
+	// Consume hands the messages to handle until ctx is done,
+	// a message is redelivered until handle succeeds
+	Consume(ctx context.Context, queue string, handle func(msg string) error)
+}
+
+// eventQueue carries the events of one kind to the consumers,
+// through the stream named after it unless a broker is given
+type eventQueue struct {
+	rdb    *redis.Client
+	name   string
+	broker Broker
+}
+
+// viaStream reports whether the events are queued along the cache update,
+// otherwise they have to be published after it succeeds
+func (q eventQueue) viaStream() bool {
+	return q.broker == nil
+}
+
+// streamFlag is the flag argument of xaddCall
+func (q eventQueue) streamFlag() string {
+	if q.viaStream() {
+		return "1"
+	}
+	return "0"
+}
+
+// publishAfter sends msg through the broker once the cache is updated.
+// If it fails the touched keys are evicted, so that they are reloaded
+// from DB which doesn't have the change either
+func (q eventQueue) publishAfter(msg string, touched ...string) error {
+	if q.viaStream() {
+		return nil
+	}
+	err := q.broker.Publish(Ctx, q.name, msg)
+	if err == nil {
+		return nil
+	}
+	if delErr := q.rdb.Del(Ctx, touched...).Err(); delErr != nil {
+		log.Printf("WARN: message %q of %s is lost and cache is left ahead of DB until the reconciliation, detail: %v\n",
+			msg, q.name, delErr)
+	}
+	return err
+}
+
+func (q eventQueue) consume(ctx context.Context, handle func(msg string) error) {
+	if q.viaStream() {
+		newStreamConsumer(q.rdb, q.name).consume(ctx, handle)
+		return
+	}
+	q.broker.Consume(ctx, q.name, handle)
+}
+
+// streamConsumer reads a stream as a member of streamGroup, so replicas
+// compete for the messages and each one is delivered to a single consumer.
+// a message is acked once it is handled, otherwise it stays pending and
+// is redelivered after minIdle, at most maxDeliveries times before
+// it is moved to the dead-letter stream
+type streamConsumer struct {
+	rdb           *redis.Client
+	stream        string
+	group         string
+	consumer      string
+	block         time.Duration
+	minIdle       time.Duration
+	maxDeliveries int64
+}
+
+func newStreamConsumer(rdb *redis.Client, stream string) *streamConsumer {
+	return &streamConsumer{
+		rdb:           rdb,
+		stream:        stream,
+		group:         streamGroup,
+		consumer:      consumerName,
+		block:         streamBlock,
+		minIdle:       streamMinIdle,
+		maxDeliveries: streamMaxDeliveries,
+	}
+}
+
+func (c *streamConsumer) ensureGroup(ctx context.Context) error {
+	// starts from the beginning, messages added before the group exists aren't lost
+	err := c.rdb.XGroupCreateMkStream(ctx, c.stream, c.group, "0").Err()
+	if err != nil && !strings.HasPrefix(err.Error(), "BUSYGROUP") {
+		return err
+	}
+	return nil
+}
+
+// consume delivers the messages to handle until ctx is done
+func (c *streamConsumer) consume(ctx context.Context, handle func(msg string) error) {
+	for {
+		err := c.ensureGroup(ctx)
+		if err == nil {
+			break
+		}
+		log.Printf("WARN: failed to create consumer group of %s, detail: %v\n", c.stream, err)
+		if !sleepContext(ctx, time.Second) {
+			return
+		}
+	}
+
+	defer c.leave()
+	for ctx.Err() == nil {
+		c.reclaim(ctx, handle)
+
+		streams, err := c.rdb.XReadGroup(ctx, &redis.XReadGroupArgs{
+			Group:    c.group,
+			Consumer: c.consumer,
+			Streams:  []string{c.stream, ">"},
+			Count:    16,
+			Block:    c.block,
+		}).Result()
+		if errors.Is(err, redis.Nil) {
+			continue
+		}
+		if err != nil {
+			if ctx.Err() != nil {
+				return
+			}
+			log.Printf("WARN: failed to read %s, detail: %v\n", c.stream, err)
+			sleepContext(ctx, time.Second)
+			continue
+		}
+
+		for _, s := range streams {
+			for _, m := range s.Messages {
+				c.process(m, handle)
+			}
+		}
+	}
+}
+
+// leave removes the consumer from the group unless it still owns pending
+// messages, which would be dropped with it instead of being reclaimed
+func (c *streamConsumer) leave() {
+	consumers, err := c.rdb.XInfoConsumers(Ctx, c.stream, c.group).Result()
+	if err != nil {
+		log.Printf("WARN: failed to list consumers of %s, detail: %v\n", c.stream, err)
+		return
+	}
+	for _, info := range consumers {
+		if info.Name == c.consumer && info.Pending == 0 {
+			c.rdb.XGroupDelConsumer(Ctx, c.stream, c.group, c.consumer)
+		}
+	}
+}
+
+func (c *streamConsumer) process(m redis.XMessage, handle func(msg string) error) {
+	msg, _ := m.Values["msg"].(string)
+	if err := handle(msg); err != nil {
+		log.Printf("WARN: failed to handle message %s of %s, it will be redelivered, detail: %v\n", m.ID, c.stream, err)
+		return
+	}
+	if err := c.rdb.XAck(Ctx, c.stream, c.group, m.ID).Err(); err != nil {
+		log.Printf("WARN: failed to ack message %s of %s, detail: %v\n", m.ID, c.stream, err)
+	}
+}
+
+// reclaim takes over the messages left unacked for minIdle,
+// whether their consumer failed to handle them or died
+func (c *streamConsumer) reclaim(ctx context.Context, handle func(msg string) error) {
+	pending, err := c.rdb.XPendingExt(ctx, &redis.XPendingExtArgs{
+		Stream: c.stream,
+		Group:  c.group,
+		Idle:   c.minIdle,
+		Start:  "-",
+		End:    "+",
+		Count:  16,
+	}).Result()
+	if err != nil {
+		if ctx.Err() == nil {
+			log.Printf("WARN: failed to list pending messages of %s, detail: %v\n", c.stream, err)
+		}
+		return
+	}
+
+	for _, p := range pending {
+		// claiming checks the idle time again, so only one consumer wins
+		msgs, err := c.rdb.XClaim(ctx, &redis.XClaimArgs{
+			Stream:   c.stream,
+			Group:    c.group,
+			Consumer: c.consumer,
+			MinIdle:  c.minIdle,
+			Messages: []string{p.ID},
+		}).Result()
+		if err != nil {
+			log.Printf("WARN: failed to claim message %s of %s, detail: %v\n", p.ID, c.stream, err)
+			continue
+		}
+		if len(msgs) == 0 {
+			continue
+		}
+
+		if p.RetryCount >= c.maxDeliveries {
+			c.deadLetter(msgs[0], p.RetryCount)
+			continue
+		}
+		c.process(msgs[0], handle)
+	}
+}
+
+func (c *streamConsumer) deadLetter(m redis.XMessage, deliveries int64) {
+	msg, _ := m.Values["msg"].(string)
+	pipe := c.rdb.TxPipeline()
+	pipe.XAdd(Ctx, &redis.XAddArgs{
+		Stream: fmtDeadLetterKey(c.stream),
+		Values: map[string]interface{}{
+			"msg":        msg,
+			"id":         m.ID,
+			"deliveries": deliveries,
+		},
+	})
+	pipe.XAck(Ctx, c.stream, c.group, m.ID)
+	if _, err := pipe.Exec(Ctx); err != nil {
+		log.Printf("WARN: failed to move message %s of %s to dead-letter stream, detail: %v\n", m.ID, c.stream, err)
+		return
+	}
+	log.Printf("WARN: message %s of %s is moved to dead-letter stream after %d deliveries\n", m.ID, c.stream, deliveries)
+}
+
+// sleepContext reports false if ctx is done before d elapses
+func sleepContext(ctx context.Context, d time.Duration) bool {
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-ctx.Done():
+		return false
+	case <-t.C:
+		return true
+	}
+}
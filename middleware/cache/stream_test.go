@@ -0,0 +1,347 @@
+package cache
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"testing"
+	"tiktok/dao"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/redis/go-redis/v9"
+)
+
+func newTestStreamConsumer(rdb *redis.Client, consumer string) *streamConsumer {
+	c := newStreamConsumer(rdb, "mq:test")
+	c.consumer = consumer
+	c.block = time.Millisecond * 50
+	c.minIdle = time.Millisecond * 100
+	c.maxDeliveries = 3
+	return c
+}
+
+func TestStreamRedeliversUntilHandled(t *testing.T) {
+	mr := miniredis.RunT(t)
+	rdb := redis.NewClient(&redis.Options{Addr: mr.Addr()})
+	defer rdb.Close()
+	if err := rdb.XAdd(Ctx, xaddArgs("mq:test", "hello")).Err(); err != nil {
+		t.Fatal(err)
+	}
+
+	var mu sync.Mutex
+	attempts := 0
+	done := make(chan struct{})
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go newTestStreamConsumer(rdb, "a").consume(ctx, func(msg string) error {
+		mu.Lock()
+		defer mu.Unlock()
+		attempts++
+		if msg != "hello" {
+			t.Errorf("unexpected msg %q", msg)
+		}
+		if attempts < 2 {
+			return errors.New("db is down")
+		}
+		close(done)
+		return nil
+	})
+
+	select {
+	case <-done:
+	case <-time.After(time.Second * 3):
+		t.Fatal("message isn't redelivered")
+	}
+	cancel()
+
+	// acked, nothing is left pending
+	pending, err := rdb.XPending(Ctx, "mq:test", streamGroup).Result()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if pending.Count != 0 {
+		t.Fatalf("expected no pending message, got %d", pending.Count)
+	}
+}
+
+func TestStreamDeadLetter(t *testing.T) {
+	mr := miniredis.RunT(t)
+	rdb := redis.NewClient(&redis.Options{Addr: mr.Addr()})
+	defer rdb.Close()
+	if err := rdb.XAdd(Ctx, xaddArgs("mq:test", "poison")).Err(); err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go newTestStreamConsumer(rdb, "a").consume(ctx, func(msg string) error {
+		return errors.New("always fails")
+	})
+
+	deadline := time.Now().Add(time.Second * 3)
+	for {
+		dead, err := rdb.XRange(Ctx, fmtDeadLetterKey("mq:test"), "-", "+").Result()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(dead) == 1 {
+			if dead[0].Values["msg"] != "poison" || dead[0].Values["deliveries"] != "3" {
+				t.Fatalf("unexpected dead letter: %v", dead[0].Values)
+			}
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("poison message isn't moved to the dead-letter stream")
+		}
+		time.Sleep(time.Millisecond * 20)
+	}
+
+	pending, err := rdb.XPending(Ctx, "mq:test", streamGroup).Result()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if pending.Count != 0 {
+		t.Fatalf("expected the poison message to be acked, got %d pending", pending.Count)
+	}
+}
+
+func TestStreamReclaimsFromDeadConsumer(t *testing.T) {
+	mr := miniredis.RunT(t)
+	rdb := redis.NewClient(&redis.Options{Addr: mr.Addr()})
+	defer rdb.Close()
+
+	crashed := newTestStreamConsumer(rdb, "crashed")
+	if err := crashed.ensureGroup(Ctx); err != nil {
+		t.Fatal(err)
+	}
+	if err := rdb.XAdd(Ctx, xaddArgs("mq:test", "orphan")).Err(); err != nil {
+		t.Fatal(err)
+	}
+	// delivered to a consumer which never acks it
+	err := rdb.XReadGroup(Ctx, &redis.XReadGroupArgs{
+		Group:    streamGroup,
+		Consumer: "crashed",
+		Streams:  []string{"mq:test", ">"},
+	}).Err()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	got := make(chan string, 1)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go newTestStreamConsumer(rdb, "b").consume(ctx, func(msg string) error {
+		got <- msg
+		return nil
+	})
+	select {
+	case msg := <-got:
+		if msg != "orphan" {
+			t.Fatalf("unexpected msg %q", msg)
+		}
+	case <-time.After(time.Second * 3):
+		t.Fatal("pending message of the dead consumer isn't reclaimed")
+	}
+}
+
+// fakeBroker keeps the published messages in memory
+type fakeBroker struct {
+	mu       sync.Mutex
+	messages map[string][]string
+}
+
+func (b *fakeBroker) Publish(ctx context.Context, queue, msg string) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.messages[queue] = append(b.messages[queue], msg)
+	return nil
+}
+
+func (b *fakeBroker) Consume(ctx context.Context, queue string, handle func(msg string) error) {
+	b.mu.Lock()
+	msgs := b.messages[queue]
+	b.mu.Unlock()
+	for _, msg := range msgs {
+		handle(msg)
+	}
+}
+
+func TestBrokerReplacesStreams(t *testing.T) {
+	mr := miniredis.RunT(t)
+	rdb := redis.NewClient(&redis.Options{Addr: mr.Addr()})
+	defer rdb.Close()
+	broker := &fakeBroker{messages: map[string][]string{}}
+	caches := NewCaches(rdb, broker)
+
+	if err := caches.Likes.LoadUserLikedVideos(1, nil); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := caches.Likes.ApplyLike(1, 2, true); err != nil {
+		t.Fatal(err)
+	}
+	if err := caches.Relations.Unfollow(2, 1); err != nil {
+		t.Fatal(err)
+	}
+	if err := caches.Comments.DeleteComment(1, 3); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, stream := range []string{getLikeMqKey(), getFollowMqKey(), getCommentMqKey()} {
+		if mr.Exists(stream) {
+			t.Fatalf("stream %s is written while a broker is given", stream)
+		}
+		if len(broker.messages[stream]) != 1 {
+			t.Fatalf("expected 1 message on %s, got %v", stream, broker.messages[stream])
+		}
+	}
+
+	var got LikeAction
+	caches.Likes.ConsumeLikeActions(context.Background(), func(a LikeAction) error {
+		got = a
+		return nil
+	})
+	if got.EventId == "" {
+		t.Fatal("expected the action to carry an event id")
+	}
+	if got.Seq == 0 {
+		t.Fatal("expected the action to carry a sequence number")
+	}
+	got.EventId, got.Seq = "", 0
+	if got != (LikeAction{UserId: 1, VideoId: 2, Liked: true}) {
+		t.Fatalf("unexpected action: %+v", got)
+	}
+}
+
+// downBroker fails every publish
+type downBroker struct{ fakeBroker }
+
+func (b *downBroker) Publish(ctx context.Context, queue, msg string) error {
+	return errors.New("broker is down")
+}
+
+func TestFailedPublishEvictsTouchedKeys(t *testing.T) {
+	mr := miniredis.RunT(t)
+	rdb := redis.NewClient(&redis.Options{Addr: mr.Addr()})
+	defer rdb.Close()
+	caches := NewCaches(rdb, &downBroker{})
+
+	if err := caches.Likes.LoadUserLikedVideos(1, nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := caches.Videos.SetVideoModel(dao.Video{Id: 2, AuthorId: 3}); err != nil {
+		t.Fatal(err)
+	}
+	if err := caches.Relations.LoadFollowedSet(1, nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := caches.Relations.LoadFollowerSet(3, nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := caches.Comments.LoadVideoComments(2, []dao.Comment{{Id: 4, VideoId: 2}}); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := caches.Likes.ApplyLike(1, 2, true); err == nil {
+		t.Fatal("expected the like to fail")
+	}
+	if err := caches.Relations.Follow(3, 1); err == nil {
+		t.Fatal("expected the follow to fail")
+	}
+	if err := caches.Comments.DeleteComment(2, 4); err == nil {
+		t.Fatal("expected the deletion to fail")
+	}
+	// reloaded from DB, which missed the changes too
+	for _, key := range []string{fmtUserLikedVideosKey(1), fmtVideoModelKey(2), fmtUserFollowedSetKey(1),
+		fmtUserFollowerSetKey(3), fmtVideoCommentSetKey(2)} {
+		if mr.Exists(key) {
+			t.Fatalf("expected %s to be evicted", key)
+		}
+	}
+}
+
+func TestSplitEventId(t *testing.T) {
+	msg := withEventId("1:2:1")
+	id, payload := splitEventId(msg)
+	if id == "" || payload != "1:2:1" {
+		t.Fatalf("unexpected split of %q: %q, %q", msg, id, payload)
+	}
+	if other, _ := splitEventId(withEventId("1:2:1")); other == id {
+		t.Fatal("expected every event to get a new id")
+	}
+
+	// queued before the ids were introduced
+	id, payload = splitEventId("1:2:1")
+	if id != "" || payload != "1:2:1" {
+		t.Fatalf("unexpected split of a legacy message: %q, %q", id, payload)
+	}
+}
+
+func TestStreamCompetingConsumers(t *testing.T) {
+	mr := miniredis.RunT(t)
+	rdb := redis.NewClient(&redis.Options{Addr: mr.Addr()})
+	defer rdb.Close()
+
+	const total = 50
+	var mu sync.Mutex
+	handled := map[string]int{}
+	var wg sync.WaitGroup
+	wg.Add(total)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	// two replicas reading the same stream
+	for _, name := range []string{"a", "b"} {
+		go newTestStreamConsumer(rdb, name).consume(ctx, func(msg string) error {
+			mu.Lock()
+			handled[msg]++
+			mu.Unlock()
+			wg.Done()
+			return nil
+		})
+	}
+
+	for i := 0; i < total; i++ {
+		if err := rdb.XAdd(Ctx, xaddArgs("mq:test", fmt.Sprint(i))).Err(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	wg.Wait()
+	// gives a duplicated delivery the chance to show up
+	time.Sleep(time.Millisecond * 200)
+
+	mu.Lock()
+	defer mu.Unlock()
+	if len(handled) != total {
+		t.Fatalf("expected %d messages handled, got %d", total, len(handled))
+	}
+	for msg, n := range handled {
+		if n != 1 {
+			t.Fatalf("message %s is handled %d times", msg, n)
+		}
+	}
+}
+
+func TestStreamConsumerLeavesGroup(t *testing.T) {
+	mr := miniredis.RunT(t)
+	rdb := redis.NewClient(&redis.Options{Addr: mr.Addr()})
+	defer rdb.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		newTestStreamConsumer(rdb, "a").consume(ctx, func(string) error { return nil })
+		close(done)
+	}()
+	time.Sleep(time.Millisecond * 100)
+	cancel()
+	<-done
+
+	consumers, err := rdb.XInfoConsumers(Ctx, "mq:test", streamGroup).Result()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(consumers) != 0 {
+		t.Fatalf("expected the idle consumer to leave, got %+v", consumers)
+	}
+}
@@ -0,0 +1,206 @@
+package cache
+
+import (
+	"errors"
+	"strconv"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// ErrTokenReused means a refresh token was presented again after its rotation,
+// it may have leaked so the whole session should be revoked
+var ErrTokenReused = errors.New("refresh token reused")
+
+// TokenCache keeps the refresh tokens and the revocation list,
+// a session is revoked by its id which every token of it carries
+type TokenCache struct {
+	rdb *redis.Client
+}
+
+func NewTokenCache(rdb *redis.Client) *TokenCache {
+	return &TokenCache{rdb: rdb}
+}
+
+// SaveRefreshToken stores the hash of a refresh token issued to the session
+func (c *TokenCache) SaveRefreshToken(hash string, uid uint64, sessionId string, ttl time.Duration) error {
+	key := fmtRefreshTokenKey(hash)
+	pipe := c.rdb.TxPipeline()
+	pipe.HSet(Ctx, key, "user_id", uid, "session_id", sessionId, "used", 0, "issued_at", time.Now().Unix())
+	pipe.Expire(Ctx, key, ttl)
+	_, err := pipe.Exec(Ctx)
+	return err
+}
+
+// a used token is kept until it expires to detect its reuse
+var rotateScript = redis.NewScript(`
+	local token_key = KEYS[1]
+	local revoked_prefix = ARGV[1]
+	local revoked_user_prefix = ARGV[2]
+
+	local token = redis.call("HMGET", token_key, "user_id", "session_id", "used", "issued_at")
+	if not token[1] then
+		return {0}
+	end
+	if redis.call("EXISTS", revoked_prefix .. token[2]) == 1 then
+		return {0}
+	end
+	local revoked_before = redis.call("GET", revoked_user_prefix .. token[1])
+	if revoked_before and tonumber(token[4] or 0) < tonumber(revoked_before) then
+		return {0}
+	end
+	if token[3] == "1" then
+		return {2, token[1], token[2]}
+	end
+	redis.call("HSET", token_key, "used", 1)
+	return {1, token[1], token[2]}
+`)
+
+// UseRefreshToken marks the refresh token as used and returns its owner,
+// ErrMiss is returned if it is unknown, expired or revoked, also by
+// RevokeUser, and
+// ErrTokenReused if it has been used before
+func (c *TokenCache) UseRefreshToken(hash string) (uid uint64, sessionId string, err error) {
+	res, err := rotateScript.Run(Ctx, c.rdb, []string{fmtRefreshTokenKey(hash)},
+		fmtRevokedTokenKey(""), fmtRevokedUserKey("")).Slice()
+	if err != nil {
+		return 0, "", err
+	}
+	status, _ := res[0].(int64)
+	if status == 0 {
+		return 0, "", ErrMiss
+	}
+	uidStr, _ := res[1].(string)
+	uid, _ = strconv.ParseUint(uidStr, 10, 64)
+	sessionId, _ = res[2].(string)
+	if status == 2 {
+		return uid, sessionId, ErrTokenReused
+	}
+	return uid, sessionId, nil
+}
+
+// Revoke puts a token or session id on the revocation list for ttl,
+// which should outlive every token carrying the id
+func (c *TokenCache) Revoke(id string, ttl time.Duration) error {
+	return c.rdb.Set(Ctx, fmtRevokedTokenKey(id), 1, ttl).Err()
+}
+
+// IsRevoked reports whether any of the ids is revoked, empty ids are skipped
+func (c *TokenCache) IsRevoked(ids ...string) (bool, error) {
+	keys := make([]string, 0, len(ids))
+	for _, id := range ids {
+		if id != "" {
+			keys = append(keys, fmtRevokedTokenKey(id))
+		}
+	}
+	if len(keys) == 0 {
+		return false, nil
+	}
+	n, err := c.rdb.Exists(Ctx, keys...).Result()
+	return n > 0, err
+}
+
+// RevokeUser revokes every token of the user issued before now for ttl,
+// which should outlive every token. The JWT issue times are in seconds
+// so a token issued within the same second is still accepted
+func (c *TokenCache) RevokeUser(uid uint64, ttl time.Duration) error {
+	key := fmtRevokedUserKey(strconv.FormatUint(uid, 10))
+	return c.rdb.Set(Ctx, key, time.Now().Unix(), ttl).Err()
+}
+
+// IsTokenRevoked reports whether any of the ids is revoked
+// or the token of the user was issued before RevokeUser
+func (c *TokenCache) IsTokenRevoked(uid string, issuedAt time.Time, ids ...string) (bool, error) {
+	pipe := c.rdb.Pipeline()
+	before := pipe.Get(Ctx, fmtRevokedUserKey(uid))
+	var exists *redis.IntCmd
+	keys := make([]string, 0, len(ids))
+	for _, id := range ids {
+		if id != "" {
+			keys = append(keys, fmtRevokedTokenKey(id))
+		}
+	}
+	if len(keys) > 0 {
+		exists = pipe.Exists(Ctx, keys...)
+	}
+	if _, err := pipe.Exec(Ctx); err != nil && !errors.Is(err, redis.Nil) {
+		return false, err
+	}
+	if exists != nil && exists.Val() > 0 {
+		return true, nil
+	}
+	if unix, err := before.Int64(); err == nil && issuedAt.Unix() < unix {
+		return true, nil
+	}
+	return false, nil
+}
+
+// SaveResetToken stores the hash of a password reset token of the user
+func (c *TokenCache) SaveResetToken(hash string, uid uint64, ttl time.Duration) error {
+	key := fmtResetTokenKey(hash)
+	pipe := c.rdb.TxPipeline()
+	pipe.HSet(Ctx, key, "user_id", uid, "issued_at", time.Now().Unix())
+	pipe.Expire(Ctx, key, ttl)
+	_, err := pipe.Exec(Ctx)
+	return err
+}
+
+// the cooldowns are only started if none of them is running
+var cooldownScript = redis.NewScript(`
+	for _, key in ipairs(KEYS) do
+		if redis.call("EXISTS", key) == 1 then
+			return 0
+		end
+	end
+	for _, key in ipairs(KEYS) do
+		redis.call("SET", key, 1, "PX", ARGV[1])
+	end
+	return 1
+`)
+
+// StartResetCooldown starts the reset mail cooldown of every subject, e.g. "user:1"
+// and "ip:10.0.0.1", it reports false and starts none while any of them is cooling down
+func (c *TokenCache) StartResetCooldown(cooldown time.Duration, subjects ...string) (bool, error) {
+	keys := make([]string, 0, len(subjects))
+	for _, subject := range subjects {
+		keys = append(keys, fmtResetCooldownKey(subject))
+	}
+	started, err := cooldownScript.Run(Ctx, c.rdb, keys, cooldown.Milliseconds()).Int()
+	return started == 1, err
+}
+
+// StartExportCooldown starts the data export cooldown of the user,
+// it reports false if the cooldown is already running
+func (c *TokenCache) StartExportCooldown(cooldown time.Duration, uid uint64) (bool, error) {
+	started, err := cooldownScript.Run(Ctx, c.rdb, []string{fmtExportCooldownKey(uid)}, cooldown.Milliseconds()).Int()
+	return started == 1, err
+}
+
+// a reset token is deleted by its first use
+var useResetScript = redis.NewScript(`
+	local token = redis.call("HMGET", KEYS[1], "user_id", "issued_at")
+	if not token[1] then
+		return {0}
+	end
+	redis.call("DEL", KEYS[1])
+	local revoked_before = redis.call("GET", ARGV[1] .. token[1])
+	if revoked_before and tonumber(token[2]) < tonumber(revoked_before) then
+		return {0}
+	end
+	return {1, token[1]}
+`)
+
+// UseResetToken consumes the password reset token and returns its user,
+// ErrMiss is returned if it is unknown, used, expired or was issued
+// before the tokens of the user were revoked, e.g. by a password change
+func (c *TokenCache) UseResetToken(hash string) (uint64, error) {
+	res, err := useResetScript.Run(Ctx, c.rdb, []string{fmtResetTokenKey(hash)}, fmtRevokedUserKey("")).Slice()
+	if err != nil {
+		return 0, err
+	}
+	if status, _ := res[0].(int64); status == 0 {
+		return 0, ErrMiss
+	}
+	uidStr, _ := res[1].(string)
+	return strconv.ParseUint(uidStr, 10, 64)
+}
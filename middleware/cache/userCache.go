@@ -0,0 +1,107 @@
+package cache
+
+import (
+	"strconv"
+	"tiktok/dao"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// UserCache keeps user models in the user_model:<id> hashes
+type UserCache struct {
+	rdb *redis.Client
+}
+
+func NewUserCache(rdb *redis.Client) *UserCache {
+	return &UserCache{rdb: rdb}
+}
+
+func (c *UserCache) GetUserModel(uid int64) (*dao.User, error) {
+	cmd := c.rdb.HGetAll(Ctx, fmtUserModelKey(uid))
+	values, err := cmd.Result()
+	if err != nil {
+		return nil, err
+	}
+	if len(values) == 0 {
+		return nil, ErrMiss
+	}
+	if _, ok := values["null_value"]; ok {
+		return nil, ErrNullValue
+	}
+
+	model := dao.User{}
+	if err := cmd.Scan(&model); err != nil {
+		return nil, err
+	}
+	return &model, nil
+}
+
+func (c *UserCache) SetUserModel(model dao.User) error {
+	key := fmtUserModelKey(int64(model.Id))
+	pipe := c.rdb.TxPipeline()
+	pipe.Del(Ctx, key)
+	pipe.HSet(Ctx, key, model)
+	pipe.Expire(Ctx, key, expireJitter(time.Minute*5))
+	_, err := pipe.Exec(Ctx)
+	return err
+}
+
+// SetUserNull caches the user as nonexistent to protect the DB from penetration
+func (c *UserCache) SetUserNull(uid int64) error {
+	key := fmtUserModelKey(uid)
+	pipe := c.rdb.Pipeline()
+	pipe.HSet(Ctx, key, "null_value", "placeholder")
+	pipe.Expire(Ctx, key, NullValTimeout)
+	_, err := pipe.Exec(Ctx)
+	return err
+}
+
+// DelUserModel evicts the user after it is changed, the next read reloads it
+func (c *UserCache) DelUserModel(uid int64) error {
+	return c.rdb.Del(Ctx, fmtUserModelKey(uid)).Err()
+}
+
+// The counters of the user_model hashes
+const (
+	FieldVideoCount      = "video_count"
+	FieldTotalLiked      = "total_liked"
+	FieldLikedVideoCount = "liked_video_count"
+)
+
+// a cached user has the id field, a null placeholder doesn't.
+// The counters don't go below zero, the model couldn't be scanned otherwise
+var incrCounterScript = redis.NewScript(`
+	if redis.call("HEXISTS", KEYS[1], "id") == 0 then
+		return 0
+	end
+	local count = tonumber(redis.call("HGET", KEYS[1], ARGV[1]) or "0")
+	if count + tonumber(ARGV[2]) >= 0 then
+		redis.call("HINCRBY", KEYS[1], ARGV[1], ARGV[2])
+	end
+	return 0
+`)
+
+// IncrCounter adds incr to a counter of a cached user, an uncached one is left alone
+func (c *UserCache) IncrCounter(uid int64, field string, incr int64) error {
+	return incrCounterScript.Run(Ctx, c.rdb, []string{fmtUserModelKey(uid)}, field, incr).Err()
+}
+
+// GetCounts returns the cached counters of the user
+func (c *UserCache) GetCounts(uid int64) (videoCount, totalLiked, likedVideoCount uint64, err error) {
+	values, err := c.rdb.HMGet(Ctx, fmtUserModelKey(uid),
+		"id", FieldVideoCount, FieldTotalLiked, FieldLikedVideoCount).Result()
+	if err != nil {
+		return 0, 0, 0, err
+	}
+	if values[0] == nil {
+		return 0, 0, 0, ErrMiss
+	}
+	counts := make([]uint64, 3)
+	for i, v := range values[1:] {
+		if s, ok := v.(string); ok {
+			counts[i], _ = strconv.ParseUint(s, 10, 64)
+		}
+	}
+	return counts[0], counts[1], counts[2], nil
+}
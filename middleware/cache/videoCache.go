@@ -0,0 +1,224 @@
+package cache
+
+import (
+	"fmt"
+	"strconv"
+	"tiktok/dao"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// VideoCache keeps the video models, the feed stream
+// and the published video sets of users
+type VideoCache struct {
+	rdb *redis.Client
+}
+
+func NewVideoCache(rdb *redis.Client) *VideoCache {
+	return &VideoCache{rdb: rdb}
+}
+
+func (c *VideoCache) GetVideoModel(videoId uint64) (dao.Video, error) {
+	key := fmtVideoModelKey(videoId)
+	values, err := c.rdb.HGetAll(Ctx, key).Result()
+	if err != nil {
+		return dao.Video{}, err
+	}
+	if len(values) == 0 {
+		return dao.Video{}, ErrMiss
+	}
+	id, _ := strconv.ParseUint(values["id"], 10, 64)
+	authorId, _ := strconv.ParseUint(values["author_id"], 10, 64)
+	likeCount, _ := strconv.ParseUint(values["like_count"], 10, 64)
+	CommentCount, _ := strconv.ParseUint(values["comment_count"], 10, 64)
+	publishAt, _ := strconv.ParseInt(values["publish_at"], 10, 64)
+
+	return dao.Video{
+		Id:           id,
+		AuthorId:     authorId,
+		Title:        values["title"],
+		PlayUrl:      values["play_url"],
+		CoverUrl:     values["cover_url"],
+		LikeCount:    likeCount,
+		CommentCount: CommentCount,
+		PublishAt:    time.UnixMilli(publishAt),
+	}, nil
+}
+
+func videoModelValues(v dao.Video) map[string]interface{} {
+	return map[string]interface{}{
+		"id":            v.Id,
+		"author_id":     v.AuthorId,
+		"title":         v.Title,
+		"play_url":      v.PlayUrl,
+		"cover_url":     v.CoverUrl,
+		"like_count":    v.LikeCount,
+		"comment_count": v.CommentCount,
+		"publish_at":    v.PublishAt.UnixMilli(),
+	}
+}
+
+func (c *VideoCache) SetVideoModel(v dao.Video) error {
+	return c.rdb.HSet(Ctx, fmtVideoModelKey(v.Id), videoModelValues(v)).Err()
+}
+
+// GetCounts returns the cached like and comment counts of the video,
+// they are signed since drifted counters may go below zero
+func (c *VideoCache) GetCounts(videoId uint64) (likeCount, commentCount int64, err error) {
+	values, err := c.rdb.HMGet(Ctx, fmtVideoModelKey(videoId), "like_count", "comment_count").Result()
+	if err != nil {
+		return 0, 0, err
+	}
+	if values[0] == nil && values[1] == nil {
+		return 0, 0, ErrMiss
+	}
+	if s, ok := values[0].(string); ok {
+		likeCount, _ = strconv.ParseInt(s, 10, 64)
+	}
+	if s, ok := values[1].(string); ok {
+		commentCount, _ = strconv.ParseInt(s, 10, 64)
+	}
+	return likeCount, commentCount, nil
+}
+
+// AddToFeed puts the video into the feed stream ordered by publish time
+func (c *VideoCache) AddToFeed(v dao.Video) error {
+	return c.rdb.ZAdd(Ctx, getVideoStreamKey(), redis.Z{
+		Score:  float64(v.PublishAt.UnixMilli()),
+		Member: v.Id,
+	}).Err()
+}
+
+// FeedAfter returns at most count ids of videos published after timestamp(ms)
+func (c *VideoCache) FeedAfter(timestamp int64, count int64) ([]uint64, error) {
+	vidStr, err := c.rdb.ZRangeByScore(Ctx, getVideoStreamKey(), &redis.ZRangeBy{
+		Min:   fmt.Sprintf("(%d", timestamp),
+		Max:   "+inf",
+		Count: count,
+	}).Result()
+	if err != nil {
+		return nil, err
+	}
+	return parseIds[uint64](vidStr), nil
+}
+
+func (c *VideoCache) LockUserPubVideos(uid uint64) (func(), error) {
+	return tryLock(c.rdb, fmtUserPubVideosKey(uid), 10*time.Second)
+}
+
+func (c *VideoCache) LoadUserPubVideos(uid uint64, videos []dao.Video) error {
+	key := fmtUserPubVideosKey(uid)
+	pipe := c.rdb.TxPipeline()
+	for _, v := range videos {
+		pipe.ZAdd(Ctx, key, redis.Z{
+			Score:  float64(v.PublishAt.UnixMilli()),
+			Member: v.Id,
+		})
+	}
+	// placeholder
+	pipe.ZAdd(Ctx, key, redis.Z{
+		Score:  0,
+		Member: "",
+	})
+	pipe.Expire(Ctx, key, 10*time.Minute)
+	_, err := pipe.Exec(Ctx)
+	return err
+}
+
+// GetUserPubVideoIds returns the ids of videos published by uid, the latest first
+func (c *VideoCache) GetUserPubVideoIds(uid uint64) ([]uint64, error) {
+	key := fmtUserPubVideosKey(uid)
+	if n, err := c.rdb.Exists(Ctx, key).Result(); err != nil {
+		return nil, err
+	} else if n == 0 {
+		return nil, ErrMiss
+	}
+	videoIds, err := c.rdb.ZRevRange(Ctx, key, 0, -1).Result()
+	if err != nil {
+		return nil, err
+	}
+	return parseIds[uint64](videoIds), nil
+}
+
+var loadNewVideoScript = redis.NewScript(`
+	local user_videos_key = KEYS[1]
+	local video_model_key = KEYS[2]
+	local video_stream_key = KEYS[3]
+
+	local vid = ARGV[1]
+	local author_id = ARGV[2]
+	local title = ARGV[3]
+	local play_url = ARGV[4]
+	local cover_url = ARGV[5]
+	local like_count = ARGV[6]
+	local comment_count = ARGV[7]
+	local publish_at = ARGV[8]
+
+	if redis.call("EXISTS", user_videos_key) == 1 then
+		redis.call("HMSET", video_model_key,
+			"id", vid,
+			"author_id", author_id,
+			"title", title,
+			"play_url", play_url,
+			"cover_url", cover_url,
+			"like_count", like_count,
+			"comment_count", comment_count,
+			"publish_at", publish_at
+		)
+		redis.call("ZADD", user_videos_key, publish_at, vid)
+		redis.call("ZADD", video_stream_key, publish_at, vid)
+		redis.call("EXPIRE", user_videos_key, 600)
+		return 0
+	else
+		return 1
+	end
+`)
+
+// AddNewVideo caches a just published video and puts it into the feed,
+// ErrMiss is returned if the published set of the author isn't cached
+func (c *VideoCache) AddNewVideo(v dao.Video) error {
+	res, err := loadNewVideoScript.Run(Ctx, c.rdb, []string{
+		fmtUserPubVideosKey(v.AuthorId),
+		fmtVideoModelKey(v.Id),
+		getVideoStreamKey(),
+	}, v.Id,
+		v.AuthorId,
+		v.Title,
+		v.PlayUrl,
+		v.CoverUrl,
+		v.LikeCount,
+		v.CommentCount,
+		v.PublishAt.UnixMilli(),
+	).Int()
+	if err != nil {
+		return fmt.Errorf("failed to run lua-script within redis - %w", err)
+	}
+	if res == 1 {
+		return ErrMiss
+	}
+	return nil
+}
+
+// EvictVideos drops deleted or changed videos from the models and the feed,
+// a changed one is loaded again on the next read
+func (c *VideoCache) EvictVideos(videoIds []uint64, deleted bool) error {
+	if len(videoIds) == 0 {
+		return nil
+	}
+	pipe := c.rdb.Pipeline()
+	members := make([]interface{}, 0, len(videoIds))
+	for _, vid := range videoIds {
+		pipe.Del(Ctx, fmtVideoModelKey(vid))
+		members = append(members, vid)
+	}
+	if deleted {
+		pipe.ZRem(Ctx, getVideoStreamKey(), members...)
+	}
+	_, err := pipe.Exec(Ctx)
+	return err
+}
+
+func (c *VideoCache) EvictUserPubVideos(uid uint64) error {
+	return c.rdb.Del(Ctx, fmtUserPubVideosKey(uid)).Err()
+}
@@ -1,25 +1,68 @@
 package jwt
 
 import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
 	"errors"
 	"fmt"
 	"strconv"
+	"strings"
 	"tiktok/config"
 	"tiktok/pkg"
 	"time"
 
 	"github.com/gin-gonic/gin"
 	"github.com/golang-jwt/jwt/v5"
+	"github.com/google/uuid"
 )
 
-const jwt_secret = "Linkvvu"
+var keys *keySet
+var tokenExpiry time.Duration
+var refreshExpiry time.Duration
+var revocations Revocations
+
+// Revocations is the revocation list consulted on every authorized request
+type Revocations interface {
+	// IsTokenRevoked reports whether any of the token or session ids is revoked
+	// or the tokens of the user issued before issuedAt are
+	IsTokenRevoked(uid string, issuedAt time.Time, ids ...string) (bool, error)
+}
+
+// Init loads the keyset and configures the tokens,
+// a nil revocations skips the revocation check
+func Init(cfg config.JWT, revoked Revocations) error {
+	set, err := loadKeySet(cfg)
+	if err != nil {
+		return err
+	}
+	keys = set
+	tokenExpiry = cfg.Expiry
+	refreshExpiry = cfg.RefreshExpiry
+	revocations = revoked
+	return nil
+}
+
+// RefreshExpiry is the lifetime of a refresh token, thus of a session
+func RefreshExpiry() time.Duration {
+	return refreshExpiry
+}
 
 type TiktokClaim struct {
 	jwt.RegisteredClaims
 	UserId string `json:"user_id"`
+	// SessionId is shared by the tokens issued from one login
+	SessionId string `json:"sid,omitempty"`
 }
 
+// getToken prefers the Authorization header, the token query and form
+// fields are still accepted but end up in the access logs
 func getToken(ctx *gin.Context) (token string) {
+	if scheme, credentials, ok := strings.Cut(ctx.GetHeader("Authorization"), " "); ok &&
+		strings.EqualFold(scheme, "Bearer") {
+		return strings.TrimSpace(credentials)
+	}
 	token = ctx.Query("token")
 	if token != "" {
 		return
@@ -28,56 +71,99 @@ func getToken(ctx *gin.Context) (token string) {
 	return
 }
 
+// AuthorizationHandler rejects the request unless it carries a valid token
 func AuthorizationHandler(ctx *gin.Context) {
 	token := getToken(ctx)
-	var appE *pkg.AppError
 	if token == "" {
-		appE = pkg.NewError(pkg.ErrValidation, fmt.Errorf("login first please!"))
+		appE := pkg.NewError(pkg.ErrValidation, fmt.Errorf("login first please!"))
+		ctx.AbortWithError(appE.HttpStatus, appE)
+		return
+	}
+	if appE := authenticate(ctx, token); appE != nil {
 		ctx.AbortWithError(appE.HttpStatus, appE)
 		return
 	}
+	ctx.Next()
+}
+
+// OptionalAuth lets tourists through with a zero user_id, a request
+// carrying a token is rejected if it is invalid so that clients refresh it
+func OptionalAuth(ctx *gin.Context) {
+	if token := getToken(ctx); token != "" {
+		if appE := authenticate(ctx, token); appE != nil {
+			if appE.Code == pkg.ErrUnmatchedPwd {
+				appE = pkg.NewError(pkg.ErrAuthException, appE.Err)
+			}
+			ctx.AbortWithError(appE.HttpStatus, appE)
+			return
+		}
+	}
+	ctx.Next()
+}
 
+// authenticate verifies the token and sets user_id and session_id
+func authenticate(ctx *gin.Context, token string) *pkg.AppError {
 	claim, err := ParsingToken(token)
 	if err != nil {
 		if errors.Is(err, jwt.ErrTokenExpired) {
-			appE = pkg.NewError(pkg.ErrAuthException, err)
-		} else {
-			appE = pkg.NewError(pkg.ErrUnmatchedPwd, err)
+			return pkg.NewError(pkg.ErrAuthException, err)
+		}
+		return pkg.NewError(pkg.ErrUnmatchedPwd, err)
+	}
+	if revocations != nil {
+		var issuedAt time.Time
+		if claim.IssuedAt != nil {
+			issuedAt = claim.IssuedAt.Time
+		}
+		revoked, err := revocations.IsTokenRevoked(claim.UserId, issuedAt, claim.ID, claim.SessionId)
+		if err != nil {
+			return pkg.NewError(pkg.ErrInternal, err)
+		}
+		if revoked {
+			return pkg.NewError(pkg.ErrAuthException, errors.New("token is revoked"))
 		}
-		ctx.AbortWithError(appE.HttpStatus, appE)
-		return
 	}
 
 	user_id, _ := strconv.ParseUint(claim.UserId, 10, 64)
 	ctx.Set("user_id", user_id)
-	ctx.Next()
+	ctx.Set("session_id", claim.SessionId)
+	return nil
 }
 
-func NewToken(user_id string) (string, error) {
+// NewToken issues an access token of the session
+func NewToken(user_id, session_id string) (string, error) {
 	claim := TiktokClaim{
-		UserId: user_id,
+		UserId:    user_id,
+		SessionId: session_id,
 		RegisteredClaims: jwt.RegisteredClaims{
+			ID:        uuid.NewString(),
 			Issuer:    "tiktok",
 			IssuedAt:  &jwt.NumericDate{Time: time.Now()},
-			ExpiresAt: &jwt.NumericDate{Time: time.Now().Add(time.Hour * 24)},
+			ExpiresAt: &jwt.NumericDate{Time: time.Now().Add(tokenExpiry)},
 		},
 	}
-	token := jwt.NewWithClaims(jwt.SigningMethodHS256, claim)
-	str, err := token.SignedString([]byte(config.JwtSecret))
-	if err != nil {
-		return "", err
+	return keys.sign(claim)
+}
+
+// NewRefreshToken returns an opaque refresh token,
+// only its hash is meant to be stored
+func NewRefreshToken() (token, hash string, err error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", "", err
 	}
-	return str, nil
+	token = base64.RawURLEncoding.EncodeToString(b)
+	return token, HashRefreshToken(token), nil
+}
+
+func HashRefreshToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
 }
 
 func ParsingToken(token string) (TiktokClaim, error) {
 	claims := &TiktokClaim{}
-	_, err := jwt.ParseWithClaims(token, claims, func(t *jwt.Token) (interface{}, error) {
-		if _, ok := t.Method.(*jwt.SigningMethodHMAC); !ok {
-			return nil, jwt.ErrSignatureInvalid
-		}
-		return []byte(jwt_secret), nil
-	})
+	_, err := jwt.ParseWithClaims(token, claims, keys.verificationKey)
 	if err != nil {
 		return TiktokClaim{}, err
 	}
@@ -0,0 +1,205 @@
+package jwt
+
+import (
+	"crypto"
+	"crypto/ed25519"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"math/big"
+	"net/http"
+	"os"
+	"sort"
+	"tiktok/config"
+
+	"github.com/gin-gonic/gin"
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// signingKey is a key of the keyset, private is nil for a key that only verifies
+type signingKey struct {
+	id      string
+	method  jwt.SigningMethod
+	private crypto.PrivateKey
+	public  crypto.PublicKey
+}
+
+type keySet struct {
+	signing *signingKey
+	keys    map[string]*signingKey
+}
+
+func loadKeySet(cfg config.JWT) (*keySet, error) {
+	set := &keySet{keys: map[string]*signingKey{}}
+	if cfg.Secret != "" {
+		secret := []byte(cfg.Secret)
+		set.keys[config.DefaultJWTKey] = &signingKey{
+			id:      config.DefaultJWTKey,
+			method:  jwt.SigningMethodHS256,
+			private: secret,
+			public:  secret,
+		}
+	}
+	for _, k := range cfg.Keys {
+		key, err := loadKey(k)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load jwt key %s - %w", k.Id, err)
+		}
+		set.keys[k.Id] = key
+	}
+
+	signing, ok := set.keys[cfg.SigningKeyId()]
+	if !ok || signing.private == nil {
+		return nil, fmt.Errorf("no private key of jwt signing key %s", cfg.SigningKeyId())
+	}
+	set.signing = signing
+	return set, nil
+}
+
+func loadKey(k config.JWTKey) (*signingKey, error) {
+	key := &signingKey{id: k.Id}
+	switch k.Algorithm {
+	case "HS256":
+		key.method = jwt.SigningMethodHS256
+		key.private = []byte(k.Secret)
+		key.public = key.private
+		return key, nil
+	case "RS256":
+		key.method = jwt.SigningMethodRS256
+	case "EdDSA":
+		key.method = jwt.SigningMethodEdDSA
+	default:
+		return nil, fmt.Errorf("unknown algorithm %s", k.Algorithm)
+	}
+
+	if k.PrivateKeyFile != "" {
+		block, err := readPEM(k.PrivateKeyFile)
+		if err != nil {
+			return nil, err
+		}
+		private, err := parsePrivateKey(block)
+		if err != nil {
+			return nil, err
+		}
+		signer, ok := private.(crypto.Signer)
+		if !ok {
+			return nil, errors.New("unsupported private key")
+		}
+		key.private = private
+		key.public = signer.Public()
+	} else {
+		block, err := readPEM(k.PublicKeyFile)
+		if err != nil {
+			return nil, err
+		}
+		if key.public, err = x509.ParsePKIXPublicKey(block.Bytes); err != nil {
+			return nil, err
+		}
+	}
+
+	switch key.public.(type) {
+	case *rsa.PublicKey:
+		if key.method != jwt.SigningMethodRS256 {
+			return nil, fmt.Errorf("an RSA key can't be used by %s", k.Algorithm)
+		}
+	case ed25519.PublicKey:
+		if key.method != jwt.SigningMethodEdDSA {
+			return nil, fmt.Errorf("an Ed25519 key can't be used by %s", k.Algorithm)
+		}
+	default:
+		return nil, fmt.Errorf("unsupported public key %T", key.public)
+	}
+	return key, nil
+}
+
+func readPEM(path string) (*pem.Block, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, fmt.Errorf("no PEM block in %s", path)
+	}
+	return block, nil
+}
+
+func parsePrivateKey(block *pem.Block) (crypto.PrivateKey, error) {
+	if block.Type == "RSA PRIVATE KEY" {
+		return x509.ParsePKCS1PrivateKey(block.Bytes)
+	}
+	return x509.ParsePKCS8PrivateKey(block.Bytes)
+}
+
+// verificationKey picks the key by the kid header of the token,
+// a token without one was signed by the default key
+func (s *keySet) verificationKey(t *jwt.Token) (interface{}, error) {
+	kid, _ := t.Header["kid"].(string)
+	if kid == "" {
+		kid = config.DefaultJWTKey
+	}
+	key, ok := s.keys[kid]
+	if !ok {
+		return nil, fmt.Errorf("unknown key %q", kid)
+	}
+	if t.Method.Alg() != key.method.Alg() {
+		return nil, jwt.ErrSignatureInvalid
+	}
+	return key.public, nil
+}
+
+func (s *keySet) sign(claims jwt.Claims) (string, error) {
+	token := jwt.NewWithClaims(s.signing.method, claims)
+	token.Header["kid"] = s.signing.id
+	return token.SignedString(s.signing.private)
+}
+
+// JWK is a public key in the JSON Web Key format
+type JWK struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Alg string `json:"alg"`
+	Use string `json:"use"`
+	// N and E are the modulus and exponent of an RSA key
+	N string `json:"n,omitempty"`
+	E string `json:"e,omitempty"`
+	// Crv and X are the curve and public key of an Ed25519 key
+	Crv string `json:"crv,omitempty"`
+	X   string `json:"x,omitempty"`
+}
+
+type JWKSResp struct {
+	Keys []JWK `json:"keys"`
+}
+
+// PublicKeys lists the asymmetric keys of the keyset, HMAC secrets are never published
+func PublicKeys() []JWK {
+	jwks := []JWK{}
+	for _, key := range keys.keys {
+		jwk := JWK{Kid: key.id, Alg: key.method.Alg(), Use: "sig"}
+		switch public := key.public.(type) {
+		case *rsa.PublicKey:
+			jwk.Kty = "RSA"
+			jwk.N = base64.RawURLEncoding.EncodeToString(public.N.Bytes())
+			jwk.E = base64.RawURLEncoding.EncodeToString(big.NewInt(int64(public.E)).Bytes())
+		case ed25519.PublicKey:
+			jwk.Kty = "OKP"
+			jwk.Crv = "Ed25519"
+			jwk.X = base64.RawURLEncoding.EncodeToString(public)
+		default:
+			continue
+		}
+		jwks = append(jwks, jwk)
+	}
+	sort.Slice(jwks, func(i, j int) bool { return jwks[i].Kid < jwks[j].Kid })
+	return jwks
+}
+
+// JWKS serves the public keys so that other services can verify the tokens
+func JWKS(ctx *gin.Context) {
+	ctx.Header("Cache-Control", "public, max-age=300")
+	ctx.JSON(http.StatusOK, JWKSResp{Keys: PublicKeys()})
+}
@@ -0,0 +1,107 @@
+package jwt
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/pem"
+	"os"
+	"path/filepath"
+	"testing"
+	"tiktok/config"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+func writePEM(t *testing.T, typ string, der []byte) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "key.pem")
+	if err := os.WriteFile(path, pem.EncodeToMemory(&pem.Block{Type: typ, Bytes: der}), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func initKeys(t *testing.T, cfg config.JWT) {
+	t.Helper()
+	cfg.Expiry = time.Hour
+	cfg.RefreshExpiry = time.Hour
+	if err := Init(cfg, nil); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestKeyRotation(t *testing.T) {
+	_, edKey, _ := ed25519.GenerateKey(rand.Reader)
+	der, err := x509.MarshalPKCS8PrivateKey(edKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	edFile := writePEM(t, "PRIVATE KEY", der)
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rsaFile := writePEM(t, "RSA PRIVATE KEY", x509.MarshalPKCS1PrivateKey(rsaKey))
+
+	// a token issued before key ids were introduced
+	legacy, err := jwt.NewWithClaims(jwt.SigningMethodHS256, TiktokClaim{UserId: "1"}).SignedString([]byte("old"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	initKeys(t, config.JWT{Secret: "old"})
+	old, err := NewToken("2", "sid")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the new key is rolled out first and signs once every replica knows it
+	initKeys(t, config.JWT{Secret: "old", Keys: []config.JWTKey{
+		{Id: "2026-10", Algorithm: "EdDSA", PrivateKeyFile: edFile},
+		{Id: "2026-04", Algorithm: "RS256", PrivateKeyFile: rsaFile},
+	}})
+	rotated, err := NewToken("3", "sid")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for token, uid := range map[string]string{legacy: "1", old: "2", rotated: "3"} {
+		claim, err := ParsingToken(token)
+		if err != nil || claim.UserId != uid {
+			t.Fatalf("expected user %s, got %+v, %v", uid, claim, err)
+		}
+	}
+	if parsed, _, _ := jwt.NewParser().ParseUnverified(rotated, &TiktokClaim{}); parsed.Header["kid"] != "2026-10" {
+		t.Fatalf("expected the token signed by the new key, header %v", parsed.Header)
+	}
+
+	jwks := PublicKeys()
+	if len(jwks) != 2 || jwks[0].Kid != "2026-04" || jwks[0].Kty != "RSA" ||
+		jwks[1].Kid != "2026-10" || jwks[1].Kty != "OKP" {
+		t.Fatalf("unexpected jwks: %+v", jwks)
+	}
+
+	// the old key is retired after the tokens it signed expire
+	initKeys(t, config.JWT{Keys: []config.JWTKey{{Id: "2026-10", Algorithm: "EdDSA", PrivateKeyFile: edFile}}})
+	if _, err := ParsingToken(old); err == nil {
+		t.Fatal("expected a token of a retired key to be rejected")
+	}
+	if _, err := ParsingToken(rotated); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestRejectsAlgorithmMismatch(t *testing.T) {
+	initKeys(t, config.JWT{Secret: "secret"})
+	// signed with the right secret but claims another algorithm of the key
+	token := jwt.NewWithClaims(jwt.SigningMethodHS512, TiktokClaim{UserId: "1"})
+	token.Header["kid"] = config.DefaultJWTKey
+	str, err := token.SignedString([]byte("secret"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ParsingToken(str); err == nil {
+		t.Fatal("expected the token to be rejected")
+	}
+}
@@ -0,0 +1,29 @@
+// Package mail sends the mails of the service, like the password reset links
+package mail
+
+import (
+	"fmt"
+	"tiktok/config"
+)
+
+type Message struct {
+	To      string
+	Subject string
+	Body    string
+}
+
+// Mailer delivers a plain text message
+type Mailer interface {
+	Send(msg Message) error
+}
+
+func NewMailer(cfg config.Mail) (Mailer, error) {
+	switch cfg.Driver {
+	case "smtp":
+		return NewSMTPMailer(cfg.From, cfg.SMTP), nil
+	case "file":
+		return NewFileMailer(cfg.From, cfg.Dir)
+	default:
+		return nil, fmt.Errorf("unknown mail driver %q", cfg.Driver)
+	}
+}
@@ -0,0 +1,51 @@
+package mail
+
+import (
+	"bytes"
+	"fmt"
+	"mime"
+	"net"
+	"net/smtp"
+	"tiktok/config"
+	"time"
+)
+
+// SMTPMailer sends the messages through an SMTP relay,
+// authenticating with PLAIN if a username is configured
+type SMTPMailer struct {
+	from string
+	cfg  config.SMTP
+}
+
+func NewSMTPMailer(from string, cfg config.SMTP) *SMTPMailer {
+	return &SMTPMailer{from: from, cfg: cfg}
+}
+
+func (m *SMTPMailer) Send(msg Message) error {
+	var auth smtp.Auth
+	if m.cfg.Username != "" {
+		host, _, err := net.SplitHostPort(m.cfg.Addr)
+		if err != nil {
+			return err
+		}
+		auth = smtp.PlainAuth("", m.cfg.Username, m.cfg.Password, host)
+	}
+	if err := smtp.SendMail(m.cfg.Addr, auth, m.from, []string{msg.To}, encode(m.from, msg)); err != nil {
+		return fmt.Errorf("failed to send mail to %s - %w", msg.To, err)
+	}
+	return nil
+}
+
+// encode renders the message in the RFC 5322 format
+func encode(from string, msg Message) []byte {
+	var b bytes.Buffer
+	fmt.Fprintf(&b, "From: %s\r\n", from)
+	fmt.Fprintf(&b, "To: %s\r\n", msg.To)
+	fmt.Fprintf(&b, "Subject: %s\r\n", mime.QEncoding.Encode("utf-8", msg.Subject))
+	fmt.Fprintf(&b, "Date: %s\r\n", time.Now().Format(time.RFC1123Z))
+	b.WriteString("MIME-Version: 1.0\r\n")
+	b.WriteString("Content-Type: text/plain; charset=utf-8\r\n")
+	b.WriteString("\r\n")
+	b.WriteString(msg.Body)
+	return b.Bytes()
+}
@@ -0,0 +1,62 @@
+package oss
+
+import (
+	"fmt"
+	"io"
+	"tiktok/config"
+	"time"
+
+	"github.com/aliyun/aliyun-oss-go-sdk/oss"
+)
+
+type AliyunStorage struct {
+	bucket     *oss.Bucket
+	bucketName string
+	endpoint   string
+}
+
+func NewAliyunStorage(cfg config.OSS) (*AliyunStorage, error) {
+	keyId, keySecret := cfg.AccessKeyId, cfg.AccessKeySecret
+	if keyId == "" || keySecret == "" {
+		provider, _ := oss.NewEnvironmentVariableCredentialsProvider()
+		cred := provider.GetCredentials()
+		keyId, keySecret = cred.GetAccessKeyID(), cred.GetAccessKeySecret()
+	}
+
+	ossClient, err := oss.New(cfg.Endpoint, keyId, keySecret)
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect OSS - %w", err)
+	}
+	bucket, err := ossClient.Bucket(cfg.Bucket)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get target bucket from OSS - %w", err)
+	}
+	return &AliyunStorage{
+		bucket:     bucket,
+		bucketName: cfg.Bucket,
+		endpoint:   cfg.Endpoint,
+	}, nil
+}
+
+func (s *AliyunStorage) Put(key string, data io.Reader) error {
+	if IsPrivate(key) {
+		return s.bucket.PutObject(key, data, oss.ObjectACL(oss.ACLPrivate))
+	}
+	return s.bucket.PutObject(key, data)
+}
+
+func (s *AliyunStorage) Get(key string) (io.ReadCloser, error) {
+	return s.bucket.GetObject(key)
+}
+
+func (s *AliyunStorage) Delete(key string) error {
+	return s.bucket.DeleteObject(key)
+}
+
+func (s *AliyunStorage) URL(key string) string {
+	return fmt.Sprintf("https://%s.%s/%s", s.bucketName, s.endpoint, key)
+}
+
+func (s *AliyunStorage) SignedURL(key string, ttl time.Duration) (string, error) {
+	return s.bucket.SignURL(key, oss.HTTPGet, int64(ttl.Seconds()))
+}
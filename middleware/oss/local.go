@@ -0,0 +1,163 @@
+package oss
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"tiktok/config"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+var ErrInvalidSignature = errors.New("invalid or expired signature")
+
+// LocalStorage keeps objects on the local disk,
+// they are served by the handler registered on RoutePath
+type LocalStorage struct {
+	dir     string
+	baseURL *url.URL
+	secret  []byte
+}
+
+func NewLocalStorage(cfg config.LocalStorage) (*LocalStorage, error) {
+	baseURL, err := url.Parse(strings.TrimSuffix(cfg.BaseURL, "/"))
+	if err != nil {
+		return nil, fmt.Errorf("invalid base url of local storage - %w", err)
+	}
+	if baseURL.Path == "" {
+		// a catch-all route on "/" would conflict with the API routes
+		return nil, errors.New("base url of local storage must have a path")
+	}
+	if err := os.MkdirAll(cfg.Dir, 0o755); err != nil {
+		return nil, fmt.Errorf("failed to create local storage dir - %w", err)
+	}
+
+	secret := []byte(cfg.Secret)
+	if len(secret) == 0 {
+		secret = make([]byte, 32)
+		if _, err := rand.Read(secret); err != nil {
+			return nil, err
+		}
+	}
+	return &LocalStorage{
+		dir:     cfg.Dir,
+		baseURL: baseURL,
+		secret:  secret,
+	}, nil
+}
+
+// filePath maps the key into dir, keys escaping dir are cleaned away
+func (s *LocalStorage) filePath(key string) string {
+	return filepath.Join(s.dir, filepath.FromSlash(path.Clean("/"+key)))
+}
+
+func (s *LocalStorage) Put(key string, data io.Reader) error {
+	p := s.filePath(key)
+	if err := os.MkdirAll(filepath.Dir(p), 0o755); err != nil {
+		return err
+	}
+
+	// writes to a temp file first so readers never see a partial object
+	tmp, err := os.CreateTemp(filepath.Dir(p), ".upload-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := io.Copy(tmp, data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), p)
+}
+
+func (s *LocalStorage) Get(key string) (io.ReadCloser, error) {
+	return os.Open(s.filePath(key))
+}
+
+func (s *LocalStorage) Delete(key string) error {
+	err := os.Remove(s.filePath(key))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	return err
+}
+
+func (s *LocalStorage) URL(key string) string {
+	return s.baseURL.JoinPath(key).String()
+}
+
+func (s *LocalStorage) SignedURL(key string, ttl time.Duration) (string, error) {
+	expires := strconv.FormatInt(time.Now().Add(ttl).Unix(), 10)
+	u := s.baseURL.JoinPath(key)
+	q := url.Values{}
+	q.Set("expires", expires)
+	q.Set("signature", s.sign(key, expires))
+	u.RawQuery = q.Encode()
+	return u.String(), nil
+}
+
+func (s *LocalStorage) sign(key, expires string) string {
+	mac := hmac.New(sha256.New, s.secret)
+	mac.Write([]byte(key + "\n" + expires))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// Verify checks the signature of a SignedURL,
+// unsigned requests are valid unless the object IsPrivate
+func (s *LocalStorage) Verify(key string, query url.Values) error {
+	expires, signature := query.Get("expires"), query.Get("signature")
+	if expires == "" && signature == "" && !IsPrivate(key) {
+		return nil
+	}
+
+	exp, err := strconv.ParseInt(expires, 10, 64)
+	if err != nil || time.Now().Unix() > exp {
+		return ErrInvalidSignature
+	}
+	if !hmac.Equal([]byte(signature), []byte(s.sign(key, expires))) {
+		return ErrInvalidSignature
+	}
+	return nil
+}
+
+// RoutePath is the path of the base url, where Serve should be mounted
+func (s *LocalStorage) RoutePath() string {
+	return s.baseURL.Path
+}
+
+// Serve handles GET requests on RoutePath + "/*key", a key which isn't clean
+// is refused as it could address a private object without looking like one
+func (s *LocalStorage) Serve(ctx *gin.Context) {
+	key := strings.TrimPrefix(ctx.Param("key"), "/")
+	if strings.TrimPrefix(path.Clean("/"+key), "/") != key {
+		ctx.AbortWithStatus(http.StatusNotFound)
+		return
+	}
+	if err := s.Verify(key, ctx.Request.URL.Query()); err != nil {
+		ctx.AbortWithStatus(http.StatusForbidden)
+		return
+	}
+
+	p := s.filePath(key)
+	info, err := os.Stat(p)
+	if err != nil || info.IsDir() {
+		ctx.AbortWithStatus(http.StatusNotFound)
+		return
+	}
+	ctx.File(p)
+}
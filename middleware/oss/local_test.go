@@ -0,0 +1,122 @@
+package oss
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"path"
+	"strings"
+	"testing"
+	"tiktok/config"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+func newTestLocalStorage(t *testing.T) (*LocalStorage, *gin.Engine) {
+	t.Helper()
+	s, err := NewLocalStorage(config.LocalStorage{
+		Dir:     t.TempDir(),
+		BaseURL: "http://localhost:8080/static",
+		Secret:  "test",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	gin.SetMode(gin.TestMode)
+	eng := gin.New()
+	eng.GET(path.Join(s.RoutePath(), "*key"), s.Serve)
+	return s, eng
+}
+
+func get(eng *gin.Engine, rawURL string) *httptest.ResponseRecorder {
+	u, _ := url.Parse(rawURL)
+	w := httptest.NewRecorder()
+	eng.ServeHTTP(w, httptest.NewRequest(http.MethodGet, u.RequestURI(), nil))
+	return w
+}
+
+func TestLocalStoragePutGetDelete(t *testing.T) {
+	s, eng := newTestLocalStorage(t)
+	key := GetKey("abc", TypeVideo)
+	if err := s.Put(key, strings.NewReader("video-data")); err != nil {
+		t.Fatal(err)
+	}
+
+	r, err := s.Get(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, _ := io.ReadAll(r)
+	r.Close()
+	if string(data) != "video-data" {
+		t.Fatalf("unexpected content %q", data)
+	}
+
+	w := get(eng, s.URL(key))
+	if w.Code != http.StatusOK || w.Body.String() != "video-data" {
+		t.Fatalf("unexpected response %d %q", w.Code, w.Body.String())
+	}
+
+	if err := s.Delete(key); err != nil {
+		t.Fatal(err)
+	}
+	if w := get(eng, s.URL(key)); w.Code != http.StatusNotFound {
+		t.Fatalf("expected 404 after delete, got %d", w.Code)
+	}
+}
+
+func TestLocalStorageSignedURL(t *testing.T) {
+	s, eng := newTestLocalStorage(t)
+	key := GetKey("abc", TypeCover)
+	if err := s.Put(key, strings.NewReader("cover")); err != nil {
+		t.Fatal(err)
+	}
+
+	signed, _ := s.SignedURL(key, time.Minute)
+	if w := get(eng, signed); w.Code != http.StatusOK {
+		t.Fatalf("expected signed url to be served, got %d", w.Code)
+	}
+
+	tampered := strings.Replace(signed, "signature=", "signature=0", 1)
+	if w := get(eng, tampered); w.Code != http.StatusForbidden {
+		t.Fatalf("expected tampered url to be rejected, got %d", w.Code)
+	}
+
+	expired, _ := s.SignedURL(key, -time.Minute)
+	if w := get(eng, expired); w.Code != http.StatusForbidden {
+		t.Fatalf("expected expired url to be rejected, got %d", w.Code)
+	}
+}
+
+func TestLocalStorageServesPrivateObjectsSignedOnly(t *testing.T) {
+	s, eng := newTestLocalStorage(t)
+	key := GetKey("abc", TypeExport)
+	if err := s.Put(key, strings.NewReader("archive")); err != nil {
+		t.Fatal(err)
+	}
+
+	if w := get(eng, s.URL(key)); w.Code != http.StatusForbidden {
+		t.Fatalf("expected the unsigned url of an archive to be rejected, got %d", w.Code)
+	}
+	signed, _ := s.SignedURL(key, time.Minute)
+	if w := get(eng, signed); w.Code != http.StatusOK {
+		t.Fatalf("expected signed url to be served, got %d", w.Code)
+	}
+
+	// keys which only become private once cleaned
+	for _, k := range []string{"/" + key, "./" + key, "cover/../" + key, "export//abc.zip"} {
+		w := get(eng, "http://localhost:8080/static/"+k)
+		if w.Code == http.StatusOK || strings.Contains(w.Body.String(), "archive") {
+			t.Fatalf("expected the unsigned url of %q to be rejected, got %d", k, w.Code)
+		}
+	}
+}
+
+func TestLocalStorageKeepsKeysInsideDir(t *testing.T) {
+	s, _ := newTestLocalStorage(t)
+	if p := s.filePath("../../etc/passwd"); !strings.HasPrefix(p, s.dir) {
+		t.Fatalf("key escaped storage dir: %s", p)
+	}
+}
@@ -3,9 +3,9 @@ package oss
 import (
 	"fmt"
 	"io"
-	"log"
-
-	"github.com/aliyun/aliyun-oss-go-sdk/oss"
+	"strings"
+	"tiktok/config"
+	"time"
 )
 
 type ObjType int
@@ -13,6 +13,9 @@ type ObjType int
 const (
 	TypeVideo ObjType = iota
 	TypeCover
+	TypeAvatar
+	TypeBackground
+	TypeExport
 )
 
 func getTypeString(t ObjType) string {
@@ -21,17 +24,58 @@ func getTypeString(t ObjType) string {
 		return "video"
 	case TypeCover:
 		return "cover"
+	case TypeAvatar:
+		return "avatar"
+	case TypeBackground:
+		return "background"
+	case TypeExport:
+		return "export"
 	default:
 		panic("invalid ObjType")
 	}
 }
 
-var ossBucket *oss.Bucket
-var bucketName = "proj-tiktok"
-var endpoint = "oss-cn-huhehaote.aliyuncs.com"
+func getTypeSuffix(t ObjType) string {
+	switch t {
+	case TypeVideo:
+		return ".mp4"
+	case TypeCover, TypeAvatar, TypeBackground:
+		return ".jpg"
+	case TypeExport:
+		return ".zip"
+	default:
+		return ""
+	}
+}
 
-// var ossChan chan OssObject
-// var defaultChanSize = 6
+// IsPrivate tells whether the object of key can only be read through a SignedURL,
+// which holds for the data archives
+func IsPrivate(key string) bool {
+	return strings.HasPrefix(key, getTypeString(TypeExport)+"/")
+}
+
+// Storage is the object storage used to keep uploaded files,
+// the objects are public unless IsPrivate
+type Storage interface {
+	Put(key string, data io.Reader) error
+	Get(key string) (io.ReadCloser, error)
+	Delete(key string) error
+	// URL returns the public address of the object
+	URL(key string) string
+	// SignedURL returns an address of the object which is valid for ttl
+	SignedURL(key string, ttl time.Duration) (string, error)
+}
+
+func NewStorage(cfg config.Storage) (Storage, error) {
+	switch cfg.Driver {
+	case "aliyun":
+		return NewAliyunStorage(cfg.OSS)
+	case "local":
+		return NewLocalStorage(cfg.Local)
+	default:
+		return nil, fmt.Errorf("unknown storage driver %q", cfg.Driver)
+	}
+}
 
 type OssObject struct {
 	T    ObjType
@@ -40,54 +84,24 @@ type OssObject struct {
 }
 
 func (o OssObject) GetKey() string {
-	var suffix string
-	switch o.T {
-	case TypeVideo:
-		suffix = ".mp4"
-	case TypeCover:
-		suffix = ".jpg"
-	}
-	return fmt.Sprintf("%s/%s%s", getTypeString(o.T), o.Name, suffix)
+	return GetKey(o.Name, o.T)
 }
 
-func init() {
-	var err error
-	var ossClient *oss.Client
-	provider, _ := oss.NewEnvironmentVariableCredentialsProvider()
-	cred := provider.GetCredentials()
-	ossClient, err = oss.New(endpoint, cred.GetAccessKeyID(), cred.GetAccessKeySecret())
-	if err != nil {
-		log.Panicln("Failed to connect OSS")
-	}
-	ossBucket, err = ossClient.Bucket(bucketName)
-	if err != nil {
-		log.Panicln("Failed to get target bucket from OSS")
-	}
-	// ossChan = make(chan OssObject, defaultChanSize)
-
-	// go handleOss()
+func GetKey(name string, t ObjType) string {
+	return fmt.Sprintf("%s/%s%s", getTypeString(t), name, getTypeSuffix(t))
 }
 
-func StoreObject(obj OssObject) error {
-	return ossBucket.PutObject(obj.GetKey(), obj.Data)
+// KeyOfURL returns the key of an object of type t from its URL,
+// false if the URL doesn't address such an object of s
+func KeyOfURL(s Storage, url string, t ObjType) (string, bool) {
+	i := strings.LastIndex(url, getTypeString(t)+"/")
+	if i < 0 {
+		return "", false
+	}
+	key := url[i:]
+	return key, s.URL(key) == url
 }
 
-// func handleOss() {
-// 	for obj := range ossChan {
-// 		err := ossBucket.PutObject(obj.GetKey(), obj.Data)
-// 		// log and discard
-// 		if err != nil {
-// 			log.Println(err.Error())
-// 		}
-// 	}
-// }
-
-func GetUrl(base string, t ObjType) string {
-	switch t {
-	case TypeVideo:
-		base += ".mp4"
-	case TypeCover:
-		base += ".jpg"
-	}
-	return fmt.Sprintf("https://%s.%s/%s/%s", bucketName, endpoint, getTypeString(t), base)
+func StoreObject(s Storage, obj OssObject) error {
+	return s.Put(obj.GetKey(), obj.Data)
 }
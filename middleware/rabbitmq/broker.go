@@ -0,0 +1,96 @@
+package rabbitmq
+
+import (
+	"context"
+	"log"
+	"strings"
+	"sync"
+	"tiktok/config"
+	"time"
+
+	amqp "github.com/rabbitmq/amqp091-go"
+)
+
+// Broker carries the named event queues of the cache over one connection,
+// the queues are declared on first use
+type Broker struct {
+	conn     *amqp.Connection
+	retry    RetryPolicy
+	prefetch int
+
+	mu     sync.Mutex
+	queues map[string]*WorkQueue
+}
+
+func NewBroker(conn *amqp.Connection, cfg config.RabbitMQ) *Broker {
+	return &Broker{
+		conn: conn,
+		retry: RetryPolicy{
+			MaxRetries: cfg.MaxRetries,
+			Backoff:    cfg.RetryBackoff,
+		},
+		prefetch: cfg.Prefetch,
+		queues:   map[string]*WorkQueue{},
+	}
+}
+
+// fmtEventQueueName maps the event names like "mq:like" to "queue.like"
+func fmtEventQueueName(name string) string {
+	return "queue." + strings.TrimPrefix(name, "mq:")
+}
+
+func (b *Broker) queue(name string) (*WorkQueue, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if q, ok := b.queues[name]; ok && !q.Channel.IsClosed() {
+		return q, nil
+	}
+
+	// (re)declares the queue, the channel of a broken one is closed by the broker
+	q, err := NewWorkQueue(b.conn, fmtEventQueueName(name), b.retry, b.prefetch)
+	if err != nil {
+		return nil, err
+	}
+	b.queues[name] = q
+	return q, nil
+}
+
+func (b *Broker) Publish(ctx context.Context, name, msg string) error {
+	q, err := b.queue(name)
+	if err != nil {
+		return err
+	}
+	return q.Publish(ctx, []byte(msg))
+}
+
+// Consume hands the messages to handle until ctx is done,
+// the consumer is restarted if its channel breaks
+func (b *Broker) Consume(ctx context.Context, name string, handle func(msg string) error) {
+	for ctx.Err() == nil {
+		q, err := b.queue(name)
+		if err == nil {
+			err = q.Consume(ctx, func(d amqp.Delivery) error {
+				return handle(string(d.Body))
+			})
+		}
+		if err == nil {
+			return
+		}
+
+		log.Printf("WARN: consumer of %s stopped, restarting, detail: %v\n", name, err)
+		select {
+		case <-ctx.Done():
+		case <-time.After(time.Second):
+		}
+	}
+}
+
+func (b *Broker) Close() error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for _, q := range b.queues {
+		q.Close()
+	}
+	b.queues = map[string]*WorkQueue{}
+	return nil
+}
@@ -7,6 +7,6 @@ const (
 	video_queue_name = "queue.video"
 )
 
-func NewCoverQueue(conn *amqp.Connection) *WorkQueue {
-	return NewWorkQueue(conn, cover_queue_name, true)
+func NewCoverQueue(conn *amqp.Connection, retry RetryPolicy, prefetch int) (*WorkQueue, error) {
+	return NewWorkQueue(conn, cover_queue_name, retry, prefetch)
 }
@@ -1,15 +1,16 @@
 package rabbitmq
 
 import (
-	"log"
+	"fmt"
+	"tiktok/config"
 
 	amqp "github.com/rabbitmq/amqp091-go"
 )
 
-func NewRmqConnection(uri string) *amqp.Connection {
-	conn, err := amqp.Dial(uri)
+func NewRmqConnection(cfg config.RabbitMQ) (*amqp.Connection, error) {
+	conn, err := amqp.Dial(cfg.URI)
 	if err != nil {
-		log.Panicf("failed to connect target MQ, detail: %s", err)
+		return nil, fmt.Errorf("failed to connect target MQ - %w", err)
 	}
-	return conn
+	return conn, nil
 }
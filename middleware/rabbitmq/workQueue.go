@@ -1,59 +1,170 @@
 package rabbitmq
 
 import (
+	"context"
+	"errors"
+	"fmt"
 	"log"
+	"time"
 
 	amqp "github.com/rabbitmq/amqp091-go"
 )
 
+// retryHeader counts the retries of a message
+const retryHeader = "x-retry-count"
+
+var ErrNacked = errors.New("message is nacked by broker")
+
+// RetryPolicy retries a failed delivery MaxRetries times, waiting
+// Backoff before the first retry and doubling it every time
+type RetryPolicy struct {
+	MaxRetries int
+	Backoff    time.Duration
+}
+
+// delay is the wait before the n-th retry, counting from 1
+func (p RetryPolicy) delay(n int) time.Duration {
+	return p.Backoff << (n - 1)
+}
+
+// WorkQueue is a durable queue with publisher confirms and manual acks.
+// Besides the queue itself it declares:
+//   - <queue>.retry.<n> queues holding the n-th retry of failed messages
+//     until their TTL expires, then dead-lettering them back to the queue
+//   - the <queue>.dlx exchange and the <queue>.dead queue bound to it,
+//     receiving the messages still failing after the last retry
 type WorkQueue struct {
 	Channel *amqp.Channel
 	Que     amqp.Queue
+
+	conn     *amqp.Connection
+	retry    RetryPolicy
+	prefetch int
+}
+
+func fmtRetryQueueName(queue string, n int) string {
+	return fmt.Sprintf("%s.retry.%d", queue, n)
+}
+
+func fmtDLXName(queue string) string {
+	return queue + ".dlx"
+}
+
+func fmtDeadQueueName(queue string) string {
+	return queue + ".dead"
 }
 
-func NewWorkQueue(conn *amqp.Connection, queue_name string, is_durable bool) *WorkQueue {
+func NewWorkQueue(conn *amqp.Connection, queue_name string, retry RetryPolicy, prefetch int) (*WorkQueue, error) {
 	channel, err := conn.Channel()
 	if err != nil {
-		log.Panicf("failed to open a channel from RabbitMQ connection, detail: %s", err)
+		return nil, fmt.Errorf("failed to open a channel from RabbitMQ connection - %w", err)
 	}
 
-	q, err := channel.QueueDeclare(
-		queue_name,
-		is_durable,
-		false,
-		false,
-		false,
-		nil,
-	)
+	q, err := declareTopology(channel, queue_name, retry)
 	if err != nil {
-		log.Panicf("failed to declare queue[%s], detail: %s", queue_name, err)
+		channel.Close()
+		return nil, err
+	}
+
+	if err := channel.Confirm(false); err != nil {
+		channel.Close()
+		return nil, fmt.Errorf("failed to put channel into confirm mode - %w", err)
 	}
 
 	return &WorkQueue{
-		Channel: channel,
-		Que:     q,
+		Channel:  channel,
+		Que:      q,
+		conn:     conn,
+		retry:    retry,
+		prefetch: prefetch,
+	}, nil
+}
+
+func declareTopology(channel *amqp.Channel, queue_name string, retry RetryPolicy) (amqp.Queue, error) {
+	dlx := fmtDLXName(queue_name)
+	if err := channel.ExchangeDeclare(dlx, amqp.ExchangeDirect, true, false, false, false, nil); err != nil {
+		return amqp.Queue{}, fmt.Errorf("failed to declare exchange[%s] - %w", dlx, err)
+	}
+	dead := fmtDeadQueueName(queue_name)
+	if _, err := channel.QueueDeclare(dead, true, false, false, false, nil); err != nil {
+		return amqp.Queue{}, fmt.Errorf("failed to declare queue[%s] - %w", dead, err)
+	}
+	if err := channel.QueueBind(dead, queue_name, dlx, false, nil); err != nil {
+		return amqp.Queue{}, fmt.Errorf("failed to bind queue[%s] - %w", dead, err)
+	}
+
+	q, err := channel.QueueDeclare(queue_name, true, false, false, false, amqp.Table{
+		"x-dead-letter-exchange":    dlx,
+		"x-dead-letter-routing-key": queue_name,
+	})
+	if err != nil {
+		return amqp.Queue{}, fmt.Errorf("failed to declare queue[%s] - %w", queue_name, err)
+	}
+
+	// a queue per retry keeps every message in it waiting the same time,
+	// a shared queue would hold short delays behind long ones
+	for n := 1; n <= retry.MaxRetries; n++ {
+		name := fmtRetryQueueName(queue_name, n)
+		_, err := channel.QueueDeclare(name, true, false, false, false, amqp.Table{
+			"x-message-ttl":             retry.delay(n).Milliseconds(),
+			"x-dead-letter-exchange":    "",
+			"x-dead-letter-routing-key": queue_name,
+		})
+		if err != nil {
+			return amqp.Queue{}, fmt.Errorf("failed to declare queue[%s] - %w", name, err)
+		}
 	}
+	return q, nil
 }
 
-func (q WorkQueue) Publish(data []byte) {
-	err := q.Channel.Publish(
+// Publish returns once the broker confirms the message is persisted
+func (q *WorkQueue) Publish(ctx context.Context, data []byte) error {
+	return q.publish(ctx, q.Que.Name, amqp.Publishing{
+		DeliveryMode: amqp.Persistent,
+		ContentType:  "text/plain",
+		Body:         data,
+	})
+}
+
+func (q *WorkQueue) publish(ctx context.Context, routingKey string, msg amqp.Publishing) error {
+	confirm, err := q.Channel.PublishWithDeferredConfirmWithContext(ctx,
 		"", // use default exchange
-		q.Que.Name,
+		routingKey,
 		false,
 		false,
-		amqp.Publishing{
-			DeliveryMode: amqp.Persistent,
-			ContentType:  "text/plain",
-			Body:         data,
-		},
+		msg,
 	)
 	if err != nil {
-		log.Panicf("failed to publish to queue[%s], detail: %s", q.Que.Name, err)
+		return fmt.Errorf("failed to publish to queue[%s] - %w", routingKey, err)
 	}
+
+	acked, err := confirm.WaitContext(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to wait for confirm of queue[%s] - %w", routingKey, err)
+	}
+	if !acked {
+		return fmt.Errorf("failed to publish to queue[%s] - %w", routingKey, ErrNacked)
+	}
+	return nil
 }
 
-func (q WorkQueue) Consume(hanlder func(amqp.Delivery)) {
-	msgs, err := q.Channel.Consume(
+// Consume hands the deliveries to handler until ctx is done. A delivery is
+// acked only after handler succeeds, otherwise it is published to the next
+// retry queue, or rejected to the dead-letter exchange after the last retry.
+// Deliveries unacked when the channel closes are requeued by the broker.
+func (q *WorkQueue) Consume(ctx context.Context, handler func(amqp.Delivery) error) error {
+	// deliveries and publishes don't share a channel,
+	// so retries aren't blocked behind unacked deliveries
+	channel, err := q.conn.Channel()
+	if err != nil {
+		return fmt.Errorf("failed to open a channel from RabbitMQ connection - %w", err)
+	}
+	defer channel.Close()
+	if err := channel.Qos(q.prefetch, 0, false); err != nil {
+		return fmt.Errorf("failed to set prefetch of queue[%s] - %w", q.Que.Name, err)
+	}
+
+	msgs, err := channel.Consume(
 		q.Que.Name,
 		"",
 		false,
@@ -63,15 +174,69 @@ func (q WorkQueue) Consume(hanlder func(amqp.Delivery)) {
 		nil,
 	)
 	if err != nil {
-		log.Panicf("failed to consume from queue[%s], detail: %s", q.Que.Name, err)
+		return fmt.Errorf("failed to consume from queue[%s] - %w", q.Que.Name, err)
+	}
+
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case d, ok := <-msgs:
+			if !ok {
+				return fmt.Errorf("deliveries of queue[%s] are closed", q.Que.Name)
+			}
+			q.settle(ctx, d, handler(d))
+		}
 	}
+}
+
+func retryCount(d amqp.Delivery) int {
+	switch n := d.Headers[retryHeader].(type) {
+	case int32:
+		return int(n)
+	case int64:
+		return int(n)
+	}
+	return 0
+}
 
-	for d := range msgs {
-		hanlder(d)
-		d.Ack(false)
+// settle acks, retries or dead-letters the delivery by the result of its handler
+func (q *WorkQueue) settle(ctx context.Context, d amqp.Delivery, err error) {
+	if err == nil {
+		if err := d.Ack(false); err != nil {
+			log.Printf("WARN: failed to ack delivery of queue[%s], detail: %v\n", q.Que.Name, err)
+		}
+		return
+	}
+
+	n := retryCount(d) + 1
+	if n > q.retry.MaxRetries {
+		log.Printf("WARN: delivery of queue[%s] failed %d times, dead-lettered, detail: %v\n", q.Que.Name, n, err)
+		d.Nack(false, false)
+		return
+	}
+
+	log.Printf("WARN: delivery of queue[%s] failed, retry %d in %v, detail: %v\n", q.Que.Name, n, q.retry.delay(n), err)
+	headers := amqp.Table{}
+	for k, v := range d.Headers {
+		headers[k] = v
+	}
+	headers[retryHeader] = int32(n)
+	err = q.publish(ctx, fmtRetryQueueName(q.Que.Name, n), amqp.Publishing{
+		Headers:      headers,
+		DeliveryMode: amqp.Persistent,
+		ContentType:  d.ContentType,
+		Body:         d.Body,
+	})
+	if err != nil {
+		// the retry isn't persisted, gives the delivery back instead of losing it
+		log.Printf("WARN: failed to schedule retry of queue[%s], requeued, detail: %v\n", q.Que.Name, err)
+		d.Nack(false, true)
+		return
 	}
+	d.Ack(false)
 }
 
-func (q WorkQueue) Close() error {
+func (q *WorkQueue) Close() error {
 	return q.Channel.Close()
 }
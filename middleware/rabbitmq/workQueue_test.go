@@ -0,0 +1,37 @@
+package rabbitmq
+
+import (
+	"testing"
+	"time"
+
+	amqp "github.com/rabbitmq/amqp091-go"
+)
+
+func TestRetryPolicyDelay(t *testing.T) {
+	p := RetryPolicy{MaxRetries: 4, Backoff: time.Second}
+	want := []time.Duration{time.Second, 2 * time.Second, 4 * time.Second, 8 * time.Second}
+	for i, w := range want {
+		if got := p.delay(i + 1); got != w {
+			t.Fatalf("retry %d: expected %v, got %v", i+1, w, got)
+		}
+	}
+}
+
+func TestRetryCount(t *testing.T) {
+	if n := retryCount(amqp.Delivery{}); n != 0 {
+		t.Fatalf("expected 0 for a first delivery, got %d", n)
+	}
+	// the header type depends on who wrote it
+	if n := retryCount(amqp.Delivery{Headers: amqp.Table{retryHeader: int32(2)}}); n != 2 {
+		t.Fatalf("expected 2, got %d", n)
+	}
+	if n := retryCount(amqp.Delivery{Headers: amqp.Table{retryHeader: int64(3)}}); n != 3 {
+		t.Fatalf("expected 3, got %d", n)
+	}
+}
+
+func TestEventQueueName(t *testing.T) {
+	if name := fmtEventQueueName("mq:delete_comment"); name != "queue.delete_comment" {
+		t.Fatalf("unexpected queue name %s", name)
+	}
+}
@@ -0,0 +1,67 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"strconv"
+	"tiktok/dao"
+)
+
+const migrateUsage = "usage: tiktok migrate [up | down [steps] | status]"
+
+// runMigrate only needs MySQL, the rest of the app isn't started
+func runMigrate(app *App, args []string) error {
+	if err := app.WithDB().Start(); err != nil {
+		return err
+	}
+	defer app.Stop(context.Background())
+
+	migrator, err := dao.NewMigrator(app.db)
+	if err != nil {
+		return err
+	}
+
+	action := "up"
+	if len(args) > 0 {
+		action = args[0]
+	}
+	switch action {
+	case "up":
+		applied, err := migrator.Up()
+		for _, m := range applied {
+			log.Printf("applied %d_%s\n", m.Version, m.Name)
+		}
+		if err == nil && len(applied) == 0 {
+			log.Println("schema is up to date")
+		}
+		return err
+	case "down":
+		steps := 1
+		if len(args) > 1 {
+			if steps, err = strconv.Atoi(args[1]); err != nil || steps <= 0 {
+				return fmt.Errorf("invalid steps %q, %s", args[1], migrateUsage)
+			}
+		}
+		reverted, err := migrator.Down(steps)
+		for _, m := range reverted {
+			log.Printf("reverted %d_%s\n", m.Version, m.Name)
+		}
+		return err
+	case "status":
+		status, err := migrator.Status()
+		if err != nil {
+			return err
+		}
+		for _, s := range status {
+			state := "pending"
+			if s.Applied {
+				state = "applied at " + s.AppliedAt.Format("2006-01-02 15:04:05")
+			}
+			fmt.Printf("%04d_%s\t%s\n", s.Version, s.Name, state)
+		}
+		return nil
+	default:
+		return fmt.Errorf("unknown action %q, %s", action, migrateUsage)
+	}
+}
@@ -3,6 +3,7 @@ package pkg
 import (
 	"fmt"
 	"net/http"
+	"time"
 )
 
 type ErrType int
@@ -12,6 +13,16 @@ type AppError struct {
 	Code       ErrType
 	Message    string
 	Err        error
+	// RetryAfter is sent as the Retry-After header if positive
+	RetryAfter time.Duration
+	// Fields are the invalid fields of the request
+	Fields []FieldError
+}
+
+// FieldError tells which field of the request is invalid and why
+type FieldError struct {
+	Field  string `json:"field"`
+	Reason string `json:"reason"`
 }
 
 func (e *AppError) Error() string {
@@ -28,6 +39,8 @@ const (
 const (
 	ErrUnmatchedPwd ErrType = iota + 2001
 	ErrAccountExisted
+	ErrLoginLocked
+	ErrUserNotFound
 )
 
 const ()
@@ -64,6 +77,16 @@ var errTypeMap = map[ErrType]AppError{
 		Code:       ErrAccountExisted,
 		Message:    "用户名已存在",
 	},
+	ErrLoginLocked: {
+		HttpStatus: http.StatusTooManyRequests,
+		Code:       ErrLoginLocked,
+		Message:    "登录失败次数过多，请稍后重试",
+	},
+	ErrUserNotFound: {
+		HttpStatus: http.StatusNotFound,
+		Code:       ErrUserNotFound,
+		Message:    "用户不存在",
+	},
 }
 
 func NewError(errType ErrType, detail error) *AppError {
@@ -75,3 +98,15 @@ func NewError(errType ErrType, detail error) *AppError {
 	appErr.Err = detail
 	return &appErr
 }
+
+// WithFields details the invalid fields of a validation error
+func (e *AppError) WithFields(fields []FieldError) *AppError {
+	e.Fields = fields
+	return e
+}
+
+// WithRetryAfter tells the client when to try again
+func (e *AppError) WithRetryAfter(d time.Duration) *AppError {
+	e.RetryAfter = d
+	return e
+}
@@ -3,6 +3,8 @@ package pkg
 type Response struct {
 	Code int    `json:"code"`
 	Msg  string `json:"message"`
+	// Fields are the invalid fields of a rejected request
+	Fields []FieldError `json:"fields,omitempty"`
 }
 
 func NewOkResp() Response {
@@ -13,5 +15,5 @@ func NewOkResp() Response {
 }
 
 func NewErrResp(err *AppError) Response {
-	return Response{int(err.Code), err.Message}
+	return Response{Code: int(err.Code), Msg: err.Message, Fields: err.Fields}
 }
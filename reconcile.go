@@ -0,0 +1,35 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"os"
+	"os/signal"
+	"tiktok/service/reconcile"
+)
+
+// runReconcile only needs MySQL and Redis, the rest of the app isn't started
+func runReconcile(app *App, args []string) error {
+	flags := flag.NewFlagSet("reconcile", flag.ContinueOnError)
+	dryRun := flags.Bool("dry-run", false, "report the discrepancies without repairing them")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+
+	if err := app.WithDB().WithCache().Start(); err != nil {
+		return err
+	}
+	defer app.Stop(context.Background())
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+	job := reconcile.NewJob(app.repos, app.caches.Videos, app.caches.Users, app.caches.Relations)
+	report, err := job.Run(ctx, *dryRun)
+	for _, d := range report.Discrepancies {
+		fmt.Println(d)
+	}
+	fmt.Printf("checked %d videos, %d users and %d follow sets, %d discrepancies found\n",
+		report.VideosChecked, report.UsersChecked, report.FollowSetsChecked, len(report.Discrepancies))
+	return err
+}
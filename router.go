@@ -1,34 +1,39 @@
 package main
 
 import (
+	"path"
 	"tiktok/controller"
 	"tiktok/middleware/jwt"
-	uSrvImp "tiktok/service/user/impl"
-	vSrvImp "tiktok/service/video/impl"
+	"tiktok/middleware/oss"
 
 	"github.com/gin-gonic/gin"
 )
 
 var videoCrl *controller.VideoController
 var userCtl *controller.UserController
+var accountCtl *controller.AccountController
 
-func initControllers() {
-	relSrv := uSrvImp.NewRelService()
-	userSrv := uSrvImp.NewUserService(relSrv)
-	likeSrv := vSrvImp.NewLikeService()
-	commSrv := vSrvImp.NewCommService()
-	videoSrv := vSrvImp.NewVideoService(userSrv, likeSrv, commSrv)
-
-	videoCrl = controller.NewVideoController(videoSrv)
-	userCtl = controller.NewUserController(userSrv)
+func initControllers(app *App) error {
+	videoCrl = controller.NewVideoController(app.videoSrv)
+	userCtl = controller.NewUserController(app.userSrv)
+	accountCtl = controller.NewAccountController(app.accountSrv)
+	return controller.RegisterValidators(app.cfg.Registration.BlockedUsernames)
 }
 
-func setRoutes(eng *gin.Engine) {
+func setRoutes(eng *gin.Engine, app *App) {
+	// serves the objects kept by the local storage backend
+	if local, ok := app.storage.(*oss.LocalStorage); ok {
+		eng.GET(path.Join(local.RoutePath(), "*key"), local.Serve)
+	}
+
+	// the public keys verifying the tokens
+	eng.GET("/.well-known/jwks.json", jwt.JWKS)
+
 	tiktok_grp := eng.Group("/tiktok", controller.ErrHandler)
 	videoGrp := tiktok_grp.Group("/videos")
-	// no need AuthorizationMiddleware
-	videoGrp.GET("/feed", videoCrl.Feed)
-	videoGrp.GET("/:video_id/comments", videoCrl.ListVideoComments)
+	// no need AuthorizationMiddleware, the viewer is known if logged in
+	videoGrp.GET("/feed", jwt.OptionalAuth, videoCrl.Feed)
+	videoGrp.GET("/:video_id/comments", jwt.OptionalAuth, videoCrl.ListVideoComments)
 
 	// need AuthorizationMiddleware
 	videoGrp.Use(jwt.AuthorizationHandler)
@@ -42,12 +47,24 @@ func setRoutes(eng *gin.Engine) {
 	// no need AuthorizationMiddleware
 	userGrp.POST("/register", userCtl.Register)
 	userGrp.POST("/login", userCtl.Login)
-	userGrp.GET("/:user_id/videos", videoCrl.ListUserPubVideos)
-	userGrp.GET("/:user_id/likes", videoCrl.ListUserLikedVideos)
+	userGrp.POST("/token/refresh", userCtl.Refresh)
+	userGrp.POST("/password/forgot", userCtl.ForgotPassword)
+	userGrp.POST("/password/reset", userCtl.ResetPassword)
+	userGrp.GET("", jwt.OptionalAuth, userCtl.ListUsers)
+	userGrp.GET("/:user_id", jwt.OptionalAuth, userCtl.GetUser)
+	userGrp.GET("/:user_id/videos", jwt.OptionalAuth, videoCrl.ListUserPubVideos)
+	userGrp.GET("/:user_id/likes", jwt.OptionalAuth, videoCrl.ListUserLikedVideos)
 
 	// need AuthorizationMiddleware
 	userGrp.Use(jwt.AuthorizationHandler)
 	userGrp.GET("/me", userCtl.GetUserInfo)
+	userGrp.PATCH("/me", userCtl.UpdateProfile)
+	userGrp.DELETE("/me", accountCtl.DeleteAccount)
+	userGrp.POST("/me/export", accountCtl.RequestExport)
+	userGrp.PUT("/me/avatar", userCtl.UploadAvatar)
+	userGrp.PUT("/me/background", userCtl.UploadBackground)
+	userGrp.POST("/logout", userCtl.Logout)
+	userGrp.PUT("/me/password", userCtl.ChangePassword)
 	userGrp.POST(":user_id/follow", userCtl.DoFollow)
 	userGrp.DELETE(":user_id/follow", userCtl.CancelFollow)
 	userGrp.GET(":user_id/followed", userCtl.GetAllFollowed)
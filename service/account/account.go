@@ -0,0 +1,137 @@
+// Package account handles the requests about an account as a whole,
+// they span the records and caches of every other service
+package account
+
+import (
+	"errors"
+	"log"
+	"tiktok/config"
+	"tiktok/dao"
+	"tiktok/middleware/cache"
+	"tiktok/middleware/jwt"
+	"tiktok/middleware/mail"
+	"tiktok/middleware/oss"
+	"tiktok/pkg"
+	uSrv "tiktok/service/user"
+)
+
+type Service struct {
+	userSrv uSrv.UserService
+	repos   dao.Repos
+	caches  cache.Caches
+	storage oss.Storage
+	mailer  mail.Mailer
+	export  config.Export
+}
+
+func NewService(userSrv uSrv.UserService, repos dao.Repos, caches cache.Caches, storage oss.Storage,
+	mailer mail.Mailer, export config.Export) *Service {
+	return &Service{
+		userSrv: userSrv,
+		repos:   repos,
+		caches:  caches,
+		storage: storage,
+		mailer:  mailer,
+		export:  export,
+	}
+}
+
+// DeleteAccount erases the user confirmed by the password along with everything
+// the user published, liked, commented or followed. The tokens are revoked first
+// so that no action of the user races the deletion. A wrong password counts as
+// a failed login of the client IP
+func (s *Service) DeleteAccount(uid uint64, password, clientIp string) error {
+	if err := s.userSrv.CheckPassword(uid, password, clientIp); err != nil {
+		return err
+	}
+	user, err := s.repos.Users.GetUserById(uid)
+	if err != nil {
+		if errors.Is(err, dao.ErrRecordNotFound) {
+			return pkg.NewError(pkg.ErrAuthException, err)
+		}
+		return pkg.NewError(pkg.ErrInternal, err)
+	}
+	if err := s.caches.Tokens.RevokeUser(uid, jwt.RefreshExpiry()); err != nil {
+		return pkg.NewError(pkg.ErrInternal, err)
+	}
+
+	videos, err := s.repos.Videos.GetVideosByAuthor(uid)
+	if err != nil {
+		return pkg.NewError(pkg.ErrInternal, err)
+	}
+	keys := s.objectKeys(user, videos)
+	deleted, err := s.repos.Users.DeleteUser(uid, keys)
+	if err != nil {
+		return pkg.NewError(pkg.ErrInternal, err)
+	}
+
+	s.purgeCaches(uid, deleted)
+	// the deleted videos include any published since the listing above
+	s.deleteObjects(s.objectKeys(user, deleted.Videos))
+	return nil
+}
+
+// objectKeys lists the storage objects of the images of user and of the videos
+func (s *Service) objectKeys(user dao.User, videos []dao.Video) []string {
+	keys := []string{}
+	add := func(url string, t oss.ObjType) {
+		if key, ok := oss.KeyOfURL(s.storage, url, t); ok {
+			keys = append(keys, key)
+		}
+	}
+	add(user.AvatarUrl, oss.TypeAvatar)
+	add(user.BackgroundImgUrl, oss.TypeBackground)
+	for _, v := range videos {
+		add(v.PlayUrl, oss.TypeVideo)
+		add(v.CoverUrl, oss.TypeCover)
+	}
+	return keys
+}
+
+// purgeCaches evicts everything the deletion changed, a failed eviction
+// leaves the cached data stale until it expires
+func (s *Service) purgeCaches(uid uint64, deleted dao.DeletedUser) {
+	warn := func(what string, err error) {
+		if err != nil {
+			log.Printf("WARN: failed to evict %s of deleted user-%d, detail: %v\n", what, uid, err)
+		}
+	}
+
+	users := append([]uint64{uid}, deleted.UserIds...)
+	for _, id := range users {
+		warn("user models", s.caches.Users.DelUserModel(int64(id)))
+		warn("follow sets", s.caches.Relations.EvictFollowSet(int64(id), false))
+		warn("follow sets", s.caches.Relations.EvictFollowSet(int64(id), true))
+	}
+	warn("liked sets", s.caches.Likes.EvictUserLikedVideos(users...))
+
+	videoIds := make([]uint64, 0, len(deleted.Videos))
+	for _, v := range deleted.Videos {
+		videoIds = append(videoIds, v.Id)
+	}
+	warn("videos", s.caches.Videos.EvictVideos(videoIds, true))
+	warn("videos", s.caches.Videos.EvictVideos(deleted.VideoIds, false))
+	warn("published videos", s.caches.Videos.EvictUserPubVideos(uid))
+
+	commented := make([]int64, 0, len(videoIds)+len(deleted.VideoIds))
+	for _, vid := range append(videoIds, deleted.VideoIds...) {
+		commented = append(commented, int64(vid))
+	}
+	warn("comments", s.caches.Comments.EvictComments(commented, deleted.CommentIds))
+}
+
+// deleteObjects deletes the objects of the deleted account, the ones failed
+// to delete stay tracked as pending uploads and are left to the upload GC
+func (s *Service) deleteObjects(keys []string) {
+	done := make([]string, 0, len(keys))
+	for _, key := range keys {
+		if err := s.storage.Delete(key); err != nil {
+			log.Printf("WARN: failed to delete object %s of a deleted account, detail: %v\n", key, err)
+			continue
+		}
+		done = append(done, key)
+	}
+	if err := s.repos.Uploads.DeletePendingUploads(done); err != nil {
+		log.Printf("WARN: failed to untrack deleted objects, detail: %v\n", err)
+	}
+}
@@ -0,0 +1,431 @@
+package account
+
+import (
+	"archive/zip"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/url"
+	"strings"
+	"testing"
+	"tiktok/config"
+	"tiktok/dao"
+	"tiktok/dao/memory"
+	"tiktok/middleware/cache"
+	"tiktok/middleware/jwt"
+	"tiktok/middleware/mail"
+	"tiktok/middleware/oss"
+	"tiktok/pkg"
+	uSrvImp "tiktok/service/user/impl"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/redis/go-redis/v9"
+	"golang.org/x/crypto/bcrypt"
+)
+
+type testEnv struct {
+	t       *testing.T
+	mr      *miniredis.Miniredis
+	repos   dao.Repos
+	caches  cache.Caches
+	storage *oss.LocalStorage
+	mailer  *recordingMailer
+	srv     *Service
+}
+
+func newTestEnv(t *testing.T) *testEnv {
+	t.Helper()
+	mr := miniredis.RunT(t)
+	rdb := redis.NewClient(&redis.Options{Addr: mr.Addr()})
+	t.Cleanup(func() { rdb.Close() })
+	caches := cache.NewCaches(rdb, nil)
+	if err := jwt.Init(config.JWT{Secret: "test", Expiry: time.Hour, RefreshExpiry: time.Hour}, caches.Tokens); err != nil {
+		t.Fatal(err)
+	}
+	storage, err := oss.NewLocalStorage(config.LocalStorage{Dir: t.TempDir(), BaseURL: "http://localhost/static"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	repos := memory.NewRepos()
+	mailer := &recordingMailer{}
+	cfg := config.Default()
+	userSrv := uSrvImp.NewUserService(nil, repos.Users, repos.Uploads, storage, caches.Users, caches.Tokens,
+		caches.Logins, mailer, cfg.Lockout, cfg.Reset)
+	return &testEnv{t: t, mr: mr, repos: repos, caches: caches, storage: storage, mailer: mailer,
+		srv: NewService(userSrv, repos, caches, storage, mailer, config.Export{Expiry: time.Hour, Cooldown: time.Hour})}
+}
+
+// recordingMailer keeps the messages instead of sending them
+type recordingMailer struct {
+	msgs []mail.Message
+	// err fails the sends while set
+	err error
+}
+
+func (m *recordingMailer) Send(msg mail.Message) error {
+	if m.err != nil {
+		return m.err
+	}
+	m.msgs = append(m.msgs, msg)
+	return nil
+}
+
+func (e *testEnv) user(username string) dao.User {
+	e.t.Helper()
+	hash, _ := bcrypt.GenerateFromPassword([]byte("p@ssw0rd"), bcrypt.MinCost)
+	u := dao.User{Username: username, Password: string(hash), Email: username + "@example.com"}
+	if err := e.repos.Users.PersistUser(&u); err != nil {
+		e.t.Fatal(err)
+	}
+	return u
+}
+
+// put stores an object and returns its URL
+func (e *testEnv) put(key string) string {
+	e.t.Helper()
+	if err := e.storage.Put(key, strings.NewReader(key)); err != nil {
+		e.t.Fatal(err)
+	}
+	return e.storage.URL(key)
+}
+
+func (e *testEnv) publish(author uint64, name string) dao.Video {
+	e.t.Helper()
+	v := dao.Video{
+		AuthorId:  author,
+		PlayUrl:   e.put(oss.GetKey(name, oss.TypeVideo)),
+		CoverUrl:  e.put(oss.GetKey(name, oss.TypeCover)),
+		PublishAt: time.Now(),
+	}
+	if _, err := e.repos.Outbox.PublishVideo(&v, nil); err != nil {
+		e.t.Fatal(err)
+	}
+	return v
+}
+
+func TestDeleteAccount(t *testing.T) {
+	e := newTestEnv(t)
+	alice, bob := e.user("alice"), e.user("bob")
+	avatar := e.put(oss.GetKey("alice", oss.TypeAvatar))
+	if _, err := e.repos.Users.UpdateProfile(alice.Id, dao.UserProfile{AvatarUrl: &avatar}, nil); err != nil {
+		t.Fatal(err)
+	}
+	aliceVideo, bobVideo := e.publish(alice.Id, "alice"), e.publish(bob.Id, "bob")
+
+	// alice and bob like, comment on and follow each other
+	for _, like := range [][2]uint64{{alice.Id, bobVideo.Id}, {bob.Id, aliceVideo.Id}} {
+		if err := e.repos.Likes.ApplyLike(like[0], like[1], true, 0); err != nil {
+			t.Fatal(err)
+		}
+		comment := dao.Comment{UserId: int64(like[0]), VideoId: int64(like[1])}
+		if err := e.repos.Comments.PersistComment(&comment); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := e.repos.Follows.PersistFollow(int64(alice.Id), int64(bob.Id), 0); err != nil {
+		t.Fatal(err)
+	}
+	if err := e.repos.Follows.PersistFollow(int64(bob.Id), int64(alice.Id), 0); err != nil {
+		t.Fatal(err)
+	}
+
+	// what bob sees is cached
+	cachedBob, _ := e.repos.Users.GetUserById(bob.Id)
+	if err := e.caches.Users.SetUserModel(cachedBob); err != nil {
+		t.Fatal(err)
+	}
+	if err := e.caches.Likes.LoadUserLikedVideos(bob.Id, []uint64{aliceVideo.Id}); err != nil {
+		t.Fatal(err)
+	}
+	if err := e.caches.Relations.LoadFollowedSet(int64(bob.Id), []int64{int64(alice.Id)}); err != nil {
+		t.Fatal(err)
+	}
+	for _, v := range []dao.Video{aliceVideo, bobVideo} {
+		if err := e.caches.Videos.SetVideoModel(v); err != nil {
+			t.Fatal(err)
+		}
+		if err := e.caches.Videos.AddToFeed(v); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	err := e.srv.DeleteAccount(alice.Id, "wrong", "10.0.0.1")
+	var appE *pkg.AppError
+	if !errors.As(err, &appE) || appE.Code != pkg.ErrUnmatchedPwd {
+		t.Fatalf("expected the wrong password to be rejected, got %v", err)
+	}
+	if err := e.srv.DeleteAccount(alice.Id, "p@ssw0rd", "10.0.0.1"); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := e.repos.Users.GetUserById(alice.Id); !errors.Is(err, dao.ErrRecordNotFound) {
+		t.Fatalf("expected alice to be gone, got %v", err)
+	}
+	if _, err := e.repos.Users.GetUserByUsername("alice"); !errors.Is(err, dao.ErrRecordNotFound) {
+		t.Fatalf("expected the username to be freed, got %v", err)
+	}
+	if _, err := e.repos.Videos.GetVideoById(aliceVideo.Id); !errors.Is(err, dao.ErrRecordNotFound) {
+		t.Fatalf("expected the video of alice to be gone, got %v", err)
+	}
+	bob, _ = e.repos.Users.GetUserById(bob.Id)
+	if bob.VideoCount != 1 || bob.TotalLiked != 0 || bob.LikedVideoCount != 0 {
+		t.Fatalf("unexpected counters of bob: %+v", bob)
+	}
+	if v, _ := e.repos.Videos.GetVideoById(bobVideo.Id); v.LikeCount != 0 || v.CommentCount != 0 {
+		t.Fatalf("unexpected counters of the video of bob: %+v", v)
+	}
+	if liked, _ := e.repos.Likes.GetLikedVideoIds(bob.Id); len(liked) != 0 {
+		t.Fatalf("expected bob to like nothing, got %v", liked)
+	}
+	if comments, _ := e.repos.Comments.GetCommentsByVideo(int64(bobVideo.Id)); len(comments) != 0 {
+		t.Fatalf("expected the comment of alice to be gone, got %+v", comments)
+	}
+	if follows, _ := e.repos.Follows.GetFollowerSet(int64(bob.Id)); len(follows) != 0 {
+		t.Fatalf("expected bob to have no follower, got %+v", follows)
+	}
+
+	for _, key := range []string{"avatar/alice.jpg", "video/alice.mp4", "cover/alice.jpg"} {
+		if r, err := e.storage.Get(key); err == nil {
+			r.Close()
+			t.Fatalf("expected %s to be deleted", key)
+		}
+	}
+	if r, err := e.storage.Get("video/bob.mp4"); err != nil {
+		t.Fatalf("expected the video of bob to be kept, got %v", err)
+	} else {
+		r.Close()
+	}
+	if pending, _ := e.repos.Uploads.ExpiredUploads(time.Now().Add(time.Hour), 10); len(pending) != 0 {
+		t.Fatalf("expected the deleted objects to be untracked, got %v", pending)
+	}
+
+	for _, key := range []string{"user_model:2", "user_likes:2", "user_followed:2", "video_model:1", "video_model:2"} {
+		if e.mr.Exists(key) {
+			t.Fatalf("expected %s to be evicted", key)
+		}
+	}
+	if feed, _ := e.caches.Videos.FeedAfter(0, 10); len(feed) != 1 || feed[0] != bobVideo.Id {
+		t.Fatalf("expected the feed to hold the video of bob only, got %v", feed)
+	}
+	if revoked, _ := e.caches.Tokens.IsTokenRevoked("1", time.Now().Add(-time.Minute)); !revoked {
+		t.Fatal("expected the tokens of alice to be revoked")
+	}
+}
+
+func TestActionsQueuedBeforeDeletionAreDropped(t *testing.T) {
+	e := newTestEnv(t)
+	alice, bob := e.user("alice"), e.user("bob")
+	aliceVideo, bobVideo := e.publish(alice.Id, "alice"), e.publish(bob.Id, "bob")
+	if err := e.srv.DeleteAccount(alice.Id, "p@ssw0rd", "10.0.0.1"); err != nil {
+		t.Fatal(err)
+	}
+
+	// consumed after the deletion
+	if err := e.repos.Likes.ApplyLike(alice.Id, bobVideo.Id, true, 1); err != nil {
+		t.Fatal(err)
+	}
+	if err := e.repos.Likes.ApplyLike(bob.Id, aliceVideo.Id, true, 1); err != nil {
+		t.Fatal(err)
+	}
+	if err := e.repos.Follows.PersistFollow(int64(bob.Id), int64(alice.Id), 1); err != nil {
+		t.Fatal(err)
+	}
+	if err := e.repos.Follows.PersistFollow(int64(alice.Id), int64(bob.Id), 1); err != nil {
+		t.Fatal(err)
+	}
+
+	if liked, _ := e.repos.Likes.GetLikedVideoIds(alice.Id); len(liked) != 0 {
+		t.Fatalf("expected alice to like nothing, got %v", liked)
+	}
+	if liked, _ := e.repos.Likes.GetLikedVideoIds(bob.Id); len(liked) != 0 {
+		t.Fatalf("expected bob to like nothing, got %v", liked)
+	}
+	if v, _ := e.repos.Videos.GetVideoById(bobVideo.Id); v.LikeCount != 0 {
+		t.Fatalf("expected no like on the video of bob, got %d", v.LikeCount)
+	}
+	if u, _ := e.repos.Users.GetUserById(bob.Id); u.TotalLiked != 0 || u.LikedVideoCount != 0 {
+		t.Fatalf("expected the counters of bob to be left alone: %+v", u)
+	}
+	followers, _ := e.repos.Follows.GetFollowerSet(int64(bob.Id))
+	followed, _ := e.repos.Follows.GetFollowedSet(int64(bob.Id))
+	if len(followers) != 0 || len(followed) != 0 {
+		t.Fatalf("expected no follow of bob, got %v and %v", followers, followed)
+	}
+}
+
+func TestDeleteAccountLockout(t *testing.T) {
+	e := newTestEnv(t)
+	alice := e.user("alice")
+	assertErrType := func(err error, want pkg.ErrType) {
+		t.Helper()
+		var appE *pkg.AppError
+		if !errors.As(err, &appE) || appE.Code != want {
+			t.Fatalf("expected error %d, got %v", want, err)
+		}
+	}
+
+	for i := 0; i < config.Default().Lockout.MaxFailures; i++ {
+		assertErrType(e.srv.DeleteAccount(alice.Id, "wrong", "10.0.0.1"), pkg.ErrUnmatchedPwd)
+	}
+	// even the right password is refused once locked out
+	assertErrType(e.srv.DeleteAccount(alice.Id, "p@ssw0rd", "10.0.0.2"), pkg.ErrLoginLocked)
+	if _, err := e.repos.Users.GetUserById(alice.Id); err != nil {
+		t.Fatalf("expected alice to be kept, got %v", err)
+	}
+}
+
+func TestExportData(t *testing.T) {
+	e := newTestEnv(t)
+	alice, bob := e.user("alice"), e.user("bob")
+	aliceVideo, bobVideo := e.publish(alice.Id, "alice"), e.publish(bob.Id, "bob")
+	if err := e.repos.Likes.ApplyLike(alice.Id, bobVideo.Id, true, 0); err != nil {
+		t.Fatal(err)
+	}
+	comment := dao.Comment{UserId: int64(alice.Id), VideoId: int64(bobVideo.Id), CommentText: "nice"}
+	if err := e.repos.Comments.PersistComment(&comment); err != nil {
+		t.Fatal(err)
+	}
+	// bob follows alice
+	if err := e.repos.Follows.PersistFollow(int64(alice.Id), int64(bob.Id), 0); err != nil {
+		t.Fatal(err)
+	}
+
+	carol := dao.User{Username: "carol"}
+	if err := e.repos.Users.PersistUser(&carol); err != nil {
+		t.Fatal(err)
+	}
+	err := e.srv.RequestExport(carol.Id)
+	var appE *pkg.AppError
+	if !errors.As(err, &appE) || appE.Code != pkg.ErrValidation {
+		t.Fatalf("expected the export to require an email, got %v", err)
+	}
+	// the second request is dropped within the cooldown
+	for range 2 {
+		if err := e.srv.RequestExport(alice.Id); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	msgs, _ := e.repos.Outbox.PendingMessages(time.Now(), 10)
+	payloads := []string{}
+	for _, m := range msgs {
+		if m.Topic == dao.TopicExportRequested {
+			payloads = append(payloads, m.Payload)
+		}
+	}
+	if len(payloads) != 1 {
+		t.Fatalf("expected one export to be queued, got %v", payloads)
+	}
+	// the first attempt fails to mail, the retry and a redelivery of the handled request follow
+	e.mailer.err = errors.New("mail server is down")
+	if err := e.srv.HandleExportRequested(payloads[0]); err == nil {
+		t.Fatal("expected the failed mail to be retried")
+	}
+	e.mailer.err = nil
+	for range 2 {
+		if err := e.srv.HandleExportRequested(payloads[0]); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if len(e.mailer.msgs) != 1 || e.mailer.msgs[0].To != alice.Email {
+		t.Fatalf("expected the link to be mailed to alice once, got %+v", e.mailer.msgs)
+	}
+	_, link, _ := strings.Cut(e.mailer.msgs[0].Body, "\n\nhttp")
+	link, _, _ = strings.Cut("http"+link, "\n")
+	u, err := url.Parse(link)
+	if err != nil {
+		t.Fatal(err)
+	}
+	key := strings.TrimPrefix(u.Path, "/static/")
+	if err := e.storage.Verify(key, u.Query()); err != nil || u.Query().Get("expires") == "" {
+		t.Fatalf("expected a signed link, got %s: %v", link, err)
+	}
+	if err := e.storage.Verify(key, url.Values{}); err == nil {
+		t.Fatal("expected the archive to require a signed link")
+	}
+
+	r, err := e.storage.Get(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, _ := io.ReadAll(r)
+	r.Close()
+	zr, err := zip.NewReader(bytes.NewReader(data), int64(len(data)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	files := map[string]string{}
+	for _, f := range zr.File {
+		fr, err := f.Open()
+		if err != nil {
+			t.Fatal(err)
+		}
+		b, _ := io.ReadAll(fr)
+		fr.Close()
+		files[f.Name] = string(b)
+	}
+	decode := func(name string, v any) {
+		t.Helper()
+		if err := json.Unmarshal([]byte(files[name]), v); err != nil {
+			t.Fatalf("invalid %s: %v", name, err)
+		}
+	}
+
+	var profile exportedProfile
+	decode("profile.json", &profile)
+	if profile.Id != alice.Id || profile.Email != alice.Email || profile.VideoCount != 1 || profile.LikedVideoCount != 1 {
+		t.Fatalf("unexpected profile: %+v", profile)
+	}
+	if strings.Contains(files["profile.json"], alice.Password) {
+		t.Fatal("expected the password hash to be left out")
+	}
+	var videos []exportedVideo
+	decode("videos.json", &videos)
+	if len(videos) != 1 || videos[0].Id != aliceVideo.Id || videos[0].PlayUrl != aliceVideo.PlayUrl {
+		t.Fatalf("unexpected videos: %+v", videos)
+	}
+	var comments []exportedComment
+	decode("comments.json", &comments)
+	if len(comments) != 1 || comments[0].Content != "nice" || comments[0].VideoId != int64(bobVideo.Id) {
+		t.Fatalf("unexpected comments: %+v", comments)
+	}
+	var likes, following, followers []int64
+	decode("likes.json", &likes)
+	decode("following.json", &following)
+	decode("followers.json", &followers)
+	if len(likes) != 1 || likes[0] != int64(bobVideo.Id) || len(following) != 0 ||
+		len(followers) != 1 || followers[0] != int64(bob.Id) {
+		t.Fatalf("unexpected likes %v, following %v or followers %v", likes, following, followers)
+	}
+
+	expiredKeys := func(now time.Time) []string {
+		msgs, _ := e.repos.Outbox.PendingMessages(now, 10)
+		keys := []string{}
+		for _, m := range msgs {
+			if m.Topic == dao.TopicExportExpired {
+				keys = append(keys, m.Payload)
+			}
+		}
+		return keys
+	}
+	if keys := expiredKeys(time.Now()); len(keys) != 0 {
+		t.Fatalf("expected the archives to be kept until the links expire, got %v", keys)
+	}
+	// the retry stored its archive over the one of the failed attempt
+	keys := expiredKeys(time.Now().Add(time.Hour + time.Minute))
+	if len(keys) != 2 || keys[0] != key || keys[1] != key {
+		t.Fatalf("expected the deletion of the archive to be scheduled by both attempts, got %v", keys)
+	}
+	for _, k := range keys {
+		if err := e.srv.HandleExportExpired(k); err != nil {
+			t.Fatal(err)
+		}
+		if r, err := e.storage.Get(k); err == nil {
+			r.Close()
+			t.Fatalf("expected archive %s to be deleted", k)
+		}
+	}
+}
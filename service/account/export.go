@@ -0,0 +1,243 @@
+package account
+
+import (
+	"archive/zip"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"strconv"
+	"strings"
+	"tiktok/dao"
+	"tiktok/middleware/mail"
+	"tiktok/middleware/oss"
+	"tiktok/pkg"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+type exportedProfile struct {
+	Id              uint64 `json:"id"`
+	Username        string `json:"username"`
+	Email           string `json:"email"`
+	Nickname        string `json:"nickname"`
+	Bio             string `json:"bio"`
+	AvatarUrl       string `json:"avatar_url"`
+	BackgroundUrl   string `json:"background_url"`
+	VideoCount      uint64 `json:"video_count"`
+	TotalLiked      uint64 `json:"total_liked"`
+	LikedVideoCount uint64 `json:"liked_video_count"`
+}
+
+type exportedVideo struct {
+	Id           uint64    `json:"id"`
+	Title        string    `json:"title"`
+	PlayUrl      string    `json:"play_url"`
+	CoverUrl     string    `json:"cover_url"`
+	PublishAt    time.Time `json:"publish_at"`
+	LikeCount    uint64    `json:"like_count"`
+	CommentCount uint64    `json:"comment_count"`
+}
+
+type exportedComment struct {
+	Id       int64  `json:"id"`
+	VideoId  int64  `json:"video_id"`
+	ParentId int64  `json:"parent_id"`
+	Content  string `json:"content"`
+	// CreateAt is a unix timestamp
+	CreateAt int64 `json:"create_at"`
+}
+
+// RequestExport queues building the data archive of the user, the download
+// link is mailed so an email address is required. Requests within the cooldown
+// of the previous one are dropped as the mail of that one is on its way
+func (s *Service) RequestExport(uid uint64) error {
+	user, err := s.repos.Users.GetUserById(uid)
+	if err != nil {
+		if errors.Is(err, dao.ErrRecordNotFound) {
+			return pkg.NewError(pkg.ErrAuthException, err)
+		}
+		return pkg.NewError(pkg.ErrInternal, err)
+	}
+	if user.Email == "" {
+		return pkg.NewError(pkg.ErrValidation, errors.New("an email address is required to receive the export"))
+	}
+	if s.export.Cooldown > 0 {
+		started, err := s.caches.Tokens.StartExportCooldown(s.export.Cooldown, uid)
+		if err != nil {
+			return pkg.NewError(pkg.ErrInternal, err)
+		}
+		if !started {
+			return nil
+		}
+	}
+	payload := fmt.Sprintf("%d:%s", uid, uuid.NewString())
+	if _, err := s.repos.Outbox.Enqueue(dao.TopicExportRequested, payload); err != nil {
+		return pkg.NewError(pkg.ErrInternal, err)
+	}
+	return nil
+}
+
+// HandleExportRequested is the outbox handler of dao.TopicExportRequested, the archive
+// is stored under the name of the request so a retry overwrites it instead of adding
+// another one, and a redelivery of a handled request is dropped
+func (s *Service) HandleExportRequested(payload string) error {
+	id, name, _ := strings.Cut(payload, ":")
+	uid, err := strconv.ParseUint(id, 10, 64)
+	if err != nil || name == "" {
+		return fmt.Errorf("invalid payload %q - %v", payload, err)
+	}
+	return s.repos.Events.Once(dao.TopicExportRequested+":"+name, func(dao.Repos) error {
+		return s.exportTo(uid, oss.GetKey(name, oss.TypeExport))
+	})
+}
+
+// exportTo stores the archive of the user under key and mails its link
+func (s *Service) exportTo(uid uint64, key string) error {
+	user, err := s.repos.Users.GetUserById(uid)
+	if errors.Is(err, dao.ErrRecordNotFound) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	archive, err := s.buildArchive(user)
+	if err != nil {
+		return fmt.Errorf("failed to build archive of user-%d - %w", uid, err)
+	}
+	// the deletion is scheduled before storing so that no archive outlives its link,
+	// apart from the transaction of Once so a failed attempt still deletes what it stored
+	expiresAt := time.Now().Add(s.export.Expiry)
+	if _, err := s.repos.Outbox.EnqueueAt(dao.TopicExportExpired, key, expiresAt); err != nil {
+		return fmt.Errorf("failed to schedule the deletion of archive %s - %w", key, err)
+	}
+	if err := s.storage.Put(key, bytes.NewReader(archive)); err != nil {
+		return fmt.Errorf("failed to store archive %s - %w", key, err)
+	}
+	link, err := s.storage.SignedURL(key, s.export.Expiry)
+	if err != nil {
+		return fmt.Errorf("failed to sign archive %s - %w", key, err)
+	}
+
+	// the email may be cleared since the request
+	if user.Email == "" {
+		log.Printf("WARN: export of user-%d is built but there is no email to send it to\n", uid)
+		return nil
+	}
+	return s.mailer.Send(mail.Message{
+		To:      user.Email,
+		Subject: "Your data export is ready",
+		Body: fmt.Sprintf("Hi %s,\n\nThe archive of your data can be downloaded within %v from the link below:\n\n%s\n\n"+
+			"If you didn't ask for it, change your password.\n",
+			user.Username, s.export.Expiry, link),
+	})
+}
+
+// HandleExportExpired is the outbox handler of dao.TopicExportExpired
+func (s *Service) HandleExportExpired(key string) error {
+	if !oss.IsPrivate(key) {
+		return fmt.Errorf("invalid payload %q - not an archive", key)
+	}
+	if err := s.storage.Delete(key); err != nil {
+		return fmt.Errorf("failed to delete archive %s - %w", key, err)
+	}
+	return nil
+}
+
+// buildArchive zips the profile, videos, comments, likes and follows of user as JSON files
+func (s *Service) buildArchive(user dao.User) ([]byte, error) {
+	videos, err := s.repos.Videos.GetVideosByAuthor(user.Id)
+	if err != nil {
+		return nil, err
+	}
+	comments, err := s.repos.Comments.GetCommentsByUser(int64(user.Id))
+	if err != nil {
+		return nil, err
+	}
+	liked, err := s.repos.Likes.GetLikedVideoIds(user.Id)
+	if err != nil {
+		return nil, err
+	}
+	followed, err := s.repos.Follows.GetFollowedSet(int64(user.Id))
+	if err != nil {
+		return nil, err
+	}
+	followers, err := s.repos.Follows.GetFollowerSet(int64(user.Id))
+	if err != nil {
+		return nil, err
+	}
+
+	exportedVideos := make([]exportedVideo, 0, len(videos))
+	for _, v := range videos {
+		exportedVideos = append(exportedVideos, exportedVideo{
+			Id:           v.Id,
+			Title:        v.Title,
+			PlayUrl:      v.PlayUrl,
+			CoverUrl:     v.CoverUrl,
+			PublishAt:    v.PublishAt,
+			LikeCount:    v.LikeCount,
+			CommentCount: v.CommentCount,
+		})
+	}
+	exportedComments := make([]exportedComment, 0, len(comments))
+	for _, c := range comments {
+		exportedComments = append(exportedComments, exportedComment{
+			Id:       c.Id,
+			VideoId:  c.VideoId,
+			ParentId: c.ParentId,
+			Content:  c.CommentText,
+			CreateAt: c.CreateAt,
+		})
+	}
+	followedIds := make([]int64, 0, len(followed))
+	for _, f := range followed {
+		followedIds = append(followedIds, f.FollowedId)
+	}
+	followerIds := make([]int64, 0, len(followers))
+	for _, f := range followers {
+		followerIds = append(followerIds, f.UserId)
+	}
+
+	files := []struct {
+		name string
+		data any
+	}{
+		{"profile.json", exportedProfile{
+			Id:              user.Id,
+			Username:        user.Username,
+			Email:           user.Email,
+			Nickname:        user.Nickname,
+			Bio:             user.Bio,
+			AvatarUrl:       user.AvatarUrl,
+			BackgroundUrl:   user.BackgroundImgUrl,
+			VideoCount:      user.VideoCount,
+			TotalLiked:      user.TotalLiked,
+			LikedVideoCount: user.LikedVideoCount,
+		}},
+		{"videos.json", exportedVideos},
+		{"comments.json", exportedComments},
+		{"likes.json", liked},
+		{"following.json", followedIds},
+		{"followers.json", followerIds},
+	}
+	var buf bytes.Buffer
+	zw := zip.NewWriter(&buf)
+	for _, f := range files {
+		w, err := zw.Create(f.name)
+		if err != nil {
+			return nil, err
+		}
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		if err := enc.Encode(f.data); err != nil {
+			return nil, err
+		}
+	}
+	if err := zw.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
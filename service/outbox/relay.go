@@ -0,0 +1,91 @@
+// Package outbox delivers the messages written to the outbox table
+// along with the changes they announce
+package outbox
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"tiktok/dao"
+	"time"
+)
+
+const (
+	// PollInterval is how often the relay looks for due messages
+	PollInterval = 5 * time.Second
+	batchSize    = 100
+	// maxBackoff bounds the delay between the attempts of a failing message,
+	// a message is retried until it is handled
+	maxBackoff = 10 * time.Minute
+)
+
+// Handler handles the payload of a message, it may be called more than once
+// for the same message so it has to be idempotent
+type Handler func(payload string) error
+
+type Relay struct {
+	repo     dao.OutboxRepo
+	handlers map[string]Handler
+	now      func() time.Time
+}
+
+func NewRelay(repo dao.OutboxRepo) *Relay {
+	return &Relay{
+		repo:     repo,
+		handlers: map[string]Handler{},
+		now:      time.Now,
+	}
+}
+
+// Handle registers the handler of the messages of topic
+func (r *Relay) Handle(topic string, h Handler) {
+	r.handlers[topic] = h
+}
+
+// Drain delivers the due messages until none is left or ctx is done,
+// a handled message is deleted and a failed one is deferred with backoff
+func (r *Relay) Drain(ctx context.Context) (delivered int, err error) {
+	for ctx.Err() == nil {
+		msgs, err := r.repo.PendingMessages(r.now(), batchSize)
+		if err != nil {
+			return delivered, fmt.Errorf("failed to list outbox messages - %w", err)
+		}
+		for _, m := range msgs {
+			if ctx.Err() != nil {
+				break
+			}
+			if err := r.deliver(m); err != nil {
+				log.Printf("WARN: failed to deliver outbox message %d of %s, attempt %d, detail: %v\n",
+					m.Id, m.Topic, m.Attempts+1, err)
+				if err := r.repo.RetryMessage(m.Id, r.now().Add(backoff(m.Attempts))); err != nil {
+					return delivered, fmt.Errorf("failed to defer outbox message %d - %w", m.Id, err)
+				}
+				continue
+			}
+			if err := r.repo.DeleteMessage(m.Id); err != nil {
+				return delivered, fmt.Errorf("failed to delete outbox message %d - %w", m.Id, err)
+			}
+			delivered++
+		}
+		if len(msgs) < batchSize {
+			break
+		}
+	}
+	return delivered, ctx.Err()
+}
+
+func (r *Relay) deliver(m dao.OutboxMessage) error {
+	h, ok := r.handlers[m.Topic]
+	if !ok {
+		return fmt.Errorf("no handler of topic %s", m.Topic)
+	}
+	return h(m.Payload)
+}
+
+// backoff is the delay after the failed attempt following the given ones
+func backoff(attempts int) time.Duration {
+	if attempts >= 10 {
+		return maxBackoff
+	}
+	return min(time.Second<<attempts, maxBackoff)
+}
@@ -0,0 +1,69 @@
+package outbox
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"tiktok/dao"
+	"tiktok/dao/memory"
+	"time"
+)
+
+func TestRelayRetriesUntilHandled(t *testing.T) {
+	repos := memory.NewRepos()
+	if _, err := repos.Outbox.PublishVideo(&dao.Video{AuthorId: 1}, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	now := time.Now()
+	relay := NewRelay(repos.Outbox)
+	relay.now = func() time.Time { return now }
+	var payloads []string
+	fail := true
+	relay.Handle(dao.TopicVideoPublished, func(payload string) error {
+		payloads = append(payloads, payload)
+		if fail {
+			return errors.New("redis is down")
+		}
+		return nil
+	})
+
+	if n, err := relay.Drain(context.Background()); err != nil || n != 0 {
+		t.Fatalf("expected nothing delivered, got %d, %v", n, err)
+	}
+	msgs, _ := repos.Outbox.PendingMessages(now.Add(time.Hour), 10)
+	if len(msgs) != 1 || msgs[0].Attempts != 1 || !msgs[0].NextAttemptAt.Equal(now.Add(time.Second)) {
+		t.Fatalf("expected the message to be deferred, got %+v", msgs)
+	}
+
+	// not due yet
+	if n, _ := relay.Drain(context.Background()); n != 0 || len(payloads) != 1 {
+		t.Fatalf("message delivered before its next attempt, %d", n)
+	}
+
+	now = now.Add(time.Second)
+	fail = false
+	if n, err := relay.Drain(context.Background()); err != nil || n != 1 {
+		t.Fatalf("expected the message delivered, got %d, %v", n, err)
+	}
+	if len(payloads) != 2 || payloads[1] != "1" {
+		t.Fatalf("unexpected payloads: %v", payloads)
+	}
+	if msgs, _ := repos.Outbox.PendingMessages(now.Add(time.Hour), 10); len(msgs) != 0 {
+		t.Fatalf("handled message isn't deleted: %+v", msgs)
+	}
+}
+
+func TestBackoff(t *testing.T) {
+	for attempts, want := range map[int]time.Duration{
+		0:  time.Second,
+		3:  8 * time.Second,
+		9:  512 * time.Second,
+		10: maxBackoff,
+		64: maxBackoff,
+	} {
+		if got := backoff(attempts); got != want {
+			t.Fatalf("backoff(%d) = %v, want %v", attempts, got, want)
+		}
+	}
+}
@@ -0,0 +1,226 @@
+// Package reconcile recomputes the denormalized counters from the records,
+// they drift when a write to MySQL or Redis is lost or applied twice
+package reconcile
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"tiktok/dao"
+	"tiktok/middleware/cache"
+)
+
+const batchSize = 500
+
+// Discrepancy is a counter that didn't match the records
+type Discrepancy struct {
+	// Store is either "mysql" or "redis"
+	Store  string
+	Object string
+	Field  string
+	Stored int64
+	Actual int64
+}
+
+func (d Discrepancy) String() string {
+	return fmt.Sprintf("%s %s %s: stored %d, actual %d", d.Store, d.Object, d.Field, d.Stored, d.Actual)
+}
+
+type Report struct {
+	VideosChecked     int
+	UsersChecked      int
+	FollowSetsChecked int
+	Discrepancies     []Discrepancy
+}
+
+// Job compares like_count and comment_count of the videos and video_count,
+// total_liked and liked_video_count of the users in MySQL and Redis
+// and the cached follow sets with the videos, likes, comments and follows tables.
+// The MySQL counters change in the same transaction as the records, while the
+// cached ones are ahead by the events still in the MQ. Those show up as discrepancies
+// too and the evicted hashes are reloaded without them, the next run catches up
+type Job struct {
+	repos      dao.Repos
+	videoCache *cache.VideoCache
+	userCache  *cache.UserCache
+	relCache   *cache.RelationCache
+}
+
+func NewJob(repos dao.Repos, videoCache *cache.VideoCache, userCache *cache.UserCache, relCache *cache.RelationCache) *Job {
+	return &Job{
+		repos:      repos,
+		videoCache: videoCache,
+		userCache:  userCache,
+		relCache:   relCache,
+	}
+}
+
+// Run reports every discrepancy and repairs it unless dryRun is set.
+// MySQL counters are recounted from the records by the statement writing them,
+// so a change made since the discrepancy was found isn't overwritten.
+// Redis hashes and follow sets are evicted to be loaded again from MySQL
+func (j *Job) Run(ctx context.Context, dryRun bool) (Report, error) {
+	report := Report{}
+	if err := j.reconcileVideos(ctx, dryRun, &report); err != nil {
+		return report, err
+	}
+	if err := j.reconcileUsers(ctx, dryRun, &report); err != nil {
+		return report, err
+	}
+	if err := j.reconcileFollowSets(ctx, dryRun, &report); err != nil {
+		return report, err
+	}
+	return report, nil
+}
+
+func (j *Job) reconcileVideos(ctx context.Context, dryRun bool, report *Report) error {
+	var afterId uint64
+	for {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		counts, err := j.repos.Videos.ListVideoCounts(afterId, batchSize)
+		if err != nil {
+			return fmt.Errorf("failed to count records of videos after %d - %w", afterId, err)
+		}
+		for _, c := range counts {
+			afterId = c.VideoId
+			report.VideosChecked++
+			if err := j.reconcileVideo(c, dryRun, report); err != nil {
+				return err
+			}
+		}
+		if len(counts) < batchSize {
+			return nil
+		}
+	}
+}
+
+func (j *Job) reconcileVideo(c dao.VideoCounts, dryRun bool, report *Report) error {
+	object := fmt.Sprintf("video-%d", c.VideoId)
+	drifted := report.compare("mysql", object, "like_count", int64(c.LikeCount), int64(c.Likes))
+	drifted = report.compare("mysql", object, "comment_count", int64(c.CommentCount), int64(c.Comments)) || drifted
+	if drifted && !dryRun {
+		if err := j.repos.Videos.RecountVideo(c.VideoId); err != nil {
+			return fmt.Errorf("failed to repair counters of %s - %w", object, err)
+		}
+	}
+
+	likeCount, commentCount, err := j.videoCache.GetCounts(c.VideoId)
+	if errors.Is(err, cache.ErrMiss) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("failed to read cached counters of %s - %w", object, err)
+	}
+	drifted = report.compare("redis", object, "like_count", likeCount, int64(c.Likes))
+	drifted = report.compare("redis", object, "comment_count", commentCount, int64(c.Comments)) || drifted
+	if drifted && !dryRun {
+		if err := j.videoCache.EvictVideos([]uint64{c.VideoId}, false); err != nil {
+			return fmt.Errorf("failed to evict %s - %w", object, err)
+		}
+	}
+	return nil
+}
+
+func (j *Job) reconcileUsers(ctx context.Context, dryRun bool, report *Report) error {
+	var afterId uint64
+	for {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		counts, err := j.repos.Users.ListUserCounts(afterId, batchSize)
+		if err != nil {
+			return fmt.Errorf("failed to count records of users after %d - %w", afterId, err)
+		}
+		for _, c := range counts {
+			afterId = c.UserId
+			report.UsersChecked++
+			if err := j.reconcileUser(c, dryRun, report); err != nil {
+				return err
+			}
+		}
+		if len(counts) < batchSize {
+			return nil
+		}
+	}
+}
+
+func (j *Job) reconcileUser(c dao.UserCounts, dryRun bool, report *Report) error {
+	object := fmt.Sprintf("user-%d", c.UserId)
+	drifted := report.compare("mysql", object, "video_count", int64(c.VideoCount), int64(c.Videos))
+	drifted = report.compare("mysql", object, "total_liked", int64(c.TotalLiked), int64(c.LikesReceived)) || drifted
+	drifted = report.compare("mysql", object, "liked_video_count", int64(c.LikedVideoCount), int64(c.LikesGiven)) || drifted
+	if drifted && !dryRun {
+		if err := j.repos.Users.RecountUser(c.UserId); err != nil {
+			return fmt.Errorf("failed to repair counters of %s - %w", object, err)
+		}
+	}
+
+	videoCount, totalLiked, likedVideoCount, err := j.userCache.GetCounts(int64(c.UserId))
+	if errors.Is(err, cache.ErrMiss) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("failed to read cached counters of %s - %w", object, err)
+	}
+	drifted = report.compare("redis", object, "video_count", int64(videoCount), int64(c.Videos))
+	drifted = report.compare("redis", object, "total_liked", int64(totalLiked), int64(c.LikesReceived)) || drifted
+	drifted = report.compare("redis", object, "liked_video_count", int64(likedVideoCount), int64(c.LikesGiven)) || drifted
+	if drifted && !dryRun {
+		if err := j.userCache.DelUserModel(int64(c.UserId)); err != nil {
+			return fmt.Errorf("failed to evict %s - %w", object, err)
+		}
+	}
+	return nil
+}
+
+func (j *Job) reconcileFollowSets(ctx context.Context, dryRun bool, report *Report) error {
+	return j.relCache.ScanFollowSets(ctx, func(uid int64, followers bool) error {
+		report.FollowSetsChecked++
+		var (
+			field   string
+			cached  uint64
+			records []dao.Follow
+			err     error
+		)
+		if followers {
+			field = "follower_count"
+			if cached, err = j.relCache.FollowerCount(uid); err == nil {
+				records, err = j.repos.Follows.GetFollowerSet(uid)
+			}
+		} else {
+			field = "followed_count"
+			if cached, err = j.relCache.FollowedCount(uid); err == nil {
+				records, err = j.repos.Follows.GetFollowedSet(uid)
+			}
+		}
+		// expired since the scan
+		if errors.Is(err, cache.ErrMiss) {
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("failed to count follows of user-%d - %w", uid, err)
+		}
+
+		object := fmt.Sprintf("user-%d", uid)
+		if report.compare("redis", object, field, int64(cached), int64(len(records))) && !dryRun {
+			if err := j.relCache.EvictFollowSet(uid, followers); err != nil {
+				return fmt.Errorf("failed to evict follow set of %s - %w", object, err)
+			}
+		}
+		return nil
+	})
+}
+
+// compare records a discrepancy and reports whether there is one
+func (r *Report) compare(store, object, field string, stored, actual int64) bool {
+	if stored == actual {
+		return false
+	}
+	d := Discrepancy{Store: store, Object: object, Field: field, Stored: stored, Actual: actual}
+	r.Discrepancies = append(r.Discrepancies, d)
+	log.Printf("WARN: counter drifted, %s\n", d)
+	return true
+}
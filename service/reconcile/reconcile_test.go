@@ -0,0 +1,187 @@
+package reconcile
+
+import (
+	"context"
+	"testing"
+	"tiktok/dao"
+	"tiktok/dao/memory"
+	"tiktok/middleware/cache"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/redis/go-redis/v9"
+)
+
+func TestReconcile(t *testing.T) {
+	mr := miniredis.RunT(t)
+	rdb := redis.NewClient(&redis.Options{Addr: mr.Addr()})
+	defer rdb.Close()
+	caches := cache.NewCaches(rdb, nil)
+	repos := memory.NewRepos()
+
+	for _, name := range []string{"alice", "bob", "carol"} {
+		if err := repos.Users.PersistUser(&dao.User{Username: name}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	video := dao.Video{AuthorId: 1, Title: "drift"}
+	if _, err := repos.Outbox.PublishVideo(&video, nil); err != nil {
+		t.Fatal(err)
+	}
+	for uid := uint64(1); uid <= 3; uid++ {
+		if err := repos.Likes.ApplyLike(uid, video.Id, true, 0); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := repos.Comments.PersistComment(&dao.Comment{UserId: 2, VideoId: int64(video.Id)}); err != nil {
+		t.Fatal(err)
+	}
+	if err := repos.Follows.PersistFollow(1, 2, 0); err != nil {
+		t.Fatal(err)
+	}
+
+	// lost and doubled writes
+	memory.SetVideoCounts(repos, video.Id, 5, 1)
+	cached := video
+	cached.LikeCount, cached.CommentCount = 3, 0
+	if err := caches.Videos.SetVideoModel(cached); err != nil {
+		t.Fatal(err)
+	}
+	if err := caches.Relations.LoadFollowerSet(1, []int64{2, 3}); err != nil {
+		t.Fatal(err)
+	}
+	if err := caches.Relations.LoadFollowedSet(2, []int64{1}); err != nil {
+		t.Fatal(err)
+	}
+
+	job := NewJob(repos, caches.Videos, caches.Users, caches.Relations)
+	report, err := job.Run(context.Background(), true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]bool{
+		"mysql video-1 like_count: stored 5, actual 3":    true,
+		"redis video-1 comment_count: stored 0, actual 1": true,
+		"redis user-1 follower_count: stored 2, actual 1": true,
+	}
+	if len(report.Discrepancies) != len(want) {
+		t.Fatalf("unexpected discrepancies: %v", report.Discrepancies)
+	}
+	for _, d := range report.Discrepancies {
+		if !want[d.String()] {
+			t.Fatalf("unexpected discrepancy: %s", d)
+		}
+	}
+	if report.VideosChecked != 1 || report.FollowSetsChecked != 2 {
+		t.Fatalf("unexpected report: %+v", report)
+	}
+	if v, _ := repos.Videos.GetVideoById(video.Id); v.LikeCount != 5 {
+		t.Fatal("dry run repaired the counters")
+	}
+
+	if _, err := job.Run(context.Background(), false); err != nil {
+		t.Fatal(err)
+	}
+	if v, _ := repos.Videos.GetVideoById(video.Id); v.LikeCount != 3 || v.CommentCount != 1 {
+		t.Fatalf("counters aren't repaired: %+v", v)
+	}
+	if mr.Exists("video_model:1") {
+		t.Fatal("drifted video isn't evicted")
+	}
+	if mr.Exists("user_followers:1") {
+		t.Fatal("drifted follower set isn't evicted")
+	}
+
+	report, err = job.Run(context.Background(), false)
+	if err != nil || len(report.Discrepancies) != 0 {
+		t.Fatalf("expected no discrepancy left, got %v, %v", report.Discrepancies, err)
+	}
+}
+
+func TestReconcileUsers(t *testing.T) {
+	mr := miniredis.RunT(t)
+	rdb := redis.NewClient(&redis.Options{Addr: mr.Addr()})
+	defer rdb.Close()
+	caches := cache.NewCaches(rdb, nil)
+	repos := memory.NewRepos()
+
+	author, fan := dao.User{Username: "author"}, dao.User{Username: "fan"}
+	for _, u := range []*dao.User{&author, &fan} {
+		if err := repos.Users.PersistUser(u); err != nil {
+			t.Fatal(err)
+		}
+	}
+	video := dao.Video{AuthorId: author.Id}
+	if _, err := repos.Outbox.PublishVideo(&video, nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := repos.Likes.ApplyLike(fan.Id, video.Id, true, 0); err != nil {
+		t.Fatal(err)
+	}
+
+	// a lost like and a doubled cached publish
+	memory.SetUserCounts(repos, fan.Id, 0, 0, 0)
+	cached, _ := repos.Users.GetUserById(author.Id)
+	cached.VideoCount = 2
+	if err := caches.Users.SetUserModel(cached); err != nil {
+		t.Fatal(err)
+	}
+
+	job := NewJob(repos, caches.Videos, caches.Users, caches.Relations)
+	report, err := job.Run(context.Background(), false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]bool{
+		"mysql user-2 liked_video_count: stored 0, actual 1": true,
+		"redis user-1 video_count: stored 2, actual 1":       true,
+	}
+	if len(report.Discrepancies) != len(want) || report.UsersChecked != 2 {
+		t.Fatalf("unexpected report: %+v", report)
+	}
+	for _, d := range report.Discrepancies {
+		if !want[d.String()] {
+			t.Fatalf("unexpected discrepancy: %s", d)
+		}
+	}
+	if u, _ := repos.Users.GetUserById(fan.Id); u.LikedVideoCount != 1 {
+		t.Fatalf("counters aren't repaired: %+v", u)
+	}
+	if mr.Exists("user_model:1") {
+		t.Fatal("drifted user isn't evicted")
+	}
+}
+
+func TestRecountKeepsConcurrentChanges(t *testing.T) {
+	repos := memory.NewRepos()
+	user := dao.User{Username: "fan"}
+	if err := repos.Users.PersistUser(&user); err != nil {
+		t.Fatal(err)
+	}
+	video := dao.Video{AuthorId: user.Id}
+	if _, err := repos.Outbox.PublishVideo(&video, nil); err != nil {
+		t.Fatal(err)
+	}
+	memory.SetVideoCounts(repos, video.Id, 5, 0)
+	memory.SetUserCounts(repos, user.Id, 0, 0, 0)
+	counts, err := repos.Videos.ListVideoCounts(0, 10)
+	if err != nil || len(counts) != 1 || counts[0].Likes != 0 {
+		t.Fatalf("unexpected counts: %+v, %v", counts, err)
+	}
+
+	// liked after the counts are read
+	if err := repos.Likes.ApplyLike(user.Id, video.Id, true, 0); err != nil {
+		t.Fatal(err)
+	}
+	if err := repos.Videos.RecountVideo(video.Id); err != nil {
+		t.Fatal(err)
+	}
+	if err := repos.Users.RecountUser(user.Id); err != nil {
+		t.Fatal(err)
+	}
+	if v, _ := repos.Videos.GetVideoById(video.Id); v.LikeCount != 1 {
+		t.Fatalf("expected the like to be kept, got %+v", v)
+	}
+	if u, _ := repos.Users.GetUserById(user.Id); u.VideoCount != 1 || u.TotalLiked != 1 || u.LikedVideoCount != 1 {
+		t.Fatalf("expected the user to be recounted, got %+v", u)
+	}
+}
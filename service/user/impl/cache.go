@@ -1,23 +1,32 @@
 package impl
 
-import "fmt"
+import (
+	"errors"
+	"log"
+	"tiktok/dao"
+	"tiktok/middleware/cache"
+)
 
-func fmtUserModelKey(uid int64) string {
-	return fmt.Sprintf("user_model:%d", uid)
-}
-
-func fmtUserFollowedSetKey(uid int64) string {
-	return fmt.Sprintf("user_followed:%d", uid)
-}
-
-func fmtUserFollowerSetKey(uid int64) string {
-	return fmt.Sprintf("user_followers:%d", uid)
-}
-
-func getFollowMqKey() string {
-	return "mq:follow"
-}
+// getUserModel reads the user through the cache and loads it from DB on miss,
+// dao.ErrRecordNotFound is returned for nonexistent users
+func getUserModel(userCache *cache.UserCache, users dao.UserRepo, uid int64) (*dao.User, error) {
+	model, err := userCache.GetUserModel(uid)
+	if errors.Is(err, cache.ErrNullValue) {
+		return nil, dao.ErrRecordNotFound
+	}
+	if !errors.Is(err, cache.ErrMiss) {
+		return model, err
+	}
 
-func init() {
-	go FollowMqConsumer()
+	loaded, err := users.GetUserById(uint64(uid))
+	if err != nil {
+		if errors.Is(err, dao.ErrRecordNotFound) {
+			userCache.SetUserNull(uid)
+		}
+		return nil, err
+	}
+	if err := userCache.SetUserModel(loaded); err != nil {
+		log.Printf("WARN: failed to cache user-%d, detail: %v\n", uid, err)
+	}
+	return &loaded, nil
 }
@@ -0,0 +1,125 @@
+package impl
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strings"
+	"tiktok/dao"
+	"tiktok/middleware/oss"
+	"tiktok/pkg"
+	uSrv "tiktok/service/user"
+
+	"github.com/google/uuid"
+)
+
+func (s *UserServiceImpl) UpdateProfile(uid uint64, nickname, bio *string) (*uSrv.UserInfo, error) {
+	if nickname != nil {
+		trimmed := strings.TrimSpace(*nickname)
+		nickname = &trimmed
+	}
+	if bio != nil {
+		trimmed := strings.TrimSpace(*bio)
+		bio = &trimmed
+	}
+	if _, err := s.updateProfile(uid, dao.UserProfile{Nickname: nickname, Bio: bio}, nil); err != nil {
+		return nil, err
+	}
+	return s.GetUserInfo(uid, uid)
+}
+
+func (s *UserServiceImpl) UploadAvatar(uid uint64, image io.Reader) (*uSrv.UserInfo, error) {
+	return s.uploadImage(uid, oss.TypeAvatar, image)
+}
+
+func (s *UserServiceImpl) UploadBackground(uid uint64, image io.Reader) (*uSrv.UserInfo, error) {
+	return s.uploadImage(uid, oss.TypeBackground, image)
+}
+
+// uploadImage replaces the avatar or background image of the user, the upload
+// is tracked as pending until the profile refers to it like a publish does
+func (s *UserServiceImpl) uploadImage(uid uint64, t oss.ObjType, image io.Reader) (*uSrv.UserInfo, error) {
+	image, err := sniffJPEG(image)
+	if err != nil {
+		return nil, err
+	}
+
+	key := oss.GetKey(uuid.NewString(), t)
+	if err := s.uploads.AddPendingUploads([]string{key}); err != nil {
+		err = fmt.Errorf("failed to track uploads, detail: %w", err)
+		return nil, pkg.NewError(pkg.ErrInternal, err)
+	}
+	if err := s.storage.Put(key, image); err != nil {
+		s.discardUpload(key)
+		err = fmt.Errorf("failed to upload to storage, detail: %w", err)
+		return nil, pkg.NewError(pkg.ErrInternal, err)
+	}
+
+	url := s.storage.URL(key)
+	profile := dao.UserProfile{AvatarUrl: &url}
+	if t == oss.TypeBackground {
+		profile = dao.UserProfile{BackgroundImgUrl: &url}
+	}
+	previous, err := s.updateProfile(uid, profile, []string{key})
+	if err != nil {
+		s.discardUpload(key)
+		return nil, err
+	}
+
+	// the replaced image isn't referred to anymore, the previous url comes
+	// from the update so that concurrent uploads each delete what they replaced
+	oldUrl := previous.AvatarUrl
+	if t == oss.TypeBackground {
+		oldUrl = previous.BackgroundImgUrl
+	}
+	if oldKey, ok := oss.KeyOfURL(s.storage, *oldUrl, t); ok {
+		if err := s.storage.Delete(oldKey); err != nil {
+			log.Printf("WARN: failed to delete replaced object %s, detail: %v\n", oldKey, err)
+		}
+	}
+	return s.GetUserInfo(uid, uid)
+}
+
+// updateProfile evicts the cached model after the update and returns the
+// replaced values, a failed eviction leaves it stale until it expires
+func (s *UserServiceImpl) updateProfile(uid uint64, profile dao.UserProfile, uploadKeys []string) (dao.UserProfile, error) {
+	previous, err := s.users.UpdateProfile(uid, profile, uploadKeys)
+	if err != nil {
+		if errors.Is(err, dao.ErrRecordNotFound) {
+			return previous, pkg.NewError(pkg.ErrAuthException, err)
+		}
+		return previous, pkg.NewError(pkg.ErrInternal, err)
+	}
+	if err := s.userCache.DelUserModel(int64(uid)); err != nil {
+		log.Printf("WARN: failed to evict user-%d, detail: %v\n", uid, err)
+	}
+	return previous, nil
+}
+
+// discardUpload deletes the object of a failed upload, the upload GC
+// deletes it later if this fails too
+func (s *UserServiceImpl) discardUpload(key string) {
+	if err := s.storage.Delete(key); err != nil {
+		log.Printf("WARN: failed to delete orphaned object %s, detail: %v\n", key, err)
+		return
+	}
+	if err := s.uploads.DeletePendingUploads([]string{key}); err != nil {
+		log.Printf("WARN: failed to untrack deleted upload %s, detail: %v\n", key, err)
+	}
+}
+
+// sniffJPEG rejects anything but a JPEG image, which is how the images are stored
+func sniffJPEG(image io.Reader) (io.Reader, error) {
+	head := make([]byte, 512)
+	n, err := io.ReadFull(image, head)
+	if err != nil && !errors.Is(err, io.ErrUnexpectedEOF) {
+		return nil, pkg.NewError(pkg.ErrValidation, err)
+	}
+	if contentType := http.DetectContentType(head[:n]); contentType != "image/jpeg" {
+		return nil, pkg.NewError(pkg.ErrValidation, fmt.Errorf("%s isn't a JPEG image", contentType))
+	}
+	return io.MultiReader(bytes.NewReader(head[:n]), image), nil
+}
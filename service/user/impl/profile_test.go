@@ -0,0 +1,120 @@
+package impl
+
+import (
+	"bytes"
+	"io"
+	"strings"
+	"testing"
+	"tiktok/dao"
+	"tiktok/middleware/oss"
+	"tiktok/pkg"
+	"time"
+)
+
+// jpeg starts like a JPEG file, enough for content sniffing
+func jpeg(content string) io.Reader {
+	return bytes.NewReader(append([]byte{0xFF, 0xD8, 0xFF, 0xE0}, content...))
+}
+
+func TestUpdateProfile(t *testing.T) {
+	s := newTestUserService(t)
+	user, err := s.Register("alice", "p@ssw0rd", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// caches the user model
+	if _, err := s.GetUserInfo(user.Id, 0); err != nil {
+		t.Fatal(err)
+	}
+
+	nickname, bio := "  Alice ", "hello"
+	info, err := s.UpdateProfile(user.Id, &nickname, &bio)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Nickname != "Alice" || info.Bio != "hello" {
+		t.Fatalf("unexpected user info: %+v", info)
+	}
+
+	// nil fields are left alone
+	bio = ""
+	info, err = s.UpdateProfile(user.Id, nil, &bio)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Nickname != "Alice" || info.Bio != "" {
+		t.Fatalf("unexpected user info: %+v", info)
+	}
+}
+
+func TestUploadAvatar(t *testing.T) {
+	s := newTestUserService(t)
+	user, err := s.Register("bob", "p@ssw0rd", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = s.UploadAvatar(user.Id, strings.NewReader("not an image"))
+	assertErrType(t, err, pkg.ErrValidation)
+
+	first, err := s.UploadAvatar(user.Id, jpeg("first"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(first.AvatarUrl, "/avatar/") {
+		t.Fatalf("unexpected avatar url: %q", first.AvatarUrl)
+	}
+	second, err := s.UploadAvatar(user.Id, jpeg("second"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if second.AvatarUrl == first.AvatarUrl || second.BackgroundImgUrl != "" {
+		t.Fatalf("unexpected user info: %+v", second)
+	}
+
+	// the replaced avatar is deleted and the current one is kept by the GC
+	_, firstKey, _ := strings.Cut(first.AvatarUrl, "/static/")
+	if _, err := s.storage.Get(firstKey); err == nil {
+		t.Fatalf("replaced avatar %s isn't deleted", firstKey)
+	}
+	if keys, _ := s.uploads.ExpiredUploads(time.Now().Add(time.Hour), 10); len(keys) != 0 {
+		t.Fatalf("uploads referred to by the profile are still tracked: %v", keys)
+	}
+
+	background, err := s.UploadBackground(user.Id, jpeg("background"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(background.BackgroundImgUrl, "/background/") || background.AvatarUrl != second.AvatarUrl {
+		t.Fatalf("unexpected user info: %+v", background)
+	}
+}
+
+func TestUploadAvatarDeletesWhatItReplaces(t *testing.T) {
+	s := newTestUserService(t)
+	user, err := s.Register("carol", "p@ssw0rd", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// caches the model without an avatar
+	if _, err := s.GetUserInfo(user.Id, 0); err != nil {
+		t.Fatal(err)
+	}
+
+	// another upload swapped the avatar, and its eviction of the cache failed
+	key := oss.GetKey("concurrent", oss.TypeAvatar)
+	if err := s.storage.Put(key, jpeg("concurrent")); err != nil {
+		t.Fatal(err)
+	}
+	url := s.storage.URL(key)
+	if _, err := s.users.UpdateProfile(user.Id, dao.UserProfile{AvatarUrl: &url}, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := s.UploadAvatar(user.Id, jpeg("latest")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.storage.Get(key); err == nil {
+		t.Fatalf("replaced avatar %s isn't deleted", key)
+	}
+}
@@ -1,250 +1,184 @@
 package impl
 
 import (
+	"context"
+	"errors"
 	"fmt"
-	"log"
-	"strconv"
 	"tiktok/dao"
 	"tiktok/middleware/cache"
 	"tiktok/pkg"
-	"time"
-
-	"github.com/redis/go-redis/v9"
 )
 
-type relServiceImpl struct{}
-
-func NewRelService() *relServiceImpl {
-	return &relServiceImpl{}
+type RelServiceImpl struct {
+	follows   dao.FollowRepo
+	users     dao.UserRepo
+	events    dao.EventRepo
+	relCache  *cache.RelationCache
+	userCache *cache.UserCache
 }
 
-func encodeFollowMqMsg(targetId, userId int64, action int8) string {
-	return fmt.Sprintf("%d:%d:%d", targetId, userId, action)
+func NewRelService(follows dao.FollowRepo, users dao.UserRepo, events dao.EventRepo, relCache *cache.RelationCache, userCache *cache.UserCache) *RelServiceImpl {
+	return &RelServiceImpl{
+		follows:   follows,
+		users:     users,
+		events:    events,
+		relCache:  relCache,
+		userCache: userCache,
+	}
 }
 
-func decodeFollowMqMsg(msg string) (targetId, userId int64, action int8) {
-	fmt.Sscanf(msg, "%d:%d:%d", &targetId, &userId, &action)
-	return
+// FollowMqConsumer persists follow actions until ctx is done,
+// an action failed to persist is retried by the stream consumer
+func (s *RelServiceImpl) FollowMqConsumer(ctx context.Context) {
+	s.relCache.ConsumeFollowActions(ctx, s.persistFollowAction)
 }
 
-func FollowMqConsumer() {
-	sub := cache.Rdb.Subscribe(cache.Ctx, getFollowMqKey())
-	defer sub.Close()
-	followChan := sub.Channel()
-	for msg := range followChan {
-		msg := msg.Payload
-		tarId, userId, action := decodeFollowMqMsg(msg)
-		switch action {
-		case 0:
-			dao.DeleteFollowRecord(tarId, userId)
-		case 1:
-			dao.PersistFollow(tarId, userId)
-		default:
-			log.Printf("FATAL: unknown action in Follow MQ")
+// persistFollowAction applies the action once, a redelivered action is dropped
+func (s *RelServiceImpl) persistFollowAction(action cache.FollowAction) error {
+	err := s.events.Once(action.EventId, func(repos dao.Repos) error {
+		if action.Followed {
+			return repos.Follows.PersistFollow(action.TargetId, action.UserId, action.Seq)
 		}
+		return repos.Follows.DeleteFollowRecord(action.TargetId, action.UserId, action.Seq)
+	})
+	if err != nil {
+		return fmt.Errorf("failed to persist follow action, user-%d target-%d - %w", action.UserId, action.TargetId, err)
 	}
+	return nil
 }
 
-// todo: 检查请求合理性
-func (s *relServiceImpl) DoFollow(targetId, userId int64) error {
-	updateCache := func() error {
-		followedKey := fmtUserFollowedSetKey(userId)
-		followerKey := fmtUserFollowerSetKey(targetId)
-		followMqKey := getFollowMqKey()
-		luaScript := redis.NewScript(`
-			local followedKey = KEYS[1]
-			local followerKey = KEYS[2]
-			local followMqKey = KEYS[3]
-			local followedId = ARGV[1]
-			local followerId = ARGV[2]
-			local msg = ARGV[3]
-
-			if redis.call("EXISTS", followedKey) == 1 then
-				redis.call("SADD", followedKey, followedId)
-			end
-			if redis.call("EXISTS", followerKey) == 1 then
-				redis.call("SADD", followerKey, followerId)
-			end
-				return redis.call("PUBLISH", followMqKey, msg)
-				
-		`)
-		return luaScript.Run(cache.Ctx, cache.Rdb,
-			[]string{followedKey, followerKey, followMqKey},
-			targetId, userId, encodeFollowMqMsg(targetId, userId, 1),
-		).Err()
-	}
-
-	if err := updateCache(); err != nil {
+// DoFollow returns pkg.ErrUserNotFound if the target doesn't exist or is deleted
+func (s *RelServiceImpl) DoFollow(targetId, userId int64) error {
+	if _, err := getUserModel(s.userCache, s.users, targetId); err != nil {
+		if errors.Is(err, dao.ErrRecordNotFound) {
+			return pkg.NewError(pkg.ErrUserNotFound, err)
+		}
+		return pkg.NewError(pkg.ErrInternal, err)
+	}
+	if err := s.relCache.Follow(targetId, userId); err != nil {
 		return pkg.NewError(pkg.ErrInternal, err)
 	}
 	return nil
 }
 
 // todo: 检查请求合理性
-func (s *relServiceImpl) CancelFollow(targetId, userId int64) error {
-	followedKey := fmtUserFollowedSetKey(userId)
-	followerKey := fmtUserFollowerSetKey(targetId)
-	followMqKey := getFollowMqKey()
-	cache.Rdb.SRem(cache.Ctx, followedKey, targetId)
-	cache.Rdb.SRem(cache.Ctx, followerKey, userId)
-	err := cache.Rdb.Publish(cache.Ctx, followMqKey, encodeFollowMqMsg(targetId, userId, 0)).Err()
-	if err != nil {
+func (s *RelServiceImpl) CancelFollow(targetId, userId int64) error {
+	if err := s.relCache.Unfollow(targetId, userId); err != nil {
 		return pkg.NewError(pkg.ErrInternal, err)
 	}
 	return nil
 }
 
 // todo: use distributed lock
-func (s *relServiceImpl) CacheFollowedSet(uid int64) error {
-	key := fmtUserFollowedSetKey(uid)
-	models, err := dao.GetFollowedSet(uid)
+func (s *RelServiceImpl) CacheFollowedSet(uid int64) error {
+	models, err := s.follows.GetFollowedSet(uid)
 	if err != nil {
 		return pkg.NewError(pkg.ErrInternal, err)
 	}
 
-	pipe := cache.Rdb.Pipeline()
+	ids := make([]int64, 0, len(models))
 	for _, m := range models {
-		pipe.SAdd(cache.Ctx, key, m.FollowedId)
+		ids = append(ids, m.FollowedId)
 	}
-	_, err = pipe.Exec(cache.Ctx)
-	if err != nil {
+	if err := s.relCache.LoadFollowedSet(uid, ids); err != nil {
 		return pkg.NewError(pkg.ErrInternal, err)
 	}
-	cache.Rdb.SAdd(cache.Ctx, key, "")
-	cache.Rdb.Expire(cache.Ctx, key, 10*time.Minute)
 	return nil
 }
 
 // todo: use distributed lock
-func (s *relServiceImpl) CacheFollowerSet(uid int64) error {
-	key := fmtUserFollowerSetKey(uid)
-	models, err := dao.GetFollowerSet(uid)
+func (s *RelServiceImpl) CacheFollowerSet(uid int64) error {
+	models, err := s.follows.GetFollowerSet(uid)
 	if err != nil {
 		return pkg.NewError(pkg.ErrInternal, err)
 	}
 
-	pipe := cache.Rdb.Pipeline()
+	ids := make([]int64, 0, len(models))
 	for _, m := range models {
-		pipe.SAdd(cache.Ctx, key, m.UserId)
+		ids = append(ids, m.UserId)
 	}
-	_, err = pipe.Exec(cache.Ctx)
-	if err != nil {
+	if err := s.relCache.LoadFollowerSet(uid, ids); err != nil {
 		return pkg.NewError(pkg.ErrInternal, err)
 	}
-	cache.Rdb.SAdd(cache.Ctx, key, "")
-	cache.Rdb.Expire(cache.Ctx, key, 10*time.Minute)
 	return nil
 }
 
-func (s *relServiceImpl) GetAllFollowedModels(targetId, userId int64) ([]dao.User, error) {
-	key := fmtUserFollowedSetKey(targetId)
-	if cache.Rdb.Exists(cache.Ctx, key).Val() == 0 {
+func (s *RelServiceImpl) GetAllFollowedModels(targetId, userId int64) ([]dao.User, error) {
+	uids, err := s.relCache.GetFollowedIds(targetId)
+	if errors.Is(err, cache.ErrMiss) {
 		if err := s.CacheFollowedSet(targetId); err != nil {
 			return nil, err
 		}
 		return s.GetAllFollowedModels(targetId, userId)
 	}
-
-	uids, err := cache.Rdb.SMembers(cache.Ctx, key).Result()
 	if err != nil {
 		return nil, pkg.NewError(pkg.ErrInternal, err)
 	}
-
-	userModels, err := s.retrieveUsersFromCacheStr(uids)
-	if err != nil {
-		return nil, err
-	}
-	return userModels, nil
+	return s.retrieveUsersFromCache(uids)
 }
 
-func (s *relServiceImpl) GetAllFollowerModels(targetId, userId int64) ([]dao.User, error) {
-	key := fmtUserFollowerSetKey(targetId)
-	if cache.Rdb.Exists(cache.Ctx, key).Val() == 0 {
+func (s *RelServiceImpl) GetAllFollowerModels(targetId, userId int64) ([]dao.User, error) {
+	uids, err := s.relCache.GetFollowerIds(targetId)
+	if errors.Is(err, cache.ErrMiss) {
 		if err := s.CacheFollowerSet(targetId); err != nil {
 			return nil, err
 		}
 		return s.GetAllFollowerModels(targetId, userId)
 	}
-
-	uids, err := cache.Rdb.SMembers(cache.Ctx, key).Result()
 	if err != nil {
 		return nil, pkg.NewError(pkg.ErrInternal, err)
 	}
-
-	userModels, err := s.retrieveUsersFromCacheStr(uids)
-	if err != nil {
-		return nil, err
-	}
-	return userModels, nil
+	return s.retrieveUsersFromCache(uids)
 }
 
-func (s *relServiceImpl) IsFollowed(targetId, userId int64) (bool, error) {
-	key := fmtUserFollowedSetKey(userId)
-	if cache.Rdb.Exists(cache.Ctx, key).Val() == 0 {
+func (s *RelServiceImpl) IsFollowed(targetId, userId int64) (bool, error) {
+	followed, err := s.relCache.IsFollowed(targetId, userId)
+	if errors.Is(err, cache.ErrMiss) {
 		if err := s.CacheFollowedSet(userId); err != nil {
 			return false, err
 		}
 		return s.IsFollowed(targetId, userId)
 	}
-
-	followed, err := cache.Rdb.SIsMember(cache.Ctx, key, interface{}(targetId)).Result()
 	if err != nil {
 		return false, pkg.NewError(pkg.ErrInternal, err)
 	}
 	return followed, nil
 }
 
-// FIXME: 优化占位符处理
-func (s *relServiceImpl) GetFollowerCnt(targetId, userId int64) (uint64, error) {
-	key := fmtUserFollowerSetKey(targetId)
-	if cache.Rdb.Exists(cache.Ctx, key).Val() == 0 {
+func (s *RelServiceImpl) GetFollowerCnt(targetId, userId int64) (uint64, error) {
+	cnt, err := s.relCache.FollowerCount(targetId)
+	if errors.Is(err, cache.ErrMiss) {
 		if err := s.CacheFollowerSet(targetId); err != nil {
 			return 0, err
 		}
 		return s.GetFollowerCnt(targetId, userId)
 	}
-	cnt, err := cache.Rdb.SCard(cache.Ctx, key).Uint64()
 	if err != nil {
 		return 0, pkg.NewError(pkg.ErrInternal, err)
 	}
-	return cnt - 1, nil
+	return cnt, nil
 }
 
-// FIXME: 优化占位符处理
-func (s *relServiceImpl) GetFollowedCnt(targetId, userId int64) (uint64, error) {
-	key := fmtUserFollowedSetKey(targetId)
-	if cache.Rdb.Exists(cache.Ctx, key).Val() == 0 {
+func (s *RelServiceImpl) GetFollowedCnt(targetId, userId int64) (uint64, error) {
+	cnt, err := s.relCache.FollowedCount(targetId)
+	if errors.Is(err, cache.ErrMiss) {
 		if err := s.CacheFollowedSet(targetId); err != nil {
 			return 0, err
 		}
 		return s.GetFollowedCnt(targetId, userId)
 	}
-	cnt, err := cache.Rdb.SCard(cache.Ctx, key).Uint64()
 	if err != nil {
 		return 0, pkg.NewError(pkg.ErrInternal, err)
 	}
-	return cnt - 1, nil
-}
-
-func (s *relServiceImpl) retrieveUsersFromCacheStr(uidStr []string) ([]dao.User, error) {
-	uids := make([]int64, 0, len(uidStr))
-	for _, str := range uidStr {
-		if str == "" {
-			continue
-		}
-
-		uid, _ := strconv.ParseInt(str, 10, 64)
-		uids = append(uids, uid)
-	}
-	return s.retrieveUsersFromCache(uids)
+	return cnt, nil
 }
 
-func (s *relServiceImpl) retrieveUsersFromCache(uids []int64) ([]dao.User, error) {
+func (s *RelServiceImpl) retrieveUsersFromCache(uids []int64) ([]dao.User, error) {
 	models := make([]dao.User, 0, len(uids))
 	for _, uid := range uids {
-		model, err := getUserModelFromCache(uid)
+		model, err := getUserModel(s.userCache, s.users, uid)
 		if err != nil {
-			fmt.Printf("WARN: video-%d retrieval failed, skipped, detail: %v\n", uid, err)
+			fmt.Printf("WARN: user-%d retrieval failed, skipped, detail: %v\n", uid, err)
 			continue
 		}
 		models = append(models, *model)
@@ -0,0 +1,63 @@
+package impl
+
+import (
+	"context"
+	"testing"
+	"tiktok/dao"
+	"tiktok/dao/memory"
+	"tiktok/middleware/cache"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/redis/go-redis/v9"
+)
+
+func TestReorderedFollowActions(t *testing.T) {
+	mr := miniredis.RunT(t)
+	caches := cache.NewCaches(redis.NewClient(&redis.Options{Addr: mr.Addr()}), nil)
+	repos := memory.NewRepos()
+	for _, name := range []string{"alice", "bob"} {
+		if err := repos.Users.PersistUser(&dao.User{Username: name}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	s := NewRelService(repos.Follows, repos.Users, repos.Events, caches.Relations, caches.Users)
+
+	if err := s.DoFollow(1, 2); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.CancelFollow(1, 2); err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	received := make(chan cache.FollowAction, 2)
+	go caches.Relations.ConsumeFollowActions(ctx, func(a cache.FollowAction) error {
+		received <- a
+		return nil
+	})
+	actions := []cache.FollowAction{}
+	for range 2 {
+		select {
+		case a := <-received:
+			actions = append(actions, a)
+		case <-time.After(5 * time.Second):
+			t.Fatal("follow action isn't delivered")
+		}
+	}
+
+	// another consumer reclaimed the follow and applies it after the unfollow
+	for _, i := range []int{1, 0} {
+		if err := s.persistFollowAction(actions[i]); err != nil {
+			t.Fatal(err)
+		}
+	}
+	followers, err := repos.Follows.GetFollowerSet(1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(followers) != 0 {
+		t.Fatalf("expected the unfollow to win, got %v", followers)
+	}
+}
@@ -2,102 +2,363 @@ package impl
 
 import (
 	"errors"
+	"fmt"
 	"log"
-	"math/rand/v2"
+	"net/url"
 	"strconv"
+	"tiktok/config"
 	"tiktok/dao"
 	"tiktok/middleware/cache"
 	"tiktok/middleware/jwt"
+	"tiktok/middleware/mail"
+	"tiktok/middleware/oss"
 	"tiktok/pkg"
 	uSrv "tiktok/service/user"
-	"time"
 
+	"github.com/google/uuid"
 	"golang.org/x/crypto/bcrypt"
-	"gorm.io/gorm"
 )
 
 type UserServiceImpl struct {
 	uSrv.RelService
+	users      dao.UserRepo
+	uploads    dao.UploadRepo
+	storage    oss.Storage
+	userCache  *cache.UserCache
+	tokenCache *cache.TokenCache
+	loginCache *cache.LoginCache
+	mailer     mail.Mailer
+	lockout    config.Lockout
+	reset      config.Reset
 }
 
-func NewUserService(relSrv uSrv.RelService) *UserServiceImpl {
+func NewUserService(relSrv uSrv.RelService, users dao.UserRepo, uploads dao.UploadRepo, storage oss.Storage,
+	userCache *cache.UserCache, tokenCache *cache.TokenCache, loginCache *cache.LoginCache, mailer mail.Mailer,
+	lockout config.Lockout, reset config.Reset) *UserServiceImpl {
 	return &UserServiceImpl{
 		RelService: relSrv,
+		users:      users,
+		uploads:    uploads,
+		storage:    storage,
+		userCache:  userCache,
+		tokenCache: tokenCache,
+		loginCache: loginCache,
+		mailer:     mailer,
+		lockout:    lockout,
+		reset:      reset,
 	}
 }
 
-func (s *UserServiceImpl) Register(username, password string) (*uSrv.AuthInfo, error) {
-	_, err := dao.GetUserByUsername(username)
-	if err == nil {
-		return nil, pkg.NewError(pkg.ErrAccountExisted, nil)
+func (s *UserServiceImpl) Register(username, password, email string) (*uSrv.AuthInfo, error) {
+	hashedPwd, err := hashPassword(password)
+	if err != nil {
+		return nil, err
 	}
 
-	if !errors.Is(err, gorm.ErrRecordNotFound) {
+	// do register
+	user_dao := dao.User{Username: username, Password: hashedPwd, Email: email}
+	err = s.users.PersistUser(&user_dao)
+	if err != nil {
+		// the unique index settles concurrent registrations of a username
+		if errors.Is(err, dao.ErrDuplicatedKey) {
+			return nil, pkg.NewError(pkg.ErrAccountExisted, nil)
+		}
 		log.Println("An unexpected error occurred, detail:", err.Error())
 		return nil, pkg.NewError(pkg.ErrInternal, err)
 	}
 
+	return s.startSession(user_dao)
+}
+
+func (s *UserServiceImpl) Login(username, password, clientIp string) (*uSrv.AuthInfo, error) {
+	if err := s.checkLockout(username, clientIp); err != nil {
+		return nil, err
+	}
+
+	user_dao, err := s.users.GetUserByUsername(username)
+	if err != nil {
+		if errors.Is(err, dao.ErrRecordNotFound) {
+			// unknown usernames are counted too, or they could be told apart
+			return nil, s.loginFailed(username, clientIp, err)
+		} else {
+			return nil, pkg.NewError(pkg.ErrInternal, err)
+		}
+	}
+
+	if err := bcrypt.CompareHashAndPassword([]byte(user_dao.Password), []byte(password)); err != nil {
+		return nil, s.loginFailed(username, clientIp, err)
+	}
+	s.loginSucceeded(username)
+	return s.startSession(user_dao)
+}
+
+func (s *UserServiceImpl) lockoutEnabled() bool {
+	return s.lockout.MaxFailures > 0 || s.lockout.IPMaxFailures > 0
+}
+
+// checkLockout returns ErrLoginLocked if the username or client IP is locked out
+func (s *UserServiceImpl) checkLockout(username, clientIp string) error {
+	if !s.lockoutEnabled() {
+		return nil
+	}
+	locked, err := s.loginCache.LockedFor(username, clientIp)
+	if err != nil {
+		return pkg.NewError(pkg.ErrInternal, err)
+	}
+	if locked > 0 {
+		return pkg.NewError(pkg.ErrLoginLocked, nil).WithRetryAfter(locked)
+	}
+	return nil
+}
+
+// loginSucceeded clears the failures of the username after a matched password
+func (s *UserServiceImpl) loginSucceeded(username string) {
+	if !s.lockoutEnabled() {
+		return
+	}
+	if err := s.loginCache.ResetFailures(username); err != nil {
+		log.Printf("WARN: failed to reset the login failures of %s, detail: %v\n", username, err)
+	}
+}
+
+// loginFailed counts the failure and returns the error of the attempt
+func (s *UserServiceImpl) loginFailed(username, clientIp string, cause error) error {
+	if !s.lockoutEnabled() {
+		return pkg.NewError(pkg.ErrUnmatchedPwd, cause)
+	}
+	locked, err := s.loginCache.RecordFailure(username, clientIp, s.lockout)
+	if err != nil {
+		// still a failed login, the next attempt is throttled when Redis recovers
+		log.Printf("WARN: failed to count the login failure of %s from %s, detail: %v\n", username, clientIp, err)
+	}
+	if locked > 0 {
+		log.Printf("WARN: login of %s from %s locked for %v\n", username, clientIp, locked)
+	}
+	return pkg.NewError(pkg.ErrUnmatchedPwd, cause)
+}
+
+func hashPassword(password string) (string, error) {
 	hashedPwd, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
 	if err != nil {
 		log.Printf("failed to encrypt, detail: %v", err)
-		return nil, pkg.NewError(pkg.ErrInternal, err)
+		return "", pkg.NewError(pkg.ErrInternal, err)
 	}
+	return string(hashedPwd), nil
+}
 
-	// do register
-	user_dao := dao.User{Username: username, Password: string(hashedPwd)}
-	err = dao.PersistUser(&user_dao)
+// startSession issues the first pair of tokens of a new session
+func (s *UserServiceImpl) startSession(user dao.User) (*uSrv.AuthInfo, error) {
+	return s.issueTokens(user.Id, user.Username, uuid.NewString())
+}
+
+func (s *UserServiceImpl) issueTokens(uid uint64, username, sessionId string) (*uSrv.AuthInfo, error) {
+	token, err := jwt.NewToken(strconv.FormatUint(uid, 10), sessionId)
 	if err != nil {
-		log.Println("An unexpected error occurred, detail:", err.Error())
 		return nil, pkg.NewError(pkg.ErrInternal, err)
 	}
-
-	var token string
-	token, err = jwt.NewToken(
-		strconv.FormatUint(user_dao.Id, 10),
-	)
+	refreshToken, hash, err := jwt.NewRefreshToken()
 	if err != nil {
 		return nil, pkg.NewError(pkg.ErrInternal, err)
 	}
+	if err := s.tokenCache.SaveRefreshToken(hash, uid, sessionId, jwt.RefreshExpiry()); err != nil {
+		return nil, pkg.NewError(pkg.ErrInternal, err)
+	}
 
 	return &uSrv.AuthInfo{
-		Id:       user_dao.Id,
-		Username: username,
-		Token:    token,
+		Id:           uid,
+		Username:     username,
+		Token:        token,
+		RefreshToken: refreshToken,
 	}, nil
 }
 
-func (s *UserServiceImpl) Login(username, password string) (*uSrv.AuthInfo, error) {
-	user_dao, err := dao.GetUserByUsername(username)
+func (s *UserServiceImpl) Refresh(refreshToken string) (*uSrv.AuthInfo, error) {
+	uid, sessionId, err := s.tokenCache.UseRefreshToken(jwt.HashRefreshToken(refreshToken))
+	if errors.Is(err, cache.ErrTokenReused) {
+		// either the owner or a thief used it already, neither can be trusted
+		log.Printf("WARN: refresh token of session %s of user-%d is reused, session revoked\n", sessionId, uid)
+		if err := s.Logout(sessionId); err != nil {
+			return nil, err
+		}
+		return nil, pkg.NewError(pkg.ErrAuthException, err)
+	}
+	if errors.Is(err, cache.ErrMiss) {
+		return nil, pkg.NewError(pkg.ErrAuthException, errors.New("invalid refresh token"))
+	}
 	if err != nil {
-		if errors.Is(err, gorm.ErrRecordNotFound) {
-			return nil, pkg.NewError(pkg.ErrUnmatchedPwd, nil)
-		} else {
-			return nil, pkg.NewError(pkg.ErrInternal, err)
+		return nil, pkg.NewError(pkg.ErrInternal, err)
+	}
+
+	user, err := getUserModel(s.userCache, s.users, int64(uid))
+	if err != nil {
+		if errors.Is(err, dao.ErrRecordNotFound) {
+			return nil, pkg.NewError(pkg.ErrAuthException, err)
 		}
+		return nil, pkg.NewError(pkg.ErrInternal, err)
 	}
+	return s.issueTokens(uid, user.Username, sessionId)
+}
 
-	if err := bcrypt.CompareHashAndPassword([]byte(user_dao.Password), []byte(password)); err != nil {
-		return nil, pkg.NewError(pkg.ErrUnmatchedPwd, err)
+// Logout revokes the session for as long as any of its tokens may live
+func (s *UserServiceImpl) Logout(sessionId string) error {
+	if sessionId == "" {
+		return pkg.NewError(pkg.ErrAuthException, errors.New("token has no session"))
 	}
+	if err := s.tokenCache.Revoke(sessionId, jwt.RefreshExpiry()); err != nil {
+		return pkg.NewError(pkg.ErrInternal, err)
+	}
+	return nil
+}
 
-	var token string
-	token, err = jwt.NewToken(strconv.FormatUint(user_dao.Id, 10))
+func (s *UserServiceImpl) ChangePassword(uid uint64, oldPassword, newPassword, clientIp string) (*uSrv.AuthInfo, error) {
+	user, err := s.users.GetUserById(uid)
 	if err != nil {
+		if errors.Is(err, dao.ErrRecordNotFound) {
+			return nil, pkg.NewError(pkg.ErrAuthException, err)
+		}
 		return nil, pkg.NewError(pkg.ErrInternal, err)
 	}
+	if err := s.checkPassword(user, oldPassword, clientIp); err != nil {
+		return nil, err
+	}
 
-	return &uSrv.AuthInfo{
-		Id:       user_dao.Id,
-		Username: user_dao.Username,
-		Token:    token,
-	}, nil
+	if err := s.setPassword(user, newPassword); err != nil {
+		return nil, err
+	}
+	// the caller stays logged in with a new session
+	return s.startSession(user)
+}
+
+func (s *UserServiceImpl) CheckPassword(uid uint64, password, clientIp string) error {
+	user, err := s.users.GetUserById(uid)
+	if err != nil {
+		if errors.Is(err, dao.ErrRecordNotFound) {
+			return pkg.NewError(pkg.ErrAuthException, err)
+		}
+		return pkg.NewError(pkg.ErrInternal, err)
+	}
+	return s.checkPassword(user, password, clientIp)
+}
+
+// checkPassword compares the password of the user, guessing it with
+// a stolen token is throttled like logging in
+func (s *UserServiceImpl) checkPassword(user dao.User, password, clientIp string) error {
+	if err := s.checkLockout(user.Username, clientIp); err != nil {
+		return err
+	}
+	if err := bcrypt.CompareHashAndPassword([]byte(user.Password), []byte(password)); err != nil {
+		return s.loginFailed(user.Username, clientIp, err)
+	}
+	s.loginSucceeded(user.Username)
+	return nil
+}
+
+// setPassword replaces the password and revokes every token issued before
+func (s *UserServiceImpl) setPassword(user dao.User, password string) error {
+	hashedPwd, err := hashPassword(password)
+	if err != nil {
+		return err
+	}
+	if err := s.users.UpdatePassword(user.Id, hashedPwd); err != nil {
+		return pkg.NewError(pkg.ErrInternal, err)
+	}
+	// the cached model carries the old hash
+	if err := s.userCache.DelUserModel(int64(user.Id)); err != nil {
+		log.Printf("WARN: failed to evict user-%d, detail: %v\n", user.Id, err)
+	}
+	if err := s.tokenCache.RevokeUser(user.Id, jwt.RefreshExpiry()); err != nil {
+		return pkg.NewError(pkg.ErrInternal, err)
+	}
+	return nil
+}
+
+func (s *UserServiceImpl) RequestPasswordReset(username, clientIp string) error {
+	subjects := []string{"ip:" + clientIp}
+	user, err := s.users.GetUserByUsername(username)
+	found := err == nil
+	if found {
+		subjects = append(subjects, fmt.Sprintf("user:%d", user.Id))
+	} else if !errors.Is(err, dao.ErrRecordNotFound) {
+		return pkg.NewError(pkg.ErrInternal, err)
+	}
+	// unknown usernames cool the IP down too, or they could be told apart
+	if s.reset.Cooldown > 0 {
+		started, err := s.tokenCache.StartResetCooldown(s.reset.Cooldown, subjects...)
+		if err != nil {
+			return pkg.NewError(pkg.ErrInternal, err)
+		}
+		if !started {
+			return nil
+		}
+	}
+	if !found {
+		return nil
+	}
+	if user.Email == "" {
+		log.Printf("WARN: user-%d requested a password reset without an email\n", user.Id)
+		return nil
+	}
+
+	// the reset token is as opaque as a refresh token
+	token, hash, err := jwt.NewRefreshToken()
+	if err != nil {
+		return pkg.NewError(pkg.ErrInternal, err)
+	}
+	if err := s.tokenCache.SaveResetToken(hash, user.Id, s.reset.Expiry); err != nil {
+		return pkg.NewError(pkg.ErrInternal, err)
+	}
+	link, err := url.Parse(s.reset.URL)
+	if err != nil {
+		return pkg.NewError(pkg.ErrInternal, err)
+	}
+	query := link.Query()
+	query.Set("token", token)
+	link.RawQuery = query.Encode()
+
+	err = s.mailer.Send(mail.Message{
+		To:      user.Email,
+		Subject: "Reset your password",
+		Body: fmt.Sprintf("Hi %s,\n\nOpen the link below within %v to choose a new password:\n\n%s\n\n"+
+			"If you didn't ask for it, ignore this mail and your password stays the same.\n",
+			user.Username, s.reset.Expiry, link),
+	})
+	if err != nil {
+		return pkg.NewError(pkg.ErrInternal, err)
+	}
+	return nil
+}
+
+func (s *UserServiceImpl) ResetPassword(resetToken, newPassword string) error {
+	uid, err := s.tokenCache.UseResetToken(jwt.HashRefreshToken(resetToken))
+	if errors.Is(err, cache.ErrMiss) {
+		return pkg.NewError(pkg.ErrAuthException, errors.New("invalid reset token"))
+	}
+	if err != nil {
+		return pkg.NewError(pkg.ErrInternal, err)
+	}
+	user, err := s.users.GetUserById(uid)
+	if err != nil {
+		if errors.Is(err, dao.ErrRecordNotFound) {
+			return pkg.NewError(pkg.ErrAuthException, err)
+		}
+		return pkg.NewError(pkg.ErrInternal, err)
+	}
+
+	if err := s.setPassword(user, newPassword); err != nil {
+		return err
+	}
+	// whoever was guessing the old password is irrelevant now
+	if err := s.loginCache.Unlock(user.Username, ""); err != nil {
+		log.Printf("WARN: failed to unlock the login of user-%d, detail: %v\n", user.Id, err)
+	}
+	return nil
 }
 
 func (s *UserServiceImpl) GetUserInfo(targetUserId, curUserId uint64) (*uSrv.UserInfo, error) {
-	userModel, err := getUserModelFromCache(int64(targetUserId))
+	userModel, err := getUserModel(s.userCache, s.users, int64(targetUserId))
 	if err != nil {
-		if errors.Is(err, gorm.ErrRecordNotFound) {
-			return nil, pkg.NewError(pkg.ErrValidation, nil)
+		if errors.Is(err, dao.ErrRecordNotFound) {
+			return nil, pkg.NewError(pkg.ErrUserNotFound, err)
 		} else {
 			return nil, pkg.NewError(pkg.ErrInternal, err)
 		}
@@ -106,6 +367,32 @@ func (s *UserServiceImpl) GetUserInfo(targetUserId, curUserId uint64) (*uSrv.Use
 	return &info, nil
 }
 
+// maxBatchUsers bounds the ids of GetUserInfos
+const maxBatchUsers = 100
+
+func (s *UserServiceImpl) GetUserInfos(targetUserIds []uint64, curUserId uint64) ([]uSrv.UserInfo, error) {
+	if len(targetUserIds) > maxBatchUsers {
+		return nil, pkg.NewError(pkg.ErrValidation, fmt.Errorf("at most %d users at a time", maxBatchUsers))
+	}
+	infos := make([]uSrv.UserInfo, 0, len(targetUserIds))
+	seen := make(map[uint64]bool, len(targetUserIds))
+	for _, id := range targetUserIds {
+		if seen[id] {
+			continue
+		}
+		seen[id] = true
+		userModel, err := getUserModel(s.userCache, s.users, int64(id))
+		if errors.Is(err, dao.ErrRecordNotFound) {
+			continue
+		}
+		if err != nil {
+			return nil, pkg.NewError(pkg.ErrInternal, err)
+		}
+		infos = append(infos, s.buildUserInfo(*userModel, curUserId))
+	}
+	return infos, nil
+}
+
 func (s *UserServiceImpl) buildUserInfo(targetUser dao.User, curUserId uint64) uSrv.UserInfo {
 	var isFollowed bool = false
 	if curUserId != 0 {
@@ -118,10 +405,14 @@ func (s *UserServiceImpl) buildUserInfo(targetUser dao.User, curUserId uint64) u
 		Id:               targetUser.Id,
 		Username:         targetUser.Username,
 		Nickname:         targetUser.Nickname,
+		Bio:              targetUser.Bio,
 		AvatarUrl:        targetUser.AvatarUrl,
 		BackgroundImgUrl: targetUser.BackgroundImgUrl,
 		FollowedCnt:      followedCnt,
 		FollowerCnt:      followerCnt,
+		VideoCnt:         targetUser.VideoCount,
+		TotalLiked:       targetUser.TotalLiked,
+		LikedVideoCnt:    targetUser.LikedVideoCount,
 		IsFollowed:       isFollowed,
 	}
 }
@@ -155,40 +446,3 @@ func (s *UserServiceImpl) GetAllFollower(targetId, userId int64) ([]uSrv.UserInf
 	}
 	return infos, err
 }
-
-func getUserModelFromCache(uid int64) (*dao.User, error) {
-	key := fmtUserModelKey(uid)
-	if cache.Rdb.Exists(cache.Ctx, key).Val() == 0 {
-		if err := setUserModelToCache(uid); err != nil {
-			return nil, err
-		}
-		return getUserModelFromCache(uid)
-	}
-	model := dao.User{}
-	err := cache.Rdb.HGetAll(cache.Ctx, key).Scan(&model)
-	if err != nil {
-		return nil, err
-	}
-	return &model, nil
-}
-
-func setUserModelToCache(uid int64) error {
-	key := fmtUserModelKey(uid)
-	model := dao.User{}
-	if err := dao.Db.Model(&model).Where("id = ?", uid).First(&model).Error; err != nil {
-		if errors.Is(err, gorm.ErrRecordNotFound) {
-			pipe := cache.Rdb.Pipeline()
-			pipe.HSet(cache.Ctx, key, "null_value", "placeholder")
-			pipe.Expire(cache.Ctx, key, cache.NullValTimeout)
-			pipe.Exec(cache.Ctx)
-		} else {
-			return err
-		}
-	}
-
-	if err := cache.Rdb.HSet(cache.Ctx, key, model).Err(); err != nil {
-		return err
-	}
-	cache.Rdb.Expire(cache.Ctx, key, time.Minute*5+time.Duration(rand.Int32N(5)))
-	return nil
-}
@@ -0,0 +1,422 @@
+package impl
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"testing"
+	"tiktok/config"
+	"tiktok/dao/memory"
+	"tiktok/middleware/cache"
+	"tiktok/middleware/jwt"
+	"tiktok/middleware/mail"
+	"tiktok/middleware/oss"
+	"tiktok/pkg"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/redis/go-redis/v9"
+)
+
+func newTestUserService(t *testing.T) *UserServiceImpl {
+	return newTestUserServiceOn(t, miniredis.RunT(t))
+}
+
+func newTestUserServiceOn(t *testing.T, mr *miniredis.Miniredis) *UserServiceImpl {
+	repos := memory.NewRepos()
+	caches := cache.NewCaches(redis.NewClient(&redis.Options{Addr: mr.Addr()}), nil)
+	if err := jwt.Init(config.JWT{Secret: "test", Expiry: time.Hour, RefreshExpiry: time.Hour * 24}, caches.Tokens); err != nil {
+		t.Fatal(err)
+	}
+	relSrv := NewRelService(repos.Follows, repos.Users, repos.Events, caches.Relations, caches.Users)
+	cfg := config.Default()
+	storage, err := oss.NewLocalStorage(config.LocalStorage{Dir: t.TempDir(), BaseURL: "http://localhost/static"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return NewUserService(relSrv, repos.Users, repos.Uploads, storage, caches.Users, caches.Tokens, caches.Logins,
+		&recordingMailer{}, cfg.Lockout, cfg.Reset)
+}
+
+// recordingMailer keeps the messages instead of sending them
+type recordingMailer struct {
+	msgs []mail.Message
+}
+
+func (m *recordingMailer) Send(msg mail.Message) error {
+	m.msgs = append(m.msgs, msg)
+	return nil
+}
+
+func assertErrType(t *testing.T, err error, want pkg.ErrType) {
+	t.Helper()
+	var appE *pkg.AppError
+	if !errors.As(err, &appE) || appE.Code != want {
+		t.Fatalf("expected error code %d, got %v", want, err)
+	}
+}
+
+func TestRegisterAndLogin(t *testing.T) {
+	s := newTestUserService(t)
+	registered, err := s.Register("alice", "p@ssw0rd", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if registered.Id == 0 || registered.Token == "" {
+		t.Fatalf("unexpected auth info: %+v", registered)
+	}
+
+	_, err = s.Register("alice", "another", "")
+	assertErrType(t, err, pkg.ErrAccountExisted)
+
+	logged, err := s.Login("alice", "p@ssw0rd", "10.0.0.1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if logged.Id != registered.Id {
+		t.Fatalf("logged in as user-%d, want user-%d", logged.Id, registered.Id)
+	}
+	claim, err := jwt.ParsingToken(logged.Token)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if claim.UserId != "1" {
+		t.Fatalf("unexpected user id in token: %s", claim.UserId)
+	}
+}
+
+func TestConcurrentRegister(t *testing.T) {
+	s := newTestUserService(t)
+	var wg sync.WaitGroup
+	errs := make(chan error, 8)
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			_, err := s.Register("grace", "p@ssw0rd", "")
+			errs <- err
+		}()
+	}
+	wg.Wait()
+	close(errs)
+
+	registered := 0
+	for err := range errs {
+		if err == nil {
+			registered++
+			continue
+		}
+		assertErrType(t, err, pkg.ErrAccountExisted)
+	}
+	if registered != 1 {
+		t.Fatalf("expected exactly one registration, got %d", registered)
+	}
+}
+
+func TestLoginRejectsBadCredentials(t *testing.T) {
+	s := newTestUserService(t)
+	if _, err := s.Register("bob", "secret", ""); err != nil {
+		t.Fatal(err)
+	}
+
+	_, err := s.Login("bob", "wrong", "10.0.0.1")
+	assertErrType(t, err, pkg.ErrUnmatchedPwd)
+
+	_, err = s.Login("nobody", "secret", "10.0.0.1")
+	assertErrType(t, err, pkg.ErrUnmatchedPwd)
+}
+
+func TestLoginLockout(t *testing.T) {
+	mr := miniredis.RunT(t)
+	s := newTestUserServiceOn(t, mr)
+	if _, err := s.Register("erin", "secret", ""); err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < s.lockout.MaxFailures; i++ {
+		_, err := s.Login("erin", "wrong", "10.0.0.1")
+		assertErrType(t, err, pkg.ErrUnmatchedPwd)
+	}
+	// even the right password is rejected from another IP
+	_, err := s.Login("erin", "secret", "10.0.0.2")
+	assertErrType(t, err, pkg.ErrLoginLocked)
+	if appE := err.(*pkg.AppError); appE.RetryAfter != s.lockout.Backoff {
+		t.Fatalf("expected retry after %v, got %v", s.lockout.Backoff, appE.RetryAfter)
+	}
+
+	// the next failure doubles the lockout
+	mr.FastForward(s.lockout.Backoff)
+	_, err = s.Login("erin", "wrong", "10.0.0.1")
+	assertErrType(t, err, pkg.ErrUnmatchedPwd)
+	mr.FastForward(s.lockout.Backoff)
+	_, err = s.Login("erin", "secret", "10.0.0.1")
+	assertErrType(t, err, pkg.ErrLoginLocked)
+
+	if err := s.loginCache.Unlock("erin", ""); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.Login("erin", "secret", "10.0.0.1"); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestChangePasswordLockout(t *testing.T) {
+	s := newTestUserService(t)
+	user, err := s.Register("grace", "p@ssw0rd", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < s.lockout.MaxFailures; i++ {
+		_, err := s.ChangePassword(user.Id, "wrong", "n3w-p@ss", "10.0.0.1")
+		assertErrType(t, err, pkg.ErrUnmatchedPwd)
+	}
+	// the guesses lock the account out of both
+	_, err = s.ChangePassword(user.Id, "p@ssw0rd", "n3w-p@ss", "10.0.0.2")
+	assertErrType(t, err, pkg.ErrLoginLocked)
+	_, err = s.Login("grace", "p@ssw0rd", "10.0.0.2")
+	assertErrType(t, err, pkg.ErrLoginLocked)
+
+	if err := s.loginCache.Unlock("grace", ""); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.ChangePassword(user.Id, "p@ssw0rd", "n3w-p@ss", "10.0.0.1"); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestLoginLockoutByIP(t *testing.T) {
+	s := newTestUserService(t)
+	s.lockout.IPMaxFailures = 3
+	if _, err := s.Register("frank", "secret", ""); err != nil {
+		t.Fatal(err)
+	}
+
+	// spraying usernames is counted by the IP
+	for _, username := range []string{"a", "b", "c"} {
+		_, err := s.Login(username, "secret", "10.0.0.1")
+		assertErrType(t, err, pkg.ErrUnmatchedPwd)
+	}
+	_, err := s.Login("frank", "secret", "10.0.0.1")
+	assertErrType(t, err, pkg.ErrLoginLocked)
+	if _, err := s.Login("frank", "secret", "10.0.0.2"); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := s.loginCache.Unlock("", "10.0.0.1"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.Login("frank", "secret", "10.0.0.1"); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestRefreshRotatesTokens(t *testing.T) {
+	s := newTestUserService(t)
+	logged, err := s.Register("carol", "secret", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	claim, err := jwt.ParsingToken(logged.Token)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	refreshed, err := s.Refresh(logged.RefreshToken)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if refreshed.Id != logged.Id || refreshed.RefreshToken == logged.RefreshToken {
+		t.Fatalf("unexpected auth info: %+v", refreshed)
+	}
+	refreshedClaim, err := jwt.ParsingToken(refreshed.Token)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if refreshedClaim.SessionId != claim.SessionId || refreshedClaim.ID == claim.ID {
+		t.Fatalf("expected a new token of the same session, got %+v", refreshedClaim)
+	}
+
+	// a rotated token is presented again, the session may be stolen
+	_, err = s.Refresh(logged.RefreshToken)
+	assertErrType(t, err, pkg.ErrAuthException)
+	if revoked, _ := s.tokenCache.IsRevoked(claim.SessionId); !revoked {
+		t.Fatal("expected the session to be revoked")
+	}
+	_, err = s.Refresh(refreshed.RefreshToken)
+	assertErrType(t, err, pkg.ErrAuthException)
+
+	_, err = s.Refresh("unknown")
+	assertErrType(t, err, pkg.ErrAuthException)
+}
+
+func TestLogout(t *testing.T) {
+	s := newTestUserService(t)
+	logged, err := s.Register("dave", "secret", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	claim, _ := jwt.ParsingToken(logged.Token)
+	if err := s.Logout(claim.SessionId); err != nil {
+		t.Fatal(err)
+	}
+	if revoked, _ := s.tokenCache.IsRevoked(claim.ID, claim.SessionId); !revoked {
+		t.Fatal("expected the session to be revoked")
+	}
+	_, err = s.Refresh(logged.RefreshToken)
+	assertErrType(t, err, pkg.ErrAuthException)
+
+	// another login isn't affected
+	other, err := s.Login("dave", "secret", "10.0.0.1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.Refresh(other.RefreshToken); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestChangePassword(t *testing.T) {
+	s := newTestUserService(t)
+	old, err := s.Register("heidi", "p@ssw0rd", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the user model is cached with the old hash
+	if _, err := s.GetUserInfo(old.Id, 0); err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = s.ChangePassword(old.Id, "wrong", "n3w-p@ss", "10.0.0.1")
+	assertErrType(t, err, pkg.ErrUnmatchedPwd)
+	// issued before the change, within an earlier second
+	time.Sleep(time.Second)
+	changed, err := s.ChangePassword(old.Id, "p@ssw0rd", "n3w-p@ss", "10.0.0.1")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	claim, _ := jwt.ParsingToken(old.Token)
+	if revoked, _ := s.tokenCache.IsTokenRevoked(claim.UserId, claim.IssuedAt.Time, claim.ID, claim.SessionId); !revoked {
+		t.Fatal("expected the token issued before the change to be revoked")
+	}
+	_, err = s.Refresh(old.RefreshToken)
+	assertErrType(t, err, pkg.ErrAuthException)
+
+	claim, _ = jwt.ParsingToken(changed.Token)
+	if revoked, _ := s.tokenCache.IsTokenRevoked(claim.UserId, claim.IssuedAt.Time, claim.ID, claim.SessionId); revoked {
+		t.Fatal("expected the token of the new session to be accepted")
+	}
+	if _, err := s.Refresh(changed.RefreshToken); err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = s.Login("heidi", "p@ssw0rd", "10.0.0.1")
+	assertErrType(t, err, pkg.ErrUnmatchedPwd)
+	if _, err := s.Login("heidi", "n3w-p@ss", "10.0.0.1"); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestPasswordReset(t *testing.T) {
+	s := newTestUserService(t)
+	mailer := s.mailer.(*recordingMailer)
+	old, err := s.Register("ivan", "p@ssw0rd", "ivan@example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.Register("judy", "p@ssw0rd", ""); err != nil {
+		t.Fatal(err)
+	}
+
+	// nothing to send to, and nothing is told
+	for i, username := range []string{"nobody", "judy"} {
+		if err := s.RequestPasswordReset(username, fmt.Sprintf("10.0.0.%d", i+1)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if len(mailer.msgs) != 0 {
+		t.Fatalf("unexpected mails: %+v", mailer.msgs)
+	}
+
+	if err := s.RequestPasswordReset("ivan", "10.0.0.3"); err != nil {
+		t.Fatal(err)
+	}
+	if len(mailer.msgs) != 1 || mailer.msgs[0].To != "ivan@example.com" {
+		t.Fatalf("expected a mail to ivan, got %+v", mailer.msgs)
+	}
+	_, link, _ := strings.Cut(mailer.msgs[0].Body, s.reset.URL+"?token=")
+	token, _, _ := strings.Cut(link, "\n")
+	if token == "" {
+		t.Fatalf("no reset link in %q", mailer.msgs[0].Body)
+	}
+
+	time.Sleep(time.Second)
+	if err := s.ResetPassword(token, "n3w-p@ss"); err != nil {
+		t.Fatal(err)
+	}
+	// single use
+	assertErrType(t, s.ResetPassword(token, "an0ther-pass"), pkg.ErrAuthException)
+	_, err = s.Refresh(old.RefreshToken)
+	assertErrType(t, err, pkg.ErrAuthException)
+	if _, err := s.Login("ivan", "n3w-p@ss", "10.0.0.1"); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestPasswordResetCooldown(t *testing.T) {
+	mr := miniredis.RunT(t)
+	s := newTestUserServiceOn(t, mr)
+	mailer := s.mailer.(*recordingMailer)
+	if _, err := s.Register("oscar", "p@ssw0rd", "oscar@example.com"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.Register("peggy", "p@ssw0rd", "peggy@example.com"); err != nil {
+		t.Fatal(err)
+	}
+
+	// throttled requests are answered the same
+	for _, req := range []struct{ username, ip string }{
+		{"oscar", "10.0.0.1"},
+		{"oscar", "10.0.0.2"}, // the user cools down
+		{"peggy", "10.0.0.1"}, // and so does the IP
+		{"nobody", "10.0.0.3"},
+		{"peggy", "10.0.0.3"}, // even after an unknown username
+	} {
+		if err := s.RequestPasswordReset(req.username, req.ip); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if len(mailer.msgs) != 1 || mailer.msgs[0].To != "oscar@example.com" {
+		t.Fatalf("expected a single mail to oscar, got %+v", mailer.msgs)
+	}
+
+	mr.FastForward(s.reset.Cooldown)
+	if err := s.RequestPasswordReset("peggy", "10.0.0.1"); err != nil {
+		t.Fatal(err)
+	}
+	if len(mailer.msgs) != 2 || mailer.msgs[1].To != "peggy@example.com" {
+		t.Fatalf("expected a mail to peggy after the cooldown, got %+v", mailer.msgs)
+	}
+}
+
+func TestResetTokenRevokedByPasswordChange(t *testing.T) {
+	s := newTestUserService(t)
+	mailer := s.mailer.(*recordingMailer)
+	user, err := s.Register("mallory", "p@ssw0rd", "mallory@example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s.RequestPasswordReset("mallory", "10.0.0.1"); err != nil {
+		t.Fatal(err)
+	}
+	_, link, _ := strings.Cut(mailer.msgs[0].Body, "?token=")
+	token, _, _ := strings.Cut(link, "\n")
+
+	time.Sleep(time.Second)
+	if _, err := s.ChangePassword(user.Id, "p@ssw0rd", "n3w-p@ss", "10.0.0.1"); err != nil {
+		t.Fatal(err)
+	}
+	assertErrType(t, s.ResetPassword(token, "an0ther-pass"), pkg.ErrAuthException)
+}
@@ -1,10 +1,40 @@
 package service
 
+import "io"
+
 type UserService interface {
 	RelService
-	Register(username, password string) (*AuthInfo, error)
-	Login(username, password string) (*AuthInfo, error)
+	// Register creates an account, email is optional and receives the reset links
+	Register(username, password, email string) (*AuthInfo, error)
+	// Login is throttled by the failures of both the username and the client IP
+	Login(username, password, clientIp string) (*AuthInfo, error)
+	// Refresh rotates the refresh token and issues a new access token of its session
+	Refresh(refreshToken string) (*AuthInfo, error)
+	// Logout revokes every token of the session
+	Logout(sessionId string) error
+	// ChangePassword revokes every token of the user and starts a new session,
+	// a wrong old password counts as a failed login
+	ChangePassword(uid uint64, oldPassword, newPassword, clientIp string) (*AuthInfo, error)
+	// CheckPassword confirms a sensitive action of the user with the password,
+	// a wrong password counts as a failed login
+	CheckPassword(uid uint64, password, clientIp string) error
+	// RequestPasswordReset mails a single-use reset link to the user, at most one per
+	// cooldown for both the user and the client IP. Nothing is reported if the user
+	// doesn't exist, has no email or the request is throttled
+	RequestPasswordReset(username, clientIp string) error
+	// ResetPassword consumes the reset token and revokes every token of the user
+	ResetPassword(resetToken, newPassword string) error
+	// GetUserInfo returns pkg.ErrUserNotFound if the target doesn't exist,
+	// curUserId is zero for a tourist
 	GetUserInfo(targetUserId, curUserId uint64) (*UserInfo, error)
+	// GetUserInfos keeps the order of the ids, skipping duplicated and missing users
+	GetUserInfos(targetUserIds []uint64, curUserId uint64) ([]UserInfo, error)
+	// UpdateProfile sets the non-nil fields and returns the updated user
+	UpdateProfile(uid uint64, nickname, bio *string) (*UserInfo, error)
+	// UploadAvatar and UploadBackground store a JPEG image and
+	// delete the one it replaces
+	UploadAvatar(uid uint64, image io.Reader) (*UserInfo, error)
+	UploadBackground(uid uint64, image io.Reader) (*UserInfo, error)
 	GetAllFollowed(targetId, userId int64) ([]UserInfo, error)
 	GetAllFollower(targetId, userId int64) ([]UserInfo, error)
 }
@@ -12,16 +42,22 @@ type UserService interface {
 type AuthInfo struct {
 	Id       uint64 // user id
 	Username string // username
-	Token    string // token
+	Token    string // access token
+	// RefreshToken can be used once to get a new pair of tokens
+	RefreshToken string
 }
 
 type UserInfo struct {
 	Id               uint64 `json:"id"`
 	Username         string `json:"username"`
 	Nickname         string `json:"nickname"`
+	Bio              string `json:"bio"`
 	AvatarUrl        string `json:"avatar_url"`
 	BackgroundImgUrl string `json:"background_img_url"`
 	FollowedCnt      uint64 `json:"followed_count"`
 	FollowerCnt      uint64 `json:"follower_count"`
+	VideoCnt         uint64 `json:"video_count"`
+	TotalLiked       uint64 `json:"total_liked"`
+	LikedVideoCnt    uint64 `json:"liked_video_count"`
 	IsFollowed       bool   `json:"is_followed"`
 }
@@ -1,25 +1,110 @@
 package impl
 
 import (
-	"log"
+	"errors"
 	"testing"
+	"tiktok/dao"
+	"tiktok/dao/memory"
+	"tiktok/middleware/cache"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/redis/go-redis/v9"
 )
 
+// newTestCaches returns the caches on an in-process redis
+func newTestCaches(t *testing.T) cache.Caches {
+	t.Helper()
+	mr := miniredis.RunT(t)
+	rdb := redis.NewClient(&redis.Options{Addr: mr.Addr()})
+	t.Cleanup(func() { rdb.Close() })
+	return cache.NewCaches(rdb, nil)
+}
+
 func TestGetCommentModel(t *testing.T) {
-	// err := setCommentModelToCache(dao.Comment{
-	// 	Id:          1,
-	// 	UserId:      1,
-	// 	CommentText: "go test",
-	// 	CreateAt:    time.Now(),
-	// })
-	// if err != nil {
-	// 	log.Println(err)
-	// 	t.Fatal("failed to set model")
-	// }
-
-	c, err := getCommentModelFromCache(1)
+	caches := newTestCaches(t)
+	repos := memory.NewRepos()
+	model := dao.Comment{
+		UserId:      1,
+		VideoId:     1,
+		CommentText: "go test",
+		CreateAt:    time.Now().Unix(),
+	}
+	if err := repos.Comments.PersistComment(&model); err != nil {
+		t.Fatal(err)
+	}
+
+	c, err := getCommentModel(caches.Comments, repos.Comments, model.Id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c.Id != model.Id || c.CommentText != model.CommentText {
+		t.Fatalf("unexpected comment: %+v", c)
+	}
+
+	// served from cache once loaded
+	cached, err := caches.Comments.GetCommentModel(model.Id)
+	if err != nil || cached.CommentText != model.CommentText {
+		t.Fatalf("comment isn't cached: %+v, %v", cached, err)
+	}
+
+	_, err = getCommentModel(caches.Comments, repos.Comments, 404)
+	if !errors.Is(err, dao.ErrRecordNotFound) {
+		t.Fatalf("expected not found, got %v", err)
+	}
+	if _, err := caches.Comments.GetCommentModel(404); !errors.Is(err, cache.ErrNullValue) {
+		t.Fatalf("expected null value cached, got %v", err)
+	}
+}
+
+func TestDoComment(t *testing.T) {
+	caches := newTestCaches(t)
+	repos := memory.NewRepos()
+	s := NewCommService(repos.Comments, repos.Events, caches.Comments)
+
+	first, err := s.DoComment(1, 1, 0, "first")
 	if err != nil {
 		t.Fatal(err)
 	}
-	log.Println(c)
+	// the comment set is cached now, the second one goes through the script
+	second, err := s.DoComment(1, 2, 0, "second")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	comments, err := s.GetCommentsOnVideo(1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(comments) != 2 {
+		t.Fatalf("expected 2 comments, got %+v", comments)
+	}
+	ids := map[int64]bool{comments[0].Id: true, comments[1].Id: true}
+	if !ids[first.Id] || !ids[second.Id] {
+		t.Fatalf("unexpected comments: %+v", comments)
+	}
+}
+
+func TestLikeAction(t *testing.T) {
+	caches := newTestCaches(t)
+	repos := memory.NewRepos()
+	s := NewLikeService(repos.Likes, repos.Videos, repos.Events, caches.Likes, caches.Videos, caches.Users)
+
+	if err := s.DoLike(1, 1); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.DoLike(1, 1); err == nil {
+		t.Fatal("expected liking twice to fail")
+	}
+	liked, err := s.HasUserLiked(1, 1)
+	if err != nil || !liked {
+		t.Fatalf("expected liked, got %t, %v", liked, err)
+	}
+	if err := s.CancelLike(1, 1); err != nil {
+		t.Fatal(err)
+	}
+	liked, err = s.HasUserLiked(1, 1)
+	if err != nil || liked {
+		t.Fatalf("expected not liked, got %t, %v", liked, err)
+	}
 }
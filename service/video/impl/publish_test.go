@@ -0,0 +1,151 @@
+package impl
+
+import (
+	"context"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"tiktok/config"
+	"tiktok/dao"
+	"tiktok/dao/memory"
+	"tiktok/middleware/oss"
+	"tiktok/pkg"
+	uSrv "tiktok/service/user"
+	"time"
+)
+
+// failingStorage fails to store the covers
+type failingStorage struct {
+	*oss.LocalStorage
+}
+
+func (s failingStorage) Put(key string, data io.Reader) error {
+	if strings.HasPrefix(key, "cover/") {
+		return errors.New("disk full")
+	}
+	return s.LocalStorage.Put(key, data)
+}
+
+// knownAuthors only knows the users in ids, as if the others were deleted
+type knownAuthors struct {
+	uSrv.UserService
+	ids map[uint64]bool
+}
+
+func (u knownAuthors) GetUserInfo(targetUserId, curUserId uint64) (*uSrv.UserInfo, error) {
+	if !u.ids[targetUserId] {
+		return nil, pkg.NewError(pkg.ErrUserNotFound, errors.New("user not found"))
+	}
+	return &uSrv.UserInfo{Id: targetUserId}, nil
+}
+
+func newTestVideoService(t *testing.T, wrap func(*oss.LocalStorage) oss.Storage) (*VideoServiceImpl, dao.Repos, string) {
+	t.Helper()
+	dir := t.TempDir()
+	local, err := oss.NewLocalStorage(config.LocalStorage{Dir: dir, BaseURL: "http://localhost/static"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var storage oss.Storage = local
+	if wrap != nil {
+		storage = wrap(local)
+	}
+	caches := newTestCaches(t)
+	repos := memory.NewRepos()
+	s := NewVideoService(nil, nil, nil, storage, repos.Videos, repos.Likes, repos.Outbox, repos.Uploads,
+		caches.Videos, caches.Likes, caches.Users)
+	return s, repos, dir
+}
+
+func countObjects(t *testing.T, dir string) int {
+	t.Helper()
+	n := 0
+	err := filepath.WalkDir(dir, func(path string, d os.DirEntry, err error) error {
+		if err == nil && !d.IsDir() {
+			n++
+		}
+		return err
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return n
+}
+
+func TestPublish(t *testing.T) {
+	s, repos, dir := newTestVideoService(t, nil)
+	if err := s.Publish(1, "title", strings.NewReader("video"), strings.NewReader("cover")); err != nil {
+		t.Fatal(err)
+	}
+
+	if ids, err := s.videoCache.FeedAfter(0, 5); err != nil || len(ids) != 1 {
+		t.Fatalf("expected the video in the feed, got %v, %v", ids, err)
+	}
+	if msgs, _ := repos.Outbox.PendingMessages(time.Now().Add(time.Hour), 10); len(msgs) != 0 {
+		t.Fatalf("delivered outbox message is left: %+v", msgs)
+	}
+	if keys, _ := repos.Uploads.ExpiredUploads(time.Now().Add(time.Hour), 10); len(keys) != 0 {
+		t.Fatalf("uploads of a committed publish are still tracked: %v", keys)
+	}
+	if n := countObjects(t, dir); n != 2 {
+		t.Fatalf("expected 2 objects, got %d", n)
+	}
+}
+
+func TestFeedSkipsDeletedAuthors(t *testing.T) {
+	s, _, _ := newTestVideoService(t, nil)
+	s.UserSrv = knownAuthors{ids: map[uint64]bool{2: true}}
+	for _, author := range []uint64{1, 2} {
+		if err := s.Publish(author, "title", strings.NewReader("video"), strings.NewReader("cover")); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	videos, err := s.Feed(0, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(videos) != 1 || videos[0].Author.Id != 2 {
+		t.Fatalf("expected only the video of user-2, got %+v", videos)
+	}
+}
+
+func TestFailedPublishDiscardsUploads(t *testing.T) {
+	s, repos, dir := newTestVideoService(t, func(local *oss.LocalStorage) oss.Storage {
+		return failingStorage{local}
+	})
+	if err := s.Publish(1, "title", strings.NewReader("video"), strings.NewReader("cover")); err == nil {
+		t.Fatal("expected the publish to fail")
+	}
+	if n := countObjects(t, dir); n != 0 {
+		t.Fatalf("expected the uploaded video to be deleted, %d objects left", n)
+	}
+	if keys, _ := repos.Uploads.ExpiredUploads(time.Now().Add(time.Hour), 10); len(keys) != 0 {
+		t.Fatalf("discarded uploads are still tracked: %v", keys)
+	}
+}
+
+func TestCollectOrphanedUploads(t *testing.T) {
+	s, repos, dir := newTestVideoService(t, nil)
+	// uploaded by a publish which crashed before committing
+	key := oss.GetKey("orphan", oss.TypeVideo)
+	if err := repos.Uploads.AddPendingUploads([]string{key}); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.storage.Put(key, strings.NewReader("video")); err != nil {
+		t.Fatal(err)
+	}
+
+	if n, err := s.CollectOrphanedUploads(context.Background(), time.Now().Add(-time.Hour)); err != nil || n != 0 {
+		t.Fatalf("expected a recent upload to be kept, got %d, %v", n, err)
+	}
+	if n, err := s.CollectOrphanedUploads(context.Background(), time.Now().Add(time.Second)); err != nil || n != 1 {
+		t.Fatalf("expected 1 orphan collected, got %d, %v", n, err)
+	}
+	if n := countObjects(t, dir); n != 0 {
+		t.Fatalf("orphaned object isn't deleted, %d objects left", n)
+	}
+}
@@ -0,0 +1,195 @@
+package impl
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+	"sync"
+	"testing"
+	"tiktok/dao"
+	"tiktok/dao/memory"
+	"time"
+)
+
+// collectEvents reads n events off the stream through consume
+func collectEvents[T any](t *testing.T, consume func(context.Context, func(T) error), n int) []T {
+	t.Helper()
+	ctx, cancel := context.WithCancel(context.Background())
+	var (
+		mu     sync.Mutex
+		events []T
+	)
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		consume(ctx, func(e T) error {
+			mu.Lock()
+			defer mu.Unlock()
+			events = append(events, e)
+			return nil
+		})
+	}()
+	defer func() {
+		cancel()
+		<-done
+	}()
+
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		mu.Lock()
+		got := len(events)
+		mu.Unlock()
+		if got >= n {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	if len(events) != n {
+		t.Fatalf("expected %d events, got %d", n, len(events))
+	}
+	return events
+}
+
+// persistUsers adds the users of ids 1 to n
+func persistUsers(t *testing.T, repos dao.Repos, n int) {
+	t.Helper()
+	for i := range n {
+		if err := repos.Users.PersistUser(&dao.User{Username: fmt.Sprintf("user%d", i+1)}); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+type dbState struct {
+	Video    dao.Video
+	Liked    map[uint64][]uint64
+	Comments []dao.Comment
+}
+
+func snapshot(t *testing.T, repos dao.Repos, vid uint64, uids ...uint64) dbState {
+	t.Helper()
+	video, err := repos.Videos.GetVideoById(vid)
+	if err != nil {
+		t.Fatal(err)
+	}
+	state := dbState{Video: video, Liked: map[uint64][]uint64{}}
+	for _, uid := range uids {
+		if state.Liked[uid], err = repos.Likes.GetLikedVideoIds(uid); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if state.Comments, err = repos.Comments.GetCommentsByVideo(int64(vid)); err != nil {
+		t.Fatal(err)
+	}
+	return state
+}
+
+func TestReplayedEventsAreIdempotent(t *testing.T) {
+	caches := newTestCaches(t)
+	repos := memory.NewRepos()
+	likeSrv := NewLikeService(repos.Likes, repos.Videos, repos.Events, caches.Likes, caches.Videos, caches.Users)
+	commSrv := NewCommService(repos.Comments, repos.Events, caches.Comments)
+
+	persistUsers(t, repos, 2)
+	video := dao.Video{AuthorId: 1, Title: "replay"}
+	if err := repos.Videos.PersistVideo(&video); err != nil {
+		t.Fatal(err)
+	}
+	for _, step := range []func() error{
+		func() error { return likeSrv.DoLike(1, video.Id) },
+		func() error { return likeSrv.DoLike(2, video.Id) },
+		func() error { return likeSrv.CancelLike(1, video.Id) },
+		func() error { return likeSrv.DoLike(1, video.Id) },
+	} {
+		if err := step(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	kept, err := commSrv.DoComment(int64(video.Id), 1, 0, "kept")
+	if err != nil {
+		t.Fatal(err)
+	}
+	deleted, err := commSrv.DoComment(int64(video.Id), 2, 0, "deleted")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := commSrv.DeleteComment(int64(video.Id), deleted.Id, 2); err != nil {
+		t.Fatal(err)
+	}
+
+	likes := collectEvents(t, caches.Likes.ConsumeLikeActions, 4)
+	deletions := collectEvents(t, caches.Comments.ConsumeCommentDeletions, 1)
+	apply := func() {
+		for _, action := range likes {
+			if err := likeSrv.persistLikeAction(action); err != nil {
+				t.Fatal(err)
+			}
+		}
+		for _, d := range deletions {
+			if err := commSrv.persistCommentDeletion(d); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+
+	apply()
+	first := snapshot(t, repos, video.Id, 1, 2)
+	if first.Video.LikeCount != 2 || first.Video.CommentCount != 1 {
+		t.Fatalf("unexpected counters after the first run: %+v", first.Video)
+	}
+	if len(first.Comments) != 1 || first.Comments[0].Id != kept.Id {
+		t.Fatalf("unexpected comments after the first run: %+v", first.Comments)
+	}
+
+	apply()
+	if second := snapshot(t, repos, video.Id, 1, 2); !reflect.DeepEqual(first, second) {
+		t.Fatalf("replay changed the state\nfirst:  %+v\nsecond: %+v", first, second)
+	}
+
+	// a late redelivery of the unlike must not undo the later like
+	if err := likeSrv.persistLikeAction(likes[2]); err != nil {
+		t.Fatal(err)
+	}
+	if third := snapshot(t, repos, video.Id, 1, 2); !reflect.DeepEqual(first, third) {
+		t.Fatalf("redelivery changed the state\nfirst: %+v\nthird: %+v", first, third)
+	}
+}
+
+func TestReorderedLikeActions(t *testing.T) {
+	caches := newTestCaches(t)
+	repos := memory.NewRepos()
+	likeSrv := NewLikeService(repos.Likes, repos.Videos, repos.Events, caches.Likes, caches.Videos, caches.Users)
+
+	persistUsers(t, repos, 2)
+	video := dao.Video{AuthorId: 1, Title: "reorder"}
+	if err := repos.Videos.PersistVideo(&video); err != nil {
+		t.Fatal(err)
+	}
+	for _, step := range []func() error{
+		func() error { return likeSrv.DoLike(2, video.Id) },
+		func() error { return likeSrv.CancelLike(2, video.Id) },
+		func() error { return likeSrv.DoLike(2, video.Id) },
+	} {
+		if err := step(); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// another consumer reclaimed the unlike and applies it last
+	likes := collectEvents(t, caches.Likes.ConsumeLikeActions, 3)
+	for _, i := range []int{0, 2, 1} {
+		if err := likeSrv.persistLikeAction(likes[i]); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	state := snapshot(t, repos, video.Id, 2)
+	if state.Video.LikeCount != 1 || len(state.Liked[2]) != 1 {
+		t.Fatalf("expected the last like to win, got %+v", state)
+	}
+	if liked, err := caches.Likes.HasLiked(2, video.Id); err != nil || !liked {
+		t.Fatalf("expected the cache to agree, got %t, %v", liked, err)
+	}
+}
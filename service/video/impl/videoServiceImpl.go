@@ -1,8 +1,11 @@
 package impl
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"io"
+	"log"
 	"strconv"
 	"sync"
 	"tiktok/dao"
@@ -14,30 +17,56 @@ import (
 	"time"
 
 	"github.com/google/uuid"
-	"github.com/redis/go-redis/v9"
 )
 
 type VideoServiceImpl struct {
 	// coverRmq *rabbitmq.WorkQueue
 	vSrv.LikeService
 	vSrv.CommentService
-	UserSrv uSrv.UserService
+	UserSrv    uSrv.UserService
+	storage    oss.Storage
+	videos     dao.VideoRepo
+	likes      dao.LikeRepo
+	outbox     dao.OutboxRepo
+	uploads    dao.UploadRepo
+	videoCache *cache.VideoCache
+	likeCache  *cache.LikeCache
+	userCache  *cache.UserCache
 }
 
-func NewVideoService(userSrv uSrv.UserService, likeSrv vSrv.LikeService, commSrv vSrv.CommentService) *VideoServiceImpl {
+func NewVideoService(userSrv uSrv.UserService, likeSrv vSrv.LikeService, commSrv vSrv.CommentService,
+	storage oss.Storage, videos dao.VideoRepo, likes dao.LikeRepo,
+	outbox dao.OutboxRepo, uploads dao.UploadRepo, videoCache *cache.VideoCache, likeCache *cache.LikeCache,
+	userCache *cache.UserCache) *VideoServiceImpl {
 	return &VideoServiceImpl{
 		// coverRmq: pic_queue,
 		LikeService:    likeSrv,
 		CommentService: commSrv,
 		UserSrv:        userSrv,
+		storage:        storage,
+		videos:         videos,
+		likes:          likes,
+		outbox:         outbox,
+		uploads:        uploads,
+		videoCache:     videoCache,
+		likeCache:      likeCache,
+		userCache:      userCache,
 	}
 }
 
-// TODO: don't HMSET, lazy load
+// Publish persists the video along with an outbox message which puts it into the feed,
+// the uploaded objects are tracked until then so that a failed publish doesn't leak them
 func (s *VideoServiceImpl) Publish(userId uint64, title string, video, thumbnail io.Reader) error {
-	// Uploads to OSS
-	uuid := uuid.New()
-	if err := s.doUpload(uuid.String(), video, thumbnail); err != nil {
+	name := uuid.NewString()
+	keys := []string{oss.GetKey(name, oss.TypeVideo), oss.GetKey(name, oss.TypeCover)}
+	if err := s.uploads.AddPendingUploads(keys); err != nil {
+		err = fmt.Errorf("failed to track uploads, detail: %w", err)
+		return pkg.NewError(pkg.ErrInternal, err)
+	}
+
+	// Uploads to storage
+	if err := s.doUpload(name, video, thumbnail); err != nil {
+		s.discardUploads(keys)
 		return err
 	}
 
@@ -45,94 +74,103 @@ func (s *VideoServiceImpl) Publish(userId uint64, title string, video, thumbnail
 	videoModel := dao.Video{
 		AuthorId:  userId,
 		Title:     title,
-		PlayUrl:   oss.GetUrl(uuid.String(), oss.TypeVideo),
-		CoverUrl:  oss.GetUrl(uuid.String(), oss.TypeCover),
+		PlayUrl:   s.storage.URL(keys[0]),
+		CoverUrl:  s.storage.URL(keys[1]),
 		PublishAt: time.Now(),
 	}
-
-	err := dao.PersistVideo(&videoModel)
+	msgId, err := s.outbox.PublishVideo(&videoModel, keys)
 	if err != nil {
+		s.discardUploads(keys)
 		return pkg.NewError(pkg.ErrInternal, err)
 	}
+	// the author is reloaded with the video counted
+	if err := s.userCache.DelUserModel(int64(userId)); err != nil {
+		log.Printf("WARN: failed to evict user-%d, detail: %v\n", userId, err)
+	}
 
-	// Updates cache
-	updateCache := func() (int, error) {
-		loadNewVideo := redis.NewScript(`
-		local user_videos_key = KEYS[1]
-		local video_model_key = KEYS[2]
-		local video_stream_key = KEYS[3]
-		
-		local vid = ARGV[1]
-		local author_id = ARGV[2]
-		local title = ARGV[3]
-		local play_url = ARGV[4]
-		local cover_url = ARGV[5]
-		local like_count = ARGV[6]
-		local comment_count = ARGV[7]
-		local publish_at = ARGV[8]
-		
-		if redis.call("EXISTS", user_videos_key) == 1 then
-			redis.call("HMSET", video_model_key,
-				"id", vid, 
-				"author_id", author_id,
-				"title", title,
-				"play_url", play_url, 
-				"cover_url", cover_url, 
-				"like_count", like_count, 
-				"comment_count", comment_count, 
-				"publish_at", publish_at
-			)
-			redis.call("ZADD", user_videos_key, publish_at, vid)
-			redis.call("ZADD", video_stream_key, publish_at, vid)
-			redis.call("EXPIRE", user_videos_key, 600)
-			return 0
-		else
-			return 1
-		end
-	`)
-
-		res, err := loadNewVideo.Run(cache.Ctx, cache.Rdb, []string{
-			fmtUserPubVideosKey(userId),
-			fmtVideoModelKey(videoModel.Id),
-			getVideoStreamKey(),
-		}, videoModel.Id,
-			videoModel.AuthorId,
-			videoModel.Title,
-			videoModel.PlayUrl,
-			videoModel.CoverUrl,
-			videoModel.LikeCount,
-			videoModel.CommentCount,
-			videoModel.PublishAt.UnixMilli(),
-		).Int()
-		if err != nil {
-			return 0, fmt.Errorf("failed to run lua-script within redis - %w", err)
-		}
-		return res, nil
+	// Updates cache right away so the video shows up at once,
+	// the outbox relay takes over if it fails
+	if err := s.addToFeed(videoModel); err != nil {
+		log.Printf("WARN: video-%d is left to the outbox relay, detail: %v\n", videoModel.Id, err)
+		return nil
 	}
+	if err := s.outbox.DeleteMessage(msgId); err != nil {
+		log.Printf("WARN: failed to delete outbox message %d, it will be delivered again, detail: %v\n", msgId, err)
+	}
+	return nil
+}
 
-	res, err := updateCache()
+// HandleVideoPublished is the outbox handler of dao.TopicVideoPublished
+func (s *VideoServiceImpl) HandleVideoPublished(payload string) error {
+	vid, err := strconv.ParseUint(payload, 10, 64)
 	if err != nil {
-		return pkg.NewError(pkg.ErrInternal, err)
+		return fmt.Errorf("invalid payload %q - %w", payload, err)
+	}
+	videoModel, err := s.videos.GetVideoById(vid)
+	if errors.Is(err, dao.ErrRecordNotFound) {
+		return nil
 	}
+	if err != nil {
+		return err
+	}
+	return s.addToFeed(videoModel)
+}
 
-	if res == 1 { // user_videos key isn't exists
-		if err := cacheUserPubVideos(userId); err != nil {
+// addToFeed caches a persisted video and puts it into the feed, it is idempotent
+func (s *VideoServiceImpl) addToFeed(videoModel dao.Video) error {
+	err := s.videoCache.AddNewVideo(videoModel)
+	if errors.Is(err, cache.ErrMiss) { // user_videos key isn't exists
+		if err := cacheUserPubVideos(s.videoCache, s.videos, videoModel.AuthorId); err != nil {
 			return err
 		}
-		res, err := updateCache()
-		if err != nil {
-			return pkg.NewError(pkg.ErrInternal, err)
+		err = s.videoCache.AddNewVideo(videoModel)
+		if errors.Is(err, cache.ErrMiss) {
+			return fmt.Errorf("unexpected case, failed to load new video-%d to cache", videoModel.Id)
 		}
+	}
+	return err
+}
 
-		if res == 1 {
-			err = fmt.Errorf("ERROR: unexpected case, failed to load new video to cache, detail: %w", err)
-			return pkg.NewError(pkg.ErrInternal, err)
+// discardUploads deletes the objects of a failed publish,
+// the ones failed to delete are left to CollectOrphanedUploads
+func (s *VideoServiceImpl) discardUploads(keys []string) {
+	for _, key := range keys {
+		if err := s.storage.Delete(key); err != nil {
+			log.Printf("WARN: failed to delete orphaned object %s, detail: %v\n", key, err)
+			return
 		}
 	}
-	return nil
+	if err := s.uploads.DeletePendingUploads(keys); err != nil {
+		log.Printf("WARN: failed to untrack deleted uploads %v, detail: %v\n", keys, err)
+	}
 }
 
-// upload to OSS
+// CollectOrphanedUploads deletes the objects uploaded before the given time
+// whose publish never committed, it returns the number of deleted objects
+func (s *VideoServiceImpl) CollectOrphanedUploads(ctx context.Context, before time.Time) (int, error) {
+	deleted := 0
+	for ctx.Err() == nil {
+		keys, err := s.uploads.ExpiredUploads(before, 100)
+		if err != nil {
+			return deleted, fmt.Errorf("failed to list orphaned uploads - %w", err)
+		}
+		if len(keys) == 0 {
+			return deleted, nil
+		}
+		for _, key := range keys {
+			if err := s.storage.Delete(key); err != nil {
+				return deleted, fmt.Errorf("failed to delete orphaned object %s - %w", key, err)
+			}
+		}
+		if err := s.uploads.DeletePendingUploads(keys); err != nil {
+			return deleted, fmt.Errorf("failed to untrack deleted uploads - %w", err)
+		}
+		deleted += len(keys)
+	}
+	return deleted, ctx.Err()
+}
+
+// upload to storage
 func (s *VideoServiceImpl) doUpload(name string, video, thumbnail io.Reader) error {
 	var err error
 	videoObj := oss.OssObject{
@@ -141,9 +179,9 @@ func (s *VideoServiceImpl) doUpload(name string, video, thumbnail io.Reader) err
 		Data: video,
 	}
 
-	err = oss.StoreObject(videoObj)
+	err = oss.StoreObject(s.storage, videoObj)
 	if err != nil {
-		err = fmt.Errorf("failed to upload to OSS, detail: %w", err)
+		err = fmt.Errorf("failed to upload to storage, detail: %w", err)
 		return pkg.NewError(pkg.ErrInternal, err)
 	}
 
@@ -153,9 +191,9 @@ func (s *VideoServiceImpl) doUpload(name string, video, thumbnail io.Reader) err
 		Data: thumbnail,
 	}
 
-	err = oss.StoreObject(thumbnailObj)
+	err = oss.StoreObject(s.storage, thumbnailObj)
 	if err != nil {
-		err = fmt.Errorf("failed to upload to OSS, detail: %w", err)
+		err = fmt.Errorf("failed to upload to storage, detail: %w", err)
 		return pkg.NewError(pkg.ErrInternal, err)
 	}
 	return nil
@@ -165,39 +203,32 @@ func (s *VideoServiceImpl) doUpload(name string, video, thumbnail io.Reader) err
 // 	s.coverRmq.Publish([]byte(title))
 // }
 
-// todo: XXX
-func (s *VideoServiceImpl) buildVideoInfo(videoModel dao.Video, userId uint64) vSrv.VideoInfo {
+// buildVideoInfo fails with pkg.ErrUserNotFound if the author is deleted
+// while the video is still cached
+func (s *VideoServiceImpl) buildVideoInfo(videoModel dao.Video, userId uint64) (vSrv.VideoInfo, error) {
 	var isLiked bool
 	var authorInfo *uSrv.UserInfo
+	var err error
 	// 游客仅需获取作者信息
 	if userId == 0 {
-		isLiked = false
-		authorInfo, _ = s.UserSrv.GetUserInfo(videoModel.AuthorId, userId)
-		return vSrv.VideoInfo{
-			Id:         videoModel.Id,
-			Author:     *authorInfo,
-			PlayUrl:    videoModel.PlayUrl,
-			CoverUrl:   videoModel.CoverUrl,
-			Title:      videoModel.Title,
-			LikeCnt:    videoModel.LikeCount,
-			CommentCnt: videoModel.CommentCount,
-			IsLike:     isLiked,
-			PublishAt:  strconv.FormatInt(videoModel.PublishAt.UnixMilli(), 10),
-		}
+		authorInfo, err = s.UserSrv.GetUserInfo(videoModel.AuthorId, userId)
+	} else {
+		grp := sync.WaitGroup{}
+		grp.Add(2)
+		go func() {
+			defer grp.Done()
+			isLiked, _ = s.HasUserLiked(videoModel.Id, userId)
+		}()
+
+		go func() {
+			defer grp.Done()
+			authorInfo, err = s.UserSrv.GetUserInfo(videoModel.AuthorId, userId)
+		}()
+		grp.Wait()
+	}
+	if err != nil {
+		return vSrv.VideoInfo{}, err
 	}
-
-	grp := sync.WaitGroup{}
-	grp.Add(2)
-	go func() {
-		defer grp.Done()
-		isLiked, _ = s.HasUserLiked(videoModel.Id, userId)
-	}()
-
-	go func() {
-		defer grp.Done()
-		authorInfo, _ = s.UserSrv.GetUserInfo(videoModel.AuthorId, userId)
-	}()
-	grp.Wait()
 
 	return vSrv.VideoInfo{
 		Id:         videoModel.Id,
@@ -209,104 +240,101 @@ func (s *VideoServiceImpl) buildVideoInfo(videoModel dao.Video, userId uint64) v
 		CommentCnt: videoModel.CommentCount,
 		IsLike:     isLiked,
 		PublishAt:  strconv.FormatInt(videoModel.PublishAt.UnixMilli(), 10),
+	}, nil
+}
+
+// buildVideoInfos skips the videos whose info can't be built
+func (s *VideoServiceImpl) buildVideoInfos(videoModels []dao.Video, userId uint64) []vSrv.VideoInfo {
+	videosInfos := make([]vSrv.VideoInfo, 0, len(videoModels))
+	for _, v := range videoModels {
+		info, err := s.buildVideoInfo(v, userId)
+		if err != nil {
+			log.Printf("WARN: video-%d of user-%d skipped, detail: %v\n", v.Id, v.AuthorId, err)
+			continue
+		}
+		videosInfos = append(videosInfos, info)
 	}
+	return videosInfos
 }
 
 func (s *VideoServiceImpl) ListUserPubVideos(targetId, userId uint64) ([]vSrv.VideoInfo, error) {
-	key := fmtUserPubVideosKey(targetId)
-	exist := cache.Rdb.Exists(cache.Ctx, key).Val()
-	if exist == 0 {
-		if err := cacheUserPubVideos(targetId); err != nil {
+	videoIds, err := s.videoCache.GetUserPubVideoIds(targetId)
+	if errors.Is(err, cache.ErrMiss) {
+		if err := cacheUserPubVideos(s.videoCache, s.videos, targetId); err != nil {
 			return nil, err
 		}
-		return s.ListUserPubVideos(targetId, userId)
+		videoIds, err = s.videoCache.GetUserPubVideoIds(targetId)
 	}
-
-	videoIds, err := cache.Rdb.ZRevRange(cache.Ctx, key, 0, -1).Result()
 	if err != nil {
 		err = fmt.Errorf("failed to retrieve user pub video set, detail: %w", err)
 		return nil, pkg.NewError(pkg.ErrInternal, err)
 	}
-	videoModels, err := s.retrieveVideosFromCacheStr(videoIds)
+	videoModels, err := s.retrieveVideosFromCache(videoIds)
 	if err != nil {
 		err = fmt.Errorf("failed to retrieve video info, detail: %w", err)
 		return nil, pkg.NewError(pkg.ErrInternal, err)
 	}
 
-	videosInfos := make([]vSrv.VideoInfo, 0, len(videoModels))
-	for _, v := range videoModels {
-		videosInfos = append(videosInfos, s.buildVideoInfo(v, userId))
-	}
-	return videosInfos, nil
+	return s.buildVideoInfos(videoModels, userId), nil
 }
 
 func (s *VideoServiceImpl) ListUserLikedVideos(targetId, userId uint64) ([]vSrv.VideoInfo, error) {
-	key := fmtUserLikedVideosKey(targetId)
-	exist := cache.Rdb.Exists(cache.Ctx, key).Val()
-	if exist == 0 {
-		if err := cacheUserLikedVideos(targetId); err != nil {
+	vids, err := s.likeCache.GetUserLikedVideoIds(targetId)
+	if errors.Is(err, cache.ErrMiss) {
+		if err := cacheUserLikedVideos(s.likeCache, s.likes, targetId); err != nil {
 			return nil, err
 		}
-		return s.ListUserLikedVideos(targetId, userId)
+		vids, err = s.likeCache.GetUserLikedVideoIds(targetId)
 	}
-
-	vids, err := cache.Rdb.SMembers(cache.Ctx, key).Result()
 	if err != nil {
 		err = fmt.Errorf("failed to retrieve user liked video set, detail: %w", err)
 		return nil, pkg.NewError(pkg.ErrInternal, err)
 	}
 
-	videoModels, err := s.retrieveVideosFromCacheStr(vids)
+	videoModels, err := s.retrieveVideosFromCache(vids)
 	if err != nil {
 		err = fmt.Errorf("failed to retrieve video info, detail: %w", err)
 		return nil, pkg.NewError(pkg.ErrInternal, err)
 	}
-	videosInfos := make([]vSrv.VideoInfo, 0, len(videoModels))
-	for _, v := range videoModels {
-		videosInfos = append(videosInfos, s.buildVideoInfo(v, userId))
-	}
-	return videosInfos, nil
+	return s.buildVideoInfos(videoModels, userId), nil
 }
 
 func (s *VideoServiceImpl) Feed(userId uint64, latestTime *time.Time) ([]vSrv.VideoInfo, error) {
-	key := getVideoStreamKey()
 	if latestTime == nil {
 		latestTime = new(time.Time)
 		*latestTime = time.UnixMilli(0)
 	}
 
 	timestamp := latestTime.UnixMilli()
-	vidStr, err := cache.Rdb.ZRangeByScore(cache.Ctx, key, &redis.ZRangeBy{
-		Min:   fmt.Sprintf("(%d", timestamp),
-		Max:   "+inf",
-		Count: 5,
-	}).Result()
+	vids, err := s.videoCache.FeedAfter(timestamp, 5)
 	if err != nil {
 		err = fmt.Errorf("WARN: failed to feed, detail: %w", err)
 		return nil, pkg.NewError(pkg.ErrInternal, err)
 	}
 
-	videoModels, err := s.retrieveVideosFromCacheStr(vidStr)
+	videoModels, err := s.retrieveVideosFromCache(vids)
 	if err != nil {
-		fmt.Println(err)
+		err = fmt.Errorf("failed to retrieve video info, detail: %w", err)
+		return nil, pkg.NewError(pkg.ErrInternal, err)
 	}
 
-	videosInfos := make([]vSrv.VideoInfo, 0, len(videoModels))
-	for _, v := range videoModels {
-		videosInfos = append(videosInfos, s.buildVideoInfo(v, userId))
-	}
-	return videosInfos, nil
+	return s.buildVideoInfos(videoModels, userId), nil
 }
 
-func (s *VideoServiceImpl) buildCommentInfo(model dao.Comment, userId int64) vSrv.CommentInfo {
-	userInfo, _ := s.UserSrv.GetUserInfo(uint64(model.UserId), uint64(userId))
+// buildCommentInfo fails with pkg.ErrUserNotFound if the commenter is deleted
+// while the comment is still cached
+func (s *VideoServiceImpl) buildCommentInfo(model dao.Comment, userId int64) (vSrv.CommentInfo, error) {
+	userInfo, err := s.UserSrv.GetUserInfo(uint64(model.UserId), uint64(userId))
+	if err != nil {
+		return vSrv.CommentInfo{}, err
+	}
 	return vSrv.CommentInfo{
 		Id:        model.Id,
 		Commenter: *userInfo,
 		ParentId:  model.ParentId,
 		Content:   model.CommentText,
 		CreateAt:  model.CreateAt,
-	}
+	}, nil
 }
 
 func (s *VideoServiceImpl) ListVideoComments(videoId, userId int64) ([]vSrv.CommentInfo, error) {
@@ -316,29 +344,21 @@ func (s *VideoServiceImpl) ListVideoComments(videoId, userId int64) ([]vSrv.Comm
 	}
 	commInfos := make([]vSrv.CommentInfo, 0, len(models))
 	for _, model := range models {
-		commInfo := s.buildCommentInfo(model, userId)
-		commInfos = append(commInfos, commInfo)
-	}
-	return commInfos, nil
-}
-
-func (s *VideoServiceImpl) retrieveVideosFromCacheStr(vidStr []string) ([]dao.Video, error) {
-	vids := make([]uint64, 0, len(vidStr))
-	for _, str := range vidStr {
-		if str == "" {
+		commInfo, err := s.buildCommentInfo(model, userId)
+		if err != nil {
+			log.Printf("WARN: comment-%d of user-%d skipped, detail: %v\n", model.Id, model.UserId, err)
 			continue
 		}
-		vid, _ := strconv.ParseUint(str, 10, 64)
-		vids = append(vids, vid)
+		commInfos = append(commInfos, commInfo)
 	}
-	return s.retrieveVideosFromCache(vids)
+	return commInfos, nil
 }
 
 // FIXME: Optimized error handling
 func (s *VideoServiceImpl) retrieveVideosFromCache(vids []uint64) ([]dao.Video, error) {
 	videos := make([]dao.Video, 0, len(vids))
 	for _, vid := range vids {
-		model, err := getVideoModelFromCache(vid)
+		model, err := getVideoModel(s.videoCache, s.videos, vid)
 		if err != nil {
 			fmt.Printf("WARN: video-%d retrieval failed, skipped, detail: %v\n", vid, err)
 			continue
@@ -353,6 +373,9 @@ func (s *VideoServiceImpl) MakeComment(videoId, userId, parentId int64, content
 	if err != nil {
 		return nil, err
 	}
-	commentInfo := s.buildCommentInfo(*model, userId)
+	commentInfo, err := s.buildCommentInfo(*model, userId)
+	if err != nil {
+		return nil, err
+	}
 	return &commentInfo, nil
 }
@@ -0,0 +1,40 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+)
+
+// runUnlock lifts the login lockout of the given usernames and IP
+func runUnlock(app *App, args []string) error {
+	flags := flag.NewFlagSet("unlock", flag.ContinueOnError)
+	ip := flags.String("ip", "", "client IP to unlock")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	usernames := flags.Args()
+	if len(usernames) == 0 && *ip == "" {
+		return errors.New("usage: unlock [--ip <ip>] [username ...]")
+	}
+
+	if err := app.WithCache().Start(); err != nil {
+		return err
+	}
+	defer app.Stop(context.Background())
+
+	if *ip != "" {
+		if err := app.caches.Logins.Unlock("", *ip); err != nil {
+			return err
+		}
+		fmt.Printf("unlocked ip %s\n", *ip)
+	}
+	for _, username := range usernames {
+		if err := app.caches.Logins.Unlock(username, ""); err != nil {
+			return err
+		}
+		fmt.Printf("unlocked user %s\n", username)
+	}
+	return nil
+}